@@ -0,0 +1,85 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// deleteSeries proxies the requests to the TSDB admin API deleting series
+// (/api/v1/admin/tsdb/delete_series). It works like matcher except that the
+// enforced matcher(s) aren't added as a standalone selector when the request
+// has no selector: it would delete all the series of the tenant.
+//
+// The deletion is rejected when the enforced matchers can match the series
+// of other tenants (e.g. with WithOrAbsent(), WithRegexMatch() or a negative
+// match type) because it's a destructive operation.
+func (r *routes) deleteSeries(w http.ResponseWriter, req *http.Request) {
+	if r.orAbsent || r.regexMatch || isNegativeMatchType(r.matchType) {
+		prometheusAPIError(w, "series deletion not supported with or-absent, regex or negative matching", http.StatusNotImplemented)
+		return
+	}
+
+	if err := requireFormContentType(req); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	matchers, err := r.newLabelMatchers(req.Context())
+	if err != nil {
+		if !r.rejectMatcherRoundTripError(w, err) {
+			r.countLabelMatchersRejection(req, err)
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	r.setInjectedLabelHeader(w, matchers)
+
+	if err := req.ParseForm(); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := req.URL.Query()
+	if len(q[matchersParam]) == 0 && len(req.PostForm[matchersParam]) == 0 {
+		prometheusAPIError(w, "no match[] parameter provided", http.StatusBadRequest)
+		return
+	}
+
+	if len(q[matchersParam]) > 0 {
+		if err := r.injectMatcher(q, matchers...); err != nil {
+			r.rejectMatchers(w, req, err)
+			return
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+
+	if len(req.PostForm[matchersParam]) > 0 {
+		if err := r.injectMatcher(req.PostForm, matchers...); err != nil {
+			r.rejectMatchers(w, req, err)
+			return
+		}
+
+		// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
+		_ = req.Body.Close()
+		newBody := req.PostForm.Encode()
+		req.Body = io.NopCloser(strings.NewReader(newBody))
+		req.ContentLength = int64(len(newBody))
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
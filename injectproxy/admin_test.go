@@ -0,0 +1,210 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestDeleteSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+		labelv []string
+		query  url.Values
+		body   url.Values
+
+		expCode  int
+		expQuery []string
+		expBody  []string
+	}{
+		{
+			name:    "admin API disabled",
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "GET",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodGet,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "PUT",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodPut,
+			labelv:  []string{"default"},
+			body:    url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "missing label value",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodPost,
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no selector",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid selector",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up{"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "selectors in the URL",
+			opts:     []Option{WithEnabledAdminAPI()},
+			method:   http.MethodPost,
+			labelv:   []string{"default"},
+			query:    url.Values{matchersParam: {"up", `{job="prometheus",namespace="other"}`}, "start": {"0"}},
+			expCode:  http.StatusNoContent,
+			expQuery: []string{`{__name__="up",namespace="default"}`, `{job="prometheus",namespace="other",namespace="default"}`},
+		},
+		{
+			name:    "selectors in the body",
+			opts:    []Option{WithEnabledAdminAPI()},
+			method:  http.MethodPost,
+			labelv:  []string{"default", "something"},
+			body:    url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNoContent,
+			expBody: []string{`{__name__="up",namespace=~"default|something"}`},
+		},
+		{
+			name:    "or-absent matching",
+			opts:    []Option{WithEnabledAdminAPI(), WithOrAbsent()},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "negative matching",
+			opts:    []Option{WithEnabledAdminAPI(), WithMatchType(labels.MatchNotEqual)},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "negative regexp matching",
+			opts:    []Option{WithEnabledAdminAPI(), WithMatchType(labels.MatchNotRegexp)},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			body:    url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "regex match",
+			opts:    []Option{WithEnabledAdminAPI(), WithRegexMatch()},
+			method:  http.MethodPost,
+			labelv:  []string{"default"},
+			query:   url.Values{matchersParam: {"up"}},
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:     "regexp match type",
+			opts:     []Option{WithEnabledAdminAPI(), WithMatchType(labels.MatchRegexp)},
+			method:   http.MethodPost,
+			labelv:   []string{"default"},
+			query:    url.Values{matchersParam: {"up"}},
+			expCode:  http.StatusNoContent,
+			expQuery: []string{`{__name__="up",namespace=~"default"}`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					prometheusAPIError(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
+					return
+				}
+
+				for _, c := range []struct {
+					name string
+					got  []string
+					exp  []string
+				}{
+					{name: "URL query", got: req.URL.Query()[matchersParam], exp: tc.expQuery},
+					{name: "body", got: req.PostForm[matchersParam], exp: tc.expBody},
+				} {
+					sort.Strings(c.got)
+					sort.Strings(c.exp)
+					if !reflect.DeepEqual(c.got, c.exp) {
+						prometheusAPIError(w, fmt.Sprintf("expected %s selectors %q, got %q", c.name, c.exp, c.got), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				if req.Form.Get(proxyLabel) != "" {
+					prometheusAPIError(w, fmt.Sprintf("unexpected %q parameter", proxyLabel), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for k, v := range tc.query {
+				q[k] = v
+			}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			var b io.Reader
+			if tc.body != nil {
+				b = strings.NewReader(tc.body.Encode())
+			}
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/admin/tsdb/delete_series?"+q.Encode(), b)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
@@ -13,14 +13,212 @@
 
 package injectproxy
 
-import "net/http"
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
 
 // alerts proxies HTTP requests to the Alertmanager /api/v2/alerts endpoint.
 func (r *routes) alerts(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		r.enforceFilterParameter(w, req)
+	case "POST":
+		// Reject multi label values with assertSingleLabelValue() because
+		// an alert can only have one value for the enforced label.
+		r.errorIfRegexpMatch(assertSingleLabelValue(r.postAlerts))(w, req)
 	default:
 		http.NotFound(w, req)
 	}
 }
+
+// postAlerts injects the enforced label(s) into the labels of the posted
+// alerts. The other fields of the alerts are forwarded untouched.
+func (r *routes) postAlerts(w http.ResponseWriter, req *http.Request) {
+	var alerts []map[string]json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i, alert := range alerts {
+		if alert == nil {
+			prometheusAPIError(w, fmt.Sprintf("bad request: alert %d must be a JSON object", i), http.StatusBadRequest)
+			return
+		}
+
+		var lset map[string]string
+		if b, ok := alert["labels"]; ok {
+			if err := json.Unmarshal(b, &lset); err != nil {
+				prometheusAPIError(w, fmt.Sprintf("bad request: can't decode labels of alert %d: %v", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		// The labels are null or missing.
+		if lset == nil {
+			lset = map[string]string{}
+		}
+
+		for _, name := range r.labelNames {
+			lvalue := MustLabelValuesFor(req.Context(), name)[0]
+			if v, found := lset[name]; found && v != lvalue && r.errorOnReplace {
+				prometheusAPIError(w, fmt.Sprintf("%v: label %s=%q of alert %d conflicts with injected value %q", ErrIllegalLabelMatcher, name, v, i, lvalue), r.replaceRejectionStatus)
+				return
+			}
+			lset[name] = lvalue
+		}
+
+		b, err := json.Marshal(lset)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+			return
+		}
+		alert["labels"] = b
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(alerts); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't encode: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(&buf)
+	req.URL.RawQuery = ""
+	req.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	req.ContentLength = int64(buf.Len())
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// filterAlertGroups drops the alerts returned by the Alertmanager
+// /api/v2/alerts/groups endpoint which don't match the enforced label(s), as
+// well as the groups left without alerts. The upstream should already have
+// applied the injected filter: this is a defense-in-depth layer which ensures
+// that the grouping labels of other tenants aren't disclosed.
+func (r *routes) filterAlertGroups(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// Pass non-200 responses as-is.
+		return nil
+	}
+
+	defer resp.Body.Close()
+	reader := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("%w: gzip decoding error: %w", errModifyResponseFailed, err)
+		}
+		defer gz.Close()
+		reader = gz
+		resp.Header.Del("Content-Encoding")
+	}
+
+	var groups []map[string]json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&groups); err != nil {
+		return fmt.Errorf("%w: can't decode the alert groups: %w", errModifyResponseFailed, err)
+	}
+
+	ms, err := r.newLabelMatchers(resp.Request.Context())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+	}
+
+	filtered := []map[string]json.RawMessage{}
+	for i, group := range groups {
+		var alerts []map[string]json.RawMessage
+		if err := json.Unmarshal(group["alerts"], &alerts); err != nil {
+			return fmt.Errorf("%w: can't decode the alerts of group %d: %w", errModifyResponseFailed, i, err)
+		}
+
+		matching := []map[string]json.RawMessage{}
+		for j, alert := range alerts {
+			var lset map[string]string
+			if err := json.Unmarshal(alert["labels"], &lset); err != nil {
+				return fmt.Errorf("%w: can't decode the labels of alert %d in group %d: %w", errModifyResponseFailed, j, i, err)
+			}
+			if matchLabels(ms, func(name string) string { return lset[name] }) {
+				matching = append(matching, alert)
+			}
+		}
+
+		if len(matching) == 0 {
+			continue
+		}
+
+		b, err := json.Marshal(matching)
+		if err != nil {
+			return fmt.Errorf("can't encode the alerts: %w", err)
+		}
+		group["alerts"] = b
+		filtered = append(filtered, group)
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(filtered); err != nil {
+		return fmt.Errorf("can't encode the alert groups: %w", err)
+	}
+	resp.Body = io.NopCloser(&buf)
+	resp.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	resp.Trailer = nil
+
+	return nil
+}
+
+// filterReceivers removes the receivers which aren't named after the label
+// value(s) from the Alertmanager /api/v2/receivers response.
+func (r *routes) filterReceivers(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		// Pass non-200 responses as-is.
+		return nil
+	}
+
+	defer resp.Body.Close()
+	reader := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("%w: gzip decoding error: %w", errModifyResponseFailed, err)
+		}
+		defer gz.Close()
+		reader = gz
+		resp.Header.Del("Content-Encoding")
+	}
+
+	var receivers []map[string]json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&receivers); err != nil {
+		return fmt.Errorf("%w: can't decode the receivers: %w", errModifyResponseFailed, err)
+	}
+
+	values := MustLabelValues(resp.Request.Context())
+	filtered := []map[string]json.RawMessage{}
+	for i, receiver := range receivers {
+		var name string
+		if err := json.Unmarshal(receiver["name"], &name); err != nil {
+			return fmt.Errorf("%w: can't decode the name of receiver %d: %w", errModifyResponseFailed, i, err)
+		}
+
+		for _, v := range values {
+			if name == v || (r.receiversSeparator != "" && strings.HasPrefix(name, v+r.receiversSeparator)) {
+				filtered = append(filtered, receiver)
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(filtered); err != nil {
+		return fmt.Errorf("can't encode the receivers: %w", err)
+	}
+	resp.Body = io.NopCloser(&buf)
+	resp.Header["Content-Length"] = []string{strconv.Itoa(buf.Len())}
+	resp.Trailer = nil
+
+	return nil
+}
@@ -14,10 +14,12 @@
 package injectproxy
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -130,3 +132,384 @@ func TestGetAlerts(t *testing.T) {
 		})
 	}
 }
+
+// checkPostedAlertsHandler verifies that the posted alerts have the expected labels.
+func checkPostedAlertsHandler(t *testing.T, expLabels []map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alerts []struct {
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&alerts); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if len(alerts) != len(expLabels) {
+			t.Errorf("expected %d alerts, got %d", len(expLabels), len(alerts))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		for i := range alerts {
+			if !reflect.DeepEqual(alerts[i].Labels, expLabels[i]) {
+				t.Errorf("expected labels %v for alert %d, got %v", expLabels[i], i, alerts[i].Labels)
+			}
+			if alerts[i].Annotations["summary"] != "test" {
+				t.Errorf("expected annotations to be preserved for alert %d, got %v", i, alerts[i].Annotations)
+			}
+		}
+
+		w.Write(okResponse)
+	})
+}
+
+func TestPostAlerts(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		labelv         []string
+		errorOnReplace bool
+		regexMatch     bool
+		body           string
+
+		expCode   int
+		expLabels []map[string]string
+	}{
+		{
+			name:    "missing label value",
+			body:    `[{"labels":{"alertname":"foo"},"annotations":{"summary":"test"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "multiple label values",
+			labelv:  []string{"default", "something"},
+			body:    `[{"labels":{"alertname":"foo"},"annotations":{"summary":"test"}}]`,
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "regex match",
+			labelv:     []string{"default"},
+			regexMatch: true,
+			body:       `[{"labels":{"alertname":"foo"},"annotations":{"summary":"test"}}]`,
+			expCode:    http.StatusNotImplemented,
+		},
+		{
+			name:    "invalid body",
+			labelv:  []string{"default"},
+			body:    `{"labels":{"alertname":"foo"}}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:      "null labels",
+			labelv:    []string{"default"},
+			body:      `[{"labels":null,"annotations":{"summary":"test"}}]`,
+			expCode:   http.StatusOK,
+			expLabels: []map[string]string{{"namespace": "default"}},
+		},
+		{
+			name:    "null alert",
+			labelv:  []string{"default"},
+			body:    `[null]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "alert isn't an object",
+			labelv:  []string{"default"},
+			body:    `[{"labels":{"alertname":"foo"}},"foo"]`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:   "label injected",
+			labelv: []string{"default"},
+			body: `[{"labels":{"alertname":"foo"},"annotations":{"summary":"test"}},` +
+				`{"labels":{"alertname":"bar","namespace":"default"},"annotations":{"summary":"test"},"startsAt":"2024-01-01T00:00:00Z"}]`,
+			expCode: http.StatusOK,
+			expLabels: []map[string]string{
+				{"alertname": "foo", "namespace": "default"},
+				{"alertname": "bar", "namespace": "default"},
+			},
+		},
+		{
+			name:      "label replaced",
+			labelv:    []string{"default"},
+			body:      `[{"labels":{"alertname":"foo","namespace":"other"},"annotations":{"summary":"test"}}]`,
+			expCode:   http.StatusOK,
+			expLabels: []map[string]string{{"alertname": "foo", "namespace": "default"}},
+		},
+		{
+			name:           "same label with errorOnReplace",
+			labelv:         []string{"default"},
+			errorOnReplace: true,
+			body:           `[{"labels":{"alertname":"foo","namespace":"default"},"annotations":{"summary":"test"}}]`,
+			expCode:        http.StatusOK,
+			expLabels:      []map[string]string{{"alertname": "foo", "namespace": "default"}},
+		},
+		{
+			name:           "conflicting label with errorOnReplace",
+			labelv:         []string{"default"},
+			errorOnReplace: true,
+			body: `[{"labels":{"alertname":"foo"},"annotations":{"summary":"test"}},` +
+				`{"labels":{"alertname":"foo","namespace":"other"},"annotations":{"summary":"test"}}]`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkPostedAlertsHandler(t, tc.expLabels))
+			defer m.Close()
+
+			var opts []Option
+			if tc.errorOnReplace {
+				opts = append(opts, WithErrorOnReplace())
+			}
+			if tc.regexMatch {
+				opts = append(opts, WithRegexMatch())
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://alertmanager.example.com/api/v2/alerts?"+q.Encode(), strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				body, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+		})
+	}
+}
+
+func TestFilterAlertGroups(t *testing.T) {
+	upstream := []byte(`[
+{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[
+	{"labels":{"alertname":"A","namespace":"ns1"},"status":{"state":"active"}},
+	{"labels":{"alertname":"A","namespace":"ns2"},"status":{"state":"active"}}
+]},
+{"labels":{"alertname":"B","team":"other"},"receiver":{"name":"default"},"alerts":[
+	{"labels":{"alertname":"B","namespace":"ns2","team":"other"},"status":{"state":"active"}}
+]},
+{"labels":{"alertname":"C"},"receiver":{"name":"default"},"alerts":[
+	{"labels":{"alertname":"C"},"status":{"state":"active"}}
+]}
+]`)
+
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		body   []byte
+		status int
+
+		expCode int
+		expBody []byte
+	}{
+		{
+			name:    "single value",
+			labelv:  []string{"ns1"},
+			body:    upstream,
+			expCode: http.StatusOK,
+			expBody: []byte(`[{"alerts":[{"labels":{"alertname":"A","namespace":"ns1"},"status":{"state":"active"}}],"labels":{"alertname":"A"},"receiver":{"name":"default"}}]`),
+		},
+		{
+			name:    "multiple values",
+			labelv:  []string{"ns1", "ns2"},
+			body:    upstream,
+			expCode: http.StatusOK,
+			expBody: []byte(`[{"alerts":[{"labels":{"alertname":"A","namespace":"ns1"},"status":{"state":"active"}},{"labels":{"alertname":"A","namespace":"ns2"},"status":{"state":"active"}}],"labels":{"alertname":"A"},"receiver":{"name":"default"}},{"alerts":[{"labels":{"alertname":"B","namespace":"ns2","team":"other"},"status":{"state":"active"}}],"labels":{"alertname":"B","team":"other"},"receiver":{"name":"default"}}]`),
+		},
+		{
+			name:    "no match",
+			labelv:  []string{"ns3"},
+			body:    upstream,
+			expCode: http.StatusOK,
+			expBody: []byte(`[]`),
+		},
+		{
+			name:    "invalid response",
+			labelv:  []string{"ns1"},
+			body:    []byte(`{"status":"success"}`),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "upstream error",
+			labelv:  []string{"ns1"},
+			body:    []byte(`error`),
+			status:  http.StatusInternalServerError,
+			expCode: http.StatusInternalServerError,
+			expBody: []byte(`error`),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if tc.status != 0 {
+					w.WriteHeader(tc.status)
+				}
+				w.Write(tc.body)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for _, lv := range tc.labelv {
+				q.Add(proxyLabel, lv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://alertmanager.example.com/api/v2/alerts/groups?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if tc.expBody == nil {
+				return
+			}
+
+			if got := strings.TrimSpace(string(body)); got != string(tc.expBody) {
+				t.Fatalf("expected body %s, got %s", string(tc.expBody), got)
+			}
+		})
+	}
+}
+
+func TestAlertmanagerStatusAndReceivers(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v2/status":
+			w.Write([]byte(`{"cluster":{"status":"ready"}}`))
+		case "/api/v2/receivers":
+			w.Write([]byte(`[{"name":"default"},{"name":"ns1"},{"name":"ns1/pager"},{"name":"ns10"},{"name":"ns2/slack"}]`))
+		}
+	}))
+	defer m.Close()
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithReceiversFiltering("/"), WithRegexMatch()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		path   string
+		labelv []string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "status disabled by default",
+			path:    "/api/v2/status",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "receivers disabled by default",
+			path:    "/api/v2/receivers",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "status passthrough",
+			opts:    []Option{WithAlertmanagerStatusPassthrough()},
+			path:    "/api/v2/status",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusOK,
+			expBody: `{"cluster":{"status":"ready"}}`,
+		},
+		{
+			name:    "status passthrough without label value",
+			opts:    []Option{WithAlertmanagerStatusPassthrough()},
+			path:    "/api/v2/status",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "receivers passthrough",
+			opts:    []Option{WithAlertmanagerStatusPassthrough()},
+			path:    "/api/v2/receivers",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusOK,
+			expBody: `[{"name":"default"},{"name":"ns1"},{"name":"ns1/pager"},{"name":"ns10"},{"name":"ns2/slack"}]`,
+		},
+		{
+			name:    "receivers filtering",
+			opts:    []Option{WithReceiversFiltering("/")},
+			path:    "/api/v2/receivers",
+			labelv:  []string{"ns1"},
+			expCode: http.StatusOK,
+			expBody: `[{"name":"ns1"},{"name":"ns1/pager"}]`,
+		},
+		{
+			name:    "receivers filtering with multiple values",
+			opts:    []Option{WithAlertmanagerStatusPassthrough(), WithReceiversFiltering("/")},
+			path:    "/api/v2/receivers",
+			labelv:  []string{"ns1", "ns2"},
+			expCode: http.StatusOK,
+			expBody: `[{"name":"ns1"},{"name":"ns1/pager"},{"name":"ns2/slack"}]`,
+		},
+		{
+			name:    "receivers filtering without match",
+			opts:    []Option{WithReceiversFiltering("/")},
+			path:    "/api/v2/receivers",
+			labelv:  []string{"ns3"},
+			expCode: http.StatusOK,
+			expBody: `[]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.labelv}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com"+tc.path+"?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" {
+				if got := strings.TrimSpace(w.Body.String()); got != tc.expBody {
+					t.Fatalf("expected body %s, got %s", tc.expBody, got)
+				}
+			}
+		})
+	}
+
+	t.Run("receivers filtering with invalid response", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"status":"success"}`))
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithReceiversFiltering("/"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com/api/v2/receivers?"+proxyLabel+"=ns1", nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// circuitBreaker stops forwarding the requests to the upstream for a cooldown
+// period after a number of consecutive upstream failures.
+//
+// Once the cooldown period has elapsed, the requests are forwarded again but
+// a single failure opens the circuit again until a request succeeds.
+type circuitBreaker struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether a request may be forwarded to the upstream. If not,
+// it also returns the remaining duration of the cooldown period.
+func (cb *circuitBreaker) allow() (bool, time.Duration) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if d := cb.openUntil.Sub(cb.now()); d > 0 {
+		return false, d
+	}
+
+	return true, 0
+}
+
+// isOpen reports whether the requests are currently short-circuited.
+func (cb *circuitBreaker) isOpen() bool {
+	ok, _ := cb.allow()
+	return !ok
+}
+
+// success records a successful upstream request and resets the failure
+// count.
+func (cb *circuitBreaker) success() {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	cb.failures = 0
+}
+
+// failure records a failed upstream request and opens the circuit once the
+// threshold is reached.
+func (cb *circuitBreaker) failure() {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.failures < cb.threshold {
+		cb.failures++
+	}
+
+	if cb.failures >= cb.threshold {
+		cb.openUntil = cb.now().Add(cb.cooldown)
+	}
+}
+
+// circuitBreakers holds one circuitBreaker per upstream so that a failing
+// upstream (e.g. with WithUpstreamResolver) doesn't short-circuit the requests
+// to the other upstreams.
+type circuitBreakers struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*circuitBreaker
+	labels    map[string]string
+	now       func() time.Time
+	desc      *prometheus.Desc
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  map[string]*circuitBreaker{},
+		labels:    map[string]string{},
+		now:       time.Now,
+		desc: prometheus.NewDesc(
+			"proxy_upstream_circuit_breaker_open",
+			"Whether the requests to the upstream are short-circuited (1) or not (0).",
+			[]string{"upstream"},
+			nil,
+		),
+	}
+}
+
+// forUpstream returns the circuit breaker of the given upstream.
+func (cbs *circuitBreakers) forUpstream(u *url.URL) *circuitBreaker {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+
+	key := u.String()
+	cb, found := cbs.breakers[key]
+	if !found {
+		cb = newCircuitBreaker(cbs.threshold, cbs.cooldown)
+		cb.now = func() time.Time { return cbs.now() }
+		cbs.breakers[key] = cb
+		// Don't expose the credentials of the upstream URL.
+		cbs.labels[key] = u.Redacted()
+	}
+
+	return cb
+}
+
+// Describe implements the prometheus.Collector interface.
+func (cbs *circuitBreakers) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cbs.desc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (cbs *circuitBreakers) Collect(ch chan<- prometheus.Metric) {
+	cbs.mtx.Lock()
+	defer cbs.mtx.Unlock()
+
+	for key, cb := range cbs.breakers {
+		var v float64
+		if cb.isOpen() {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(cbs.desc, prometheus.GaugeValue, v, cbs.labels[key])
+	}
+}
+
+// isUpstreamFailure returns true if the response denotes an unhealthy
+// upstream. The errors of the Prometheus API caused by the query itself
+// (e.g. "503 Service Unavailable" for query timeouts and "422 Unprocessable
+// Entity" for evaluation errors) aren't failures: they are JSON documents
+// whereas the proxies and load balancers in front of the upstream usually
+// return plain text or HTML pages.
+func isUpstreamFailure(resp *http.Response) bool {
+	if resp.StatusCode < http.StatusInternalServerError {
+		return false
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		return err != nil || mt != "application/json"
+	}
+
+	return true
+}
+
+// withCircuitBreaker rejects the requests with "503 Service Unavailable"
+// while the circuit of the request's upstream is open.
+func (r *routes) withCircuitBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ok, retryAfter := r.breakers.forUpstream(r.upstreamURL(req.Context())).allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			prometheusAPIError(w, "the upstream is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithCircuitBreaker(t *testing.T) {
+	var (
+		failing  atomic.Bool
+		requests atomic.Int32
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	for _, opt := range []Option{WithCircuitBreaker(-1, time.Second), WithCircuitBreaker(1, 0)} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opt); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithCircuitBreaker(2, 10*time.Second), WithPrometheusRegistry(reg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Unix(0, 0)
+	r.breakers.now = func() time.Time { return now }
+
+	for i, tc := range []struct {
+		failing bool
+		advance time.Duration
+
+		expCode     int
+		expRequests int32
+		expOpen     int
+	}{
+		{failing: true, expCode: http.StatusInternalServerError, expRequests: 1},
+		// A success resets the failure count.
+		{expCode: http.StatusOK, expRequests: 2},
+		{failing: true, expCode: http.StatusInternalServerError, expRequests: 3},
+		{failing: true, expCode: http.StatusInternalServerError, expRequests: 4, expOpen: 1},
+		// The circuit is open: the upstream isn't requested.
+		{expCode: http.StatusServiceUnavailable, expRequests: 4, expOpen: 1},
+		// After the cooldown, a single failure opens the circuit again.
+		{failing: true, advance: 10 * time.Second, expCode: http.StatusInternalServerError, expRequests: 5, expOpen: 1},
+		{expCode: http.StatusServiceUnavailable, expRequests: 5, expOpen: 1},
+		{advance: 10 * time.Second, expCode: http.StatusOK, expRequests: 6},
+		{failing: true, expCode: http.StatusInternalServerError, expRequests: 7},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			failing.Store(tc.failing)
+			now = now.Add(tc.advance)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "10" {
+				t.Fatalf("expected Retry-After header %q, got %q", "10", w.Header().Get("Retry-After"))
+			}
+
+			if got := requests.Load(); got != tc.expRequests {
+				t.Fatalf("expected %d upstream requests, got %d", tc.expRequests, got)
+			}
+
+			expMetric := fmt.Sprintf(`
+# HELP proxy_upstream_circuit_breaker_open Whether the requests to the upstream are short-circuited (1) or not (0).
+# TYPE proxy_upstream_circuit_breaker_open gauge
+proxy_upstream_circuit_breaker_open{upstream=%q} %d
+`, m.url.String(), tc.expOpen)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(expMetric), "proxy_upstream_circuit_breaker_open"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerConnectionErrors(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithCircuitBreaker(1, time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expCode := range []int{http.StatusBadGateway, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+
+		if w.Code != expCode {
+			t.Fatalf("expected status code %d, got %d", expCode, w.Code)
+		}
+	}
+}
+
+func TestCircuitBreakerQueryErrors(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get(queryParam) {
+		case `timeout{namespace="ns1"}`:
+			prometheusAPIError(w, "query timed out", http.StatusServiceUnavailable)
+		case `invalid{namespace="ns1"}`:
+			prometheusAPIError(w, "execution error", http.StatusUnprocessableEntity)
+		case `slow{namespace="ns1"}`:
+			select {
+			case <-req.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		default:
+			http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+		}
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		query string
+
+		expCode int
+		expOpen bool
+	}{
+		{query: "timeout", expCode: http.StatusServiceUnavailable},
+		{query: "invalid", expCode: http.StatusUnprocessableEntity},
+		{query: "slow", expCode: http.StatusGatewayTimeout},
+		{query: "up", expCode: http.StatusServiceUnavailable, expOpen: true},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithCircuitBreaker(1, time.Minute), WithRequestTimeout(100*time.Millisecond))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?namespace=ns1&query="+tc.query, nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if got := r.breakers.forUpstream(m.url).isOpen(); got != tc.expOpen {
+				t.Fatalf("expected the circuit to be open: %v, got %v", tc.expOpen, got)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerPerUpstream(t *testing.T) {
+	failing := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	healthy := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer healthy.Close()
+
+	r, err := NewRoutes(healthy.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithCircuitBreaker(1, time.Minute),
+		WithUpstreamResolver(func(v string) (*url.URL, error) {
+			if v == "ns1" {
+				return failing.url, nil
+			}
+			return healthy.url, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		labelv string
+
+		expCode int
+	}{
+		{labelv: "ns1", expCode: http.StatusInternalServerError},
+		{labelv: "ns1", expCode: http.StatusServiceUnavailable},
+		// The other upstream isn't short-circuited.
+		{labelv: "ns2", expCode: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace="+tc.labelv, nil))
+
+		if w.Code != tc.expCode {
+			t.Fatalf("%s: expected status code %d, got %d: %s", tc.labelv, tc.expCode, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// ClientCertField identifies the field of the client certificate holding the
+// label value.
+type ClientCertField int
+
+const (
+	// ClientCertCommonName extracts the label value from the subject's
+	// common name.
+	ClientCertCommonName ClientCertField = iota
+	// ClientCertDNSName extracts the label value(s) from the DNS subject
+	// alternative names.
+	ClientCertDNSName
+	// ClientCertExtension extracts the label value from the string value of
+	// a certificate extension.
+	ClientCertExtension
+)
+
+// ClientCertEnforcer enforces a label value extracted from the client
+// certificate of TLS connections terminated by the proxy. Requests without a
+// client certificate or whose certificate doesn't hold a label value are
+// rejected with "401 Unauthorized".
+// The proxy doesn't verify the certificate: the TLS server must be configured
+// to require and verify client certificates (tls.RequireAndVerifyClientCert).
+type ClientCertEnforcer struct {
+	Field ClientCertField
+
+	// DNSNameRegexp selects the DNS names when Field is ClientCertDNSName.
+	// If the regexp has a capture group, the first group is used as the
+	// label value instead of the full DNS name. All the DNS names are used
+	// if nil.
+	DNSNameRegexp *regexp.Regexp
+
+	// OID is the object identifier of the extension when Field is
+	// ClientCertExtension.
+	OID asn1.ObjectIdentifier
+}
+
+// Validate verifies that the enforcer's field is valid.
+func (cce ClientCertEnforcer) Validate() error {
+	switch cce.Field {
+	case ClientCertCommonName, ClientCertDNSName:
+	case ClientCertExtension:
+		if len(cce.OID) == 0 {
+			return errors.New("missing extension OID")
+		}
+	default:
+		return fmt.Errorf("invalid client certificate field %d", cce.Field)
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (cce ClientCertEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			prometheusAPIError(w, "missing client certificate", http.StatusUnauthorized)
+			return
+		}
+
+		labelValues, err := cce.getLabelValues(r.TLS.PeerCertificates[0])
+		if err != nil {
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+func (cce ClientCertEnforcer) getLabelValues(cert *x509.Certificate) ([]string, error) {
+	switch cce.Field {
+	case ClientCertCommonName:
+		if cert.Subject.CommonName == "" {
+			return nil, errors.New("missing common name in the client certificate")
+		}
+
+		return []string{cert.Subject.CommonName}, nil
+
+	case ClientCertDNSName:
+		var labelValues []string
+		for _, name := range cert.DNSNames {
+			if cce.DNSNameRegexp == nil {
+				labelValues = append(labelValues, name)
+				continue
+			}
+
+			m := cce.DNSNameRegexp.FindStringSubmatch(name)
+			switch {
+			case m == nil:
+			case len(m) > 1:
+				labelValues = append(labelValues, m[1])
+			default:
+				labelValues = append(labelValues, name)
+			}
+		}
+
+		labelValues = removeEmptyValues(labelValues)
+		if len(labelValues) == 0 {
+			return nil, errors.New("no matching DNS name in the client certificate")
+		}
+
+		return labelValues, nil
+
+	case ClientCertExtension:
+		for _, ext := range cert.Extensions {
+			if !ext.Id.Equal(cce.OID) {
+				continue
+			}
+
+			var v string
+			if _, err := asn1.Unmarshal(ext.Value, &v); err != nil {
+				return nil, fmt.Errorf("invalid value for extension %s in the client certificate: %w", cce.OID, err)
+			}
+
+			if v == "" {
+				break
+			}
+
+			return []string{v}, nil
+		}
+
+		return nil, fmt.Errorf("missing extension %s in the client certificate", cce.OID)
+	}
+
+	return nil, fmt.Errorf("invalid client certificate field %d", cce.Field)
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestClientCertEnforcer(t *testing.T) {
+	tenantOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	mustMarshal := func(v interface{}) []byte {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return b
+	}
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "team-a"},
+		DNSNames: []string{"scraper.example.com", "team-b.tenants.example.com", "team-c.tenants.example.com"},
+		Extensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Value: []byte{0xff}},
+			{Id: tenantOID, Value: mustMarshal("team-d")},
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		el    ClientCertEnforcer
+		state *tls.ConnectionState
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:    "no TLS",
+			el:      ClientCertEnforcer{Field: ClientCertCommonName},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "no client certificate",
+			el:      ClientCertEnforcer{Field: ClientCertCommonName},
+			state:   &tls.ConnectionState{},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "common name",
+			el:       ClientCertEnforcer{Field: ClientCertCommonName},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-a"}`,
+		},
+		{
+			name:    "empty common name",
+			el:      ClientCertEnforcer{Field: ClientCertCommonName},
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "DNS names with capture group",
+			el:       ClientCertEnforcer{Field: ClientCertDNSName, DNSNameRegexp: regexp.MustCompile(`^([^.]+)\.tenants\.example\.com$`)},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"team-b|team-c"}`,
+		},
+		{
+			name:     "DNS name without capture group",
+			el:       ClientCertEnforcer{Field: ClientCertDNSName, DNSNameRegexp: regexp.MustCompile(`^scraper\.`)},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="scraper.example.com"}`,
+		},
+		{
+			name:    "no matching DNS name",
+			el:      ClientCertEnforcer{Field: ClientCertDNSName, DNSNameRegexp: regexp.MustCompile(`\.other\.example\.com$`)},
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "extension",
+			el:       ClientCertEnforcer{Field: ClientCertExtension, OID: tenantOID},
+			state:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-d"}`,
+		},
+		{
+			name:    "invalid extension value",
+			el:      ClientCertEnforcer{Field: ClientCertExtension, OID: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}},
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing extension",
+			el:      ClientCertEnforcer{Field: ClientCertExtension, OID: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 3}},
+			state:   &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+			expCode: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", "query", tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.el)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.TLS = tc.state
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestClientCertEnforcerValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		el   ClientCertEnforcer
+
+		expErr bool
+	}{
+		{
+			name: "common name",
+			el:   ClientCertEnforcer{Field: ClientCertCommonName},
+		},
+		{
+			name: "DNS name",
+			el:   ClientCertEnforcer{Field: ClientCertDNSName},
+		},
+		{
+			name:   "extension without OID",
+			el:     ClientCertEnforcer{Field: ClientCertExtension},
+			expErr: true,
+		},
+		{
+			name:   "invalid field",
+			el:     ClientCertEnforcer{Field: ClientCertField(42)},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.el.Validate()
+			if tc.expErr && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.expErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
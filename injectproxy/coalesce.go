@@ -0,0 +1,139 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// queryCoalescer collapses concurrent identical requests into a single
+// upstream request. The response is buffered and replayed to all the waiters.
+type queryCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is an in-flight upstream request shared by several waiters.
+type coalescedCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	resp    *bufferedResponseWriter
+}
+
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{calls: map[string]*coalescedCall{}}
+}
+
+// serve forwards the request to next unless an identical request (as defined
+// by key) is already in flight in which case it waits for its response.
+//
+// The upstream request isn't tied to the context of any client request: it is
+// canceled only when all the waiters have gone away.
+func (c *queryCoalescer) serve(w http.ResponseWriter, req *http.Request, key string, next http.Handler) {
+	c.mu.Lock()
+	call, found := c.calls[key]
+	if !found {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		call = &coalescedCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		c.calls[key] = call
+
+		go func() {
+			defer cancel()
+
+			bw := &bufferedResponseWriter{header: http.Header{}}
+			next.ServeHTTP(bw, req.WithContext(ctx))
+
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+
+			call.resp = bw
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		call.resp.replay(w)
+	case <-req.Context().Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody is interested in the response anymore.
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// coalescingIgnoredHeaders are the request headers which aren't part of the
+// coalescing key: they change with every request without affecting the
+// upstream response (hop-by-hop, tracing and client identification headers).
+var coalescingIgnoredHeaders = map[string]struct{}{
+	"Connection":        {},
+	"Content-Length":    {},
+	"Keep-Alive":        {},
+	"Proxy-Connection":  {},
+	"Te":                {},
+	"Trailer":           {},
+	"Transfer-Encoding": {},
+	"Upgrade":           {},
+	"Traceparent":       {},
+	"Tracestate":        {},
+	"User-Agent":        {},
+	"X-Request-Id":      {},
+}
+
+// coalescingKey returns the key identifying identical enforced requests. It
+// is made of the tenant, the request's path, the enforced parameters and the
+// request headers: any of them (e.g. Cookie or a custom authentication
+// header) may be checked by the upstream or by a proxy in front of it, so
+// the clients sending different credentials never share a response.
+func coalescingKey(req *http.Request, body string) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if _, ok := coalescingIgnoredHeaders[http.CanonicalHeaderKey(name)]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	parts := []string{
+		tenantKey(req.Context()),
+		req.Method,
+		req.URL.Path,
+		req.URL.RawQuery,
+		body,
+	}
+	for _, name := range names {
+		parts = append(parts, http.CanonicalHeaderKey(name)+": "+strings.Join(req.Header[name], "\x00"))
+	}
+
+	return strings.Join(parts, "\xff")
+}
@@ -0,0 +1,345 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until the coalescer has n waiters in total.
+func waitForWaiters(t *testing.T, c *queryCoalescer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		var got int
+		for _, call := range c.calls {
+			got += call.waiters
+		}
+		c.mu.Unlock()
+
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timeout waiting for %d waiters", n)
+}
+
+func TestQueryCoalescing(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		requests []string
+		headers  []http.Header
+
+		expUpstreamRequests int64
+	}{
+		{
+			name: "identical requests",
+			requests: []string{
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+			},
+			expUpstreamRequests: 1,
+		},
+		{
+			name: "identical requests with parameters in different order",
+			requests: []string{
+				"/api/v1/query_range?query=up&start=0&end=10&step=1&namespace=ns1",
+				"/api/v1/query_range?namespace=ns1&step=1&end=10&start=0&query=up",
+			},
+			expUpstreamRequests: 1,
+		},
+		{
+			name: "different tenants",
+			requests: []string{
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns2",
+				"/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			},
+			expUpstreamRequests: 3,
+		},
+		{
+			name: "different queries",
+			requests: []string{
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=down&namespace=ns1",
+			},
+			expUpstreamRequests: 2,
+		},
+		{
+			name: "different time ranges",
+			requests: []string{
+				"/api/v1/query_range?query=up&start=0&end=10&step=1&namespace=ns1",
+				"/api/v1/query_range?query=up&start=0&end=20&step=1&namespace=ns1",
+				"/api/v1/query?query=up&time=10&namespace=ns1",
+			},
+			expUpstreamRequests: 3,
+		},
+		{
+			name: "different credentials",
+			requests: []string{
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+			},
+			headers: []http.Header{
+				nil,
+				{"Cookie": []string{"session=secret"}},
+				{"X-Auth-Token": []string{"secret"}},
+				{"Authorization": []string{"Bearer secret"}},
+			},
+			expUpstreamRequests: 4,
+		},
+		{
+			name: "different tracing headers",
+			requests: []string{
+				"/api/v1/query?query=up&namespace=ns1",
+				"/api/v1/query?query=up&namespace=ns1",
+			},
+			headers: []http.Header{
+				{"Traceparent": []string{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, "User-Agent": []string{"grafana"}},
+				{"Traceparent": []string{"00-0af7651916cd43dd8448eb211c80319d-b7ad6b7169203332-01"}, "X-Request-Id": []string{"1"}},
+			},
+			expUpstreamRequests: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				hits    atomic.Int64
+				release = make(chan struct{})
+			)
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				hits.Add(1)
+				<-release
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryCoalescing())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var (
+				wg    sync.WaitGroup
+				codes = make([]int, len(tc.requests))
+				resps = make([]string, len(tc.requests))
+			)
+			for i, u := range tc.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+u, nil)
+					if i < len(tc.headers) {
+						for name, values := range tc.headers[i] {
+							req.Header[name] = values
+						}
+					}
+
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, req)
+					codes[i] = w.Code
+					resps[i] = w.Body.String()
+				}()
+			}
+
+			waitForWaiters(t, r.coalescer, len(tc.requests))
+			close(release)
+			wg.Wait()
+
+			if got := hits.Load(); got != tc.expUpstreamRequests {
+				t.Fatalf("expected %d upstream requests, got %d", tc.expUpstreamRequests, got)
+			}
+
+			for i := range tc.requests {
+				if codes[i] != http.StatusOK {
+					t.Fatalf("request %d: expected status code %d, got %d: %s", i, http.StatusOK, codes[i], resps[i])
+				}
+				if resps[i] != string(okResponse) {
+					t.Fatalf("request %d: expected body %q, got %q", i, string(okResponse), resps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCoalescingWithPost(t *testing.T) {
+	var (
+		hits    atomic.Int64
+		release = make(chan struct{})
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryCoalescing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, body := range []string{"query=up&namespace=ns1", "query=up&namespace=ns1", "query=up&namespace=ns2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		}()
+	}
+
+	waitForWaiters(t, r.coalescer, 3)
+	close(release)
+	wg.Wait()
+
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", got)
+	}
+}
+
+func TestQueryCoalescingSequentialRequests(t *testing.T) {
+	var hits atomic.Int64
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryCoalescing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Responses aren't cached once the upstream request has completed.
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	if got := hits.Load(); got != 3 {
+		t.Fatalf("expected 3 upstream requests, got %d", got)
+	}
+}
+
+func TestQueryCoalescingCancellation(t *testing.T) {
+	var (
+		hits      atomic.Int64
+		canceled  = make(chan struct{})
+		release   = make(chan struct{})
+		requested = make(chan struct{}, 1)
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Only the first upstream request is released.
+		n := hits.Add(1)
+		requested <- struct{}{}
+		if n == 1 {
+			<-release
+			w.Write(okResponse)
+			return
+		}
+
+		<-req.Context().Done()
+		close(canceled)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryCoalescing())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const u = "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1"
+
+	// The first client goes away while the second one still waits for the
+	// response.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil).WithContext(ctx))
+	}()
+
+	var w *httptest.ResponseRecorder
+	secondDone := make(chan struct{})
+	go func() {
+		defer close(secondDone)
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u, nil))
+	}()
+
+	<-requested
+	waitForWaiters(t, r.coalescer, 2)
+
+	cancel()
+	select {
+	case <-firstDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the canceled request")
+	}
+
+	close(release)
+	<-secondDone
+	if w.Code != http.StatusOK || w.Body.String() != string(okResponse) {
+		t.Fatalf("expected status code %d and body %q, got %d and %q", http.StatusOK, string(okResponse), w.Code, w.Body.String())
+	}
+
+	// The upstream request is canceled when all clients go away.
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil).WithContext(ctx))
+	}()
+
+	<-requested
+	cancel()
+	<-done
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the upstream request to be canceled")
+	}
+
+	if got := hits.Load(); got != 2 {
+		t.Fatalf("expected 2 upstream requests, got %d", got)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// dryRun records the request which would have been sent to the upstream.
+type dryRun struct {
+	// forwarding is true once the enforcement has been simulated and the
+	// original request is forwarded to the upstream.
+	forwarding bool
+
+	enforced    bool
+	rawQuery    string
+	body        string
+	labelValues map[string][]string
+}
+
+// dryRunExtractor simulates the enforcement of the request, logs the outcome
+// and forwards the original request to the upstream.
+type dryRunExtractor struct {
+	ExtractLabeler
+	r *routes
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (dre dryRunExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	h := dre.ExtractLabeler.ExtractLabel(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []byte
+		if req.Body != nil && req.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			if err != nil {
+				prometheusAPIError(w, "failed to read the request body", http.StatusBadRequest)
+				return
+			}
+			_ = req.Body.Close()
+		}
+
+		dr := &dryRun{}
+		ctx := context.WithValue(req.Context(), keyDryRun, dr)
+
+		// Simulate the enforcement on a copy of the request.
+		sim := req.Clone(ctx)
+		sim.Body = io.NopCloser(bytes.NewReader(body))
+		bw := &bufferedResponseWriter{header: http.Header{}}
+		h.ServeHTTP(bw, sim)
+
+		dre.r.logDryRun(req, string(body), dr, bw)
+
+		// Forward the original request.
+		dr.forwarding = true
+		orig := req.WithContext(ctx)
+		orig.Body = io.NopCloser(bytes.NewReader(body))
+		orig.ContentLength = int64(len(body))
+		dre.r.handler.ServeHTTP(w, orig)
+	})
+}
+
+// logDryRun logs the original request and either the request which would
+// have been sent to the upstream or the rejection.
+func (r *routes) logDryRun(req *http.Request, body string, dr *dryRun, bw *bufferedResponseWriter) {
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("query", req.URL.RawQuery),
+	}
+	if body != "" {
+		attrs = append(attrs, slog.String("body", body))
+	}
+
+	if !dr.enforced {
+		code := bw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		attrs = append(attrs,
+			slog.Int("code", code),
+			slog.String("response", strings.TrimSpace(bw.body.String())),
+		)
+		r.logger.LogAttrs(req.Context(), slog.LevelWarn, "dry run: request would be rejected", attrs...)
+		return
+	}
+
+	attrs = append(attrs,
+		slog.Any("labels", dr.labelValues),
+		slog.String("enforced_query", dr.rawQuery),
+	)
+	if dr.body != "" {
+		attrs = append(attrs, slog.String("enforced_body", dr.body))
+	}
+	r.logger.LogAttrs(req.Context(), slog.LevelInfo, "dry run: request would be enforced", attrs...)
+}
+
+// withDryRunCapture records the requests sent to the upstream during the
+// simulation of the enforcement instead of forwarding them.
+func withDryRunCapture(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dr, ok := req.Context().Value(keyDryRun).(*dryRun)
+		if !ok || dr.forwarding {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		dr.enforced = true
+		dr.rawQuery = req.URL.RawQuery
+		if req.Body != nil {
+			b, _ := io.ReadAll(req.Body)
+			dr.body = string(b)
+		}
+		dr.labelValues, _ = req.Context().Value(keyNamedLabels).(map[string][]string)
+	})
+}
+
+// isDryRun returns true if the request is forwarded as-is in dry-run mode.
+func isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(keyDryRun).(*dryRun)
+	return ok
+}
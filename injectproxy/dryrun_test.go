@@ -0,0 +1,200 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		body   url.Values
+
+		expLog map[string]interface{}
+	}{
+		{
+			name:  "enforced query",
+			path:  "/api/v1/query",
+			query: url.Values{"query": []string{"up"}, proxyLabel: []string{"default"}},
+			expLog: map[string]interface{}{
+				"level":          "INFO",
+				"msg":            "dry run: request would be enforced",
+				"method":         "GET",
+				"path":           "/api/v1/query",
+				"query":          "namespace=default&query=up",
+				"enforced_query": `query=up%7Bnamespace%3D%22default%22%7D`,
+				"labels":         map[string]interface{}{"namespace": []interface{}{"default"}},
+			},
+		},
+		{
+			name:   "enforced query in the body",
+			method: http.MethodPost,
+			path:   "/api/v1/query",
+			body:   url.Values{"query": []string{"up"}, proxyLabel: []string{"default"}},
+			expLog: map[string]interface{}{
+				"level":          "INFO",
+				"msg":            "dry run: request would be enforced",
+				"method":         "POST",
+				"path":           "/api/v1/query",
+				"query":          "",
+				"body":           "namespace=default&query=up",
+				"enforced_query": "",
+				"enforced_body":  `query=up%7Bnamespace%3D%22default%22%7D`,
+				"labels":         map[string]interface{}{"namespace": []interface{}{"default"}},
+			},
+		},
+		{
+			name:  "enforced matcher",
+			path:  "/api/v1/series",
+			query: url.Values{"match[]": []string{`up{job="a"}`}, proxyLabel: []string{"default"}},
+			expLog: map[string]interface{}{
+				"level":          "INFO",
+				"msg":            "dry run: request would be enforced",
+				"method":         "GET",
+				"path":           "/api/v1/series",
+				"query":          "match%5B%5D=up%7Bjob%3D%22a%22%7D&namespace=default",
+				"enforced_query": `match%5B%5D=%7Bjob%3D%22a%22%2C__name__%3D%22up%22%2Cnamespace%3D%22default%22%7D`,
+				"labels":         map[string]interface{}{"namespace": []interface{}{"default"}},
+			},
+		},
+		{
+			name:  "missing label",
+			path:  "/api/v1/query",
+			query: url.Values{"query": []string{"up"}},
+			expLog: map[string]interface{}{
+				"level":    "WARN",
+				"msg":      "dry run: request would be rejected",
+				"method":   "GET",
+				"path":     "/api/v1/query",
+				"query":    "query=up",
+				"code":     float64(http.StatusBadRequest),
+				"response": `{"error":"The \"namespace\" query parameter must be provided.","errorType":"prom-label-proxy","status":"error"}`,
+			},
+		},
+		{
+			name:  "invalid query",
+			path:  "/api/v1/query",
+			query: url.Values{"query": []string{"up{"}, proxyLabel: []string{"default"}},
+			expLog: map[string]interface{}{
+				"level":  "WARN",
+				"msg":    "dry run: request would be rejected",
+				"method": "GET",
+				"path":   "/api/v1/query",
+				"query":  "namespace=default&query=up%7B",
+				"code":   float64(http.StatusBadRequest),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				gotQuery string
+				gotBody  string
+			)
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotQuery = req.URL.RawQuery
+				b, _ := io.ReadAll(req.Body)
+				gotBody = string(b)
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			var buf bytes.Buffer
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithDryRun(),
+				WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.path+"?"+tc.query.Encode(), strings.NewReader(tc.body.Encode()))
+			if tc.body != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+
+			// The upstream receives the original request.
+			if gotQuery != tc.query.Encode() {
+				t.Fatalf("expected upstream query %q, got %q", tc.query.Encode(), gotQuery)
+			}
+			if gotBody != tc.body.Encode() {
+				t.Fatalf("expected upstream body %q, got %q", tc.body.Encode(), gotBody)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("unexpected error: %v (log: %q)", err, buf.String())
+			}
+			delete(got, "time")
+			if _, ok := tc.expLog["response"]; !ok {
+				delete(got, "response")
+			}
+
+			if !reflect.DeepEqual(got, tc.expLog) {
+				t.Fatalf("expected log\n%v\ngot\n%v", tc.expLog, got)
+			}
+		})
+	}
+}
+
+func TestDryRunResponseUnmodified(t *testing.T) {
+	const rules = `{"status":"success","data":{"groups":[{"name":"group1","file":"file1","rules":[{"name":"rule1","query":"up","labels":{"namespace":"other"},"health":"ok","type":"recording"}],"interval":10}]}}`
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(rules))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithDryRun(), WithLogger(slog.New(slog.NewJSONHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/rules?namespace=default", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if got := w.Body.String(); got != rules {
+		t.Fatalf("expected unmodified response %q, got %q", rules, got)
+	}
+}
@@ -16,18 +16,74 @@ package injectproxy
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+// PromQLParser parses PromQL expressions and metric selectors.
+// It allows to use a PromQL parser matching the version of the upstream
+// instead of the one vendored by the proxy.
+type PromQLParser interface {
+	ParseExpr(input string) (parser.Expr, error)
+	ParseMetricSelector(input string) ([]*labels.Matcher, error)
+}
+
+// DefaultPromQLParser is the PromQLParser implementation backed by the
+// vendored Prometheus parser.
+type DefaultPromQLParser struct{}
+
+// ParseExpr implements the PromQLParser interface.
+func (DefaultPromQLParser) ParseExpr(input string) (parser.Expr, error) {
+	return parser.ParseExpr(input)
+}
+
+// ParseMetricSelector implements the PromQLParser interface.
+func (DefaultPromQLParser) ParseMetricSelector(input string) ([]*labels.Matcher, error) {
+	return parser.ParseMetricSelector(input)
+}
+
+// Enforcer enforces label matchers in queries.
+type Enforcer interface {
+	// Enforce returns the query with the label matchers enforced. The
+	// returned error should wrap ErrQueryParse, ErrIllegalLabelMatcher or
+	// ErrEnforceLabel.
+	Enforce(query string) (string, error)
+}
+
+var (
+	_ Enforcer = &PromQLEnforcer{}
+	_ Enforcer = &LogQLEnforcer{}
+)
+
 // PromQLEnforcer can enforce label matchers in PromQL expressions.
 type PromQLEnforcer struct {
 	labelMatchers  map[string]*labels.Matcher
 	errorOnReplace bool
+	parser         PromQLParser
+
+	// stripAbsentLabels removes the enforced labels from the output of the
+	// absent() and absent_over_time() functions.
+	stripAbsentLabels bool
+
+	// deniedMetricNames are the (anchored) regular expressions of the metric
+	// names which can't be selected.
+	deniedMetricNames []*regexp.Regexp
 }
 
+// NewPromQLEnforcer returns an enforcer injecting the given label matchers
+// into all the selectors of the PromQL expressions. If errorOnReplace is true,
+// Enforce returns ErrIllegalLabelMatcher when an expression has a matcher on
+// an enforced label which differs from the enforced matcher.
 func NewPromQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *PromQLEnforcer {
+	return NewPromQLEnforcerWithParser(DefaultPromQLParser{}, errorOnReplace, ms...)
+}
+
+// NewPromQLEnforcerWithParser is like NewPromQLEnforcer but it uses the
+// given parser to parse the PromQL expressions.
+func NewPromQLEnforcerWithParser(p PromQLParser, errorOnReplace bool, ms ...*labels.Matcher) *PromQLEnforcer {
 	entries := make(map[string]*labels.Matcher)
 
 	for _, matcher := range ms {
@@ -37,6 +93,7 @@ func NewPromQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *PromQLEnforc
 	return &PromQLEnforcer{
 		labelMatchers:  entries,
 		errorOnReplace: errorOnReplace,
+		parser:         p,
 	}
 }
 
@@ -49,17 +106,30 @@ var (
 
 	// ErrEnforceLabel is returned when the label matchers couldn't be enforced.
 	ErrEnforceLabel = errors.New("failed to enforce label")
+
+	// ErrDeniedMetricName is returned when the input query selects a denied metric name.
+	ErrDeniedMetricName = errors.New("denied metric name")
 )
 
-// Enforce the label matchers in a PromQL expression.
+// EnforceQuery enforces the label matcher in the PromQL query like the proxy
+// does for the query endpoints. It is a shortcut for
+// NewPromQLEnforcer(errorOnReplace, matcher).Enforce(query) which can be used
+// to test the enforcement without an HTTP server.
+func EnforceQuery(query string, matcher *labels.Matcher, errorOnReplace bool) (string, error) {
+	return NewPromQLEnforcer(errorOnReplace, matcher).Enforce(query)
+}
+
+// Enforce the label matchers in a PromQL expression. It returns the modified
+// expression or an error wrapping ErrQueryParse, ErrIllegalLabelMatcher or
+// ErrEnforceLabel.
 func (ms *PromQLEnforcer) Enforce(q string) (string, error) {
-	expr, err := parser.ParseExpr(q)
+	expr, err := ms.parser.ParseExpr(q)
 	if err != nil {
 		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
 	}
 
 	if err := ms.EnforceNode(expr); err != nil {
-		if errors.Is(err, ErrIllegalLabelMatcher) {
+		if errors.Is(err, ErrIllegalLabelMatcher) || errors.Is(err, ErrDeniedMetricName) {
 			return "", err
 		}
 
@@ -109,6 +179,10 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 			return err
 		}
 
+		if ms.stripAbsentLabels && (n.Func.Name == "absent" || n.Func.Name == "absent_over_time") {
+			ms.stripLabels(n)
+		}
+
 	case *parser.SubqueryExpr:
 		if err := ms.EnforceNode(n.Expr); err != nil {
 			return err
@@ -130,6 +204,10 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 	case *parser.MatrixSelector:
 		// inject labelselector
 		if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+			if err := ms.checkMetricName(vs.LabelMatchers); err != nil {
+				return err
+			}
+
 			var err error
 			vs.LabelMatchers, err = ms.EnforceMatchers(vs.LabelMatchers)
 			if err != nil {
@@ -138,6 +216,10 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 		}
 
 	case *parser.VectorSelector:
+		if err := ms.checkMetricName(n.LabelMatchers); err != nil {
+			return err
+		}
+
 		// inject labelselector
 		var err error
 		n.LabelMatchers, err = ms.EnforceMatchers(n.LabelMatchers)
@@ -152,6 +234,85 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 	return nil
 }
 
+// checkMetricName returns an error if the metric names selected by the
+// matchers match one of the denied metric names.
+func (ms PromQLEnforcer) checkMetricName(matchers []*labels.Matcher) error {
+	return checkMetricName(ms.deniedMetricNames, matchers)
+}
+
+// checkMetricName returns an error if the metric names selected by the
+// matchers match one of the denied regular expressions. The names are only
+// known for the equality matchers and the regexp matchers made of literal
+// alternatives (e.g. "foo|bar"): the selectors without such a matcher on the
+// metric name (e.g. `{job="x"}` or `{__name__=~"api.*"}`) and the selectors
+// with a negative matcher on the metric name are rejected as they may select
+// denied metrics.
+func checkMetricName(denied []*regexp.Regexp, matchers []*labels.Matcher) error {
+	if len(denied) == 0 {
+		return nil
+	}
+
+	var known bool
+	for _, m := range matchers {
+		if m.Name != labels.MetricName {
+			continue
+		}
+
+		var names []string
+		switch m.Type {
+		case labels.MatchEqual:
+			names = []string{m.Value}
+		case labels.MatchRegexp:
+			names = m.SetMatches()
+			if len(names) == 0 {
+				return fmt.Errorf("%w: the metric name matcher %s isn't a list of literal names", ErrDeniedMetricName, m)
+			}
+		default:
+			return fmt.Errorf("%w: negative metric name matcher %s", ErrDeniedMetricName, m)
+		}
+		known = true
+
+		for _, name := range names {
+			for _, re := range denied {
+				if re.MatchString(name) {
+					return fmt.Errorf("%w: %q", ErrDeniedMetricName, name)
+				}
+			}
+		}
+	}
+
+	if !known {
+		return fmt.Errorf("%w: the selector has no metric name", ErrDeniedMetricName)
+	}
+
+	return nil
+}
+
+// stripLabels wraps the function call into label_replace() calls removing
+// the enforced labels with an equality matcher from the output. The absent()
+// and absent_over_time() functions copy these labels from their argument.
+func (ms PromQLEnforcer) stripLabels(n *parser.Call) {
+	names := make([]string, 0, len(ms.labelMatchers))
+	for name, m := range ms.labelMatchers {
+		if m.Type == labels.MatchEqual {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		inner := &parser.Call{Func: n.Func, Args: n.Args, PosRange: n.PosRange}
+		n.Func = parser.Functions["label_replace"]
+		n.Args = parser.Expressions{
+			inner,
+			&parser.StringLiteral{Val: name},
+			&parser.StringLiteral{Val: ""},
+			&parser.StringLiteral{Val: ""},
+			&parser.StringLiteral{Val: ""},
+		}
+	}
+}
+
 // EnforceMatchers appends the enforced label matcher(s) to the list of matchers
 // if not already present.
 //
@@ -163,6 +324,7 @@ func (ms PromQLEnforcer) EnforceNode(node parser.Node) error {
 //   - Otherwise the existing matcher is preserved.
 //
 // * if errorOnReplace is true
+//   - And the label matcher is identical to the enforced matcher, the existing matcher is discarded.
 //   - And the label matcher and the enforced matcher are disjoint, the function returns an error.
 //   - Otherwise the existing matcher is preserved.
 func (ms PromQLEnforcer) EnforceMatchers(targets []*labels.Matcher) ([]*labels.Matcher, error) {
@@ -175,7 +337,9 @@ func (ms PromQLEnforcer) EnforceMatchers(targets []*labels.Matcher) ([]*labels.M
 			continue
 		}
 
-		if ms.errorOnReplace {
+		// An expression's matcher identical to the enforced matcher is
+		// always accepted.
+		if ms.errorOnReplace && matcher.String() != target.String() {
 			var ok bool
 
 			// Ensure that the expression's matcher combined with the
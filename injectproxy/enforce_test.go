@@ -16,9 +16,11 @@ package injectproxy
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"testing"
 
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 func mustNewMatcher(t labels.MatchType, n, v string) *labels.Matcher {
@@ -339,6 +341,198 @@ var tests = []struct {
 			hasExpression(`metric1{namespace="NS",pod="POD"} + on (pod, namespace) sum by (pod) (metric2{label="baz",namespace="NS",pod="POD"})`),
 		),
 	},
+	{
+		name:       "scalar function with selector",
+		expression: `scalar(metric1{pod="baz"})`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`scalar(metric1{namespace="NS",pod="baz"})`),
+		),
+	},
+	{
+		name:       "vector function with nested scalar function",
+		expression: `vector(scalar(metric1))`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`vector(scalar(metric1{namespace="NS"}))`),
+		),
+	},
+	{
+		name:       "vector function with number literal",
+		expression: `vector(1)`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`vector(1)`),
+		),
+	},
+	{
+		name:       "scalar function with number literal",
+		expression: `scalar(vector(1))`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`scalar(vector(1))`),
+		),
+	},
+	{
+		name:       "vector function with time function",
+		expression: `vector(time())`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`vector(time())`),
+		),
+	},
+	{
+		name:       "binary expression with scalar and vector functions",
+		expression: `scalar(sum(metric1)) * vector(1) + on () metric2`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`scalar(sum(metric1{namespace="NS"})) * vector(1) + on () metric2{namespace="NS"}`),
+		),
+	},
+	{
+		name:       "scalar function in function argument",
+		expression: `clamp_max(metric1, scalar(metric2))`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`clamp_max(metric1{namespace="NS"}, scalar(metric2{namespace="NS"}))`),
+		),
+	},
+	{
+		name:       "@ modifier with end()",
+		expression: `rate(http_requests[5m] @ end())`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`rate(http_requests{namespace="NS"}[5m] @ end())`),
+		),
+	},
+	{
+		name:       "@ modifier with timestamp and offset",
+		expression: `rate(http_requests[5m] @ 1609746000 offset 1h)`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`rate(http_requests{namespace="NS"}[5m] @ 1609746000.000 offset 1h)`),
+		),
+	},
+	{
+		name:       "negative offset",
+		expression: `http_requests offset -5m`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`http_requests{namespace="NS"} offset -5m`),
+		),
+	},
+	{
+		name:       "subquery with @ modifier",
+		expression: `max_over_time(rate(http_requests[1m])[1h:5m] @ start())`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`max_over_time(rate(http_requests{namespace="NS"}[1m])[1h:5m] @ start())`),
+		),
+	},
+	{
+		name:       "subquery with offset",
+		expression: `max_over_time(http_requests[1h:5m] offset 1d)`,
+		enforcer: NewPromQLEnforcer(
+			false,
+			&labels.Matcher{
+				Name:  "namespace",
+				Type:  labels.MatchEqual,
+				Value: "NS",
+			},
+		),
+		check: checks(
+			noError(),
+			hasExpression(`max_over_time(http_requests{namespace="NS"}[1h:5m] offset 1d)`),
+		),
+	},
 	{
 		name:       "invalid PromQL expression",
 		expression: `metric1{pod="baz"`,
@@ -367,6 +561,71 @@ func TestEnforce(t *testing.T) {
 	}
 }
 
+func TestEnforcePreservesModifiers(t *testing.T) {
+	enforced := mustNewMatcher(labels.MatchEqual, "namespace", "NS")
+
+	for _, q := range []string{
+		`http_requests @ end()`,
+		`http_requests @ start() offset 5m`,
+		`http_requests offset 5m`,
+		`http_requests offset -5m @ 1609746000`,
+		`rate(http_requests{job="api"}[5m] @ end())`,
+		`rate(http_requests[5m] offset 5m @ end())`,
+		`rate(http_requests[5m:1m] @ end() offset 5m)`,
+		`max_over_time(rate(http_requests[1m] offset 5m)[1h:5m] @ end())`,
+		`min_over_time(max_over_time(rate(http_requests[1m] @ start())[30m:1m] offset 1h)[1d:] @ end())`,
+		`sum by (job) (rate(http_requests[5m] @ end())) / on (job) group_left () sum by (job) (rate(http_errors[5m] offset 1w))`,
+		`count_over_time({job="api"}[5m] @ end())`,
+		`(http_requests @ end())[10m:1m]`,
+	} {
+		t.Run(q, func(t *testing.T) {
+			got, err := NewPromQLEnforcer(false, enforced).Enforce(q)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expr, err := parser.ParseExpr(got)
+			if err != nil {
+				t.Fatalf("failed to parse the enforced query %q: %v", got, err)
+			}
+
+			// Remove the injected matcher from every selector: the query
+			// must then be the same as the original one.
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				vs, ok := node.(*parser.VectorSelector)
+				if !ok {
+					return nil
+				}
+
+				var found bool
+				ms := vs.LabelMatchers[:0]
+				for _, m := range vs.LabelMatchers {
+					if m.String() == enforced.String() {
+						found = true
+						continue
+					}
+					ms = append(ms, m)
+				}
+				if !found {
+					t.Errorf("expected %s in selector %s", enforced, vs)
+				}
+				vs.LabelMatchers = ms
+
+				return nil
+			})
+
+			orig, err := parser.ParseExpr(q)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if expr.String() != orig.String() {
+				t.Fatalf("expected %q (without the injected matcher), got %q", orig.String(), expr.String())
+			}
+		})
+	}
+}
+
 func TestEnforceWithErrOnReplace(t *testing.T) {
 	type subTestCase struct {
 		labelSelector string
@@ -960,6 +1219,18 @@ func TestEnforceWithErrOnReplace(t *testing.T) {
 					`up{job!~"",job=~"foo.*"}`,
 					false,
 				},
+				{
+					// Identical matcher.
+					`job=~"foo.*"`,
+					`up{job=~"foo.*"}`,
+					false,
+				},
+				{
+					// Overlapping but different matcher.
+					`job=~"foo.+"`,
+					``,
+					true,
+				},
 			},
 		},
 	} {
@@ -994,3 +1265,267 @@ func TestEnforceWithErrOnReplace(t *testing.T) {
 		})
 	}
 }
+
+// stubPromQLParser rewrites the "stub" expression into the given vector
+// selector before delegating to the default parser.
+type stubPromQLParser struct {
+	DefaultPromQLParser
+	calls int
+}
+
+func (p *stubPromQLParser) ParseExpr(input string) (parser.Expr, error) {
+	p.calls++
+	if input == "stub" {
+		input = `up{job="stub"}`
+	}
+
+	return p.DefaultPromQLParser.ParseExpr(input)
+}
+
+func TestEnforceWithCustomParser(t *testing.T) {
+	p := &stubPromQLParser{}
+	e := NewPromQLEnforcerWithParser(p, false, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+
+	got, err := e.Enforce("stub")
+	if err := checks(noError(), hasExpression(`up{job="stub",namespace="NS"}`))(got, err); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.calls != 1 {
+		t.Fatalf("expected the custom parser to be called once, got %d", p.calls)
+	}
+}
+
+func TestEnforceWithAbsentLabelsStripping(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		expression string
+		matchers   []*labels.Matcher
+		strip      bool
+
+		expExpression string
+	}{
+		{
+			name:          "absent without stripping",
+			expression:    `absent(up{job="x"})`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			expExpression: `absent(up{job="x",namespace="NS"})`,
+		},
+		{
+			name:          "absent",
+			expression:    `absent(up{job="x"})`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `label_replace(absent(up{job="x",namespace="NS"}), "namespace", "", "", "")`,
+		},
+		{
+			name:          "absent_over_time",
+			expression:    `absent_over_time(up{job="x"}[5m])`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `label_replace(absent_over_time(up{job="x",namespace="NS"}[5m]), "namespace", "", "", "")`,
+		},
+		{
+			name:          "absent with the tenant label in the original selector",
+			expression:    `absent(up{job="x",namespace="other"})`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `label_replace(absent(up{job="x",namespace="NS"}), "namespace", "", "", "")`,
+		},
+		{
+			name:       "absent with multiple labels",
+			expression: `absent(up)`,
+			matchers: []*labels.Matcher{
+				mustNewMatcher(labels.MatchEqual, "pod", "POD"),
+				mustNewMatcher(labels.MatchEqual, "namespace", "NS"),
+			},
+			strip:         true,
+			expExpression: `label_replace(label_replace(absent(up{namespace="NS",pod="POD"}), "namespace", "", "", ""), "pod", "", "", "")`,
+		},
+		{
+			name:       "absent with regexp matcher",
+			expression: `absent(up)`,
+			matchers: []*labels.Matcher{
+				mustNewMatcher(labels.MatchRegexp, "namespace", "NS1|NS2"),
+				mustNewMatcher(labels.MatchEqual, "pod", "POD"),
+			},
+			strip:         true,
+			expExpression: `label_replace(absent(up{namespace=~"NS1|NS2",pod="POD"}), "pod", "", "", "")`,
+		},
+		{
+			name:          "nested absent",
+			expression:    `sum(absent(up{job="x"})) or absent(nonexistent)`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `sum(label_replace(absent(up{job="x",namespace="NS"}), "namespace", "", "", "")) or label_replace(absent(nonexistent{namespace="NS"}), "namespace", "", "", "")`,
+		},
+		{
+			name:          "absent with aggregation",
+			expression:    `absent(sum(up))`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `label_replace(absent(sum(up{namespace="NS"})), "namespace", "", "", "")`,
+		},
+		{
+			name:          "other functions",
+			expression:    `rate(up[5m])`,
+			matchers:      []*labels.Matcher{mustNewMatcher(labels.MatchEqual, "namespace", "NS")},
+			strip:         true,
+			expExpression: `rate(up{namespace="NS"}[5m])`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewPromQLEnforcer(false, tc.matchers...)
+			e.stripAbsentLabels = tc.strip
+
+			got, err := e.Enforce(tc.expression)
+			if err := checks(noError(), hasExpression(tc.expExpression))(got, err); err != nil {
+				t.Fatal(err)
+			}
+
+			// The rewritten expression must be valid.
+			if _, err := parser.ParseExpr(got); err != nil {
+				t.Fatalf("invalid expression %q: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestEnforceWithDeniedMetricNames(t *testing.T) {
+	denied := []*regexp.Regexp{regexp.MustCompile("^(?:apiserver_.*)$"), regexp.MustCompile("^(?:secret)$")}
+	for _, tc := range []struct {
+		name       string
+		expression string
+
+		check checkFunc
+	}{
+		{
+			name:       "allowed metric",
+			expression: `up`,
+			check:      checks(noError(), hasExpression(`up{namespace="NS"}`)),
+		},
+		{
+			name:       "denied metric",
+			expression: `rate(apiserver_request_total[5m])`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "denied metric with __name__ matcher",
+			expression: `{__name__="secret"}`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "denied metric in regexp alternatives",
+			expression: `{__name__=~"up|secret"}`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "denied metric in binary expression",
+			expression: `up / on() group_left sum(secret)`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "denied metric in subquery",
+			expression: `max_over_time(apiserver_up[1h:5m])`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "partial match",
+			expression: `secret_total + my_apiserver_requests`,
+			check:      checks(noError(), hasExpression(`secret_total{namespace="NS"} + my_apiserver_requests{namespace="NS"}`)),
+		},
+		{
+			name:       "negative matcher",
+			expression: `{__name__!="secret",job="x"}`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "negative regexp matcher",
+			expression: `{__name__!~"secret|apiserver_.*",job="x"}`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "non-literal regexp matcher",
+			expression: `{__name__=~"api.*"}`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "no metric name",
+			expression: `count({job="x"})`,
+			check:      errorIs(ErrDeniedMetricName),
+		},
+		{
+			name:       "literal regexp alternatives",
+			expression: `{__name__=~"up|down"}`,
+			check:      checks(noError(), hasExpression(`{__name__=~"up|down",namespace="NS"}`)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewPromQLEnforcer(false, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+			e.deniedMetricNames = denied
+
+			if err := tc.check(e.Enforce(tc.expression)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestEnforceQuery(t *testing.T) {
+	m := mustNewMatcher(labels.MatchEqual, "namespace", "NS")
+
+	got, err := EnforceQuery(`sum(rate(http_requests_total{namespace="other"}[5m]))`, m, false)
+	if err := checks(noError(), hasExpression(`sum(rate(http_requests_total{namespace="NS"}[5m]))`))(got, err); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = EnforceQuery(`http_requests_total{namespace="other"}`, m, true)
+	if err := errorIs(ErrIllegalLabelMatcher)(got, err); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = EnforceQuery(`http_requests_total{`, m, false)
+	if err := errorIs(ErrQueryParse)(got, err); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ExampleEnforceQuery() {
+	q, err := EnforceQuery(
+		`sum by (job) (rate(http_requests_total[5m]))`,
+		labels.MustNewMatcher(labels.MatchEqual, "namespace", "team-a"),
+		false,
+	)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(q)
+	// Output: sum by (job) (rate(http_requests_total{namespace="team-a"}[5m]))
+}
+
+func ExamplePromQLEnforcer_Enforce() {
+	e := NewPromQLEnforcer(
+		true,
+		labels.MustNewMatcher(labels.MatchEqual, "namespace", "team-a"),
+	)
+
+	for _, q := range []string{
+		`up{namespace="team-a"}`,
+		`up{namespace="team-b"}`,
+	} {
+		got, err := e.Enforce(q)
+		switch {
+		case errors.Is(err, ErrIllegalLabelMatcher):
+			fmt.Println("rejected:", q)
+		case err != nil:
+			fmt.Println(err)
+		default:
+			fmt.Println(got)
+		}
+	}
+	// Output:
+	// up{namespace="team-a"}
+	// rejected: up{namespace="team-b"}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// requestLog holds the request's information which is logged with the
+// errors.
+type requestLog struct {
+	logger      *slog.Logger
+	method      string
+	path        string
+	labelValues map[string][]string
+}
+
+// withRequestLogging logs the errors returned by prometheusAPIError() for
+// the request with the given logger.
+func withRequestLogging(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rl := &requestLog{
+			logger: logger,
+			method: req.Method,
+			path:   req.URL.Path,
+		}
+
+		w = &loggingResponseWriter{ResponseWriter: w, rl: rl}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), keyRequestLog, rl)))
+	})
+}
+
+// recordLabelValues records the extracted label values for the request's
+// log.
+func recordLabelValues(ctx context.Context) {
+	if rl, ok := ctx.Value(keyRequestLog).(*requestLog); ok {
+		rl.labelValues, _ = ctx.Value(keyNamedLabels).(map[string][]string)
+	}
+}
+
+// log logs the message with the request's attributes. Client errors are
+// logged at the warning level and server errors at the error level.
+func (rl *requestLog) log(ctx context.Context, msg string, code int, err string) {
+	level := slog.LevelWarn
+	if code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", rl.method),
+		slog.String("path", rl.path),
+		slog.Int("code", code),
+		slog.String("err", err),
+	}
+	if len(rl.labelValues) > 0 {
+		attrs = append(attrs, slog.Any("labels", rl.labelValues))
+	}
+
+	rl.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// loggingResponseWriter gives access to the request's log to
+// prometheusAPIError().
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	rl *requestLog
+}
+
+// Unwrap returns the original http.ResponseWriter (used by http.ResponseController).
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements the http.Flusher interface.
+func (w *loggingResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// requestLogFor returns the request's log if the response writer (or one of
+// the writers it wraps) is a loggingResponseWriter.
+func requestLogFor(w http.ResponseWriter) *requestLog {
+	for {
+		switch rw := w.(type) {
+		case *loggingResponseWriter:
+			return rw.rl
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// logRequestError logs an error which happened while processing the request.
+// The request's attributes are added if the request logging is enabled.
+func (r *routes) logRequestError(req *http.Request, msg string, code int, err error) {
+	if rl, ok := req.Context().Value(keyRequestLog).(*requestLog); ok {
+		rl.log(req.Context(), msg, code, err.Error())
+		return
+	}
+
+	attrs := []any{"method", req.Method, "path", req.URL.Path, "code", code, "err", err}
+	if lvs, _ := req.Context().Value(keyNamedLabels).(map[string][]string); len(lvs) > 0 {
+		attrs = append(attrs, "labels", lvs)
+	}
+	r.logger.Error(msg, attrs...)
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestWithLogger(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		upstream http.Handler
+		opts     []Option
+
+		expCode int
+		expLog  map[string]interface{}
+	}{
+		{
+			name:     "missing label value",
+			url:      "/api/v1/query?query=up",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) }),
+			expCode:  http.StatusBadRequest,
+			expLog: map[string]interface{}{
+				"level":  "WARN",
+				"msg":    "request rejected",
+				"method": "GET",
+				"path":   "/api/v1/query",
+				"code":   float64(http.StatusBadRequest),
+				"err":    `The "namespace" query parameter must be provided.`,
+			},
+		},
+		{
+			name:     "conflicting label matcher",
+			url:      "/api/v1/query?query=up{namespace=\"other\"}&namespace=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) }),
+			opts:     []Option{WithErrorOnReplace()},
+			expCode:  http.StatusBadRequest,
+			expLog: map[string]interface{}{
+				"level":  "WARN",
+				"msg":    "request rejected",
+				"method": "GET",
+				"path":   "/api/v1/query",
+				"code":   float64(http.StatusBadRequest),
+				"err":    `conflicting label matcher: label matcher "namespace=\"other\"" conflicts with injected matcher "namespace=\"default\""`,
+				"labels": map[string]interface{}{"namespace": []interface{}{"default"}},
+			},
+		},
+		{
+			name: "modify response failure",
+			url:  "/api/v1/query?query=up&namespace=default",
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("up 1"))
+			}),
+			opts:    []Option{WithVerifyQueryResults(VerifyQueryResultsFail)},
+			expCode: http.StatusBadRequest,
+			expLog: map[string]interface{}{
+				"level":  "WARN",
+				"msg":    "http: proxy error",
+				"method": "GET",
+				"path":   "/api/v1/query",
+				"code":   float64(http.StatusBadRequest),
+				"err":    `failed to process the API response: can't verify query results with content type "text/plain"`,
+				"labels": map[string]interface{}{"namespace": []interface{}{"default"}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithLogger(logger))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com" + tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			u.RawQuery = u.Query().Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("unexpected error: %v (log: %q)", err, buf.String())
+			}
+			delete(got, "time")
+
+			if !reflect.DeepEqual(got, tc.expLog) {
+				t.Fatalf("expected log %v, got %v", tc.expLog, got)
+			}
+		})
+	}
+}
+
+// headerCountingResponseWriter counts the calls to WriteHeader().
+type headerCountingResponseWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *headerCountingResponseWriter) WriteHeader(code int) {
+	w.n++
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestErrorHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+
+		expCode int
+	}{
+		{
+			name:    "upstream error",
+			err:     errors.New("connection refused"),
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:    "modify response failure",
+			err:     fmt.Errorf("%w: invalid data", errModifyResponseFailed),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			u, _ := url.Parse("http://prometheus.example.com")
+			r, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", nil)
+			req = req.WithContext(withNamedLabelValues(req.Context(), proxyLabel, []string{"default"}))
+
+			w := &headerCountingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+			r.errorHandler(w, req, tc.err)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, w.Code)
+			}
+			if w.n != 1 {
+				t.Fatalf("expected 1 call to WriteHeader(), got %d", w.n)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("unexpected error: %v (log: %q)", err, buf.String())
+			}
+			delete(got, "time")
+
+			exp := map[string]interface{}{
+				"level":  "ERROR",
+				"msg":    "http: proxy error",
+				"method": "POST",
+				"path":   "/api/v1/query",
+				"code":   float64(tc.expCode),
+				"err":    tc.err.Error(),
+				"labels": map[string]interface{}{"namespace": []interface{}{"default"}},
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected log %v, got %v", exp, got)
+			}
+		})
+	}
+}
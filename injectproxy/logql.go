@@ -0,0 +1,154 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LogQLEnforcer can enforce label matchers in the stream selectors of LogQL
+// queries.
+//
+// The query is scanned for stream selectors (e.g. `{app="foo"}`) outside of
+// string literals and comments. Only the stream selectors are rewritten, the
+// rest of the query (line filters, parsers, range aggregations, ...) is
+// forwarded as-is except for the comments which are removed.
+type LogQLEnforcer struct {
+	e *PromQLEnforcer
+}
+
+// NewLogQLEnforcer returns a LogQLEnforcer. The errorOnReplace parameter has
+// the same semantics as for NewPromQLEnforcer.
+func NewLogQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) *LogQLEnforcer {
+	return &LogQLEnforcer{e: NewPromQLEnforcer(errorOnReplace, ms...)}
+}
+
+// Enforce the label matchers in a LogQL query.
+func (le *LogQLEnforcer) Enforce(q string) (string, error) {
+	var (
+		sb        strings.Builder
+		selectors int
+	)
+
+	for i := 0; i < len(q); {
+		switch c := q[i]; c {
+		case '"', '`':
+			end, err := logQLStringEnd(q, i)
+			if err != nil {
+				return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+			}
+
+			sb.WriteString(q[i:end])
+			i = end
+
+		case '#':
+			// Comments run until the end of the line.
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				i = len(q)
+				continue
+			}
+			i += end
+
+		case '{':
+			end, err := logQLSelectorEnd(q, i)
+			if err != nil {
+				return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+			}
+
+			s, err := le.enforceSelector(q[i:end])
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString(s)
+			selectors++
+			i = end
+
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+
+	if selectors == 0 {
+		return "", fmt.Errorf("%w: no stream selector found", ErrQueryParse)
+	}
+
+	return sb.String(), nil
+}
+
+func (le *LogQLEnforcer) enforceSelector(s string) (string, error) {
+	ms, err := le.e.parser.ParseMetricSelector(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrQueryParse, err)
+	}
+
+	ms, err = le.e.EnforceMatchers(ms)
+	if err != nil {
+		if errors.Is(err, ErrIllegalLabelMatcher) {
+			return "", err
+		}
+
+		return "", fmt.Errorf("%w: %w", ErrEnforceLabel, err)
+	}
+
+	return matchersToString(ms...), nil
+}
+
+// logQLStringEnd returns the index following the string literal starting at
+// index i.
+func logQLStringEnd(q string, i int) (int, error) {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		switch q[j] {
+		case '\\':
+			// Raw strings (backticks) don't support escape sequences.
+			if quote == '"' {
+				j++
+			}
+		case quote:
+			return j + 1, nil
+		}
+	}
+
+	return 0, errors.New("unterminated string literal")
+}
+
+// logQLSelectorEnd returns the index following the stream selector starting
+// at index i.
+func logQLSelectorEnd(q string, i int) (int, error) {
+	for j := i + 1; j < len(q); {
+		switch q[j] {
+		case '"', '`':
+			end, err := logQLStringEnd(q, j)
+			if err != nil {
+				return 0, err
+			}
+			j = end
+		case '{':
+			return 0, errors.New("unexpected '{' in stream selector")
+		case '}':
+			return j + 1, nil
+		default:
+			j++
+		}
+	}
+
+	return 0, errors.New("unterminated stream selector")
+}
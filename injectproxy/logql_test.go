@@ -0,0 +1,154 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestLogQLEnforcer(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		expression     string
+		errorOnReplace bool
+
+		check checkFunc
+	}{
+		{
+			name:       "stream selector",
+			expression: `{app="foo"}`,
+			check:      checks(noError(), hasExpression(`{app="foo",namespace="NS"}`)),
+		},
+		{
+			name:       "stream selector with line filters and parser",
+			expression: `{app="foo"} |= "error" != "timeout" | json | level="error" | line_format "{{.msg}}"`,
+			check:      checks(noError(), hasExpression(`{app="foo",namespace="NS"} |= "error" != "timeout" | json | level="error" | line_format "{{.msg}}"`)),
+		},
+		{
+			name:       "metric query",
+			expression: `sum by (app) (rate({app="foo"} |~ "err.*" [5m]))`,
+			check:      checks(noError(), hasExpression(`sum by (app) (rate({app="foo",namespace="NS"} |~ "err.*" [5m]))`)),
+		},
+		{
+			name:       "binary expression",
+			expression: `count_over_time({app="foo"}[1m]) / count_over_time({app="bar"}[1m])`,
+			check:      checks(noError(), hasExpression(`count_over_time({app="foo",namespace="NS"}[1m]) / count_over_time({app="bar",namespace="NS"}[1m])`)),
+		},
+		{
+			name:       "braces in string literals",
+			expression: "{app=\"f{o}o\"} |= `{app=\"bar\"}` |= \"\\\"{\"",
+			check:      checks(noError(), hasExpression("{app=\"f{o}o\",namespace=\"NS\"} |= `{app=\"bar\"}` |= \"\\\"{\"")),
+		},
+		{
+			name:       "comment",
+			expression: "{app=\"foo\"} # |= \"\n|= \"error\"",
+			check:      checks(noError(), hasExpression("{app=\"foo\",namespace=\"NS\"} \n|= \"error\"")),
+		},
+		{
+			name:       "existing matcher replaced",
+			expression: `{app="foo",namespace="other"}`,
+			check:      checks(noError(), hasExpression(`{app="foo",namespace="NS"}`)),
+		},
+		{
+			name:           "existing matcher with errorOnReplace",
+			expression:     `{app="foo",namespace="other"}`,
+			errorOnReplace: true,
+			check:          checks(errorIs(ErrIllegalLabelMatcher)),
+		},
+		{
+			name:           "same matcher with errorOnReplace",
+			expression:     `{app="foo",namespace="NS"}`,
+			errorOnReplace: true,
+			check:          checks(noError(), hasExpression(`{app="foo",namespace="NS"}`)),
+		},
+		{
+			name:       "no stream selector",
+			expression: `vector(1)`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+		{
+			name:       "stream selector in comment only",
+			expression: `vector(1) # {app="foo"}`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+		{
+			name:       "unterminated stream selector",
+			expression: `{app="foo"`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+		{
+			name:       "unterminated string",
+			expression: `{app="foo"} |= "error`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+		{
+			name:       "nested braces",
+			expression: `{app="foo",{namespace="other"}}`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+		{
+			name:       "invalid stream selector",
+			expression: `{app}`,
+			check:      checks(errorIs(ErrQueryParse)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewLogQLEnforcer(tc.errorOnReplace, mustNewMatcher(labels.MatchEqual, "namespace", "NS"))
+
+			if err := tc.check(e.Enforce(tc.expression)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWithEnforcer(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", queryParam, `rate({app="foo",namespace="default"} |= "error" [5m])`))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEnforcer(func(errorOnReplace bool, ms ...*labels.Matcher) Enforcer {
+			return NewLogQLEnforcer(errorOnReplace, ms...)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	q := url.Values{proxyLabel: []string{"default"}, queryParam: []string{`rate({app="foo"} |= "error" [5m])`}}
+	req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Requests which aren't valid LogQL queries are rejected.
+	req = httptest.NewRequest(http.MethodGet, `http://prometheus.example.com/api/v1/query?namespace=default&query=up`, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
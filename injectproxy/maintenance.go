@@ -0,0 +1,102 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaintenanceMessage is the error message returned in maintenance
+// mode when none is configured.
+const defaultMaintenanceMessage = "the service is under maintenance"
+
+// maintenanceExemptPaths are served even in maintenance mode.
+var maintenanceExemptPaths = map[string]struct{}{
+	"/healthz":       {},
+	"/readyz":        {},
+	"/livez":         {},
+	"/-/maintenance": {},
+}
+
+// maintenanceMode holds the configuration and the state of the maintenance
+// mode.
+type maintenanceMode struct {
+	enabled    atomic.Bool
+	token      string
+	message    string
+	retryAfter time.Duration
+}
+
+// SetMaintenanceMode enables or disables the maintenance mode. It has no
+// effect unless the proxy has been created with WithMaintenanceMode().
+// It is safe for concurrent use.
+func (r *routes) SetMaintenanceMode(enabled bool) {
+	if r.maintenance == nil {
+		return
+	}
+
+	r.maintenance.enabled.Store(enabled)
+}
+
+// MaintenanceMode returns true if the maintenance mode is enabled.
+func (r *routes) MaintenanceMode() bool {
+	return r.maintenance != nil && r.maintenance.enabled.Load()
+}
+
+// withMaintenanceMode rejects all the requests with "503 Service Unavailable"
+// while the maintenance mode is enabled, except for the health and the
+// maintenance endpoints.
+func (r *routes) withMaintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := maintenanceExemptPaths[req.URL.Path]; ok || !r.maintenance.enabled.Load() {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if r.maintenance.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(r.maintenance.retryAfter.Seconds()))))
+		}
+		prometheusAPIError(w, r.maintenance.message, http.StatusServiceUnavailable)
+	})
+}
+
+// maintenanceHandler reports (GET), enables (POST) or disables (DELETE) the
+// maintenance mode. The requests must provide the configured token as bearer
+// token.
+func (r *routes) maintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.maintenance.token)) != 1 {
+		prometheusAPIError(w, "invalid or missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		r.SetMaintenanceMode(true)
+		r.logger.Info("maintenance mode enabled")
+	case http.MethodDelete:
+		r.SetMaintenanceMode(false)
+		r.logger.Info("maintenance mode disabled")
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"enabled": r.MaintenanceMode()})
+}
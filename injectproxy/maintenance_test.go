@@ -0,0 +1,274 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", "query", `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithMaintenanceMode("secret", "upgrading Prometheus", 90*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://prometheus.example.com"+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		return w
+	}
+
+	const queryPath = "/api/v1/query?query=up&namespace=default"
+
+	for _, step := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+
+		expCode       int
+		expRetryAfter string
+		expError      string
+		expEnabled    *bool
+	}{
+		{
+			name:    "query before maintenance",
+			method:  http.MethodGet,
+			path:    queryPath,
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "enable without token",
+			method:  http.MethodPost,
+			path:    "/-/maintenance",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "enable with invalid token",
+			method:  http.MethodPost,
+			path:    "/-/maintenance",
+			token:   "invalid",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "status before maintenance",
+			method:     http.MethodGet,
+			path:       "/-/maintenance",
+			token:      "secret",
+			expCode:    http.StatusOK,
+			expEnabled: boolPtr(false),
+		},
+		{
+			name:       "enable",
+			method:     http.MethodPost,
+			path:       "/-/maintenance",
+			token:      "secret",
+			expCode:    http.StatusOK,
+			expEnabled: boolPtr(true),
+		},
+		{
+			name:          "query during maintenance",
+			method:        http.MethodGet,
+			path:          queryPath,
+			expCode:       http.StatusServiceUnavailable,
+			expRetryAfter: "90",
+			expError:      "upgrading Prometheus",
+		},
+		{
+			name:          "unknown path during maintenance",
+			method:        http.MethodGet,
+			path:          "/unknown",
+			expCode:       http.StatusServiceUnavailable,
+			expRetryAfter: "90",
+			expError:      "upgrading Prometheus",
+		},
+		{
+			name:    "healthz during maintenance",
+			method:  http.MethodGet,
+			path:    "/healthz",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "livez during maintenance",
+			method:  http.MethodGet,
+			path:    "/livez",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "readyz during maintenance",
+			method:  http.MethodGet,
+			path:    "/readyz",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "disable with invalid token",
+			method:  http.MethodDelete,
+			path:    "/-/maintenance",
+			token:   "invalid",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "disable",
+			method:     http.MethodDelete,
+			path:       "/-/maintenance",
+			token:      "secret",
+			expCode:    http.StatusOK,
+			expEnabled: boolPtr(false),
+		},
+		{
+			name:    "query after maintenance",
+			method:  http.MethodGet,
+			path:    queryPath,
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			w := do(step.method, step.path, step.token)
+
+			if w.Code != step.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", step.expCode, w.Code, w.Body.String())
+			}
+
+			if got := w.Header().Get("Retry-After"); got != step.expRetryAfter {
+				t.Fatalf("expected Retry-After header %q, got %q", step.expRetryAfter, got)
+			}
+
+			if step.expError != "" {
+				var apir struct {
+					Error string `json:"error"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&apir); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if apir.Error != step.expError {
+					t.Fatalf("expected error %q, got %q", step.expError, apir.Error)
+				}
+			}
+
+			if step.expEnabled != nil {
+				var status struct {
+					Enabled bool `json:"enabled"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				if status.Enabled != *step.expEnabled {
+					t.Fatalf("expected enabled=%v, got %v", *step.expEnabled, status.Enabled)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceModeWithoutToken(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", "query", `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaintenanceMode("", "", 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The maintenance endpoint isn't registered.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/-/maintenance", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	r.SetMaintenanceMode(true)
+	if !r.MaintenanceMode() {
+		t.Fatal("expected maintenance mode to be enabled")
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Fatalf("expected no Retry-After header, got %q", got)
+	}
+
+	r.SetMaintenanceMode(false)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestMaintenanceModeConcurrentToggle(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write(okResponse) }))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaintenanceMode("secret", "", time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(enabled bool) {
+			defer wg.Done()
+			r.SetMaintenanceMode(enabled)
+		}(i%2 == 0)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+			if w.Code != http.StatusOK && w.Code != http.StatusServiceUnavailable {
+				t.Errorf("unexpected status code %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Without the option, the maintenance mode can't be enabled.
+	r, err = NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r.SetMaintenanceMode(true)
+	if r.MaintenanceMode() {
+		t.Fatal("expected maintenance mode to be disabled")
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// metricNamesCacheTTL is how long the metric names of a tenant are cached
+// when emulating the filtering of the metadata API.
+const metricNamesCacheTTL = 15 * time.Second
+
+type ttlCacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache caches the values computed from upstream requests (e.g. the metric
+// names matching a set of label matchers) for a fixed duration.
+type ttlCache[V any] struct {
+	mtx     sync.Mutex
+	entries map[string]ttlCacheEntry[V]
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{
+		entries: map[string]ttlCacheEntry[V]{},
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.expires) {
+		var zero V
+		return zero, false
+	}
+
+	return e.value, true
+}
+
+func (c *ttlCache[V]) set(key string, v V) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	// Purge the expired entries to keep the cache bounded.
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = ttlCacheEntry[V]{value: v, expires: now.Add(c.ttl)}
+}
+
+// upstreamAPI returns a client for the Prometheus API of the request's
+// upstream.
+func (r *routes) upstreamAPI(ctx context.Context) (promv1.API, error) {
+	c, err := api.NewClient(api.Config{Address: r.upstreamURL(ctx).String(), RoundTripper: r.upstreamTransport})
+	if err != nil {
+		return nil, err
+	}
+
+	return promv1.NewAPI(c), nil
+}
+
+// metricNames returns the names of the metrics having series which match the
+// given matchers. The result is cached per tenant key and selector.
+func (r *routes) metricNames(ctx context.Context, ms []*labels.Matcher) (map[string]struct{}, error) {
+	selector := matchersToString(ms...)
+	key := tenantKey(ctx) + "\xff" + selector
+	if names, ok := r.metricNamesCache.get(key); ok {
+		return names, nil
+	}
+
+	client, err := r.upstreamAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values, _, err := client.LabelValues(ctx, labels.MetricName, []string{selector}, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("can't get the metric names: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		names[string(v)] = struct{}{}
+	}
+	r.metricNamesCache.set(key, names)
+
+	return names, nil
+}
+
+// filterMetadata drops the metadata of the metrics which have no series
+// matching the enforced label(s).
+// The filtering happens after the upstream applied the "limit" parameter
+// hence the response may contain less metrics than requested.
+func (r *routes) filterMetadata(ms []*labels.Matcher, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var metadata map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &metadata); err != nil {
+		return nil, fmt.Errorf("can't decode metadata: %w", err)
+	}
+
+	names, err := r.metricNames(req.Context(), ms)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(map[string]json.RawMessage, len(metadata))
+	for name, md := range metadata {
+		if _, ok := names[name]; ok {
+			filtered[name] = md
+		}
+	}
+
+	return filtered, nil
+}
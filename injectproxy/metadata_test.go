@@ -0,0 +1,211 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// metadataUpstream serves the metadata of 3 metrics and the metric names of
+// the "ns1" and "ns2" tenants.
+type metadataUpstream struct {
+	t           *testing.T
+	labelValues atomic.Int32
+}
+
+func (m *metadataUpstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/api/v1/label/__name__/values":
+		m.labelValues.Add(1)
+
+		var data []string
+		switch match := req.URL.Query()["match[]"]; {
+		case slices.Equal(match, []string{`{namespace="ns1"}`}):
+			data = []string{"http_requests_total", "up"}
+		case slices.Equal(match, []string{`{namespace="ns2"}`}):
+			data = []string{"up"}
+		default:
+			m.t.Errorf("unexpected match[] parameter: %v", match)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+
+	case "/api/v1/metadata":
+		if req.URL.Query().Has(proxyLabel) {
+			m.t.Errorf("unexpected %q parameter forwarded to the upstream", proxyLabel)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{
+"http_requests_total":[{"type":"counter","help":"Total number of HTTP requests.","unit":""}],
+"node_cpu_seconds_total":[{"type":"counter","help":"Seconds the CPUs spent in each mode.","unit":""}],
+"up":[{"type":"gauge","help":"","unit":""}]
+}}`))
+
+	default:
+		m.t.Errorf("unexpected request path: %s", req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEmulatedMetadataFiltering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv string
+
+		expMetrics []string
+	}{
+		{
+			name:       "ns1",
+			labelv:     "ns1",
+			expMetrics: []string{"http_requests_total", "up"},
+		},
+		{
+			name:       "ns2",
+			labelv:     "ns2",
+			expMetrics: []string{"up"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream := &metadataUpstream{t: t}
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithEmulatedMetadataFiltering())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/metadata?namespace="+tc.labelv, nil))
+
+				resp := w.Result()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+				}
+
+				var apir struct {
+					Status string                     `json:"status"`
+					Data   map[string]json.RawMessage `json:"data"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				var got []string
+				for name := range apir.Data {
+					got = append(got, name)
+				}
+				sort.Strings(got)
+
+				if !slices.Equal(got, tc.expMetrics) {
+					t.Fatalf("expected metrics %v, got %v", tc.expMetrics, got)
+				}
+			}
+
+			// The metric names should be cached.
+			if n := upstream.labelValues.Load(); n != 1 {
+				t.Fatalf("expected 1 request for the metric names, got %d", n)
+			}
+		})
+	}
+}
+
+func TestTTLCache(t *testing.T) {
+	now := time.Now()
+	c := newTTLCache[map[string]struct{}](time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.set("foo", map[string]struct{}{"up": {}})
+	if _, ok := c.get("foo"); !ok {
+		t.Fatal("expected cache hit")
+	}
+	if _, ok := c.get("bar"); ok {
+		t.Fatal("expected cache miss")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("foo"); ok {
+		t.Fatal("expected cache miss after expiration")
+	}
+
+	c.set("bar", map[string]struct{}{"up": {}})
+	if len(c.entries) != 1 {
+		t.Fatalf("expected expired entries to be purged, got %d entries", len(c.entries))
+	}
+}
+
+func TestEmulatedMetadataFilteringWithTenantKeyFunc(t *testing.T) {
+	upstream := &metadataUpstream{t: t}
+	m := newMockUpstream(upstream)
+	defer m.Close()
+
+	var keys []string
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithEmulatedMetadataFiltering(),
+		WithTenantKeyFunc(func(req *http.Request) string {
+			k := MustLabelValue(req.Context()) + "/" + req.Header.Get("X-Region")
+			keys = append(keys, k)
+			return k
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		labelv string
+		region string
+
+		expRequests int32
+	}{
+		{labelv: "ns1", region: "eu", expRequests: 1},
+		{labelv: "ns1", region: "eu", expRequests: 1},
+		{labelv: "ns1", region: "us", expRequests: 2},
+		{labelv: "ns2", region: "eu", expRequests: 3},
+		{labelv: "ns1", region: "us", expRequests: 3},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/metadata?namespace="+tc.labelv, nil)
+		req.Header.Set("X-Region", tc.region)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+
+		if n := upstream.labelValues.Load(); n != tc.expRequests {
+			t.Fatalf("%s/%s: expected %d requests for the metric names, got %d", tc.labelv, tc.region, tc.expRequests, n)
+		}
+	}
+
+	expKeys := []string{"ns1/eu", "ns1/eu", "ns1/us", "ns2/eu", "ns1/us"}
+	if !slices.Equal(keys, expKeys) {
+		t.Fatalf("expected tenant keys %v, got %v", expKeys, keys)
+	}
+}
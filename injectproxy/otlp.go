@@ -0,0 +1,199 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpMetricsPath is the path of the OTLP metrics receiver of Prometheus.
+const otlpMetricsPath = "/api/v1/otlp/v1/metrics"
+
+// otlpMetrics proxies HTTP requests to the OTLP metrics endpoint. The enforced
+// label is injected as an attribute of every data point of the protobuf or
+// JSON encoded export request: Prometheus converts the data point attributes
+// to series labels and they take precedence over the promoted resource
+// attributes. It is also injected as a resource attribute so that the
+// resource (e.g. target_info) can't claim another tenant either.
+//
+// The request is decoded as a MetricsData message, which has the same
+// encoding as ExportMetricsServiceRequest but doesn't depend on the gRPC
+// service definitions.
+func (r *routes) otlpMetrics(w http.ResponseWriter, req *http.Request) {
+	ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (ct != "application/x-protobuf" && ct != "application/json") {
+		prometheusAPIError(w, fmt.Sprintf("unsupported content type %q", req.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var md metricsv1.MetricsData
+	if ct == "application/json" {
+		// The trace and span IDs of the exemplars are hex-encoded in OTLP/JSON
+		// while protojson expects base64. Their length being a multiple of 4,
+		// they are decoded and encoded back unchanged.
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, &md)
+	} else {
+		err = proto.Unmarshal(b, &md)
+	}
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode export request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, name := range r.labelNames {
+		lvalue := MustLabelValuesFor(req.Context(), name)[0]
+		for _, rm := range md.ResourceMetrics {
+			if rm.Resource == nil {
+				rm.Resource = &resourcev1.Resource{}
+			}
+			attrs, err := r.injectOTLPAttribute(rm.Resource.Attributes, name, lvalue)
+			if err != nil {
+				prometheusAPIError(w, err.Error(), r.replaceRejectionStatus)
+				return
+			}
+			rm.Resource.Attributes = attrs
+
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					if err := r.injectOTLPDataPointAttribute(m, name, lvalue); err != nil {
+						prometheusAPIError(w, err.Error(), r.replaceRejectionStatus)
+						return
+					}
+				}
+			}
+		}
+	}
+
+	if ct == "application/json" {
+		// OTLP/JSON requires the enum values to be encoded as integers.
+		b, err = protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(&md)
+	} else {
+		b, err = proto.Marshal(&md)
+	}
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't encode export request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.Header["Content-Length"] = []string{strconv.Itoa(len(b))}
+	req.ContentLength = int64(len(b))
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// injectOTLPDataPointAttribute sets the enforced label on the attributes of
+// all the data points of the metric.
+func (r *routes) injectOTLPDataPointAttribute(m *metricsv1.Metric, name, lvalue string) error {
+	var attrs []*[]*commonv1.KeyValue
+	switch data := m.Data.(type) {
+	case *metricsv1.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			attrs = append(attrs, &dp.Attributes)
+		}
+	case *metricsv1.Metric_Sum:
+		for _, dp := range data.Sum.GetDataPoints() {
+			attrs = append(attrs, &dp.Attributes)
+		}
+	case *metricsv1.Metric_Histogram:
+		for _, dp := range data.Histogram.GetDataPoints() {
+			attrs = append(attrs, &dp.Attributes)
+		}
+	case *metricsv1.Metric_ExponentialHistogram:
+		for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+			attrs = append(attrs, &dp.Attributes)
+		}
+	case *metricsv1.Metric_Summary:
+		for _, dp := range data.Summary.GetDataPoints() {
+			attrs = append(attrs, &dp.Attributes)
+		}
+	}
+
+	for _, a := range attrs {
+		kvs, err := r.injectOTLPAttribute(*a, name, lvalue)
+		if err != nil {
+			return fmt.Errorf("metric %q: %w", m.Name, err)
+		}
+		*a = kvs
+	}
+
+	return nil
+}
+
+// injectOTLPAttribute sets the enforced label on the given attributes. If the
+// attribute already exists with a different value, it is either overwritten
+// or an error is returned depending on errorOnReplace. Prometheus joins the
+// values of the attributes converted to the same label name, hence all the
+// attributes whose key or normalized key is the label name are replaced.
+func (r *routes) injectOTLPAttribute(kvs []*commonv1.KeyValue, name, lvalue string) ([]*commonv1.KeyValue, error) {
+	filtered := kvs[:0]
+	for _, kv := range kvs {
+		if kv.Key != name && normalizeOTLPLabelName(kv.Key) != name {
+			filtered = append(filtered, kv)
+			continue
+		}
+
+		if kv.Value.GetStringValue() != lvalue && r.errorOnReplace {
+			return nil, fmt.Errorf("%w: attribute %s=%q conflicts with injected value %q", ErrIllegalLabelMatcher, kv.Key, kv.Value.GetStringValue(), lvalue)
+		}
+	}
+
+	v := &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: lvalue}}
+	return append(filtered, &commonv1.KeyValue{Key: name, Value: v}), nil
+}
+
+// normalizeOTLPLabelName returns the label name to which Prometheus converts
+// the attribute key when UTF-8 label names aren't allowed (see NormalizeLabel
+// in github.com/prometheus/otlptranslator).
+func normalizeOTLPLabelName(key string) string {
+	if key == "" {
+		return key
+	}
+
+	key = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, key)
+
+	if unicode.IsDigit(rune(key[0])) {
+		return "key_" + key
+	}
+	if strings.HasPrefix(key, "_") && !strings.HasPrefix(key, "__") {
+		return "key" + key
+	}
+
+	return key
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	metricsv1 "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcev1 "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpKeyValues(kvs ...string) []*commonv1.KeyValue {
+	var attrs []*commonv1.KeyValue
+	for i := 0; i < len(kvs); i += 2 {
+		attrs = append(attrs, &commonv1.KeyValue{
+			Key:   kvs[i],
+			Value: &commonv1.AnyValue{Value: &commonv1.AnyValue_StringValue{StringValue: kvs[i+1]}},
+		})
+	}
+
+	return attrs
+}
+
+// newMetricsData returns an export request made of one resource with a gauge
+// and a histogram.
+func newMetricsData(resourceAttrs, dataPointAttrs []string) *metricsv1.MetricsData {
+	return &metricsv1.MetricsData{
+		ResourceMetrics: []*metricsv1.ResourceMetrics{{
+			Resource: &resourcev1.Resource{Attributes: otlpKeyValues(resourceAttrs...)},
+			ScopeMetrics: []*metricsv1.ScopeMetrics{{
+				Metrics: []*metricsv1.Metric{
+					{
+						Name: "up",
+						Data: &metricsv1.Metric_Gauge{Gauge: &metricsv1.Gauge{
+							DataPoints: []*metricsv1.NumberDataPoint{{
+								Attributes: otlpKeyValues(dataPointAttrs...),
+								Value:      &metricsv1.NumberDataPoint_AsDouble{AsDouble: 1},
+							}},
+						}},
+					},
+					{
+						Name: "http_request_duration_seconds",
+						Data: &metricsv1.Metric_Histogram{Histogram: &metricsv1.Histogram{
+							AggregationTemporality: metricsv1.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+							DataPoints: []*metricsv1.HistogramDataPoint{{
+								Attributes: otlpKeyValues(dataPointAttrs...),
+								Count:      1,
+							}},
+						}},
+					},
+				},
+			}},
+		}},
+	}
+}
+
+// otlpAttributes returns the attributes of the resources and data points as
+// "key=value" strings.
+func otlpAttributes(md *metricsv1.MetricsData) (resourceAttrs, dataPointAttrs []string) {
+	format := func(kvs []*commonv1.KeyValue) string {
+		s := make([]string, 0, len(kvs))
+		for _, kv := range kvs {
+			s = append(s, kv.Key+"="+kv.Value.GetStringValue())
+		}
+		return strings.Join(s, ",")
+	}
+
+	for _, rm := range md.ResourceMetrics {
+		resourceAttrs = append(resourceAttrs, format(rm.Resource.GetAttributes()))
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				for _, dp := range m.GetGauge().GetDataPoints() {
+					dataPointAttrs = append(dataPointAttrs, format(dp.Attributes))
+				}
+				for _, dp := range m.GetHistogram().GetDataPoints() {
+					dataPointAttrs = append(dataPointAttrs, format(dp.Attributes))
+				}
+			}
+		}
+	}
+
+	return resourceAttrs, dataPointAttrs
+}
+
+// checkOTLPHandler verifies that the upstream receives metrics with the given
+// resource and data point attributes.
+func checkOTLPHandler(t *testing.T, expResourceAttrs, expDataPointAttrs []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			prometheusAPIError(w, "failed to read body", http.StatusInternalServerError)
+			return
+		}
+
+		var md metricsv1.MetricsData
+		if req.Header.Get("Content-Type") == "application/json" {
+			err = protojson.Unmarshal(b, &md)
+		} else {
+			err = proto.Unmarshal(b, &md)
+		}
+		if err != nil {
+			prometheusAPIError(w, "failed to decode body", http.StatusInternalServerError)
+			return
+		}
+
+		resourceAttrs, dataPointAttrs := otlpAttributes(&md)
+		if !reflect.DeepEqual(resourceAttrs, expResourceAttrs) {
+			t.Errorf("expected resource attributes %q, got %q", expResourceAttrs, resourceAttrs)
+		}
+		if !reflect.DeepEqual(dataPointAttrs, expDataPointAttrs) {
+			t.Errorf("expected data point attributes %q, got %q", expDataPointAttrs, dataPointAttrs)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		label          string
+		labelv         []string
+		contentType    string
+		body           []byte
+		resourceAttrs  []string
+		dataPointAttrs []string
+		opts           []Option
+
+		expCode           int
+		expResourceAttrs  []string
+		expDataPointAttrs []string
+	}{
+		{
+			name:    "no label value",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:              "attribute injected",
+			labelv:            []string{"default"},
+			resourceAttrs:     []string{"service.name", "api"},
+			dataPointAttrs:    []string{"code", "200"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"service.name=api,namespace=default"},
+			expDataPointAttrs: []string{"code=200,namespace=default", "code=200,namespace=default"},
+		},
+		{
+			name:              "attribute injected with JSON encoding",
+			labelv:            []string{"default"},
+			contentType:       "application/json",
+			resourceAttrs:     []string{"service.name", "api"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"service.name=api,namespace=default"},
+			expDataPointAttrs: []string{"namespace=default", "namespace=default"},
+		},
+		{
+			name:              "existing resource attribute overwritten",
+			labelv:            []string{"default"},
+			resourceAttrs:     []string{"namespace", "other"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"namespace=default"},
+			expDataPointAttrs: []string{"namespace=default", "namespace=default"},
+		},
+		{
+			name:              "existing data point attribute overwritten",
+			labelv:            []string{"default"},
+			dataPointAttrs:    []string{"namespace", "victim"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"namespace=default"},
+			expDataPointAttrs: []string{"namespace=default", "namespace=default"},
+		},
+		{
+			name:           "conflicting data point attribute with errorOnReplace",
+			labelv:         []string{"default"},
+			dataPointAttrs: []string{"namespace", "other"},
+			opts:           []Option{WithErrorOnReplace()},
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:          "conflicting resource attribute with errorOnReplace",
+			labelv:        []string{"default"},
+			resourceAttrs: []string{"namespace", "other"},
+			opts:          []Option{WithErrorOnReplace()},
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:              "duplicate data point attributes overwritten",
+			labelv:            []string{"default"},
+			dataPointAttrs:    []string{"namespace", "default", "code", "200", "namespace", "other"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"namespace=default"},
+			expDataPointAttrs: []string{"code=200,namespace=default", "code=200,namespace=default"},
+		},
+		{
+			name:           "duplicate conflicting data point attributes with errorOnReplace",
+			labelv:         []string{"default"},
+			dataPointAttrs: []string{"namespace", "default", "namespace", "other"},
+			opts:           []Option{WithErrorOnReplace()},
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:              "attributes normalized to the label name overwritten",
+			label:             "k8s_namespace",
+			labelv:            []string{"default"},
+			resourceAttrs:     []string{"k8s.namespace", "other"},
+			dataPointAttrs:    []string{"k8s-namespace", "other", "k8s.namespace.name", "other"},
+			expCode:           http.StatusOK,
+			expResourceAttrs:  []string{"k8s_namespace=default"},
+			expDataPointAttrs: []string{"k8s.namespace.name=other,k8s_namespace=default", "k8s.namespace.name=other,k8s_namespace=default"},
+		},
+		{
+			name:           "conflicting attribute normalized to the label name with errorOnReplace",
+			label:          "k8s_namespace",
+			labelv:         []string{"default"},
+			dataPointAttrs: []string{"k8s.namespace", "other"},
+			opts:           []Option{WithErrorOnReplace()},
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:    "body too large",
+			labelv:  []string{"default"},
+			body:    bytes.Repeat([]byte("a"), 65),
+			opts:    []Option{WithMaxBodyBytes(64)},
+			expCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "multiple label values",
+			labelv:  []string{"default", "other"},
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "regex match",
+			labelv:  []string{"default"},
+			opts:    []Option{WithRegexMatch()},
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:        "unsupported content type",
+			labelv:      []string{"default"},
+			contentType: "text/plain",
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "invalid protobuf payload",
+			labelv:  []string{"default"},
+			body:    []byte("not protobuf"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:        "invalid JSON payload",
+			labelv:      []string{"default"},
+			contentType: "application/json",
+			body:        []byte(`{"resourceMetrics":`),
+			expCode:     http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkOTLPHandler(t, tc.expResourceAttrs, tc.expDataPointAttrs))
+			defer m.Close()
+
+			label := tc.label
+			if label == "" {
+				label = proxyLabel
+			}
+
+			r, err := NewRoutes(m.url, label, HTTPHeaderEnforcer{Name: "X-Namespace"}, append(tc.opts, WithEnabledOTLP())...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			contentType := tc.contentType
+			if contentType == "" {
+				contentType = "application/x-protobuf"
+			}
+
+			body := tc.body
+			if body == nil {
+				md := newMetricsData(tc.resourceAttrs, tc.dataPointAttrs)
+				if contentType == "application/json" {
+					body, err = protojson.Marshal(md)
+				} else {
+					body, err = proto.Marshal(md)
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/otlp/v1/metrics", bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			for _, lv := range tc.labelv {
+				req.Header.Add("X-Namespace", lv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		m := newMockUpstream(checkOTLPHandler(t, nil, nil))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/otlp/v1/metrics", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
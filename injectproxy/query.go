@@ -0,0 +1,700 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const lookbackDeltaParam = "lookback_delta"
+
+// QueryResultsVerification defines how the proxy handles query results which
+// don't carry the enforced label value.
+type QueryResultsVerification int
+
+const (
+	// VerifyQueryResultsNone disables the verification of the query results.
+	VerifyQueryResultsNone QueryResultsVerification = iota
+	// VerifyQueryResultsDrop removes the series not matching the enforced
+	// label value from the query results.
+	VerifyQueryResultsDrop
+	// VerifyQueryResultsFail fails the request if any series doesn't match
+	// the enforced label value.
+	VerifyQueryResultsFail
+)
+
+// LookbackDeltaLimitMode defines how the proxy handles lookback_delta values
+// exceeding the configured maximum.
+type LookbackDeltaLimitMode int
+
+const (
+	// LookbackDeltaClamp replaces the lookback_delta value by the maximum.
+	LookbackDeltaClamp LookbackDeltaLimitMode = iota
+	// LookbackDeltaReject fails the request with "400 Bad Request".
+	LookbackDeltaReject
+)
+
+// seriesMetric decodes the labels of a vector or matrix result item.
+type seriesMetric struct {
+	Metric map[string]string `json:"metric"`
+}
+
+// modifyQueryResponse verifies the query results of requests for which a
+// label was enforced. Responses to bypassed queries are returned unmodified.
+// Successful responses which aren't JSON-encoded (e.g. when the client
+// negotiated another format) can't be verified: they are rejected with
+// VerifyQueryResultsFail and returned unmodified with VerifyQueryResultsDrop,
+// relying on the enforcement of the query only.
+func (r *routes) modifyQueryResponse(resp *http.Response) error {
+	if _, ok := resp.Request.Context().Value(keyLabel).([]string); !ok {
+		return nil
+	}
+
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode == http.StatusOK && ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+			if r.queryResultsVerification == VerifyQueryResultsFail {
+				return fmt.Errorf("%w: can't verify query results with content type %q", errModifyResponseFailed, ct)
+			}
+
+			r.logger.Warn("skipping the verification of query results", "content_type", ct)
+			return nil
+		}
+	}
+
+	return r.modifyAPIResponse(r.verifyQueryResults)(resp)
+}
+
+// verifyQueryResults checks that all the series returned by the
+// /api/v1/query and /api/v1/query_range endpoints match the enforced label
+// value. Scalar and string results have no labels and are returned as-is.
+func (r *routes) verifyQueryResults(ms []*labels.Matcher, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode query data: %w", err)
+	}
+
+	var resultType string
+	if err := json.Unmarshal(data["resultType"], &resultType); err != nil {
+		return nil, fmt.Errorf("can't decode result type: %w", err)
+	}
+
+	if resultType != "vector" && resultType != "matrix" {
+		return data, nil
+	}
+
+	var results []json.RawMessage
+	if err := json.Unmarshal(data["result"], &results); err != nil {
+		return nil, fmt.Errorf("can't decode %s result: %w", resultType, err)
+	}
+
+	filtered := []json.RawMessage{}
+	for _, result := range results {
+		var s seriesMetric
+		if err := json.Unmarshal(result, &s); err != nil {
+			return nil, fmt.Errorf("can't decode %s result: %w", resultType, err)
+		}
+
+		if matchLabels(ms, func(name string) string { return s.Metric[name] }) {
+			filtered = append(filtered, result)
+			continue
+		}
+
+		if r.queryResultsVerification == VerifyQueryResultsFail {
+			return nil, fmt.Errorf("series %v doesn't match %s", s.Metric, matchersToString(ms...))
+		}
+	}
+
+	b, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode %s result: %w", resultType, err)
+	}
+	data["result"] = b
+
+	return data, nil
+}
+
+// parseDuration parses a duration the same way as the Prometheus API does,
+// either as a number of seconds or as a Prometheus duration (e.g. "5m").
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration: it overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// limitLookbackDelta enforces the maximum lookback delta (if configured) on
+// the lookback_delta parameter of the given values.
+func (r *routes) limitLookbackDelta(v url.Values) error {
+	if r.maxLookbackDelta <= 0 || !v.Has(lookbackDeltaParam) {
+		return nil
+	}
+
+	for _, s := range v[lookbackDeltaParam] {
+		d, err := parseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", lookbackDeltaParam, err)
+		}
+
+		if d <= r.maxLookbackDelta {
+			continue
+		}
+
+		if r.lookbackDeltaLimitMode == LookbackDeltaReject {
+			return fmt.Errorf("parameter %q exceeds the maximum of %s", lookbackDeltaParam, model.Duration(r.maxLookbackDelta))
+		}
+
+		v.Set(lookbackDeltaParam, model.Duration(r.maxLookbackDelta).String())
+		return nil
+	}
+
+	return nil
+}
+
+// parseTime parses a timestamp the same way as the Prometheus API (Unix
+// timestamp in seconds or RFC 3339).
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(sec), int64(ns*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// limitQueryRange enforces the range limits (if configured) on the start,
+// end and step parameters of a range query. Like Prometheus, the values of
+// the POST body take precedence over the ones of the URL query string.
+// The requests with missing parameters are forwarded as-is since the upstream
+// rejects them anyway.
+func (r *routes) limitQueryRange(req *http.Request) error {
+	if r.maxQueryRange <= 0 && r.minQueryStep <= 0 {
+		return nil
+	}
+
+	var (
+		q     = req.URL.Query()
+		names = []string{"start", "end", "step"}
+		v     = url.Values{}
+	)
+	for _, name := range names {
+		if q.Has(name) {
+			v.Set(name, q.Get(name))
+		}
+	}
+
+	var (
+		bodies = []url.Values{nil}
+		batch  bool
+	)
+	switch {
+	case isJSONBody(req):
+		var (
+			objects []map[string]json.RawMessage
+			err     error
+		)
+		objects, batch, err = r.decodeJSONObjects(req)
+		if err != nil {
+			return err
+		}
+
+		bodies = bodies[:0]
+		for i, fields := range objects {
+			body, err := jsonStringFields(fields, names...)
+			if err != nil {
+				if batch {
+					return fmt.Errorf("batch query %d: %w", i, err)
+				}
+				return err
+			}
+			bodies = append(bodies, body)
+		}
+		if len(bodies) == 0 {
+			// Empty batch: only the URL parameters apply.
+			bodies = append(bodies, nil)
+		}
+	case req.Method == http.MethodPost:
+		body, err := peekPostForm(req)
+		if err != nil {
+			return err
+		}
+		bodies[0] = body
+	}
+
+	for i, body := range bodies {
+		bv := url.Values{}
+		for _, name := range names {
+			switch {
+			case body.Has(name):
+				bv.Set(name, body.Get(name))
+			case v.Has(name):
+				bv.Set(name, v.Get(name))
+			}
+		}
+
+		if err := r.checkRangeLimits(bv); err != nil {
+			if batch {
+				return fmt.Errorf("batch query %d: %w", i, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRangeLimits verifies the start, end and step parameters against the
+// range limits.
+func (r *routes) checkRangeLimits(v url.Values) error {
+	if r.minQueryStep > 0 && v.Has("step") {
+		step, err := parseDuration(v.Get("step"))
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", "step", err)
+		}
+
+		if step < r.minQueryStep {
+			return fmt.Errorf("parameter %q is lower than the minimum of %s", "step", model.Duration(r.minQueryStep))
+		}
+	}
+
+	if r.maxQueryRange > 0 && v.Has("start") && v.Has("end") {
+		start, err := parseTime(v.Get("start"))
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", "start", err)
+		}
+
+		end, err := parseTime(v.Get("end"))
+		if err != nil {
+			return fmt.Errorf("invalid parameter %q: %w", "end", err)
+		}
+
+		if end.Sub(start) > r.maxQueryRange {
+			return fmt.Errorf("query range exceeds the maximum of %s", model.Duration(r.maxQueryRange))
+		}
+	}
+
+	return nil
+}
+
+// peekPostForm returns the values of a form-encoded POST body without
+// consuming the body (contrary to http.Request.ParseForm()).
+func peekPostForm(req *http.Request) (url.Values, error) {
+	if req.PostForm != nil {
+		return req.PostForm, nil
+	}
+
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mt != "application/x-www-form-urlencoded" || req.Body == nil {
+		return url.Values{}, nil
+	}
+
+	b, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.ParseQuery(string(b))
+}
+
+// readBody reads the request body and restores it so it can be read again.
+func readBody(req *http.Request) ([]byte, error) {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(b))
+
+	return b, nil
+}
+
+// encodeInOrder encodes the values like url.Values.Encode() but keeps the
+// order of the parameters of raw (the original encoded values). The
+// parameters which haven't been modified are copied verbatim and the new ones
+// are appended.
+func encodeInOrder(raw string, v url.Values) string {
+	var (
+		sb   strings.Builder
+		seen = map[string]int{}
+	)
+	write := func(s string) {
+		if sb.Len() > 0 {
+			sb.WriteByte('&')
+		}
+		sb.WriteString(s)
+	}
+
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+
+		k, val, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			continue
+		}
+
+		i := seen[key]
+		seen[key]++
+		if i >= len(v[key]) {
+			// The parameter has been removed.
+			continue
+		}
+
+		if orig, err := url.QueryUnescape(val); err == nil && orig == v[key][i] {
+			write(pair)
+			continue
+		}
+		write(k + "=" + url.QueryEscape(v[key][i]))
+	}
+
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		if len(v[k]) > seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, val := range v[k][seen[k]:] {
+			write(url.QueryEscape(k) + "=" + url.QueryEscape(val))
+		}
+	}
+
+	return sb.String()
+}
+
+// isJSONBody returns true if the request is a POST request with a
+// JSON-encoded body.
+func isJSONBody(req *http.Request) bool {
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody {
+		return false
+	}
+
+	mt, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// decodeJSONBody reads the JSON object from the request body and restores the
+// body so it can be read again.
+func decodeJSONBody(req *http.Request) (map[string]json.RawMessage, error) {
+	b, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("can't decode JSON body: %w", err)
+	}
+
+	return fields, nil
+}
+
+// decodeJSONObjects reads the JSON object(s) from the request body and
+// restores the body so it can be read again. When WithBatchQueryField() is
+// configured and the body is a JSON array, it returns the objects of the array
+// and true.
+func (r *routes) decodeJSONObjects(req *http.Request) ([]map[string]json.RawMessage, bool, error) {
+	if r.batchQueryField == "" {
+		fields, err := decodeJSONBody(req)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return []map[string]json.RawMessage{fields}, false, nil
+	}
+
+	b, err := readBody(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("[")) {
+		fields, err := decodeJSONBody(req)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return []map[string]json.RawMessage{fields}, false, nil
+	}
+
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(b, &objects); err != nil {
+		return nil, false, fmt.Errorf("can't decode JSON batch body: %w", err)
+	}
+
+	for i, fields := range objects {
+		if fields == nil {
+			return nil, false, fmt.Errorf("batch query %d: must be a JSON object", i)
+		}
+	}
+
+	return objects, true, nil
+}
+
+// jsonStringFields returns the given fields of the JSON object as URL values.
+// It fails if a field isn't a string or if the object has a key which differs
+// from a field name only by case: upstreams decoding the body into a struct
+// match the keys case-insensitively and such a key would escape the
+// enforcement.
+func jsonStringFields(fields map[string]json.RawMessage, names ...string) (url.Values, error) {
+	for k := range fields {
+		for _, name := range names {
+			if k != name && strings.EqualFold(k, name) {
+				return nil, fmt.Errorf("invalid JSON field %q: field names are case-sensitive, expected %q", k, name)
+			}
+		}
+	}
+
+	v := url.Values{}
+	for _, name := range names {
+		raw, found := fields[name]
+		if !found {
+			continue
+		}
+
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("invalid JSON field %q: must be a string", name)
+		}
+		v.Set(name, s)
+	}
+
+	return v, nil
+}
+
+// removeJSONFields removes the given fields from the JSON object (or from
+// each object of the JSON array) of the request body. The body is left
+// untouched if it isn't made of JSON objects or if none of the fields is
+// found.
+func removeJSONFields(req *http.Request, names []string) error {
+	b, err := readBody(req)
+	if err != nil {
+		return err
+	}
+
+	var (
+		v       any
+		objects []map[string]json.RawMessage
+	)
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("[")) {
+		if err := json.Unmarshal(b, &objects); err != nil {
+			return nil
+		}
+		v = objects
+	} else {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil
+		}
+		objects = append(objects, fields)
+		v = fields
+	}
+
+	var found bool
+	for _, fields := range objects {
+		for _, name := range names {
+			if _, ok := fields[name]; ok {
+				delete(fields, name)
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	_, _, err = replaceJSONBody(req, v)
+	return err
+}
+
+// enforceJSONBody enforces the query of a JSON-encoded POST body (e.g.
+// {"query":"up","time":"..."}) as sent by Grafana and some client libraries.
+// With WithBatchQueryField(), the body can also be an array of objects whose
+// queries are all enforced. The other fields are forwarded untouched. It
+// returns the new body and whether a query was found.
+func (r *routes) enforceJSONBody(e Enforcer, req *http.Request) (string, bool, error) {
+	objects, batch, err := r.decodeJSONObjects(req)
+	if err != nil {
+		return "", false, err
+	}
+
+	if !batch {
+		var found bool
+		for _, name := range r.queryParams {
+			f, err := r.enforceJSONObject(e, objects[0], name)
+			if err != nil {
+				return "", false, err
+			}
+			found = found || f
+		}
+
+		if !found {
+			return "", false, nil
+		}
+
+		return replaceJSONBody(req, objects[0])
+	}
+
+	var found bool
+	for i, fields := range objects {
+		if _, ok := fields[r.batchQueryField]; !ok {
+			return "", false, fmt.Errorf("batch query %d: missing field %q", i, r.batchQueryField)
+		}
+
+		if _, err := r.enforceJSONObject(e, fields, r.batchQueryField); err != nil {
+			return "", false, fmt.Errorf("batch query %d: %w", i, err)
+		}
+		found = true
+	}
+
+	if !found {
+		return "", false, nil
+	}
+
+	return replaceJSONBody(req, objects)
+}
+
+// enforceJSONObject enforces the query in the given field of the JSON object.
+// It returns whether a query was found.
+func (r *routes) enforceJSONObject(e Enforcer, fields map[string]json.RawMessage, field string) (bool, error) {
+	v, err := jsonStringFields(fields, field, lookbackDeltaParam)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.limitLookbackDelta(v); err != nil {
+		return false, err
+	}
+
+	q := url.Values{queryParam: v[field]}
+	if _, found, err := r.enforceQueryValues(e, q); err != nil || !found {
+		return found, err
+	}
+	v[field] = q[queryParam]
+
+	for name := range v {
+		b, err := json.Marshal(v.Get(name))
+		if err != nil {
+			return false, fmt.Errorf("can't encode JSON field %q: %w", name, err)
+		}
+		fields[name] = b
+	}
+
+	return true, nil
+}
+
+// replaceJSONBody replaces the request body by the JSON encoding of v and
+// returns the new body.
+func replaceJSONBody(req *http.Request, v any) (string, bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false, fmt.Errorf("can't encode JSON body: %w", err)
+	}
+
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+
+	return string(b), true, nil
+}
+
+// maxQueryRewriteHeaderLength is the maximum length of the queries reported
+// by the X-Original-Query and X-Enforced-Query headers (before escaping).
+const maxQueryRewriteHeaderLength = 1024
+
+// queryRewrite records the last query enforced by the wrapped Enforcer. The
+// queries of the body are enforced after the ones of the URL and they take
+// precedence for Prometheus too.
+type queryRewrite struct {
+	Enforcer
+	original string
+	enforced string
+}
+
+// Enforce implements the Enforcer interface.
+func (qr *queryRewrite) Enforce(q string) (string, error) {
+	eq, err := qr.Enforcer.Enforce(q)
+	if err == nil {
+		qr.original, qr.enforced = q, eq
+	}
+
+	return eq, err
+}
+
+// setQueryRewriteHeaders adds the X-Original-Query and X-Enforced-Query
+// headers to the upstream response.
+func setQueryRewriteHeaders(resp *http.Response) {
+	qr, ok := resp.Request.Context().Value(keyQueryRewrite).(*queryRewrite)
+	if !ok || qr.enforced == "" {
+		return
+	}
+
+	resp.Header.Set("X-Original-Query", queryHeaderValue(qr.original))
+	resp.Header.Set("X-Enforced-Query", queryHeaderValue(qr.enforced))
+}
+
+// queryHeaderValue truncates the query and escapes the non-printable and
+// non-ASCII characters so that it can be used as a header value.
+func queryHeaderValue(q string) string {
+	var truncated bool
+	if len(q) > maxQueryRewriteHeaderLength {
+		// Don't split a multi-byte character.
+		n := maxQueryRewriteHeaderLength
+		for n > 0 && !utf8.RuneStart(q[n]) {
+			n--
+		}
+		q = q[:n]
+		truncated = true
+	}
+
+	v := strconv.QuoteToASCII(q)
+	v = v[1 : len(v)-1]
+	if truncated {
+		v += "..."
+	}
+
+	return v
+}
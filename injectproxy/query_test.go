@@ -0,0 +1,726 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func queryResponse(data string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":` + data + `}`))
+	})
+}
+
+func TestVerifyQueryResults(t *testing.T) {
+	const (
+		mixedVector = `{"resultType":"vector","result":[` +
+			`{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]},` +
+			`{"metric":{"__name__":"up","namespace":"ns2"},"value":[1,"1"]},` +
+			`{"metric":{"__name__":"up"},"value":[1,"1"]}]}`
+		mixedMatrix = `{"resultType":"matrix","result":[` +
+			`{"metric":{"__name__":"up","namespace":"ns2"},"values":[[1,"1"]]},` +
+			`{"metric":{"__name__":"up","namespace":"ns1"},"values":[[1,"1"]]}]}`
+		tenantVector = `{"resultType":"vector","result":[` +
+			`{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]}]}`
+		scalar = `{"resultType":"scalar","result":[1,"1"]}`
+		str    = `{"resultType":"string","result":[1,"foo"]}`
+	)
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		mode     QueryResultsVerification
+		data     string
+		bypass   bool
+
+		expCode int
+		expData string
+	}{
+		{
+			name:     "mixed vector in drop mode",
+			endpoint: "query",
+			mode:     VerifyQueryResultsDrop,
+			data:     mixedVector,
+			expCode:  http.StatusOK,
+			expData:  `{"result":[{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]}],"resultType":"vector"}`,
+		},
+		{
+			name:     "mixed matrix in drop mode",
+			endpoint: "query_range",
+			mode:     VerifyQueryResultsDrop,
+			data:     mixedMatrix,
+			expCode:  http.StatusOK,
+			expData:  `{"result":[{"metric":{"__name__":"up","namespace":"ns1"},"values":[[1,"1"]]}],"resultType":"matrix"}`,
+		},
+		{
+			name:     "mixed vector in fail mode",
+			endpoint: "query",
+			mode:     VerifyQueryResultsFail,
+			data:     mixedVector,
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "mixed matrix in fail mode",
+			endpoint: "query_range",
+			mode:     VerifyQueryResultsFail,
+			data:     mixedMatrix,
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "tenant vector in fail mode",
+			endpoint: "query",
+			mode:     VerifyQueryResultsFail,
+			data:     tenantVector,
+			expCode:  http.StatusOK,
+			expData:  `{"result":[{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]}],"resultType":"vector"}`,
+		},
+		{
+			name:     "scalar in fail mode",
+			endpoint: "query",
+			mode:     VerifyQueryResultsFail,
+			data:     scalar,
+			expCode:  http.StatusOK,
+			expData:  `{"result":[1,"1"],"resultType":"scalar"}`,
+		},
+		{
+			name:     "string in fail mode",
+			endpoint: "query",
+			mode:     VerifyQueryResultsFail,
+			data:     str,
+			expCode:  http.StatusOK,
+			expData:  `{"result":[1,"foo"],"resultType":"string"}`,
+		},
+		{
+			name:     "mixed vector without verification",
+			endpoint: "query",
+			mode:     VerifyQueryResultsNone,
+			data:     mixedVector,
+			expCode:  http.StatusOK,
+			expData:  mixedVector,
+		},
+		{
+			name:     "bypassed query isn't verified",
+			endpoint: "query",
+			mode:     VerifyQueryResultsFail,
+			data:     mixedVector,
+			bypass:   true,
+			expCode:  http.StatusOK,
+			expData:  mixedVector,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(queryResponse(tc.data))
+			defer m.Close()
+
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				WithVerifyQueryResults(tc.mode),
+				WithBypassQueries([]string{"bypassed"}),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := "up"
+			if tc.bypass {
+				q = "bypassed"
+			}
+
+			w := &headerCountingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/"+tc.endpoint+"?query="+q+"&namespace=ns1", nil))
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+
+			if w.n > 1 {
+				t.Fatalf("expected a single call to WriteHeader(), got %d", w.n)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(apir.Data) != tc.expData {
+				t.Fatalf("expected data %s, got %s", tc.expData, string(apir.Data))
+			}
+		})
+	}
+}
+
+func TestVerifyQueryResultsWithNonJSONEncoding(t *testing.T) {
+	const (
+		mixedVector = `{"resultType":"vector","result":[` +
+			`{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]},` +
+			`{"metric":{"__name__":"up","namespace":"ns2"},"value":[1,"1"]}]}`
+		arrowPayload = "ARROW1\x00\x00binary"
+	)
+
+	// The upstream negotiates the encoding of the results with the Accept
+	// header.
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch accept := req.Header.Get("Accept"); accept {
+		case "", "application/json", "*/*":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = w.Write([]byte(`{"status":"success","data":` + mixedVector + `}`))
+		case "application/vnd.apache.arrow.stream":
+			w.Header().Set("Content-Type", accept)
+			_, _ = w.Write([]byte(arrowPayload))
+		default:
+			w.WriteHeader(http.StatusNotAcceptable)
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		mode   QueryResultsVerification
+		accept string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "JSON in drop mode",
+			mode:    VerifyQueryResultsDrop,
+			accept:  "application/json",
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"result":[{"metric":{"__name__":"up","namespace":"ns1"},"value":[1,"1"]}],"resultType":"vector"}}`,
+		},
+		{
+			name:    "JSON in fail mode",
+			mode:    VerifyQueryResultsFail,
+			accept:  "*/*",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "non-JSON in drop mode",
+			mode:    VerifyQueryResultsDrop,
+			accept:  "application/vnd.apache.arrow.stream",
+			expCode: http.StatusOK,
+			expBody: arrowPayload,
+		},
+		{
+			name:    "non-JSON in fail mode",
+			mode:    VerifyQueryResultsFail,
+			accept:  "application/vnd.apache.arrow.stream",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "non-JSON without verification",
+			mode:    VerifyQueryResultsNone,
+			accept:  "application/vnd.apache.arrow.stream",
+			expCode: http.StatusOK,
+			expBody: arrowPayload,
+		},
+		{
+			name:    "non-acceptable in fail mode",
+			mode:    VerifyQueryResultsFail,
+			accept:  "application/x-protobuf",
+			expCode: http.StatusNotAcceptable,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithVerifyQueryResults(tc.mode))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil)
+			req.Header.Set("Accept", tc.accept)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			if got := strings.TrimSpace(string(body)); got != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestMaxLookbackDelta(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		mode          LookbackDeltaLimitMode
+		method        string
+		lookbackDelta []string
+
+		expCode          int
+		expLookbackDelta []string
+	}{
+		{
+			name:    "no lookback_delta",
+			mode:    LookbackDeltaClamp,
+			method:  http.MethodGet,
+			expCode: http.StatusOK,
+		},
+		{
+			name:             "clamp mode with value lower than the maximum",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"1m"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"1m"},
+		},
+		{
+			name:             "clamp mode with value equal to the maximum",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"300"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"300"},
+		},
+		{
+			name:             "clamp mode with value greater than the maximum",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"1d"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"5m"},
+		},
+		{
+			name:             "clamp mode with value in seconds greater than the maximum",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"3600.5"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"5m"},
+		},
+		{
+			name:             "clamp mode with multiple values",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"1m", "1h"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"5m"},
+		},
+		{
+			name:             "clamp mode with POST",
+			mode:             LookbackDeltaClamp,
+			method:           http.MethodPost,
+			lookbackDelta:    []string{"10m"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"5m"},
+		},
+		{
+			name:             "reject mode with value lower than the maximum",
+			mode:             LookbackDeltaReject,
+			method:           http.MethodGet,
+			lookbackDelta:    []string{"4m59s"},
+			expCode:          http.StatusOK,
+			expLookbackDelta: []string{"4m59s"},
+		},
+		{
+			name:          "reject mode with value greater than the maximum",
+			mode:          LookbackDeltaReject,
+			method:        http.MethodGet,
+			lookbackDelta: []string{"5m1s"},
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:          "reject mode with POST",
+			mode:          LookbackDeltaReject,
+			method:        http.MethodPost,
+			lookbackDelta: []string{"1y"},
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:          "invalid value",
+			mode:          LookbackDeltaClamp,
+			method:        http.MethodGet,
+			lookbackDelta: []string{"5 minutes"},
+			expCode:       http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var h http.Handler
+			if tc.method == http.MethodPost {
+				h = checkFormHandler(lookbackDeltaParam, tc.expLookbackDelta...)
+			} else {
+				h = checkQueryHandler("", lookbackDeltaParam, tc.expLookbackDelta...)
+			}
+			m := newMockUpstream(h)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxLookbackDelta(5*time.Minute, tc.mode))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: {"ns1"}}
+			for _, v := range tc.lookbackDelta {
+				q.Add(lookbackDeltaParam, v)
+			}
+
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query", strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestQueryRewriteHeader(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	long := "up{job=\"" + strings.Repeat("a", maxQueryRewriteHeaderLength) + "\"}"
+	for _, tc := range []struct {
+		name   string
+		url    string
+		body   url.Values
+		noOpts bool
+
+		expOriginal string
+		expEnforced string
+	}{
+		{
+			name:        "query",
+			url:         "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			expOriginal: `up`,
+			expEnforced: `up{namespace=\"ns1\"}`,
+		},
+		{
+			name:        "query in the body",
+			url:         "http://prometheus.example.com/api/v1/query_range?query=up&namespace=ns1",
+			body:        url.Values{"query": {"down"}},
+			expOriginal: `down`,
+			expEnforced: `down{namespace=\"ns1\"}`,
+		},
+		{
+			name:        "non-ASCII characters",
+			url:         "http://prometheus.example.com/api/v1/query?" + url.Values{"query": {"up{job=\"é\"}\n"}, "namespace": {"ns1"}}.Encode(),
+			expOriginal: `up{job=\"\u00e9\"}\n`,
+			expEnforced: `up{job=\"\u00e9\",namespace=\"ns1\"}`,
+		},
+		{
+			name:        "long query",
+			url:         "http://prometheus.example.com/api/v1/query?" + url.Values{"query": {long}, "namespace": {"ns1"}}.Encode(),
+			expOriginal: `up{job=\"` + strings.Repeat("a", maxQueryRewriteHeaderLength-len(`up{job="`)) + `...`,
+			expEnforced: `up{job=\"` + strings.Repeat("a", maxQueryRewriteHeaderLength-len(`up{job="`)) + `...`,
+		},
+		{
+			name: "series",
+			url:  "http://prometheus.example.com/api/v1/series?match[]=up&namespace=ns1",
+		},
+		{
+			name:   "without the option",
+			url:    "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			noOpts: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []Option
+			if !tc.noOpts {
+				opts = append(opts, WithQueryRewriteHeader())
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if tc.body != nil {
+				req = httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("X-Original-Query"); got != tc.expOriginal {
+				t.Fatalf("expected X-Original-Query header %q, got %q", tc.expOriginal, got)
+			}
+
+			if got := resp.Header.Get("X-Enforced-Query"); got != tc.expEnforced {
+				t.Fatalf("expected X-Enforced-Query header %q, got %q", tc.expEnforced, got)
+			}
+		})
+	}
+}
+
+func TestRangeLimits(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	u, _ := url.Parse("http://prometheus.example.com")
+	if _, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRangeLimits(-time.Hour, 0)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		url  url.Values
+		body url.Values
+		json string
+
+		expCode int
+	}{
+		{
+			name:    "within the limits",
+			url:     url.Values{"start": {"0"}, "end": {"86400"}, "step": {"60"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "RFC 3339 timestamps",
+			url:     url.Values{"start": {"2024-01-01T00:00:00Z"}, "end": {"2024-01-08T00:00:00.000Z"}, "step": {"1m"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "range exceeding the maximum",
+			url:     url.Values{"start": {"2024-01-01T00:00:00Z"}, "end": {"2024-01-08T00:00:01Z"}, "step": {"1m"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "step lower than the minimum",
+			url:     url.Values{"start": {"0"}, "end": {"3600"}, "step": {"1s"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid start",
+			url:     url.Values{"start": {"yesterday"}, "end": {"3600"}, "step": {"60"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid step",
+			url:     url.Values{"start": {"0"}, "end": {"3600"}, "step": {"1 minute"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing parameters",
+			url:     url.Values{"start": {"0"}},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "POST body",
+			body:    url.Values{"start": {"0"}, "end": {"315360000"}, "step": {"60"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "POST body takes precedence",
+			url:     url.Values{"start": {"0"}, "end": {"3600"}, "step": {"60"}},
+			body:    url.Values{"step": {"1"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "parameters split between the URL and the body",
+			url:     url.Values{"start": {"0"}, "step": {"60"}},
+			body:    url.Values{"end": {"315360000"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "JSON body",
+			json:    `{"start":"0","end":"315360000","step":"60"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "instant query",
+			path:    "/api/v1/query",
+			url:     url.Values{"start": {"0"}, "end": {"315360000"}, "step": {"1"}},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRangeLimits(7*24*time.Hour, 15*time.Second))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			path := tc.path
+			if path == "" {
+				path = "/api/v1/query_range"
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: {"ns1"}}
+			for k, v := range tc.url {
+				q[k] = v
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+path+"?"+q.Encode(), nil)
+			switch {
+			case tc.body != nil:
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+path+"?"+q.Encode(), strings.NewReader(tc.body.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			case tc.json != "":
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+path+"?"+q.Encode(), strings.NewReader(tc.json))
+				req.Header.Set("Content-Type", "application/json")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestPreserveParameterOrder(t *testing.T) {
+	enforced := url.QueryEscape(`up{namespace="default"}`)
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		opts   []Option
+
+		expQuery string
+		expBody  string
+	}{
+		{
+			name:     "GET",
+			method:   http.MethodGet,
+			url:      "/api/v1/query?dedup=true&query=up&partial_response=false&timeout=10s",
+			opts:     []Option{WithPreserveParameterOrder()},
+			expQuery: "dedup=true&query=" + enforced + "&partial_response=false&timeout=10s",
+		},
+		{
+			name:     "GET with verbatim encoding",
+			method:   http.MethodGet,
+			url:      "/api/v1/query_range?step=1m&start=2024-01-01T00%3a00%3a00Z&query=up&end=2024-01-01T01:00:00Z",
+			opts:     []Option{WithPreserveParameterOrder()},
+			expQuery: "step=1m&start=2024-01-01T00%3a00%3a00Z&query=" + enforced + "&end=2024-01-01T01:00:00Z",
+		},
+		{
+			name:     "GET with clamped lookback delta",
+			method:   http.MethodGet,
+			url:      "/api/v1/query?timeout=10s&lookback_delta=1h&query=up&lookback_delta=2h",
+			opts:     []Option{WithPreserveParameterOrder(), WithMaxLookbackDelta(5*time.Minute, LookbackDeltaClamp)},
+			expQuery: "timeout=10s&lookback_delta=5m&query=" + enforced,
+		},
+		{
+			name:    "POST",
+			method:  http.MethodPost,
+			url:     "/api/v1/query",
+			body:    "timeout=10s&query=up&dedup=true",
+			opts:    []Option{WithPreserveParameterOrder()},
+			expBody: "timeout=10s&query=" + enforced + "&dedup=true",
+		},
+		{
+			name:    "POST range query",
+			method:  http.MethodPost,
+			url:     "/api/v1/query_range",
+			body:    "step=60&query=up&start=0&end=3600",
+			opts:    []Option{WithPreserveParameterOrder(), WithRangeLimits(time.Hour, 0)},
+			expBody: "step=60&query=" + enforced + "&start=0&end=3600",
+		},
+		{
+			name:     "without the option",
+			method:   http.MethodGet,
+			url:      "/api/v1/query?dedup=true&query=up&partial_response=false&timeout=10s",
+			expQuery: "dedup=true&partial_response=false&query=" + enforced + "&timeout=10s",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.RawQuery != tc.expQuery {
+					t.Errorf("expected query string %q, got %q", tc.expQuery, req.URL.RawQuery)
+				}
+
+				b, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(b) != tc.expBody {
+					t.Errorf("expected body %q, got %q", tc.expBody, string(b))
+				}
+
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com"+tc.url, body)
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitedTenants is the maximum number of per-tenant limiters kept in
+// memory.
+const maxRateLimitedTenants = 10000
+
+type tenantLimiter struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+// tenantRateLimiter maintains a token-bucket limiter per tenant key.
+//
+// The limiters are created on demand and kept in a list ordered from the most
+// to the least recently used. When the number of limiters reaches
+// maxRateLimitedTenants, the least recently used limiters whose bucket is full
+// are purged (they are equivalent to new limiters) and if it isn't enough,
+// the least recently used limiter is evicted. Both operations run in constant
+// (amortized) time.
+type tenantRateLimiter struct {
+	mtx      sync.Mutex
+	limiters map[string]*list.Element
+	lru      *list.List
+	limit    rate.Limit
+	burst    int
+	max      int
+	now      func() time.Time
+}
+
+func newTenantRateLimiter(qps float64, burst int) *tenantRateLimiter {
+	return &tenantRateLimiter{
+		limiters: map[string]*list.Element{},
+		lru:      list.New(),
+		limit:    rate.Limit(qps),
+		burst:    burst,
+		max:      maxRateLimitedTenants,
+		now:      time.Now,
+	}
+}
+
+// allow reports whether a request for the given tenant key may proceed.
+func (l *tenantRateLimiter) allow(key string) bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	e, found := l.limiters[key]
+	if found {
+		l.lru.MoveToFront(e)
+	} else {
+		if len(l.limiters) >= l.max {
+			l.evict(now)
+		}
+
+		e = l.lru.PushFront(&tenantLimiter{key: key, limiter: rate.NewLimiter(l.limit, l.burst)})
+		l.limiters[key] = e
+	}
+
+	return e.Value.(*tenantLimiter).limiter.AllowN(now, 1)
+}
+
+// evict removes the least recently used limiters with a full bucket or the
+// least recently used limiter if its bucket is being consumed.
+func (l *tenantRateLimiter) evict(now time.Time) {
+	for e := l.lru.Back(); e != nil; e = l.lru.Back() {
+		tl := e.Value.(*tenantLimiter)
+		if tl.limiter.TokensAt(now) < float64(l.burst) {
+			break
+		}
+
+		l.remove(e)
+	}
+
+	if len(l.limiters) >= l.max {
+		l.remove(l.lru.Back())
+	}
+}
+
+func (l *tenantRateLimiter) remove(e *list.Element) {
+	l.lru.Remove(e)
+	delete(l.limiters, e.Value.(*tenantLimiter).key)
+}
+
+// rateLimitingExtractor rejects the requests exceeding the rate limit of the
+// tenant once the label values have been extracted.
+type rateLimitingExtractor struct {
+	ExtractLabeler
+	r *routes
+	l *tenantRateLimiter
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (rle rateLimitingExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return rle.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		if !rle.l.allow(tenantKey(req.Context())) {
+			rle.r.countRejection(req, rejectionRateLimited)
+			prometheusAPIError(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, req)
+	})
+}
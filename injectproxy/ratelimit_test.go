@@ -0,0 +1,132 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithRateLimit(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, opt := range []Option{WithRateLimit(-1, 1), WithRateLimit(1, 0)} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opt); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRateLimit(0.001, 2), WithPrometheusRegistry(reg))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, tc := range []struct {
+		labelv  string
+		expCode int
+	}{
+		{labelv: "ns1", expCode: http.StatusOK},
+		{labelv: "ns1", expCode: http.StatusOK},
+		{labelv: "ns1", expCode: http.StatusTooManyRequests},
+		// The limit is per tenant.
+		{labelv: "ns2", expCode: http.StatusOK},
+		// Requests without tenant aren't rate-limited.
+		{expCode: http.StatusBadRequest},
+		{labelv: "ns1", expCode: http.StatusTooManyRequests},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			q := url.Values{queryParam: {"up"}}
+			if tc.labelv != "" {
+				q.Set(proxyLabel, tc.labelv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.rejections.WithLabelValues(rejectionRateLimited, "/api/v1/query")); got != 2 {
+		t.Fatalf("expected 2 rate-limited requests, got %v", got)
+	}
+}
+
+func TestTenantRateLimiterEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTenantRateLimiter(1, 1)
+	l.max = 2
+	l.now = func() time.Time { return now }
+
+	if !l.allow("a") || !l.allow("b") {
+		t.Fatal("expected requests to be allowed")
+	}
+
+	// The buckets of "a" and "b" are empty: "a" is the least recently used.
+	now = now.Add(100 * time.Millisecond)
+	l.allow("b")
+	if !l.allow("c") {
+		t.Fatal("expected request to be allowed")
+	}
+	if _, found := l.limiters["a"]; found {
+		t.Fatal("expected limiter of a to be evicted")
+	}
+	if l.allow("b") {
+		t.Fatal("expected limiter of b to be kept")
+	}
+
+	// All the buckets are full again.
+	now = now.Add(time.Second)
+	if !l.allow("d") {
+		t.Fatal("expected request to be allowed")
+	}
+	if len(l.limiters) != 1 {
+		t.Fatalf("expected 1 limiter, got %d", len(l.limiters))
+	}
+}
+
+func TestTenantRateLimiterLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newTenantRateLimiter(1, 2)
+	l.max = 3
+	l.now = func() time.Time { return now }
+
+	for _, k := range []string{"a", "b", "c", "a"} {
+		l.allow(k)
+	}
+
+	// "b" is the least recently used limiter once "a" has been used again.
+	for i, k := range []string{"d", "e", "f"} {
+		l.allow(k)
+		if len(l.limiters) != l.max || l.lru.Len() != l.max {
+			t.Fatalf("expected %d limiters, got %d (%d in the list)", l.max, len(l.limiters), l.lru.Len())
+		}
+
+		evicted := []string{"b", "c", "a"}[i]
+		if _, found := l.limiters[evicted]; found {
+			t.Fatalf("expected limiter of %s to be evicted", evicted)
+		}
+	}
+}
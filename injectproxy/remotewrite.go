@@ -0,0 +1,112 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteWrite proxies HTTP requests to the Prometheus /api/v1/write endpoint.
+// The enforced label is injected into every time series of the (snappy
+// compressed) write request.
+func (r *routes) remoteWrite(w http.ResponseWriter, req *http.Request) {
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// snappy.Decode allocates the decoded length declared by the payload
+	// header upfront: check it before decoding.
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decompress body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if r.maxBodyBytes >= 0 && int64(n) > r.maxBodyBytes {
+		prometheusAPIError(w, fmt.Sprintf("decompressed request body is larger than %d bytes", r.maxBodyBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decompress body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var wr prompb.WriteRequest
+	if err := wr.Unmarshal(b); err != nil {
+		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, name := range r.labelNames {
+		lvalue := MustLabelValuesFor(req.Context(), name)[0]
+		for i := range wr.Timeseries {
+			ls, err := r.injectRemoteWriteLabel(wr.Timeseries[i].Labels, name, lvalue)
+			if err != nil {
+				prometheusAPIError(w, err.Error(), r.replaceRejectionStatus)
+				return
+			}
+			wr.Timeseries[i].Labels = ls
+		}
+	}
+
+	b, err = wr.Marshal()
+	if err != nil {
+		prometheusAPIError(w, fmt.Sprintf("can't encode write request: %v", err), http.StatusInternalServerError)
+		return
+	}
+	b = snappy.Encode(nil, b)
+
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.Header["Content-Length"] = []string{strconv.Itoa(len(b))}
+	req.ContentLength = int64(len(b))
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// injectRemoteWriteLabel sets the enforced label on the given series labels.
+// If the series already has the label with a different value, it is either
+// overwritten or an error is returned depending on errorOnReplace. Every
+// occurrence of the label is replaced since the receivers may keep any of
+// them when a series has duplicate label names.
+func (r *routes) injectRemoteWriteLabel(ls []prompb.Label, name, lvalue string) ([]prompb.Label, error) {
+	filtered := ls[:0]
+	for _, l := range ls {
+		if l.Name != name {
+			filtered = append(filtered, l)
+			continue
+		}
+
+		if l.Value != lvalue && r.errorOnReplace {
+			return nil, fmt.Errorf("%w: label %s=%q conflicts with injected value %q", ErrIllegalLabelMatcher, name, l.Value, lvalue)
+		}
+	}
+
+	ls = append(filtered, prompb.Label{Name: name, Value: lvalue})
+	// Remote write receivers expect the labels to be sorted by name.
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+
+	return ls, nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func encodeWriteRequest(t *testing.T, series ...[]prompb.Label) []byte {
+	t.Helper()
+
+	wr := prompb.WriteRequest{}
+	for _, ls := range series {
+		wr.Timeseries = append(wr.Timeseries, prompb.TimeSeries{
+			Labels:  ls,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		})
+	}
+
+	b, err := wr.Marshal()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return snappy.Encode(nil, b)
+}
+
+// snappyHeader returns a snappy block which only declares the given decoded
+// length.
+func snappyHeader(n int) []byte {
+	return binary.AppendUvarint(nil, uint64(n))
+}
+
+// checkWriteRequestHandler verifies that the upstream receives series with the given labels.
+func checkWriteRequestHandler(t *testing.T, expSeries ...[]prompb.Label) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		compressed, err := io.ReadAll(req.Body)
+		if err != nil {
+			prometheusAPIError(w, "failed to read body", http.StatusInternalServerError)
+			return
+		}
+
+		b, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			prometheusAPIError(w, "failed to decompress body", http.StatusInternalServerError)
+			return
+		}
+
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(b); err != nil {
+			prometheusAPIError(w, "failed to decode body", http.StatusInternalServerError)
+			return
+		}
+
+		var got [][]prompb.Label
+		for _, ts := range wr.Timeseries {
+			got = append(got, ts.Labels)
+		}
+
+		if !reflect.DeepEqual(got, expSeries) {
+			t.Errorf("expected series %v, got %v", expSeries, got)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestRemoteWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		labelv         []string
+		body           []byte
+		series         [][]prompb.Label
+		errorOnReplace bool
+		regexMatch     bool
+
+		expCode   int
+		expSeries [][]prompb.Label
+	}{
+		{
+			name:    "no label value",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:   "label injected",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "job", Value: "prometheus"}},
+				{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "localhost"}},
+			},
+			expCode: http.StatusNoContent,
+			expSeries: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "job", Value: "prometheus"}, {Name: "namespace", Value: "default"}},
+				{{Name: "__name__", Value: "up"}, {Name: "instance", Value: "localhost"}, {Name: "namespace", Value: "default"}},
+			},
+		},
+		{
+			name:   "existing label overwritten",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "other"}},
+			},
+			expCode: http.StatusNoContent,
+			expSeries: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "default"}},
+			},
+		},
+		{
+			name:   "duplicate existing labels overwritten",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "default"}, {Name: "namespace", Value: "other"}, {Name: "job", Value: "prometheus"}},
+			},
+			expCode: http.StatusNoContent,
+			expSeries: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "job", Value: "prometheus"}, {Name: "namespace", Value: "default"}},
+			},
+		},
+		{
+			name:   "duplicate conflicting labels with errorOnReplace",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "default"}, {Name: "namespace", Value: "other"}},
+			},
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:   "same existing label with errorOnReplace",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "default"}},
+			},
+			errorOnReplace: true,
+			expCode:        http.StatusNoContent,
+			expSeries: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "default"}},
+			},
+		},
+		{
+			name:   "conflicting existing label with errorOnReplace",
+			labelv: []string{"default"},
+			series: [][]prompb.Label{
+				{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "other"}},
+			},
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:    "multiple label values",
+			labelv:  []string{"default", "other"},
+			series:  [][]prompb.Label{{{Name: "__name__", Value: "up"}}},
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "regex match",
+			labelv:     []string{"default"},
+			series:     [][]prompb.Label{{{Name: "__name__", Value: "up"}}},
+			regexMatch: true,
+			expCode:    http.StatusNotImplemented,
+		},
+		{
+			name:    "invalid snappy payload",
+			labelv:  []string{"default"},
+			body:    []byte("not snappy"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "decompressed payload too large",
+			labelv:  []string{"default"},
+			body:    snappyHeader(defaultMaxBodyBytes + 1),
+			expCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "invalid protobuf payload",
+			labelv:  []string{"default"},
+			body:    snappy.Encode(nil, []byte("not protobuf")),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkWriteRequestHandler(t, tc.expSeries...))
+			defer m.Close()
+
+			opts := []Option{WithEnabledRemoteWrite()}
+			if tc.errorOnReplace {
+				opts = append(opts, WithErrorOnReplace())
+			}
+			if tc.regexMatch {
+				opts = append(opts, WithRegexMatch())
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPHeaderEnforcer{Name: "X-Namespace"}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			body := tc.body
+			if body == nil {
+				body = encodeWriteRequest(t, tc.series...)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/write", bytes.NewReader(body))
+			req.Header.Set("Content-Encoding", "snappy")
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			for _, lv := range tc.labelv {
+				req.Header.Add("X-Namespace", lv)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		m := newMockUpstream(checkWriteRequestHandler(t))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/write", bytes.NewReader(encodeWriteRequest(t))))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status code %d, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
@@ -14,25 +14,35 @@
 package injectproxy
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/efficientgo/core/merrors"
 	"github.com/metalmatze/signal/server/signalhttp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"golang.org/x/exp/slices"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -41,29 +51,140 @@ const (
 )
 
 type routes struct {
-	upstream *url.URL
-	handler  http.Handler
-	label    string
-	el       ExtractLabeler
-
-	mux                   http.Handler
-	modifiers             map[string]func(*http.Response) error
-	errorOnReplace        bool
-	regexMatch            bool
-	rulesWithActiveAlerts bool
-	bypassQueries         []string
-
-	logger *log.Logger
+	upstream   *url.URL
+	handler    http.Handler
+	labelNames []string
+	el         ExtractLabeler
+
+	mux                      http.Handler
+	paths                    []string
+	drain                    drainer
+	breakers                 *circuitBreakers
+	modifiers                map[string]func(*http.Response) error
+	errorOnReplace           bool
+	regexMatch               bool
+	regexAnchoring           bool
+	allowEmptyMatchingRegex  bool
+	rulesWithActiveAlerts    bool
+	redactRuleFiles          bool
+	alertStates              []string
+	bypassQueries            []string
+	bypassSelectors          [][]*labels.Matcher
+	strictContentLength      bool
+	promQLParser             PromQLParser
+	queryResultsVerification QueryResultsVerification
+	injectedLabelHeader      string
+	serverTimingHeader       bool
+	metricNamesCache         *ttlCache[map[string]struct{}]
+	tsdbStatsCache           *ttlCache[*tsdbSeriesStats]
+	tsdbStatsMaxSeries       int
+	behaviorVersion          int
+	replaceRejectionStatus   int
+	maxLookbackDelta         time.Duration
+	lookbackDeltaLimitMode   LookbackDeltaLimitMode
+	maxQueryRange            time.Duration
+	minQueryStep             time.Duration
+	batchQueryField          string
+	queryParams              []string
+	receiversSeparator       string
+	preserveParameterOrder   bool
+	upstreamHealthCheckPath  string
+	modifierConcurrency      int
+	matchType                labels.MatchType
+	matcherRoundTrip         bool
+	maintenance              *maintenanceMode
+	upstreamTransport        http.RoundTripper
+	stripAbsentLabels        bool
+	deniedMetricNames        []*regexp.Regexp
+	lenientMatchSelectors    bool
+	coalescer                *queryCoalescer
+	newEnforcer              func(errorOnReplace bool, ms ...*labels.Matcher) Enforcer
+	rejections               *prometheus.CounterVec
+	dryRun                   bool
+	maxBodyBytes             int64
+	orAbsent                 bool
+	queryRewriteHeader       bool
+
+	logger *slog.Logger
 }
 
 type options struct {
-	enableLabelAPIs       bool
-	passthroughPaths      []string
-	errorOnReplace        bool
-	registerer            prometheus.Registerer
-	regexMatch            bool
-	rulesWithActiveAlerts bool
-	bypassQueries         []string
+	enableLabelAPIs          bool
+	enableAdminAPI           bool
+	passthroughPaths         []string
+	exactPassthroughPaths    bool
+	passthroughPathsMethods  map[string][]string
+	streamingPaths           []string
+	errorOnReplace           bool
+	registerer               prometheus.Registerer
+	regexMatch               bool
+	regexAnchoring           bool
+	allowEmptyMatchingRegex  bool
+	rulesWithActiveAlerts    bool
+	redactRuleFiles          bool
+	alertStates              []string
+	bypassQueries            []string
+	bypassMatchers           []string
+	strictContentLength      bool
+	promQLParser             PromQLParser
+	alertsPath               string
+	rulesPath                string
+	enableRemoteWrite        bool
+	enableOTLP               bool
+	queryResultsVerification QueryResultsVerification
+	htmlErrorPages           bool
+	errorResponseDecorator   func(*http.Request, int, map[string]any)
+	injectedLabelHeader      string
+	serverTimingHeader       bool
+	metadataPassthrough      bool
+	metadataFiltering        bool
+	alertmanagerStatus       bool
+	receiversFiltering       bool
+	receiversSeparator       string
+	tsdbStatsScoping         bool
+	tsdbStatsMaxSeries       int
+	topologyFiltering        bool
+	behaviorVersion          int
+	replaceRejectionStatus   int
+	maxLookbackDelta         time.Duration
+	lookbackDeltaLimitMode   LookbackDeltaLimitMode
+	maxQueryRange            time.Duration
+	minQueryStep             time.Duration
+	batchQueryField          string
+	queryParamAliases        []string
+	preserveParameterOrder   bool
+	upstreamHealthCheckPath  string
+	modifierConcurrency      int
+	matchType                labels.MatchType
+	defaultLabelValue        string
+	labelValueMapper         func(context.Context, []string) ([]string, error)
+	allowedLabelValues       []string
+	deniedLabelValues        []string
+	maxLabelValues           int
+	singleValueOnly          bool
+	matcherRoundTrip         bool
+	tenantKeyFunc            func(*http.Request) string
+	upstreamDurationTenant   bool
+	maintenance              *maintenanceMode
+	upstreamTransport        http.RoundTripper
+	h2c                      bool
+	requestTimeout           time.Duration
+	breakerThreshold         int
+	breakerCooldown          time.Duration
+	upstreamResolver         func(string) (*url.URL, error)
+	stripAbsentLabels        bool
+	metricNameDenylist       []string
+	lenientMatchSelectors    bool
+	queryCoalescing          bool
+	newEnforcer              func(errorOnReplace bool, ms ...*labels.Matcher) Enforcer
+	logger                   *slog.Logger
+	dryRun                   bool
+	maxBodyBytes             int64
+	orAbsent                 bool
+	rateLimit                float64
+	rateLimitBurst           int
+	queryRewriteHeader       bool
+	forwardOrgIDHeader       string
 }
 
 type Option interface {
@@ -90,6 +211,113 @@ func WithEnabledLabelsAPI() Option {
 	})
 }
 
+// WithEnabledAdminAPI enables proxying to the TSDB admin API endpoint
+// deleting series (/api/v1/admin/tsdb/delete_series). The enforced label
+// matcher(s) are injected into all the series selectors so that a tenant can
+// only delete its own series. If false, the endpoint isn't proxied.
+func WithEnabledAdminAPI() Option {
+	return optionFunc(func(o *options) {
+		o.enableAdminAPI = true
+	})
+}
+
+// WithEnabledRemoteWrite enables proxying to the remote write API. The
+// enforced label is injected into all the written series. Only one label
+// value is supported and regex match isn't supported.
+func WithEnabledRemoteWrite() Option {
+	return optionFunc(func(o *options) {
+		o.enableRemoteWrite = true
+	})
+}
+
+// WithEnabledOTLP enables proxying to the OTLP metrics receiver
+// (/api/v1/otlp/v1/metrics). The enforced label is injected as an attribute
+// of each data point and of each resource of the written metrics.
+// Only one label value is supported and regex match isn't supported.
+func WithEnabledOTLP() Option {
+	return optionFunc(func(o *options) {
+		o.enableOTLP = true
+	})
+}
+
+// WithMetadataPassthrough enables proxying to the metric metadata API
+// (/api/v1/metadata) without enforcing the label. The metadata isn't
+// attached to series so it can't be filtered by tenant: the names, types and
+// help texts of all the metrics are visible to all the tenants.
+func WithMetadataPassthrough() Option {
+	return optionFunc(func(o *options) {
+		o.metadataPassthrough = true
+	})
+}
+
+// WithEmulatedMetadataFiltering enables proxying to the metric metadata API
+// (/api/v1/metadata). The response only contains the metrics which have
+// series matching the enforced label(s): the proxy determines them by
+// requesting the values of the "__name__" label from the upstream, the
+// result being cached for a short time.
+// It supersedes WithMetadataPassthrough().
+func WithEmulatedMetadataFiltering() Option {
+	return optionFunc(func(o *options) {
+		o.metadataFiltering = true
+	})
+}
+
+// WithAlertmanagerStatusPassthrough enables proxying to the Alertmanager
+// status and receivers APIs (/api/v2/status and /api/v2/receivers) without
+// enforcing the label. These APIs aren't scoped to a tenant: the cluster
+// status, the configuration and the receiver names are visible to all the
+// tenants.
+func WithAlertmanagerStatusPassthrough() Option {
+	return optionFunc(func(o *options) {
+		o.alertmanagerStatus = true
+	})
+}
+
+// WithReceiversFiltering enables proxying to the Alertmanager receivers API
+// (/api/v2/receivers). The response only contains the receivers named after
+// the label value, either exactly or followed by the separator and a suffix
+// (e.g. "team-a" and "team-a/pager" with the "/" separator). Regex match
+// isn't supported.
+func WithReceiversFiltering(separator string) Option {
+	return optionFunc(func(o *options) {
+		o.receiversFiltering = true
+		o.receiversSeparator = separator
+	})
+}
+
+// WithTSDBStatsScoping enables proxying to the TSDB stats API
+// (/api/v1/status/tsdb). The head statistics are recomputed from the series
+// matching the enforced label(s) which are requested from the upstream series
+// API, the result being cached per tenant for a short time. Without this
+// option, the TSDB stats API returns "501 Not Implemented".
+func WithTSDBStatsScoping() Option {
+	return optionFunc(func(o *options) {
+		o.tsdbStatsScoping = true
+	})
+}
+
+// WithTSDBStatsMaxSeries configures the maximum number of series retrieved
+// from the upstream to compute the TSDB stats of a tenant. The requests for
+// tenants with more series are rejected with "422 Unprocessable Content".
+// Defaults to 100000, a negative value disables the limit.
+func WithTSDBStatsMaxSeries(n int) Option {
+	return optionFunc(func(o *options) {
+		o.tsdbStatsMaxSeries = n
+	})
+}
+
+// WithTargetsAndStoresFiltering enables proxying to the targets API
+// (/api/v1/targets) and to the Thanos stores API (/api/v1/stores). The
+// responses only contain the active targets and the stores whose labels match
+// the enforced label(s); the dropped targets are always removed. Without this
+// option, both APIs return "501 Not Implemented" unless they are configured
+// as passthrough paths.
+func WithTargetsAndStoresFiltering() Option {
+	return optionFunc(func(o *options) {
+		o.topologyFiltering = true
+	})
+}
+
 // WithPassthroughPaths configures routes to register given paths as passthrough handlers for all HTTP methods.
 // that, if requested, will be forwarded without enforcing label. Use with care.
 // NOTE: Passthrough "all" paths like "/" or "" and regex are not allowed.
@@ -99,6 +327,40 @@ func WithPassthroughPaths(paths []string) Option {
 	})
 }
 
+// WithExactPassthroughPaths causes the passthrough paths (including the
+// method-scoped and streaming ones) to only match the exact paths. By
+// default, a passthrough path also forwards all its sub-paths without
+// enforcement (e.g. "/federate" also forwards "/federate/" and
+// "/federate/foo") which may expose more than intended when the upstream
+// serves different content under the sub-paths (e.g. directory listings).
+// The sub-paths of a passthrough path still can't be registered by the
+// proxy.
+func WithExactPassthroughPaths() Option {
+	return optionFunc(func(o *options) {
+		o.exactPassthroughPaths = true
+	})
+}
+
+// WithPassthroughPathsMethods is like WithPassthroughPaths but each path is
+// only forwarded for the given HTTP methods. Requests with other methods get
+// "404 Not Found". Use with care.
+func WithPassthroughPathsMethods(paths map[string][]string) Option {
+	return optionFunc(func(o *options) {
+		o.passthroughPathsMethods = paths
+	})
+}
+
+// WithStreamingPassthroughPaths is like WithPassthroughPaths but the
+// responses of the given paths are flushed to the client as soon as they are
+// received from the upstream and they are never modified. It is meant for
+// live endpoints (e.g. Server-Sent Events or WebSocket upgrades). Use with
+// care.
+func WithStreamingPassthroughPaths(paths []string) Option {
+	return optionFunc(func(o *options) {
+		o.streamingPaths = paths
+	})
+}
+
 // WithErrorOnReplace causes the proxy to return 400 if a label matcher we want to
 // inject is present in the query already and matches something different
 func WithErrorOnReplace() Option {
@@ -107,6 +369,26 @@ func WithErrorOnReplace() Option {
 	})
 }
 
+// WithReplaceRejectionStatus configures the HTTP status code returned when the
+// request is rejected because of WithErrorOnReplace (e.g. 403 to distinguish
+// authorization denials from malformed requests). Defaults to 400.
+func WithReplaceRejectionStatus(code int) Option {
+	return optionFunc(func(o *options) {
+		o.replaceRejectionStatus = code
+	})
+}
+
+// WithMaxBodyBytes configures the maximum size of the request bodies accepted
+// by the query, matcher, remote write and OTLP endpoints. Larger bodies are
+// rejected with "413 Request Entity Too Large". For remote write requests, the
+// limit also applies to the decompressed body. Defaults to 10MiB, a negative
+// value disables the limit.
+func WithMaxBodyBytes(n int64) Option {
+	return optionFunc(func(o *options) {
+		o.maxBodyBytes = n
+	})
+}
+
 // WithActiveAlerts causes the proxy to return rules with active alerts.
 func WithActiveAlerts() Option {
 	return optionFunc(func(o *options) {
@@ -114,6 +396,15 @@ func WithActiveAlerts() Option {
 	})
 }
 
+// WithRedactedRuleFiles causes the proxy to remove the paths of the rule
+// files from the rules API responses because they may reveal the naming
+// conventions of the other tenants.
+func WithRedactedRuleFiles() Option {
+	return optionFunc(func(o *options) {
+		o.redactRuleFiles = true
+	})
+}
+
 // WithRegexMatch causes the proxy to handle tenant name as regexp
 func WithRegexMatch() Option {
 	return optionFunc(func(o *options) {
@@ -121,279 +412,2071 @@ func WithRegexMatch() Option {
 	})
 }
 
-// WithBypassQueries configures routes to bypass certain queries
-func WithBypassQueries(queries []string) Option {
+// WithRegexAnchoring explicitly anchors the regexp tenant names (e.g. "team"
+// becomes "^(?:team)$") and rejects the regexps which would match the tenant
+// names with any prefix (e.g. ".*team"): each alternative must start with a
+// literal prefix. It requires WithRegexMatch().
+func WithRegexAnchoring() Option {
 	return optionFunc(func(o *options) {
-		o.bypassQueries = queries
+		o.regexAnchoring = true
 	})
 }
 
-// mux abstracts away the behavior we expect from the http.ServeMux type in this package.
-type mux interface {
-	http.Handler
-	Handle(string, http.Handler)
+// WithAllowEmptyMatchingRegex disables the rejection of the regexp tenant
+// names matching the empty string (e.g. "team-a|"). It requires
+// WithRegexMatch().
+// Use with care: a label matcher matching the empty string also matches the
+// series without the enforced label. Clients can then read the series which
+// don't belong to any tenant and, unless other matchers restrict the query,
+// the regexp (e.g. ".*") may give access to the data of all the tenants.
+func WithAllowEmptyMatchingRegex() Option {
+	return optionFunc(func(o *options) {
+		o.allowEmptyMatchingRegex = true
+	})
 }
 
-// strictMux is a mux that wraps standard HTTP handler with safer handler that allows safe user provided handler registrations.
-type strictMux struct {
-	mux
-	seen map[string]struct{}
+// WithBypassQueries configures routes to bypass certain queries. A request is
+// only bypassed when all the values of the query parameter and its aliases,
+// in the URL as well as in the body, are bypassed.
+func WithBypassQueries(queries []string) Option {
+	return optionFunc(func(o *options) {
+		o.bypassQueries = queries
+	})
 }
 
-func newStrictMux(m mux) *strictMux {
-	return &strictMux{
-		m,
-		map[string]struct{}{},
-	}
-
+// WithBypassMatchers configures routes to bypass the queries for which all
+// the selectors match the series of one of the given metric selectors (e.g.
+// `up{job="prometheus"}`). Contrary to WithBypassQueries, the queries are
+// compared after parsing hence formatting and label ordering don't matter.
+func WithBypassMatchers(selectors []string) Option {
+	return optionFunc(func(o *options) {
+		o.bypassMatchers = selectors
+	})
 }
 
-// Handle is like HTTP mux handle but it does not allow to register paths that are shared with previously registered paths.
-// It also makes sure the trailing / is registered too.
-// For example if /api/v1/federate was registered consequent registrations like /api/v1/federate/ or /api/v1/federate/some will
-// return error. In the mean time request with both /api/v1/federate and /api/v1/federate/ will point to the handled passed by /api/v1/federate
-// registration.
-// This allows to de-risk ability for user to mis-configure and leak inject isolation.
-func (s *strictMux) Handle(pattern string, handler http.Handler) error {
-	sanitized := pattern
-	for next := strings.TrimSuffix(sanitized, "/"); next != sanitized; sanitized = next {
-	}
+// WithStrictContentLength causes the proxy to return 400 if the size of the
+// request body doesn't match the declared Content-Length header. Requests
+// without Content-Length (e.g. chunked encoding) aren't checked.
+func WithStrictContentLength() Option {
+	return optionFunc(func(o *options) {
+		o.strictContentLength = true
+	})
+}
 
-	if _, ok := s.seen[sanitized]; ok {
-		return fmt.Errorf("pattern %q was already registered", sanitized)
-	}
+// WithPromQLParser configures the proxy to parse PromQL expressions and
+// selectors with the given parser instead of the vendored one.
+func WithPromQLParser(p PromQLParser) Option {
+	return optionFunc(func(o *options) {
+		o.promQLParser = p
+	})
+}
 
-	for p := range s.seen {
-		if strings.HasPrefix(sanitized+"/", p+"/") {
-			return fmt.Errorf("pattern %q is registered, cannot register path %q that shares it", p, sanitized)
-		}
-	}
+// WithEnforcer configures the function creating the enforcer for the queries
+// of the query endpoints. The function is called for every request with the
+// label matchers to enforce. By default, the queries are parsed as PromQL
+// expressions. For instance, NewLogQLEnforcer() can be used to enforce LogQL
+// queries.
+func WithEnforcer(f func(errorOnReplace bool, ms ...*labels.Matcher) Enforcer) Option {
+	return optionFunc(func(o *options) {
+		o.newEnforcer = f
+	})
+}
 
-	s.mux.Handle(sanitized, handler)
-	s.mux.Handle(sanitized+"/", handler)
-	s.seen[sanitized] = struct{}{}
+// WithLogger configures the logger of the proxy. When set, the rejected
+// requests and the proxy errors are logged with the request's method, path
+// and enforced label values. Defaults to slog.Default() (which writes to
+// log.Default() unless configured otherwise) without logging the rejected
+// requests.
+func WithLogger(l *slog.Logger) Option {
+	return optionFunc(func(o *options) {
+		o.logger = l
+	})
+}
 
-	return nil
+// WithDryRun configures the proxy to simulate the enforcement without
+// modifying the requests. For every enforced request, the proxy logs the
+// request which would have been sent to the upstream (or the rejection) and
+// forwards the original request and the upstream response unmodified.
+func WithDryRun() Option {
+	return optionFunc(func(o *options) {
+		o.dryRun = true
+	})
 }
 
-// instrumentedMux wraps a mux and instruments it.
-type instrumentedMux struct {
-	mux
-	i signalhttp.HandlerInstrumenter
+// WithAlertStates configures the states of the alerts (e.g. "firing")
+// returned by the Prometheus alerts API. The other alerts of the tenant are
+// dropped from the response. Defaults to all the states.
+func WithAlertStates(states []string) Option {
+	return optionFunc(func(o *options) {
+		o.alertStates = states
+	})
 }
 
-func newInstrumentedMux(m mux, r prometheus.Registerer) *instrumentedMux {
-	return &instrumentedMux{
-		m,
-		signalhttp.NewHandlerInstrumenter(r, []string{"handler"}),
-	}
+// WithAlertsPath configures the path of the Prometheus alerts API for which
+// the response is filtered by tenant. Defaults to "/api/v1/alerts".
+func WithAlertsPath(path string) Option {
+	return optionFunc(func(o *options) {
+		o.alertsPath = path
+	})
 }
 
-// Handle implements the mux interface.
-func (i *instrumentedMux) Handle(pattern string, handler http.Handler) {
-	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, handler))
+// WithRulesPath configures the path of the Prometheus rules API for which the
+// response is filtered by tenant. Defaults to "/api/v1/rules".
+func WithRulesPath(path string) Option {
+	return optionFunc(func(o *options) {
+		o.rulesPath = path
+	})
 }
 
-// ExtractLabeler is an HTTP handler that extract the label value to be
-// enforced from the HTTP request.  If a valid label value is found, it should
-// store it in the request's context.  Otherwise it should return an error in
-// the HTTP response (usually 400 or 500).
-type ExtractLabeler interface {
-	ExtractLabel(next http.HandlerFunc) http.Handler
+// WithVerifyQueryResults configures the proxy to verify that all the series
+// returned by the /api/v1/query and /api/v1/query_range endpoints carry the
+// enforced label value. Depending on the mode, non-matching series are
+// dropped or the request fails.
+// This is a defense-in-depth mechanism: note that expressions which don't
+// preserve the enforced label (e.g. "sum(up)") return series without the
+// label which will be dropped or rejected too.
+func WithVerifyQueryResults(mode QueryResultsVerification) Option {
+	return optionFunc(func(o *options) {
+		o.queryResultsVerification = mode
+	})
 }
 
-// bypassHandler wraps an existing handler and checks for bypass queries before delegating
-func bypassHandler(bypassQueries []string, upstream http.Handler, enforcerChain http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only check for bypass queries if bypass queries are configured
-		if len(bypassQueries) > 0 {
-			qry, err := extractQueryParam(r)
-			if err == nil {
-				if slices.Contains(bypassQueries, qry) {
-					// if bypass query is found, serve the request without enforcement
-					upstream.ServeHTTP(w, r)
-					return
-				}
-			}
-		}
+// WithMaxLookbackDelta configures the maximum value of the lookback_delta
+// parameter for the query endpoints. Depending on the mode, greater values are
+// replaced by the maximum or the request fails.
+func WithMaxLookbackDelta(max time.Duration, mode LookbackDeltaLimitMode) Option {
+	return optionFunc(func(o *options) {
+		o.maxLookbackDelta = max
+		o.lookbackDeltaLimitMode = mode
+	})
+}
 
-		// Otherwise continue with normal processing
-		enforcerChain.ServeHTTP(w, r)
+// WithRangeLimits configures the maximum range (end - start) and the minimum
+// step of the /api/v1/query_range endpoint. The requests exceeding the limits
+// are rejected with "400 Bad Request". A zero value disables the limit.
+func WithRangeLimits(maxRange, minStep time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.maxQueryRange = maxRange
+		o.minQueryStep = minStep
 	})
 }
 
-// extractQueryParam extracts the query parameter from either the URL query parameters or the POST body
-func extractQueryParam(req *http.Request) (string, error) {
-	// Try to get query from URL query parameters first
-	if q := req.URL.Query().Get("query"); q != "" {
-		return q, nil
-	}
+// WithBatchQueryField configures the query endpoints to accept JSON-encoded
+// POST bodies made of an array of objects (e.g. [{"expr":"up"},{"expr":"count(up)"}])
+// in which the given field holds the query. The label matchers are enforced in
+// the query of each object and the whole request is rejected if one of the
+// queries can't be enforced.
+func WithBatchQueryField(field string) Option {
+	return optionFunc(func(o *options) {
+		o.batchQueryField = field
+	})
+}
 
-	// For POST requests, we need to peek at the body without consuming it
-	if req.Method == http.MethodPost && req.Body != nil {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err != nil {
-			return "", fmt.Errorf("failed to read request body: %w", err)
-		}
+// WithQueryParamAliases configures additional names of the query parameter
+// (e.g. "g0.expr" as sent by Grafana Explore). The label matchers are
+// enforced in the values of all these parameters in addition to "query".
+func WithQueryParamAliases(aliases []string) Option {
+	return optionFunc(func(o *options) {
+		o.queryParamAliases = aliases
+	})
+}
 
-		// Restore the body so it can be read again later
-		req.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
+// WithPreserveParameterOrder causes the query endpoints to keep the order of
+// the parameters of the URL query string and of the form-encoded body when
+// the query is enforced. Only the modified values are re-encoded which is
+// required by upstreams verifying signed requests.
+// The order isn't preserved when HTTPFormEnforcer removes the label parameter
+// from the request.
+func WithPreserveParameterOrder() Option {
+	return optionFunc(func(o *options) {
+		o.preserveParameterOrder = true
+	})
+}
 
-		form, err := url.ParseQuery(string(bodyBytes))
-		if err != nil {
-			return "", fmt.Errorf("failed to parse form data: %w", err)
-		}
+// WithUpstreamHealthCheck causes the /healthz endpoint to request the given
+// upstream path (e.g. "/-/ready") and to return "503 Service Unavailable" if
+// the request fails or if the upstream doesn't reply with a 2xx status code.
+func WithUpstreamHealthCheck(path string) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamHealthCheckPath = path
+	})
+}
 
-		if q := form.Get("query"); q != "" {
-			return q, nil
-		}
-	}
+// WithModifierConcurrency configures the number of goroutines decoding and
+// filtering the rule groups of the /api/v1/rules responses and the alerts of
+// the /api/v1/alerts responses. It reduces the latency for large rule sets.
+// Defaults to 1 (no concurrency).
+func WithModifierConcurrency(n int) Option {
+	return optionFunc(func(o *options) {
+		o.modifierConcurrency = n
+	})
+}
 
-	return "", fmt.Errorf("no query parameter found in URL or form data")
+// WithMatchType configures the type of the injected label matchers.
+// With labels.MatchNotEqual or labels.MatchNotRegexp, the tenant can access
+// all the series except the ones matching the label value(s). With
+// labels.MatchRegexp or labels.MatchNotRegexp, the matcher is always a regexp
+// matcher even for a single label value.
+// Negative matchers aren't supported by the endpoints which require equality
+// matchers (e.g. silences and remote write). Defaults to labels.MatchEqual.
+func WithMatchType(t labels.MatchType) Option {
+	return optionFunc(func(o *options) {
+		o.matchType = t
+	})
 }
 
-// HTTPFormEnforcer enforces a label value extracted from the HTTP form parameters.
-type HTTPFormEnforcer struct {
-	ParameterName string
+// WithMatcherRoundTripValidation verifies that the string representation of
+// the label matchers injected into the PromQL expressions and the series
+// selectors parses back into the same matchers. Requests
+// failing the verification are rejected with "500 Internal Server Error".
+// It protects against escaping bugs in the label matcher implementation.
+func WithMatcherRoundTripValidation() Option {
+	return optionFunc(func(o *options) {
+		o.matcherRoundTrip = true
+	})
 }
 
-// ExtractLabel implements the ExtractLabeler interface.
-func (hff HTTPFormEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		labelValues, err := hff.getLabelValues(r)
-		if err != nil {
-			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
-			return
-		}
+// WithTenantKeyFunc configures the function returning the key which
+// identifies the tenant of a request for the per-tenant state (e.g. the cache
+// of WithEmulatedMetadataFiltering()). The function is called once the label
+// values have been extracted and can combine them with other request
+// attributes (e.g. a region header).
+// Defaults to the extracted label value(s).
+func WithTenantKeyFunc(f func(*http.Request) string) Option {
+	return optionFunc(func(o *options) {
+		o.tenantKeyFunc = f
+	})
+}
 
-		// Remove the proxy label from the query parameters.
-		q := r.URL.Query()
-		q.Del(hff.ParameterName)
-		r.URL.RawQuery = q.Encode()
+// WithUpstreamDurationTenantLabel adds the "tenant" label (the extracted
+// label values) to the proxy_upstream_duration_seconds histogram. It should
+// only be used when the number of tenants is bounded.
+func WithUpstreamDurationTenantLabel() Option {
+	return optionFunc(func(o *options) {
+		o.upstreamDurationTenant = true
+	})
+}
 
-		// Remove the param from the PostForm.
-		if r.Method == http.MethodPost {
-			if err := r.ParseForm(); err != nil {
-				prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusInternalServerError)
-				return
-			}
-			if r.PostForm.Get(hff.ParameterName) != "" {
-				r.PostForm.Del(hff.ParameterName)
-				newBody := r.PostForm.Encode()
-				// We are replacing request body, close previous one (r.FormValue ensures it is read fully and not nil).
-				_ = r.Body.Close()
-				r.Body = io.NopCloser(strings.NewReader(newBody))
-				r.ContentLength = int64(len(newBody))
-			}
+// WithMaintenanceMode allows to put the proxy into maintenance mode with
+// SetMaintenanceMode(). In maintenance mode, all the requests except for the
+// health endpoints are rejected with "503 Service Unavailable", the given
+// message (if not empty) and the Retry-After header (if retryAfter is
+// positive).
+// If the token isn't empty, the /-/maintenance endpoint reports (GET), enables
+// (POST) and disables (DELETE) the maintenance mode for the requests providing
+// the token as bearer token.
+func WithMaintenanceMode(token, message string, retryAfter time.Duration) Option {
+	return optionFunc(func(o *options) {
+		if message == "" {
+			message = defaultMaintenanceMessage
 		}
-
-		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+		o.maintenance = &maintenanceMode{token: token, message: message, retryAfter: retryAfter}
 	})
 }
 
-func (hff HTTPFormEnforcer) getLabelValues(r *http.Request) ([]string, error) {
-	err := r.ParseForm()
-	if err != nil {
-		return nil, fmt.Errorf("the form data can not be parsed: %w", err)
-	}
-
-	formValues := removeEmptyValues(r.Form[hff.ParameterName])
-	if len(formValues) == 0 {
-		return nil, fmt.Errorf("the %q query parameter must be provided", hff.ParameterName)
-	}
+// WithUpstreamTransport configures the transport used for the requests to the
+// upstream (e.g. to set timeouts, connection limits or the TLS configuration).
+// Defaults to a transport with bounded dial and response header timeouts.
+func WithUpstreamTransport(rt http.RoundTripper) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamTransport = rt
+	})
+}
 
-	return formValues, nil
+// WithRequestTimeout bounds the duration of the upstream requests (including
+// the transfer of the response body). When the timeout is exceeded, the
+// upstream request is cancelled and the proxy returns "504 Gateway Timeout"
+// if the response hasn't been sent yet. The requests abandoned by the clients
+// are always cancelled.
+func WithRequestTimeout(d time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.requestTimeout = d
+	})
 }
 
-// HTTPHeaderEnforcer enforces a label value extracted from the HTTP headers.
-type HTTPHeaderEnforcer struct {
-	Name            string
-	ParseListSyntax bool
+// WithCircuitBreaker stops forwarding the requests to the upstream for the
+// cooldown period after threshold consecutive upstream failures (5xx
+// responses, connection errors and upstream timeouts). Meanwhile, the
+// requests are rejected with "503 Service Unavailable" and the Retry-After
+// header. After the cooldown period, a single failure opens the circuit again
+// until a request succeeds.
+// The Prometheus API errors caused by the query (JSON-encoded "503 Service
+// Unavailable" and "422 Unprocessable Entity" responses) and the requests
+// exceeding WithRequestTimeout aren't failures. There is one circuit per
+// upstream (see WithUpstreamResolver) which is shared by all the tenants of
+// the upstream: the failures caused by one tenant also reject the requests
+// of the others.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return optionFunc(func(o *options) {
+		o.breakerThreshold = threshold
+		o.breakerCooldown = cooldown
+	})
 }
 
-// ExtractLabel implements the ExtractLabeler interface.
-func (hhe HTTPHeaderEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		labelValues, err := hhe.getLabelValues(r)
-		if err != nil {
-			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
-			return
-		}
+// WithUpstreamResolver configures a function returning the upstream of the
+// given label value (e.g. when the tenants are sharded across several
+// backends). The upstream passed to NewRoutes is only used for the requests
+// without label value (e.g. the health checks). If the function returns an
+// error, the request is rejected with "502 Bad Gateway". It requires a single
+// enforced label and isn't compatible with WithRegexMatch.
+func WithUpstreamResolver(f func(labelValue string) (*url.URL, error)) Option {
+	return optionFunc(func(o *options) {
+		o.upstreamResolver = f
+	})
+}
 
-		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+// WithH2C causes the proxy to speak HTTP/2 over cleartext TCP connections
+// (h2c) to the upstream which must use the "http" scheme. If the transport
+// configured with WithUpstreamTransport is an *http.Transport, its dialer is
+// reused.
+func WithH2C() Option {
+	return optionFunc(func(o *options) {
+		o.h2c = true
 	})
 }
 
+// WithAbsentLabelsStripping removes the enforced label(s) from the series
+// returned by the absent() and absent_over_time() functions. These functions
+// still only consider the series matching the enforced label(s) but the
+// output doesn't echo the label(s) because the function calls are wrapped into
+// label_replace() calls.
+func WithAbsentLabelsStripping() Option {
+	return optionFunc(func(o *options) {
+		o.stripAbsentLabels = true
+	})
+}
+
+// WithMetricNameDenylist rejects the queries selecting metric names which
+// match one of the given regular expressions (e.g. "apiserver_.*") with "403
+// Forbidden". The regular expressions are fully anchored. The metric names
+// must be selected by equality matchers or regexp matchers made of literal
+// alternatives: the other selectors (e.g. `{job="x"}`) are rejected as they
+// may select denied metrics. It also applies to the match[] parameters.
+func WithMetricNameDenylist(patterns []string) Option {
+	return optionFunc(func(o *options) {
+		o.metricNameDenylist = patterns
+	})
+}
+
+// WithLenientMatchSelectors accepts match[] values which aren't bare series
+// selectors (e.g. 'rate(up[5m])') for the endpoints enforcing the match[]
+// parameter. Some backends tolerate such values. The label is then enforced
+// in all the selectors of the expression like for the query endpoints instead
+// of rejecting the request.
+func WithLenientMatchSelectors() Option {
+	return optionFunc(func(o *options) {
+		o.lenientMatchSelectors = true
+	})
+}
+
+// WithOrAbsent makes the injected label matchers also match the series
+// without the enforced label(s), e.g. 'namespace=~"default|"' instead of
+// 'namespace="default"'. It keeps global series (without tenant label)
+// visible to all tenants. It can't be used with negative match types.
+func WithOrAbsent() Option {
+	return optionFunc(func(o *options) {
+		o.orAbsent = true
+	})
+}
+
+// WithRateLimit limits the rate of requests per tenant with a token-bucket
+// limiter keyed on the extracted label value(s). Requests exceeding the limit
+// are rejected with "429 Too Many Requests".
+func WithRateLimit(perTenantQPS float64, burst int) Option {
+	return optionFunc(func(o *options) {
+		o.rateLimit = perTenantQPS
+		o.rateLimitBurst = burst
+	})
+}
+
+// WithQueryCoalescing collapses concurrent identical requests to the query
+// endpoints into a single upstream request. Requests are identical when they
+// have the same tenant, the same enforced parameters and the same headers,
+// except for the hop-by-hop, tracing, User-Agent and X-Request-Id headers.
+func WithQueryCoalescing() Option {
+	return optionFunc(func(o *options) {
+		o.queryCoalescing = true
+	})
+}
+
+// WithDefaultLabelValue configures the label value to enforce when the
+// request doesn't provide any value for the ExtractLabeler (e.g. because the
+// header or the parameter is missing) instead of returning an error. Invalid
+// values are still rejected. It applies to all the enforced labels and only to
+// the HTTPFormEnforcer, HTTPHeaderEnforcer, PathParameterEnforcer and
+// FirstMatchEnforcer ExtractLabelers.
+// Use with care: requests without tenant information get access to the
+// default tenant's data.
+func WithDefaultLabelValue(value string) Option {
+	return optionFunc(func(o *options) {
+		o.defaultLabelValue = value
+	})
+}
+
+// WithLabelValueMapper configures a function transforming the label values
+// once they have been extracted and before the label matchers are built (e.g.
+// to lowercase the values or to look them up in a table). It applies to the
+// values of each enforced label. If the function returns an error, the
+// request is rejected with "400 Bad Request".
+func WithLabelValueMapper(f func(context.Context, []string) ([]string, error)) Option {
+	return optionFunc(func(o *options) {
+		o.labelValueMapper = f
+	})
+}
+
+// WithAllowedLabelValues restricts the label values accepted by the proxy
+// to the given list (e.g. to catch typos in the tenant names). The requests
+// with other values are rejected with "403 Forbidden". The list is ignored
+// when WithRegexMatch is set since the values are regular expressions.
+func WithAllowedLabelValues(values []string) Option {
+	return optionFunc(func(o *options) {
+		o.allowedLabelValues = values
+	})
+}
+
+// WithDeniedLabelValues configures label values which are always rejected
+// with "403 Forbidden". When WithRegexMatch is set, the values are compared
+// literally to the regular expressions.
+func WithDeniedLabelValues(values []string) Option {
+	return optionFunc(func(o *options) {
+		o.deniedLabelValues = values
+	})
+}
+
+// WithMaxLabelValues limits the number of values of each enforced label per
+// request. The requests exceeding the limit are rejected with "400 Bad
+// Request". It bounds the size of the regular expressions matching several
+// values. The limit applies to the values after the default value fallback
+// and the mapping (see WithDefaultLabelValue and WithLabelValueMapper).
+func WithMaxLabelValues(n int) Option {
+	return optionFunc(func(o *options) {
+		o.maxLabelValues = n
+	})
+}
+
+// WithSingleValueOnly rejects the requests with more than one value for an
+// enforced label with "400 Bad Request" on all the endpoints instead of
+// matching the values with a regular expression (e.g. for upstreams with poor
+// regexp matcher performance). It's equivalent to WithMaxLabelValues(1) and
+// takes precedence over it.
+func WithSingleValueOnly() Option {
+	return optionFunc(func(o *options) {
+		o.singleValueOnly = true
+	})
+}
+
+// WithHTMLErrorPages causes the proxy to return errors as HTML pages instead
+// of JSON documents when the client prefers HTML (e.g. web browsers).
+func WithHTMLErrorPages() Option {
+	return optionFunc(func(o *options) {
+		o.htmlErrorPages = true
+	})
+}
+
+// WithErrorResponseDecorator configures a function called with the request,
+// the status code and the fields of the JSON error documents returned by the
+// proxy ("status", "errorType" and "error") before they are encoded. The
+// function can add fields (e.g. a correlation ID) or modify the existing ones.
+// The HTML error pages aren't decorated.
+func WithErrorResponseDecorator(f func(req *http.Request, code int, body map[string]any)) Option {
+	return optionFunc(func(o *options) {
+		o.errorResponseDecorator = f
+	})
+}
+
+// WithInjectedLabelResponseHeader configures the proxy to return the label
+// matcher(s) injected into the query and match[] parameters in the given
+// response header (e.g. `X-Prom-Label-Proxy-Injected: namespace="team-a"`).
+func WithInjectedLabelResponseHeader(name string) Option {
+	return optionFunc(func(o *options) {
+		o.injectedLabelHeader = name
+	})
+}
+
+// WithForwardOrgIDHeader configures the proxy to set the enforced label value
+// in the given header of the upstream requests (e.g. "X-Scope-OrgID" for
+// Cortex and Mimir) in addition to the label injection. The upstream can
+// then enforce its own tenancy as well. The header sent by the client is
+// removed from all the upstream requests, including the passthrough ones,
+// and it is also set on the requests sent by the proxy itself (e.g. to verify
+// the silences or to filter the metadata). It requires a single enforced
+// label and isn't compatible with regex match. The requests with multiple
+// label values are rejected with "422 Unprocessable Content".
+func WithForwardOrgIDHeader(name string) Option {
+	return optionFunc(func(o *options) {
+		o.forwardOrgIDHeader = name
+	})
+}
+
+// WithQueryRewriteHeader causes the proxy to report the original query of
+// the client and the enforced query in the X-Original-Query and
+// X-Enforced-Query response headers of the query endpoints. Long queries are
+// truncated.
+func WithQueryRewriteHeader() Option {
+	return optionFunc(func(o *options) {
+		o.queryRewriteHeader = true
+	})
+}
+
+// WithServerTimingHeader causes the proxy to report the time spent extracting
+// the label value, enforcing the label and waiting for the upstream response
+// in the Server-Timing response header.
+func WithServerTimingHeader() Option {
+	return optionFunc(func(o *options) {
+		o.serverTimingHeader = true
+	})
+}
+
+const (
+	// BehaviorVersion1 is the enforcement behavior of the proxy before
+	// behavior versions were introduced.
+	BehaviorVersion1 = 1
+
+	// BehaviorVersion2 rejects POST requests to the query endpoints (e.g.
+	// /api/v1/query) with "415 Unsupported Media Type" when the body is
+	// neither form-encoded nor JSON-encoded. With BehaviorVersion1, such
+	// bodies are dropped: the upstream receives an empty body and only the
+	// parameters of the URL query string are enforced. The matcher endpoints
+	// (e.g. /api/v1/series, /api/v1/labels) reject them in all versions.
+	BehaviorVersion2 = 2
+
+	// LatestBehaviorVersion is the default behavior version.
+	LatestBehaviorVersion = BehaviorVersion2
+)
+
+// WithBehaviorVersion pins the enforcement behavior of the proxy to the given
+// version so that upgrading the proxy doesn't change which requests are
+// accepted or rejected. Defaults to LatestBehaviorVersion.
+// The versions only cover the stricter handling of requests which the
+// upstream doesn't evaluate anyway. The fixes of requests bypassing the
+// enforcement (e.g. repeated query parameters or silences with conflicting
+// matchers) apply to all the versions: pinning an older version never
+// re-opens them.
+func WithBehaviorVersion(v int) Option {
+	return optionFunc(func(o *options) {
+		o.behaviorVersion = v
+	})
+}
+
+// mux abstracts away the behavior we expect from the http.ServeMux type in this package.
+type mux interface {
+	http.Handler
+	Handle(string, http.Handler)
+}
+
+// strictMux is a mux that wraps standard HTTP handler with safer handler that allows safe user provided handler registrations.
+type strictMux struct {
+	mux
+	seen map[string]struct{}
+}
+
+func newStrictMux(m mux) *strictMux {
+	return &strictMux{
+		m,
+		map[string]struct{}{},
+	}
+
+}
+
+// Handle is like HTTP mux handle but it does not allow to register paths that are shared with previously registered paths.
+// It also makes sure the trailing / is registered too.
+// For example if /api/v1/federate was registered consequent registrations like /api/v1/federate/ or /api/v1/federate/some will
+// return error. In the mean time request with both /api/v1/federate and /api/v1/federate/ will point to the handled passed by /api/v1/federate
+// registration.
+// The pattern is cleaned first so that repeated and trailing slashes (e.g. /api/v1/federate// or
+// /api/v1//federate) don't circumvent the check. Patterns which resolve to the root path are rejected.
+// This allows to de-risk ability for user to mis-configure and leak inject isolation.
+func (s *strictMux) Handle(pattern string, handler http.Handler) error {
+	return s.handle(pattern, handler, false)
+}
+
+// HandleExact is like Handle but the handler only serves the exact path: the
+// pattern with trailing / isn't registered so that the sub-paths (e.g.
+// /api/v1/federate/ or /api/v1/federate/some) aren't handled. The sub-paths
+// still can't be registered afterwards.
+func (s *strictMux) HandleExact(pattern string, handler http.Handler) error {
+	return s.handle(pattern, handler, true)
+}
+
+func (s *strictMux) handle(pattern string, handler http.Handler, exact bool) error {
+	sanitized := sanitizePattern(pattern)
+	if sanitized == "" {
+		return fmt.Errorf("pattern %q is not allowed", pattern)
+	}
+
+	if _, ok := s.seen[sanitized]; ok {
+		return fmt.Errorf("pattern %q was already registered", sanitized)
+	}
+
+	for p := range s.seen {
+		if strings.HasPrefix(sanitized+"/", p+"/") {
+			return fmt.Errorf("pattern %q is registered, cannot register path %q that shares it", p, sanitized)
+		}
+	}
+
+	s.mux.Handle(sanitized, handler)
+	if !exact {
+		s.mux.Handle(sanitized+"/", handler)
+	}
+	s.seen[sanitized] = struct{}{}
+
+	return nil
+}
+
+// patterns returns the sorted list of the registered patterns (without
+// trailing slash).
+func (s *strictMux) patterns() []string {
+	patterns := make([]string, 0, len(s.seen))
+	for p := range s.seen {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+
+	return patterns
+}
+
+// sanitizePattern returns the cleaned pattern without trailing slash. It
+// returns an empty string if the pattern is relative or resolves to the root
+// path.
+func sanitizePattern(pattern string) string {
+	if !strings.HasPrefix(pattern, "/") {
+		return ""
+	}
+
+	sanitized := path.Clean(pattern)
+	if sanitized == "/" {
+		return ""
+	}
+
+	return sanitized
+}
+
+// instrumentedMux wraps a mux and instruments it.
+type instrumentedMux struct {
+	mux
+	i signalhttp.HandlerInstrumenter
+}
+
+func newInstrumentedMux(m mux, r prometheus.Registerer) *instrumentedMux {
+	return &instrumentedMux{
+		m,
+		signalhttp.NewHandlerInstrumenter(r, []string{"handler"}),
+	}
+}
+
+// Handle implements the mux interface.
+func (i *instrumentedMux) Handle(pattern string, handler http.Handler) {
+	i.mux.Handle(pattern, i.i.NewHandler(prometheus.Labels{"handler": pattern}, handler))
+}
+
+// ExtractLabeler is an HTTP handler that extract the label value to be
+// enforced from the HTTP request.  If a valid label value is found, it should
+// store it in the request's context.  Otherwise it should return an error in
+// the HTTP response (usually 400 or 500).
+// If the implementation also has a `Validate() error` method, NewRoutes calls
+// it to detect misconfigurations early.
+type ExtractLabeler interface {
+	ExtractLabel(next http.HandlerFunc) http.Handler
+}
+
+// validator is implemented by the ExtractLabelers which can verify their
+// configuration.
+type validator interface {
+	Validate() error
+}
+
+// labelValueChecker is implemented by the ExtractLabelers which can tell
+// whether the request provides a label value at all (e.g. the header or the
+// parameter is present). FirstMatchEnforcer and the default label value only
+// fall back when hasLabelValue returns false: a request providing an invalid
+// value is always rejected.
+type labelValueChecker interface {
+	hasLabelValue(*http.Request) bool
+}
+
+// hasLabelValue returns false if el reports that the request doesn't provide
+// any label value. ExtractLabelers which don't implement labelValueChecker
+// are assumed to always find a value.
+func hasLabelValue(el ExtractLabeler, r *http.Request) bool {
+	c, ok := el.(labelValueChecker)
+	return !ok || c.hasLabelValue(r)
+}
+
+// bypassHandler wraps an existing handler and checks for bypass queries before delegating
+func (r *routes) bypassHandler(enforcerChain http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Only check for bypass queries if bypass queries are configured
+		if len(r.bypassQueries) > 0 || len(r.bypassSelectors) > 0 {
+			values, err := queryValues(req, r.queryParams)
+			if err == nil && r.bypassesAll(values) {
+				// if all the queries are bypassed, serve the request without enforcement
+				r.handler.ServeHTTP(w, req)
+				return
+			}
+		}
+
+		// Otherwise continue with normal processing
+		enforcerChain.ServeHTTP(w, req)
+	})
+}
+
+// bypassesAll returns true if there is at least one query and all the
+// queries are bypass queries or match the bypass selectors.
+func (r *routes) bypassesAll(queries []string) bool {
+	if len(queries) == 0 {
+		return false
+	}
+
+	for _, q := range queries {
+		if !slices.Contains(r.bypassQueries, q) && !r.matchesBypassSelectors(q) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesBypassSelectors returns true if the query has at least one selector
+// and if each selector includes all the matchers of one of the bypass
+// selectors. Such selectors match a subset of the bypass selector's series.
+func (r *routes) matchesBypassSelectors(qry string) bool {
+	if len(r.bypassSelectors) == 0 {
+		return false
+	}
+
+	expr, err := r.promQLParser.ParseExpr(qry)
+	if err != nil {
+		return false
+	}
+
+	selectors := parser.ExtractSelectors(expr)
+	if len(selectors) == 0 {
+		return false
+	}
+
+	for _, sel := range selectors {
+		if !slices.ContainsFunc(r.bypassSelectors, func(bypass []*labels.Matcher) bool {
+			return containsMatchers(sel, bypass)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsMatchers returns true if all the matchers from sub are present in
+// ms.
+func containsMatchers(ms, sub []*labels.Matcher) bool {
+	for _, m := range sub {
+		if !slices.ContainsFunc(ms, func(o *labels.Matcher) bool {
+			return o.Name == m.Name && o.Type == m.Type && o.Value == m.Value
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// queryValues returns the non-empty values of the given query parameters
+// from both the URL query string and the POST body (form-encoded or JSON).
+// The upstream may read the query from any of them so they all need to be
+// considered.
+func queryValues(req *http.Request, names []string) ([]string, error) {
+	values := nonEmptyValues(req.URL.Query(), names)
+
+	if isJSONBody(req) {
+		fields, err := decodeJSONBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := jsonStringFields(fields, names...)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(values, nonEmptyValues(v, names)...), nil
+	}
+
+	if req.Method == http.MethodPost && req.Body != nil {
+		b, err := readBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		form, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse form data: %w", err)
+		}
+
+		values = append(values, nonEmptyValues(form, names)...)
+	}
+
+	return values, nil
+}
+
+// nonEmptyValues returns the non-empty values of all the given parameters.
+func nonEmptyValues(v url.Values, names []string) []string {
+	var values []string
+	for _, name := range names {
+		values = append(values, removeEmptyValues(v[name])...)
+	}
+
+	return values
+}
+
+// HTTPFormEnforcer enforces a label value extracted from the HTTP form parameters.
+//
+// The parameter name is independent from the name of the enforced label: a
+// client can pass "?tenant=foo" while the proxy enforces namespace="foo".
+//
+// The parameters are removed from the upstream request: from the URL query,
+// the form-encoded body and the top-level fields of a JSON-encoded body.
+type HTTPFormEnforcer struct {
+	ParameterName string
+
+	// Aliases is an optional list of additional parameter names which are
+	// accepted for the same enforced label. The values of all parameters are
+	// merged and the parameters are removed from the upstream request.
+	Aliases []string
+}
+
+// Validate verifies that the parameter name and the aliases aren't empty and
+// that they are unique.
+func (hff HTTPFormEnforcer) Validate() error {
+	if hff.ParameterName == "" {
+		return errors.New("empty parameter name")
+	}
+
+	seen := map[string]struct{}{hff.ParameterName: {}}
+	for _, alias := range hff.Aliases {
+		if alias == "" {
+			return errors.New("empty parameter alias")
+		}
+
+		if _, found := seen[alias]; found {
+			return fmt.Errorf("duplicate parameter name %q", alias)
+		}
+		seen[alias] = struct{}{}
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (hff HTTPFormEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labelValues, err := hff.getLabelValues(r)
+		if err != nil {
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+			return
+		}
+
+		// Remove the proxy label from the query parameters.
+		q := r.URL.Query()
+		for _, name := range hff.parameterNames() {
+			q.Del(name)
+		}
+		r.URL.RawQuery = q.Encode()
+
+		// Remove the param from the PostForm.
+		if r.Method == http.MethodPost {
+			if err := r.ParseForm(); err != nil {
+				prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			var found bool
+			for _, name := range hff.parameterNames() {
+				if r.PostForm.Get(name) != "" {
+					r.PostForm.Del(name)
+					found = true
+				}
+			}
+
+			if found {
+				newBody := r.PostForm.Encode()
+				// We are replacing request body, close previous one (r.FormValue ensures it is read fully and not nil).
+				_ = r.Body.Close()
+				r.Body = io.NopCloser(strings.NewReader(newBody))
+				r.ContentLength = int64(len(newBody))
+			}
+		}
+
+		// Remove the param from the JSON body (the label value is still
+		// only read from the query parameters).
+		if isJSONBody(r) {
+			if err := removeJSONFields(r, hff.parameterNames()); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+// hasLabelValue implements the labelValueChecker interface.
+func (hff HTTPFormEnforcer) hasLabelValue(r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		// Let ExtractLabel report the error.
+		return true
+	}
+
+	for _, name := range hff.parameterNames() {
+		if len(removeEmptyValues(r.Form[name])) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (hff HTTPFormEnforcer) parameterNames() []string {
+	return append([]string{hff.ParameterName}, hff.Aliases...)
+}
+
+func (hff HTTPFormEnforcer) getLabelValues(r *http.Request) ([]string, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, fmt.Errorf("the form data can not be parsed: %w", err)
+	}
+
+	var formValues []string
+	for _, name := range hff.parameterNames() {
+		formValues = append(formValues, removeEmptyValues(r.Form[name])...)
+	}
+
+	if len(formValues) == 0 {
+		return nil, fmt.Errorf("the %q query parameter must be provided", hff.ParameterName)
+	}
+
+	return formValues, nil
+}
+
+var errMissingHeader = errors.New("missing HTTP header")
+
+// HTTPHeaderEnforcer enforces a label value extracted from the HTTP headers.
+//
+// When ParseListSyntax is true, each header line is parsed as a list of
+// values separated by ListDelimiter (default: ","). A value can be enclosed
+// in double quotes to contain the delimiter (e.g. `"team,a",team-b` yields
+// "team,a" and "team-b"); a backslash escapes the next character inside
+// quotes.
+type HTTPHeaderEnforcer struct {
+	Name            string
+	ParseListSyntax bool
+	ListDelimiter   string
+}
+
+// Validate verifies that the header name isn't empty.
+func (hhe HTTPHeaderEnforcer) Validate() error {
+	if hhe.Name == "" {
+		return errors.New("empty header name")
+	}
+
+	if hhe.ListDelimiter != "" && strings.ContainsAny(hhe.ListDelimiter, "\"\\") {
+		return fmt.Errorf("invalid list delimiter %q", hhe.ListDelimiter)
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (hhe HTTPHeaderEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labelValues, err := hhe.getLabelValues(r)
+		if err != nil {
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), labelValues)))
+	})
+}
+
+// hasLabelValue implements the labelValueChecker interface.
+func (hhe HTTPHeaderEnforcer) hasLabelValue(r *http.Request) bool {
+	_, err := hhe.getLabelValues(r)
+	return !errors.Is(err, errMissingHeader)
+}
+
 func (hhe HTTPHeaderEnforcer) getLabelValues(r *http.Request) ([]string, error) {
 	headerValues := r.Header[hhe.Name]
 
-	if hhe.ParseListSyntax {
-		headerValues = trimValues(splitValues(headerValues, ","))
+	if hhe.ParseListSyntax {
+		sep := hhe.ListDelimiter
+		if sep == "" {
+			sep = ","
+		}
+
+		var err error
+		headerValues, err = splitValues(headerValues, sep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP header %q: %w", hhe.Name, err)
+		}
+	}
+
+	headerValues = removeEmptyValues(headerValues)
+
+	if len(headerValues) == 0 {
+		return nil, fmt.Errorf("%w %q", errMissingHeader, hhe.Name)
+	}
+
+	return headerValues, nil
+}
+
+// PathParameterEnforcer enforces a label value extracted from the URL path.
+// Regexp must match the beginning of the path and contain a capture group
+// named Name which holds the label value (e.g. `^/tenants/(?P<tenant>[^/]+)`).
+// The matched prefix is stripped from the path before the request is routed
+// and forwarded upstream.
+type PathParameterEnforcer struct {
+	Regexp *regexp.Regexp
+	Name   string
+}
+
+// Validate verifies that the regexp contains the named capture group.
+func (ppe PathParameterEnforcer) Validate() error {
+	if ppe.Regexp == nil {
+		return errors.New("missing path regexp")
+	}
+
+	if ppe.Name == "" {
+		return errors.New("empty capture group name")
+	}
+
+	if ppe.Regexp.SubexpIndex(ppe.Name) < 0 {
+		return fmt.Errorf("path regexp %q has no capture group named %q", ppe.Regexp.String(), ppe.Name)
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ppe PathParameterEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, _ := r.Context().Value(keyPathParameters).(map[string]string)
+		if v[ppe.Name] == "" {
+			prometheusAPIError(w, fmt.Sprintf("the URL path doesn't match %q", ppe.Regexp.String()), http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), []string{v[ppe.Name]})))
+	})
+}
+
+// hasLabelValue implements the labelValueChecker interface.
+func (ppe PathParameterEnforcer) hasLabelValue(r *http.Request) bool {
+	v, _ := r.Context().Value(keyPathParameters).(map[string]string)
+	return v[ppe.Name] != ""
+}
+
+// rewritePath implements the pathRewriter interface.
+func (ppe PathParameterEnforcer) rewritePath(next http.Handler) http.Handler {
+	idx := ppe.Regexp.SubexpIndex(ppe.Name)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loc := ppe.Regexp.FindStringSubmatchIndex(r.URL.Path)
+		if loc == nil || loc[0] != 0 || loc[2*idx] < 0 {
+			// Don't reject the request here: the ExtractLabel handler of
+			// the enforced paths will.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params, _ := r.Context().Value(keyPathParameters).(map[string]string)
+		m := make(map[string]string, len(params)+1)
+		for k, v := range params {
+			m[k] = v
+		}
+		m[ppe.Name] = r.URL.Path[loc[2*idx]:loc[2*idx+1]]
+
+		u := *r.URL
+		u.Path = r.URL.Path[loc[1]:]
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		u.RawPath = ""
+
+		r = r.WithContext(context.WithValue(r.Context(), keyPathParameters, m))
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathRewriter is implemented by the ExtractLabelers which need to look at
+// (and modify) the request before it is routed.
+type pathRewriter interface {
+	rewritePath(http.Handler) http.Handler
+}
+
+// EnforcedLabel associates the name of a label to enforce with the
+// ExtractLabeler providing its value(s).
+type EnforcedLabel struct {
+	Name           string
+	ExtractLabeler ExtractLabeler
+}
+
+// multiLabelExtractor runs the ExtractLabelers of all the enforced labels and
+// stores the extracted values per label name in the request's context.
+type multiLabelExtractor []EnforcedLabel
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (mle multiLabelExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		markLabelExtracted(req.Context())
+		recordLabelValues(req.Context())
+		next(w, req)
+	})
+	for i := len(mle) - 1; i >= 0; i-- {
+		name, inner := mle[i].Name, h
+		h = mle[i].ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+			ctx := withNamedLabelValues(req.Context(), name, MustLabelValues(req.Context()))
+			inner.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+
+	return h
+}
+
+// Reasons of the enforcement rejections.
+const (
+	rejectionIllegalMatcher    = "illegal_matcher"
+	rejectionQueryParse        = "query_parse"
+	rejectionMissingLabel      = "missing_label"
+	rejectionRegexEmpty        = "regex_empty"
+	rejectionInvalidLabelValue = "invalid_label_value"
+	rejectionRateLimited       = "rate_limited"
+	rejectionDeniedMetricName  = "denied_metric_name"
+)
+
+// countRejection increments the number of rejected requests for the given
+// reason.
+func (r *routes) countRejection(req *http.Request, reason string) {
+	r.rejections.WithLabelValues(reason, req.Pattern).Inc()
+}
+
+// countLabelMatchersRejection counts the rejection for an error returned by
+// newLabelMatchers().
+func (r *routes) countLabelMatchersRejection(req *http.Request, err error) {
+	if errors.Is(err, errRegexMatchesEmpty) {
+		r.countRejection(req, rejectionRegexEmpty)
+		return
+	}
+
+	r.countRejection(req, rejectionInvalidLabelValue)
+}
+
+// rejectionCountingExtractor counts the requests rejected by the
+// ExtractLabeler.
+type rejectionCountingExtractor struct {
+	ExtractLabeler
+	r *routes
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (rce rejectionCountingExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var extracted bool
+		sw := &statusResponseWriter{ResponseWriter: w}
+		rce.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+			extracted = true
+			next(w, req)
+		}).ServeHTTP(sw, req)
+
+		if !extracted && sw.code >= http.StatusBadRequest {
+			rce.r.countRejection(req, rejectionMissingLabel)
+		}
+	})
+}
+
+// statusResponseWriter records the status code of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the original http.ResponseWriter (used by http.ResponseController).
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements the http.Flusher interface.
+func (w *statusResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// tenantKeyExtractor stores the tenant key computed by f in the request's
+// context once the label values have been extracted.
+type tenantKeyExtractor struct {
+	ExtractLabeler
+	f func(*http.Request) string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (tke tenantKeyExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return tke.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		next(w, req.WithContext(context.WithValue(req.Context(), keyTenant, tke.f(req))))
+	})
+}
+
+// orgIDHeaderExtractor stores the label value to be set in the header of the
+// upstream request once the label value has been extracted. The header is set
+// by the director of the proxies (see withOrgIDHeader()).
+type orgIDHeaderExtractor struct {
+	ExtractLabeler
+	name string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ohe orgIDHeaderExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return ohe.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		lvalues := MustLabelValues(req.Context())
+		if len(lvalues) > 1 {
+			prometheusAPIError(w, fmt.Sprintf("Multiple label values not supported with the %s header", ohe.name), http.StatusUnprocessableEntity)
+			return
+		}
+
+		next(w, req.WithContext(context.WithValue(req.Context(), keyOrgID, lvalues[0])))
+	})
+}
+
+// withOrgIDHeader wraps the director of a proxy to remove the header sent by
+// the client (if any) from all the upstream requests, including the ones of
+// the passthrough paths. The header is only set to the extracted label value.
+func withOrgIDHeader(name string, director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		director(req)
+
+		req.Header.Del(name)
+		if v, ok := req.Context().Value(keyOrgID).(string); ok {
+			req.Header.Set(name, v)
+		}
+	}
+}
+
+// orgIDRoundTripper sets the header to the extracted label value on the
+// requests sent by the proxy itself to the upstream (e.g. to verify the
+// silence before its deletion) which don't go through the proxy directors.
+type orgIDRoundTripper struct {
+	next http.RoundTripper
+	name string
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (ort orgIDRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del(ort.name)
+	if v, ok := req.Context().Value(keyOrgID).(string); ok {
+		req.Header.Set(ort.name, v)
+	}
+
+	return ort.next.RoundTrip(req)
+}
+
+// tenantKey returns the tenant key stored in the context.
+func tenantKey(ctx context.Context) string {
+	k, _ := ctx.Value(keyTenant).(string)
+	return k
+}
+
+// defaultTenantKey returns a key made of the extracted label values.
+func (r *routes) defaultTenantKey(req *http.Request) string {
+	var sb strings.Builder
+	for i, name := range r.labelNames {
+		if i > 0 {
+			sb.WriteByte(0xff)
+		}
+		sb.WriteString(name)
+		for _, v := range MustLabelValuesFor(req.Context(), name) {
+			sb.WriteByte(0xfe)
+			sb.WriteString(v)
+		}
+	}
+
+	return sb.String()
+}
+
+// StaticLabelEnforcer enforces a static label value.
+type StaticLabelEnforcer []string
+
+// Validate verifies that the enforcer has at least one value and no empty
+// value.
+func (sle StaticLabelEnforcer) Validate() error {
+	if len(sle) == 0 {
+		return errors.New("no static label value")
+	}
+
+	for _, v := range sle {
+		if v == "" {
+			return errors.New("empty static label value")
+		}
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (sle StaticLabelEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(WithLabelValues(r.Context(), sle)))
+	})
+}
+
+// FirstMatchEnforcer tries the ExtractLabelers in order and enforces the
+// label value(s) of the first one which finds a value in the request. An
+// ExtractLabeler is skipped only when the request doesn't provide a value for
+// it (e.g. the header or the parameter is missing): invalid values and other
+// errors are returned to the client. The last ExtractLabeler is never skipped.
+// For instance, FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"},
+// StaticLabelEnforcer{"default"}} enforces the value of the header when it is
+// present and "default" otherwise.
+type FirstMatchEnforcer []ExtractLabeler
+
+// Validate verifies that the enforcer has at least one ExtractLabeler and
+// that they are valid.
+func (fme FirstMatchEnforcer) Validate() error {
+	if len(fme) == 0 {
+		return errors.New("no ExtractLabeler")
+	}
+
+	for i, el := range fme {
+		if el == nil {
+			return fmt.Errorf("missing ExtractLabeler %d", i)
+		}
+
+		if v, ok := el.(validator); ok {
+			if err := v.Validate(); err != nil {
+				return fmt.Errorf("invalid ExtractLabeler %d: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (fme FirstMatchEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	handlers := make([]http.Handler, len(fme))
+	for i, el := range fme {
+		handlers[i] = el.ExtractLabel(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i, el := range fme {
+			if i < len(fme)-1 && !hasLabelValue(el, req) {
+				continue
+			}
+
+			handlers[i].ServeHTTP(w, req)
+			return
+		}
+	})
+}
+
+// hasLabelValue implements the labelValueChecker interface.
+func (fme FirstMatchEnforcer) hasLabelValue(r *http.Request) bool {
+	for _, el := range fme {
+		if hasLabelValue(el, r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultLabelValueExtractor falls back to a default label value when the
+// request doesn't provide a value for the wrapped ExtractLabeler (e.g. the
+// header or the parameter is missing).
+type defaultLabelValueExtractor struct {
+	ExtractLabeler
+	value string
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (d defaultLabelValueExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	h := d.ExtractLabeler.ExtractLabel(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !hasLabelValue(d.ExtractLabeler, req) {
+			next(w, req.WithContext(WithLabelValues(req.Context(), []string{d.value})))
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// labelValueMappingExtractor transforms the label values extracted by the
+// wrapped ExtractLabeler with f.
+type labelValueMappingExtractor struct {
+	ExtractLabeler
+	f func(context.Context, []string) ([]string, error)
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (lvm labelValueMappingExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return lvm.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		values, err := lvm.f(req.Context(), MustLabelValues(req.Context()))
+		if err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(values) == 0 {
+			prometheusAPIError(w, "no label value after mapping", http.StatusBadRequest)
+			return
+		}
+
+		next(w, req.WithContext(WithLabelValues(req.Context(), values)))
+	})
+}
+
+// labelValueFilteringExtractor rejects the label values extracted by the
+// wrapped ExtractLabeler which aren't in the allowed set (if not nil) or are
+// in the denied set.
+type labelValueFilteringExtractor struct {
+	ExtractLabeler
+	allowed map[string]struct{}
+	denied  map[string]struct{}
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (lvf labelValueFilteringExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return lvf.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		for _, v := range MustLabelValues(req.Context()) {
+			_, denied := lvf.denied[v]
+			_, allowed := lvf.allowed[v]
+			if denied || (lvf.allowed != nil && !allowed) {
+				// The same response is returned in both cases to not reveal
+				// which values are valid.
+				prometheusAPIError(w, fmt.Sprintf("label value %q is not allowed", v), http.StatusForbidden)
+				return
+			}
+		}
+
+		next(w, req)
+	})
+}
+
+// labelValuesLimitingExtractor rejects the requests with more label values
+// than the limit.
+type labelValuesLimitingExtractor struct {
+	ExtractLabeler
+	name string
+	max  int
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (lvl labelValuesLimitingExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return lvl.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		if n := len(MustLabelValues(req.Context())); n > lvl.max {
+			prometheusAPIError(w, fmt.Sprintf("too many values for label %q: %d (limit: %d)", lvl.name, n, lvl.max), http.StatusBadRequest)
+			return
+		}
+
+		next(w, req)
+	})
+}
+
+// bufferedResponseWriter records the response of a handler in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (bw *bufferedResponseWriter) Header() http.Header { return bw.header }
+
+func (bw *bufferedResponseWriter) WriteHeader(code int) {
+	if bw.code == 0 {
+		bw.code = code
+	}
+}
+
+func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	return bw.body.Write(b)
+}
+
+// replay writes the recorded response to w.
+func (bw *bufferedResponseWriter) replay(w http.ResponseWriter) {
+	for k, v := range bw.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	if bw.code != 0 {
+		w.WriteHeader(bw.code)
+	}
+	_, _ = w.Write(bw.body.Bytes())
+}
+
+const (
+	defaultUpstreamDialTimeout           = 30 * time.Second
+	defaultUpstreamResponseHeaderTimeout = 5 * time.Minute
+	defaultUpstreamMaxIdleConnsPerHost   = 100
+)
+
+// newDefaultUpstreamTransport returns the default transport for the requests
+// to the upstream. Unlike http.DefaultTransport, it bounds the time waiting
+// for the response headers and keeps more idle connections to the upstream.
+func newDefaultUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   defaultUpstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.ResponseHeaderTimeout = defaultUpstreamResponseHeaderTimeout
+	t.MaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+
+	return t
+}
+
+// instrumentedRoundTripper observes the duration of the upstream round-trips
+// (until the response headers are received) per registered path and
+// optionally per tenant. The time spent by the proxy to enforce the label isn't included.
+//
+// The tenant is made of the values of each enforced label joined by ",", the
+// labels being separated by ";" (e.g. "ns1,ns2;eu-west").
+type instrumentedRoundTripper struct {
+	next     http.RoundTripper
+	duration *prometheus.HistogramVec
+	// tenantLabels is nil when the tenant isn't reported.
+	tenantLabels []string
+}
+
+func newInstrumentedRoundTripper(next http.RoundTripper, reg prometheus.Registerer, tenantLabels []string) *instrumentedRoundTripper {
+	labelNames := []string{"path"}
+	if tenantLabels != nil {
+		labelNames = append(labelNames, "tenant")
+	}
+
+	return &instrumentedRoundTripper{
+		next: next,
+		duration: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_upstream_duration_seconds",
+				Help:    "Duration of the round-trips to the upstream, excluding the enforcement.",
+				Buckets: prometheus.DefBuckets,
+			},
+			labelNames,
+		),
+		tenantLabels: tenantLabels,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt *instrumentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.next.RoundTrip(req)
+
+	// The sub-paths are reported under the registered path.
+	labelValues := []string{strings.TrimSuffix(req.Pattern, "/")}
+	if rt.tenantLabels != nil {
+		labelValues = append(labelValues, rt.tenant(req.Context()))
+	}
+	rt.duration.WithLabelValues(labelValues...).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// tenant returns the extracted label values of the request. It returns an
+// empty string for the requests forwarded without label extraction.
+func (rt *instrumentedRoundTripper) tenant(ctx context.Context) string {
+	named, _ := ctx.Value(keyNamedLabels).(map[string][]string)
+	if len(named) == 0 {
+		return ""
+	}
+
+	values := make([]string, 0, len(rt.tenantLabels))
+	for _, name := range rt.tenantLabels {
+		values = append(values, strings.Join(named[name], ","))
+	}
+
+	return strings.ToValidUTF8(strings.Join(values, ";"), "")
+}
+
+// newH2CUpstreamTransport returns a HTTP/2 transport dialing cleartext
+// connections with the dialer of rt if any.
+func newH2CUpstreamTransport(rt http.RoundTripper) *http2.Transport {
+	dial := (&net.Dialer{
+		Timeout:   defaultUpstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if t, ok := rt.(*http.Transport); ok && t.DialContext != nil {
+		dial = t.DialContext
+	}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+	}
+}
+
+func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, opts ...Option) (*routes, error) {
+	return NewMultiLabelRoutes(upstream, []EnforcedLabel{{Name: label, ExtractLabeler: extractLabeler}}, opts...)
+}
+
+// NewMultiLabelRoutes is like NewRoutes but it enforces several distinct
+// labels at once.
+func NewMultiLabelRoutes(upstream *url.URL, enforcedLabels []EnforcedLabel, opts ...Option) (*routes, error) {
+	if len(enforcedLabels) == 0 {
+		return nil, errors.New("at least one label to enforce is required")
+	}
+
+	labelNames := make([]string, 0, len(enforcedLabels))
+	for _, l := range enforcedLabels {
+		if l.Name == "" {
+			return nil, errors.New("the name of the label to enforce can't be empty")
+		}
+		if l.ExtractLabeler == nil {
+			return nil, fmt.Errorf("missing ExtractLabeler for label %q", l.Name)
+		}
+		if v, ok := l.ExtractLabeler.(validator); ok {
+			if err := v.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid ExtractLabeler for label %q: %w", l.Name, err)
+			}
+		}
+		if slices.Contains(labelNames, l.Name) {
+			return nil, fmt.Errorf("label %q is enforced more than once", l.Name)
+		}
+		labelNames = append(labelNames, l.Name)
+	}
+
+	opt := options{}
+	for _, o := range opts {
+		o.apply(&opt)
+	}
+
+	if opt.registerer == nil {
+		opt.registerer = prometheus.NewRegistry()
+	}
+
+	if opt.promQLParser == nil {
+		opt.promQLParser = DefaultPromQLParser{}
+	}
+
+	if opt.behaviorVersion == 0 {
+		opt.behaviorVersion = LatestBehaviorVersion
+	}
+	if opt.behaviorVersion < BehaviorVersion1 || opt.behaviorVersion > LatestBehaviorVersion {
+		return nil, fmt.Errorf("invalid behavior version %d: must be between %d and %d", opt.behaviorVersion, BehaviorVersion1, LatestBehaviorVersion)
+	}
+
+	if opt.tsdbStatsMaxSeries == 0 {
+		opt.tsdbStatsMaxSeries = defaultTSDBStatsMaxSeries
+	}
+
+	if opt.replaceRejectionStatus == 0 {
+		opt.replaceRejectionStatus = http.StatusBadRequest
+	}
+	if opt.replaceRejectionStatus < 400 || opt.replaceRejectionStatus > 499 {
+		return nil, fmt.Errorf("invalid replace rejection status %d: must be a 4xx status code", opt.replaceRejectionStatus)
+	}
+
+	if opt.regexAnchoring && !opt.regexMatch {
+		return nil, errors.New("regex anchoring requires regex match")
+	}
+
+	if opt.maxLabelValues < 0 {
+		return nil, fmt.Errorf("invalid max label values %d: must be positive", opt.maxLabelValues)
+	}
+
+	if opt.singleValueOnly {
+		opt.maxLabelValues = 1
+	}
+
+	if opt.allowEmptyMatchingRegex && !opt.regexMatch {
+		return nil, errors.New("allowing empty matching regex requires regex match")
+	}
+
+	if opt.maxBodyBytes == 0 {
+		opt.maxBodyBytes = defaultMaxBodyBytes
+	}
+
+	switch opt.matchType {
+	case labels.MatchEqual, labels.MatchNotEqual, labels.MatchRegexp, labels.MatchNotRegexp:
+	default:
+		return nil, fmt.Errorf("invalid match type %d", opt.matchType)
 	}
 
-	headerValues = removeEmptyValues(headerValues)
+	if opt.rateLimit < 0 || (opt.rateLimit > 0 && opt.rateLimitBurst < 1) {
+		return nil, fmt.Errorf("invalid rate limit %v with burst %d: the rate must be positive and the burst at least 1", opt.rateLimit, opt.rateLimitBurst)
+	}
 
-	if len(headerValues) == 0 {
-		return nil, fmt.Errorf("missing HTTP header %q", hhe.Name)
+	if opt.orAbsent && isNegativeMatchType(opt.matchType) {
+		// Negative matchers already match the series without the label.
+		return nil, errors.New("or-absent matching requires a positive match type")
 	}
 
-	return headerValues, nil
-}
+	if opt.maxQueryRange < 0 || opt.minQueryStep < 0 {
+		return nil, fmt.Errorf("invalid range limits %s and %s: must be positive", opt.maxQueryRange, opt.minQueryStep)
+	}
 
-// StaticLabelEnforcer enforces a static label value.
-type StaticLabelEnforcer []string
+	if opt.upstreamResolver != nil && len(labelNames) > 1 {
+		return nil, errors.New("the upstream resolver requires a single enforced label")
+	}
 
-// ExtractLabel implements the ExtractLabeler interface.
-func (sle StaticLabelEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next(w, r.WithContext(WithLabelValues(r.Context(), sle)))
-	})
-}
+	if opt.upstreamResolver != nil && opt.regexMatch {
+		return nil, errors.New("the upstream resolver can't be used with regex match")
+	}
 
-func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, opts ...Option) (*routes, error) {
-	opt := options{}
-	for _, o := range opts {
-		o.apply(&opt)
+	for _, alias := range opt.queryParamAliases {
+		if alias == "" || alias == queryParam {
+			return nil, fmt.Errorf("invalid query parameter alias %q", alias)
+		}
 	}
 
-	if opt.registerer == nil {
-		opt.registerer = prometheus.NewRegistry()
+	if opt.receiversFiltering && opt.regexMatch {
+		return nil, errors.New("receivers filtering can't be used with regex match")
+	}
+
+	if opt.requestTimeout < 0 {
+		return nil, fmt.Errorf("invalid request timeout %s: must be positive", opt.requestTimeout)
+	}
+
+	if opt.breakerThreshold < 0 || (opt.breakerThreshold > 0 && opt.breakerCooldown <= 0) {
+		return nil, fmt.Errorf("invalid circuit breaker threshold %d with cooldown %s: the threshold and the cooldown must be positive", opt.breakerThreshold, opt.breakerCooldown)
+	}
+
+	if opt.forwardOrgIDHeader != "" && len(labelNames) > 1 {
+		return nil, fmt.Errorf("the %s header can only be forwarded with a single enforced label", opt.forwardOrgIDHeader)
+	}
+
+	if opt.forwardOrgIDHeader != "" && opt.regexMatch {
+		return nil, fmt.Errorf("the %s header can't be forwarded with regex match", opt.forwardOrgIDHeader)
+	}
+
+	if opt.alertsPath == "" {
+		opt.alertsPath = "/api/v1/alerts"
+	}
+
+	if opt.rulesPath == "" {
+		opt.rulesPath = "/api/v1/rules"
+	}
+
+	bypassSelectors := make([][]*labels.Matcher, 0, len(opt.bypassMatchers))
+	for _, sel := range opt.bypassMatchers {
+		ms, err := opt.promQLParser.ParseMetricSelector(sel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bypass selector %q: %w", sel, err)
+		}
+		bypassSelectors = append(bypassSelectors, ms)
+	}
+
+	deniedMetricNames := make([]*regexp.Regexp, 0, len(opt.metricNameDenylist))
+	for _, p := range opt.metricNameDenylist {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied metric name %q: %w", p, err)
+		}
+		deniedMetricNames = append(deniedMetricNames, re)
+	}
+
+	var pathRewriters []pathRewriter
+	for _, l := range enforcedLabels {
+		if pr, ok := l.ExtractLabeler.(pathRewriter); ok {
+			pathRewriters = append(pathRewriters, pr)
+		}
+	}
+
+	if opt.defaultLabelValue != "" {
+		wrapped := make([]EnforcedLabel, 0, len(enforcedLabels))
+		for _, l := range enforcedLabels {
+			wrapped = append(wrapped, EnforcedLabel{
+				Name:           l.Name,
+				ExtractLabeler: defaultLabelValueExtractor{ExtractLabeler: l.ExtractLabeler, value: opt.defaultLabelValue},
+			})
+		}
+		enforcedLabels = wrapped
+	}
+
+	if opt.labelValueMapper != nil {
+		wrapped := make([]EnforcedLabel, 0, len(enforcedLabels))
+		for _, l := range enforcedLabels {
+			wrapped = append(wrapped, EnforcedLabel{
+				Name:           l.Name,
+				ExtractLabeler: labelValueMappingExtractor{ExtractLabeler: l.ExtractLabeler, f: opt.labelValueMapper},
+			})
+		}
+		enforcedLabels = wrapped
+	}
+
+	// The limit applies to the values which are eventually enforced (after the
+	// fallback to the default value and the mapping).
+	if opt.maxLabelValues > 0 {
+		wrapped := make([]EnforcedLabel, 0, len(enforcedLabels))
+		for _, l := range enforcedLabels {
+			wrapped = append(wrapped, EnforcedLabel{
+				Name:           l.Name,
+				ExtractLabeler: labelValuesLimitingExtractor{ExtractLabeler: l.ExtractLabeler, name: l.Name, max: opt.maxLabelValues},
+			})
+		}
+		enforcedLabels = wrapped
+	}
+
+	if len(opt.deniedLabelValues) > 0 || (len(opt.allowedLabelValues) > 0 && !opt.regexMatch) {
+		lvf := labelValueFilteringExtractor{denied: map[string]struct{}{}}
+		for _, v := range opt.deniedLabelValues {
+			lvf.denied[v] = struct{}{}
+		}
+		if len(opt.allowedLabelValues) > 0 && !opt.regexMatch {
+			lvf.allowed = map[string]struct{}{}
+			for _, v := range opt.allowedLabelValues {
+				lvf.allowed[v] = struct{}{}
+			}
+		}
+
+		wrapped := make([]EnforcedLabel, 0, len(enforcedLabels))
+		for _, l := range enforcedLabels {
+			lvf.ExtractLabeler = l.ExtractLabeler
+			wrapped = append(wrapped, EnforcedLabel{Name: l.Name, ExtractLabeler: lvf})
+		}
+		enforcedLabels = wrapped
+	}
+
+	if opt.h2c {
+		if upstream.Scheme != "http" {
+			return nil, fmt.Errorf("h2c requires an upstream with the http scheme, got %q", upstream.Scheme)
+		}
+		opt.upstreamTransport = newH2CUpstreamTransport(opt.upstreamTransport)
+	}
+
+	if opt.upstreamTransport == nil {
+		opt.upstreamTransport = newDefaultUpstreamTransport()
 	}
 
+	var tenantLabels []string
+	if opt.upstreamDurationTenant {
+		tenantLabels = labelNames
+	}
+	proxyTransport := newInstrumentedRoundTripper(opt.upstreamTransport, opt.registerer, tenantLabels)
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.Transport = proxyTransport
+	if opt.upstreamResolver != nil {
+		proxy.Director = withResolvedUpstream(proxy.Director)
+	}
+	if opt.forwardOrgIDHeader != "" {
+		proxy.Director = withOrgIDHeader(opt.forwardOrgIDHeader, proxy.Director)
+	}
+	// The federation responses can be very large. They are forwarded by a
+	// copy of the proxy (made once it is fully configured) which flushes
+	// immediately and never buffers them with a response modifier.
+	federateProxy := &httputil.ReverseProxy{}
 
 	r := &routes{
-		upstream:              upstream,
-		handler:               proxy,
-		label:                 label,
-		el:                    extractLabeler,
-		errorOnReplace:        opt.errorOnReplace,
-		regexMatch:            opt.regexMatch,
-		rulesWithActiveAlerts: opt.rulesWithActiveAlerts,
-		bypassQueries:         opt.bypassQueries,
-		logger:                log.Default(),
+		upstream:                 upstream,
+		handler:                  routeFederation(proxy, federateProxy),
+		labelNames:               labelNames,
+		el:                       multiLabelExtractor(enforcedLabels),
+		errorOnReplace:           opt.errorOnReplace,
+		regexMatch:               opt.regexMatch,
+		regexAnchoring:           opt.regexAnchoring,
+		allowEmptyMatchingRegex:  opt.allowEmptyMatchingRegex,
+		rulesWithActiveAlerts:    opt.rulesWithActiveAlerts,
+		redactRuleFiles:          opt.redactRuleFiles,
+		alertStates:              opt.alertStates,
+		bypassQueries:            opt.bypassQueries,
+		bypassSelectors:          bypassSelectors,
+		strictContentLength:      opt.strictContentLength,
+		promQLParser:             opt.promQLParser,
+		queryResultsVerification: opt.queryResultsVerification,
+		injectedLabelHeader:      opt.injectedLabelHeader,
+		serverTimingHeader:       opt.serverTimingHeader,
+		behaviorVersion:          opt.behaviorVersion,
+		replaceRejectionStatus:   opt.replaceRejectionStatus,
+		maxLookbackDelta:         opt.maxLookbackDelta,
+		lookbackDeltaLimitMode:   opt.lookbackDeltaLimitMode,
+		maxQueryRange:            opt.maxQueryRange,
+		minQueryStep:             opt.minQueryStep,
+		batchQueryField:          opt.batchQueryField,
+		queryParams:              append([]string{queryParam}, opt.queryParamAliases...),
+		receiversSeparator:       opt.receiversSeparator,
+		preserveParameterOrder:   opt.preserveParameterOrder,
+		upstreamHealthCheckPath:  opt.upstreamHealthCheckPath,
+		modifierConcurrency:      opt.modifierConcurrency,
+		matchType:                opt.matchType,
+		matcherRoundTrip:         opt.matcherRoundTrip,
+		maintenance:              opt.maintenance,
+		upstreamTransport:        opt.upstreamTransport,
+		stripAbsentLabels:        opt.stripAbsentLabels,
+		deniedMetricNames:        deniedMetricNames,
+		lenientMatchSelectors:    opt.lenientMatchSelectors,
+		newEnforcer:              opt.newEnforcer,
+		logger:                   opt.logger,
+		dryRun:                   opt.dryRun,
+		maxBodyBytes:             opt.maxBodyBytes,
+		orAbsent:                 opt.orAbsent,
+		queryRewriteHeader:       opt.queryRewriteHeader,
+	}
+	if opt.tenantKeyFunc == nil {
+		opt.tenantKeyFunc = r.defaultTenantKey
+	}
+
+	if opt.queryCoalescing {
+		r.coalescer = newQueryCoalescer()
+	}
+
+	if r.newEnforcer == nil {
+		r.newEnforcer = r.newPromQLEnforcer
+	}
+
+	if r.logger == nil {
+		r.logger = slog.Default()
+	}
+	r.el = tenantKeyExtractor{ExtractLabeler: r.el, f: opt.tenantKeyFunc}
+
+	r.rejections = promauto.With(opt.registerer).NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_enforcement_rejections_total",
+			Help: "Total number of requests rejected because the label couldn't be enforced.",
+		},
+		[]string{"reason", "path"},
+	)
+	r.el = rejectionCountingExtractor{ExtractLabeler: r.el, r: r}
+	if opt.forwardOrgIDHeader != "" {
+		r.el = orgIDHeaderExtractor{ExtractLabeler: r.el, name: opt.forwardOrgIDHeader}
+		r.upstreamTransport = orgIDRoundTripper{next: r.upstreamTransport, name: opt.forwardOrgIDHeader}
 	}
+	if opt.upstreamResolver != nil {
+		r.el = upstreamResolvingExtractor{ExtractLabeler: r.el, f: opt.upstreamResolver}
+	}
+	if opt.rateLimit > 0 {
+		r.el = rateLimitingExtractor{ExtractLabeler: r.el, r: r, l: newTenantRateLimiter(opt.rateLimit, opt.rateLimitBurst)}
+	}
+	if opt.requestTimeout > 0 {
+		r.handler = withRequestTimeout(opt.requestTimeout, r.handler)
+	}
+	if opt.breakerThreshold > 0 {
+		r.breakers = newCircuitBreakers(opt.breakerThreshold, opt.breakerCooldown)
+		// Expose the state of the default upstream before the first request.
+		r.breakers.forUpstream(upstream)
+		r.handler = r.withCircuitBreaker(r.handler)
+		opt.registerer.MustRegister(r.breakers)
+	}
+	if r.dryRun {
+		r.handler = withDryRunCapture(r.handler)
+		r.el = dryRunExtractor{ExtractLabeler: r.el, r: r}
+	}
+
 	mux := newStrictMux(newInstrumentedMux(http.NewServeMux(), opt.registerer))
 
 	errs := merrors.New(
 		mux.Handle("/federate", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
-		mux.Handle("/api/v1/query", bypassHandler(r.bypassQueries, r.handler, r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST")))),
-		mux.Handle("/api/v1/query_range", bypassHandler(r.bypassQueries, r.handler, r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST")))),
-		mux.Handle("/api/v1/alerts", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/rules", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
-		mux.Handle("/api/v1/series", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
-		mux.Handle("/api/v1/query_exemplars", r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST"))),
+		mux.Handle("/api/v1/query", r.limitRequestBody(r.bypassHandler(r.el.ExtractLabel(enforceMethods(r.queryInstant, "GET", "POST"))))),
+		mux.Handle("/api/v1/query_range", r.limitRequestBody(r.bypassHandler(r.el.ExtractLabel(enforceMethods(r.queryRange, "GET", "POST"))))),
+		mux.Handle(opt.alertsPath, r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		mux.Handle(opt.rulesPath, r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		mux.Handle("/api/v1/series", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST")))),
+		mux.Handle("/api/v1/query_exemplars", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST")))),
+		// The formatted and parsed queries reflect the query which the tenant
+		// would execute.
+		mux.Handle("/api/v1/format_query", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST")))),
+		mux.Handle("/api/v1/parse_query", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.query, "GET", "POST")))),
 	)
 
 	if opt.enableLabelAPIs {
 		errs.Add(
-			mux.Handle("/api/v1/labels", r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST"))),
+			mux.Handle("/api/v1/labels", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.matcher, "GET", "POST")))),
 			// Full path is /api/v1/label/<label_name>/values but http mux does not support patterns.
 			// This is fine though as we don't care about name for matcher injector.
 			mux.Handle("/api/v1/label/", r.el.ExtractLabel(enforceMethods(r.matcher, "GET"))),
 		)
 	}
 
+	if opt.enableAdminAPI {
+		errs.Add(
+			// Prometheus also accepts PUT requests but only the bodies of
+			// POST requests are enforced.
+			mux.Handle("/api/v1/admin/tsdb/delete_series", r.limitRequestBody(r.el.ExtractLabel(enforceMethods(r.deleteSeries, "POST")))),
+		)
+	}
+
+	if opt.metadataPassthrough || opt.metadataFiltering {
+		errs.Add(
+			mux.Handle("/api/v1/metadata", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		)
+	}
+
+	if opt.alertmanagerStatus {
+		errs.Add(
+			mux.Handle("/api/v2/status", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		)
+	}
+
+	if opt.alertmanagerStatus || opt.receiversFiltering {
+		errs.Add(
+			mux.Handle("/api/v2/receivers", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		)
+	}
+
+	if opt.tsdbStatsScoping {
+		errs.Add(
+			mux.Handle("/api/v1/status/tsdb", r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))),
+		)
+	} else {
+		errs.Add(
+			mux.Handle("/api/v1/status/tsdb", http.HandlerFunc(tsdbStatsNotImplemented)),
+		)
+	}
+
+	isPassthroughPath := func(path string) bool {
+		return slices.Contains(opt.passthroughPaths, path) || opt.passthroughPathsMethods[path] != nil
+	}
+
+	// The metadata endpoint is registered before its parent path which
+	// otherwise handles the sub-paths. It can still be forwarded as a
+	// passthrough path.
+	if !isPassthroughPath("/api/v1/targets/metadata") {
+		errs.Add(
+			mux.Handle("/api/v1/targets/metadata", r.el.ExtractLabel(enforceMethods(r.targetsMetadata, "GET"))),
+		)
+	}
+
+	if opt.enableRemoteWrite {
+		errs.Add(
+			// Reject multi label values with assertSingleLabelValue() because
+			// a series can only have one value for the enforced label.
+			mux.Handle("/api/v1/write", r.limitRequestBody(r.el.ExtractLabel(
+				r.errorIfRegexpMatch(
+					enforceMethods(
+						assertSingleLabelValue(r.remoteWrite),
+						"POST",
+					),
+				),
+			))),
+		)
+	}
+
+	if opt.enableOTLP {
+		errs.Add(
+			// Reject multi label values with assertSingleLabelValue() because
+			// a series can only have one value for the enforced label.
+			mux.Handle(otlpMetricsPath, r.limitRequestBody(r.el.ExtractLabel(
+				r.errorIfRegexpMatch(
+					enforceMethods(
+						assertSingleLabelValue(r.otlpMetrics),
+						"POST",
+					),
+				),
+			))),
+		)
+	}
+
 	errs.Add(
 		// Reject multi label values with assertSingleLabelValue() because the
 		// semantics of the Silences API don't support multi-label matchers.
@@ -414,73 +2497,382 @@ func NewRoutes(upstream *url.URL, label string, extractLabeler ExtractLabeler, o
 			),
 		)),
 		mux.Handle("/api/v2/alerts/groups", r.el.ExtractLabel(enforceMethods(r.enforceFilterParameter, "GET"))),
-		mux.Handle("/api/v2/alerts", r.el.ExtractLabel(enforceMethods(r.alerts, "GET"))),
+		mux.Handle("/api/v2/alerts", r.el.ExtractLabel(enforceMethods(r.alerts, "GET", "POST"))),
 	)
 
 	errs.Add(
-		mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
-		})),
+		mux.Handle("/healthz", http.HandlerFunc(r.healthz)),
+		mux.Handle("/readyz", http.HandlerFunc(r.healthz)),
+		mux.Handle("/livez", http.HandlerFunc(livez)),
 	)
 
+	if r.maintenance != nil && r.maintenance.token != "" {
+		errs.Add(
+			mux.Handle("/-/maintenance", enforceMethods(r.maintenanceHandler, "GET", "POST", "DELETE")),
+		)
+	}
+
 	if err := errs.Err(); err != nil {
 		return nil, err
 	}
 
+	methodScopedPaths := make([]string, 0, len(opt.passthroughPathsMethods))
+	for path, methods := range opt.passthroughPathsMethods {
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("no HTTP method for passthrough path %q", path)
+		}
+		methodScopedPaths = append(methodScopedPaths, path)
+	}
+	sort.Strings(methodScopedPaths)
+
 	// Validate paths.
-	for _, path := range opt.passthroughPaths {
+	allPaths := append(slices.Clone(opt.passthroughPaths), methodScopedPaths...)
+	allPaths = append(allPaths, opt.streamingPaths...)
+	for _, path := range allPaths {
 		u, err := url.Parse(fmt.Sprintf("http://example.com%v", path))
 		if err != nil {
-			return nil, fmt.Errorf("path %q is not a valid URI path, got %v", path, opt.passthroughPaths)
+			return nil, fmt.Errorf("path %q is not a valid URI path, got %v", path, allPaths)
 		}
 		if u.Path != path {
-			return nil, fmt.Errorf("path %q is not a valid URI path, got %v", path, opt.passthroughPaths)
+			return nil, fmt.Errorf("path %q is not a valid URI path, got %v", path, allPaths)
 		}
 		if u.Path == "" || u.Path == "/" {
-			return nil, fmt.Errorf("path %q is not allowed, got %v", u.Path, opt.passthroughPaths)
+			return nil, fmt.Errorf("path %q is not allowed, got %v", u.Path, allPaths)
 		}
 	}
 
 	// Register optional passthrough paths.
+	handlePassthrough := mux.Handle
+	if opt.exactPassthroughPaths {
+		handlePassthrough = mux.HandleExact
+	}
 	for _, path := range opt.passthroughPaths {
-		if err := mux.Handle(path, http.HandlerFunc(r.passthrough)); err != nil {
+		if err := handlePassthrough(path, http.HandlerFunc(r.passthrough)); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range methodScopedPaths {
+		if err := handlePassthrough(path, enforceMethods(r.passthrough, opt.passthroughPathsMethods[path]...)); err != nil {
 			return nil, err
 		}
-	}
+	}
+
+	// The topology paths are registered after the passthrough paths so that
+	// their sub-paths (e.g. /api/v1/targets/metadata) can be passthrough
+	// paths too.
+	for _, path := range []string{"/api/v1/targets", "/api/v1/stores"} {
+		switch {
+		case opt.topologyFiltering:
+			if err := mux.Handle(path, r.el.ExtractLabel(enforceMethods(r.passthrough, "GET"))); err != nil {
+				return nil, err
+			}
+		case !isPassthroughPath(path):
+			// The paths were never proxied before: they can still be
+			// forwarded as passthrough paths.
+			if err := mux.Handle(path, http.HandlerFunc(topologyNotImplemented)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(opt.streamingPaths) > 0 {
+		// The streaming responses are forwarded by a dedicated proxy which
+		// flushes immediately and has no response modifier.
+		streamingProxy := httputil.NewSingleHostReverseProxy(upstream)
+		streamingProxy.Transport = proxyTransport
+		if opt.forwardOrgIDHeader != "" {
+			streamingProxy.Director = withOrgIDHeader(opt.forwardOrgIDHeader, streamingProxy.Director)
+		}
+		streamingProxy.FlushInterval = -1
+		streamingProxy.ErrorHandler = r.errorHandler
+		streamingProxy.ErrorLog = slog.NewLogLogger(r.logger.Handler(), slog.LevelError)
+
+		for _, path := range opt.streamingPaths {
+			if err := handlePassthrough(path, streamingProxy); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r.mux = mux
+	r.paths = mux.patterns()
+	for i := len(pathRewriters) - 1; i >= 0; i-- {
+		r.mux = pathRewriters[i].rewritePath(r.mux)
+	}
+	r.mux = decompressRequestBody(r.mux)
+	if r.strictContentLength {
+		r.mux = enforceContentLength(r.mux)
+	}
+	if r.maintenance != nil {
+		r.mux = r.withMaintenanceMode(r.mux)
+	}
+	if opt.htmlErrorPages {
+		r.mux = withHTMLErrorPages(r.mux)
+	}
+	if opt.errorResponseDecorator != nil {
+		r.mux = withErrorResponseDecorator(opt.errorResponseDecorator, r.mux)
+	}
+	if r.serverTimingHeader {
+		r.mux = withServerTiming(r.mux)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			markUpstreamStarted(req.Context())
+		}
+	}
+	if opt.logger != nil {
+		r.mux = withRequestLogging(opt.logger, r.mux)
+	}
+	r.modifiers = map[string]func(*http.Response) error{
+		opt.rulesPath:  r.modifyAPIResponse(r.filterRules),
+		opt.alertsPath: r.modifyAPIResponse(r.filterAlerts),
+		// Alertmanager responses aren't wrapped in the Prometheus API envelope.
+		"/api/v2/alerts/groups": r.filterAlertGroups,
+	}
+	if r.queryResultsVerification != VerifyQueryResultsNone {
+		r.modifiers["/api/v1/query"] = r.modifyQueryResponse
+		r.modifiers["/api/v1/query_range"] = r.modifyQueryResponse
+	}
+	if opt.metadataFiltering {
+		r.metricNamesCache = newTTLCache[map[string]struct{}](metricNamesCacheTTL)
+		r.modifiers["/api/v1/metadata"] = r.modifyAPIResponse(r.filterMetadata)
+	}
+	if opt.receiversFiltering {
+		r.modifiers["/api/v2/receivers"] = r.filterReceivers
+	}
+	if opt.tsdbStatsScoping {
+		r.tsdbStatsCache = newTTLCache[*tsdbSeriesStats](tsdbStatsCacheTTL)
+		r.tsdbStatsMaxSeries = opt.tsdbStatsMaxSeries
+		r.modifiers["/api/v1/status/tsdb"] = r.modifyAPIResponse(r.scopeTSDBStats)
+	}
+	if opt.topologyFiltering {
+		r.modifiers["/api/v1/targets"] = r.modifyAPIResponse(r.filterTargets)
+		r.modifiers["/api/v1/stores"] = r.modifyAPIResponse(r.filterStores)
+	}
+	proxy.ModifyResponse = r.ModifyResponse
+	proxy.ErrorHandler = r.errorHandler
+	proxy.ErrorLog = slog.NewLogLogger(r.logger.Handler(), slog.LevelError)
+
+	*federateProxy = *proxy
+	federateProxy.FlushInterval = -1
+	federateProxy.ModifyResponse = func(resp *http.Response) error {
+		r.inspectResponse(resp)
+		return nil
+	}
+
+	return r, nil
+}
+
+// routeFederation forwards the /federate requests to the federate handler
+// and all the other requests to next.
+func routeFederation(next, federate http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/federate" {
+			federate.ServeHTTP(w, req)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// RegisteredPaths returns the sorted list of the paths handled by the proxy.
+// Each path also handles its sub-paths (e.g. "/api/v2/silence" handles
+// "/api/v2/silence/<id>") except the passthrough paths with
+// WithExactPassthroughPaths().
+func (r *routes) RegisteredPaths() []string {
+	return slices.Clone(r.paths)
+}
+
+func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.drain.start() {
+		prometheusAPIError(w, "the proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer r.drain.done()
+
+	r.mux.ServeHTTP(w, req)
+}
+
+// Handler returns the proxy as an http.Handler which can be wrapped by other
+// middlewares or registered under a sub-path (with http.StripPrefix()).
+func (r *routes) Handler() http.Handler {
+	return r
+}
+
+func (r *routes) ModifyResponse(resp *http.Response) error {
+	r.inspectResponse(resp)
+
+	m, found := r.modifiers[resp.Request.URL.Path]
+	if !found || isDryRun(resp.Request.Context()) {
+		// Return the server's response unmodified.
+		return nil
+	}
+
+	return m(resp)
+}
+
+// inspectResponse records the upstream response in the circuit breaker and
+// sets the headers added by the proxy. It never reads the response body.
+func (r *routes) inspectResponse(resp *http.Response) {
+	if r.breakers != nil {
+		cb := r.breakers.forUpstream(r.upstreamURL(resp.Request.Context()))
+		if isUpstreamFailure(resp) {
+			cb.failure()
+		} else {
+			cb.success()
+		}
+	}
+	if r.serverTimingHeader {
+		setServerTimingHeader(resp)
+	}
+	if r.queryRewriteHeader {
+		setQueryRewriteHeaders(resp)
+	}
+}
+
+func (r *routes) errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, errTSDBStatsTooManySeries) {
+		r.logRequestError(req, "http: proxy error", http.StatusUnprocessableEntity, err)
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if errors.Is(err, errModifyResponseFailed) {
+		r.logRequestError(req, "http: proxy error", http.StatusBadRequest, err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The requests cancelled by the clients or exceeding the request timeout
+	// (e.g. expensive queries) don't denote upstream failures.
+	if r.breakers != nil && req.Context().Err() == nil && !errors.Is(err, context.Canceled) {
+		r.breakers.forUpstream(r.upstreamURL(req.Context())).failure()
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		r.logRequestError(req, "http: proxy error", http.StatusGatewayTimeout, err)
+		rw.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
+	r.logRequestError(req, "http: proxy error", http.StatusBadGateway, err)
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// withRequestTimeout cancels the context of the requests forwarded to the
+// upstream after the given duration. The reverse proxy uses the request's
+// context for the upstream request.
+func withRequestTimeout(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// enforceContentLength verifies that the request body is exactly as long as
+// the declared Content-Length before passing the request to the next handler.
+func enforceContentLength(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength < 0 || req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// Read one extra byte to detect bodies longer than declared.
+		body, err := io.ReadAll(io.LimitReader(req.Body, req.ContentLength+1))
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if int64(len(body)) != req.ContentLength {
+			prometheusAPIError(w, fmt.Sprintf("request body size doesn't match Content-Length (expected %d bytes)", req.ContentLength), http.StatusBadRequest)
+			return
+		}
+
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// maxDecompressedBodySize is the maximum size of a decompressed request body.
+// It matches the limit applied by http.Request.ParseForm().
+const maxDecompressedBodySize = 10 << 20
+
+// decompressRequestBody decompresses the gzip-encoded request bodies before
+// passing the request to the next handler so that the handlers can parse the
+// form data. The request is forwarded upstream without the Content-Encoding
+// header.
+func decompressRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody || !strings.EqualFold(strings.TrimSpace(req.Header.Get("Content-Encoding")), "gzip") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		gr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to decompress request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// Read one extra byte to detect bodies exceeding the limit.
+		body, err := io.ReadAll(io.LimitReader(gr, maxDecompressedBodySize+1))
+		if err != nil {
+			prometheusAPIError(w, fmt.Sprintf("failed to decompress request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if len(body) > maxDecompressedBodySize {
+			prometheusAPIError(w, fmt.Sprintf("decompressed request body is larger than %d bytes", maxDecompressedBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
 
-	r.mux = mux
-	r.modifiers = map[string]func(*http.Response) error{
-		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
-		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
-	}
-	proxy.ModifyResponse = r.ModifyResponse
-	proxy.ErrorHandler = r.errorHandler
-	proxy.ErrorLog = log.Default()
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Encoding")
 
-	return r, nil
+		next.ServeHTTP(w, req)
+	})
 }
 
-func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	r.mux.ServeHTTP(w, req)
-}
+// defaultMaxBodyBytes is the default maximum size of the request bodies
+// accepted by the query and matcher endpoints.
+const defaultMaxBodyBytes = 10 << 20
+
+// limitRequestBody reads the request body up to the configured maximum size
+// before passing the request to the next handler. Larger bodies are rejected
+// with "413 Request Entity Too Large" instead of being buffered by the
+// handlers parsing the body.
+func (r *routes) limitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.maxBodyBytes < 0 || req.Body == nil || req.Body == http.NoBody {
+			next.ServeHTTP(w, req)
+			return
+		}
 
-func (r *routes) ModifyResponse(resp *http.Response) error {
-	m, found := r.modifiers[resp.Request.URL.Path]
-	if !found {
-		// Return the server's response unmodified.
-		return nil
-	}
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, r.maxBodyBytes))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				prometheusAPIError(w, fmt.Sprintf("request body is larger than %d bytes", mbe.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
 
-	return m(resp)
-}
+			prometheusAPIError(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+			return
+		}
 
-func (r *routes) errorHandler(rw http.ResponseWriter, _ *http.Request, err error) {
-	r.logger.Printf("http: proxy error: %v", err)
-	if errors.Is(err, errModifyResponseFailed) {
-		rw.WriteHeader(http.StatusBadRequest)
-	}
+		req.Body = io.NopCloser(bytes.NewReader(body))
 
-	rw.WriteHeader(http.StatusBadGateway)
+		next.ServeHTTP(w, req)
+	})
 }
 
 func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
@@ -495,6 +2887,9 @@ func enforceMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
 	}
 }
 
+// errorIfRegexpMatch rejects the requests for the endpoints which only support
+// equality matchers, e.g. when WithRegexMatch() or a negative match type is
+// configured.
 func (r *routes) errorIfRegexpMatch(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		if r.regexMatch {
@@ -502,13 +2897,29 @@ func (r *routes) errorIfRegexpMatch(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		if isNegativeMatchType(r.matchType) {
+			prometheusAPIError(w, "support for negative match not implemented", http.StatusNotImplemented)
+			return
+		}
+
 		next(w, req)
 	}
 }
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const (
+	keyLabel ctxKey = iota
+	keyNamedLabels
+	keyServerTiming
+	keyPathParameters
+	keyTenant
+	keyRequestLog
+	keyDryRun
+	keyQueryRewrite
+	keyUpstream
+	keyOrgID
+)
 
 // MustLabelValues returns labels (previously stored using WithLabelValue())
 // from the given context.
@@ -536,6 +2947,40 @@ func MustLabelValue(ctx context.Context) string {
 	return v[0]
 }
 
+// MustLabelValuesFor returns the values of the given label (previously
+// extracted by the routes' ExtractLabeler) from the given context.
+// It will panic if no value is found for the label.
+func MustLabelValuesFor(ctx context.Context, name string) []string {
+	named, _ := ctx.Value(keyNamedLabels).(map[string][]string)
+	values, ok := named[name]
+	if !ok {
+		panic(fmt.Sprintf("can't find the values of label %q in the context", name))
+	}
+	if len(values) == 0 {
+		panic(fmt.Sprintf("empty values for label %q in the context", name))
+	}
+
+	sort.Strings(values)
+
+	return values
+}
+
+// withNamedLabelValues stores the values of the given label in the context,
+// preserving the values of the other labels.
+func withNamedLabelValues(ctx context.Context, name string, values []string) context.Context {
+	named, _ := ctx.Value(keyNamedLabels).(map[string][]string)
+	m := make(map[string][]string, len(named)+1)
+	for k, v := range named {
+		m[k] = v
+	}
+	m[name] = values
+
+	return context.WithValue(ctx, keyNamedLabels, m)
+}
+
+// labelValuesToRegexpString returns an alternation of the quoted label values.
+// The result is free of anchors and wildcards so that Prometheus can optimize
+// the regexp matcher into a set of literal values.
 func labelValuesToRegexpString(labelValues []string) string {
 	lvs := make([]string, len(labelValues))
 	for i := range labelValues {
@@ -550,93 +2995,208 @@ func WithLabelValues(ctx context.Context, labels []string) context.Context {
 	return context.WithValue(ctx, keyLabel, labels)
 }
 
+// upstreamHealthCheckTimeout is the timeout of the upstream health check.
+const upstreamHealthCheckTimeout = 5 * time.Second
+
+// livez reports whether the proxy is serving requests. Contrary to healthz, it
+// never checks the upstream so it can be used as a liveness probe.
+func livez(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// healthz (also registered as /readyz) reports whether the proxy is ready to
+// serve requests. When WithUpstreamHealthCheck() is configured, it fails if
+// the upstream isn't healthy so it can be used as a readiness probe.
+func (r *routes) healthz(w http.ResponseWriter, req *http.Request) {
+	if r.upstreamHealthCheckPath != "" {
+		if err := r.checkUpstreamHealth(req.Context()); err != nil {
+			r.logger.Warn("upstream health check failed", "err", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]bool{"ok": false})
+			return
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// checkUpstreamHealth requests the upstream health check path.
+func (r *routes) checkUpstreamHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamHealthCheckTimeout)
+	defer cancel()
+
+	u := *r.upstream
+	u.Path = path.Join(u.Path, r.upstreamHealthCheckPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Transport: r.upstreamTransport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
 func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
-func (r *routes) query(w http.ResponseWriter, req *http.Request) {
-	var matcher *labels.Matcher
+// errUnsupportedMediaType is returned when the request body can't be parsed
+// for enforcing the label.
+var errUnsupportedMediaType = errors.New("unsupported media type")
 
-	if len(MustLabelValues(req.Context())) > 1 {
-		if r.regexMatch {
-			prometheusAPIError(w, "Only one label value allowed with regex match", http.StatusBadRequest)
-			return
-		}
+// checkFormContentType verifies that the body of POST requests (if any) is
+// form-encoded. Other formats (gRPC-Web, ...) can't be parsed for enforcing
+// the label and must not be forwarded to the upstream. The query endpoints
+// additionally accept JSON-encoded bodies.
+func (r *routes) checkFormContentType(req *http.Request) error {
+	if r.behaviorVersion < BehaviorVersion2 {
+		return nil
+	}
 
-		matcher = &labels.Matcher{
-			Name:  r.label,
-			Type:  labels.MatchRegexp,
-			Value: labelValuesToRegexpString(MustLabelValues(req.Context())),
-		}
-	} else {
-		matcherType := labels.MatchEqual
-		matcherValue := MustLabelValue(req.Context())
-		if r.regexMatch {
-			compiledRegex, err := regexp.Compile(matcherValue)
-			if err != nil {
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if compiledRegex.MatchString("") {
-				prometheusAPIError(w, "Regex should not match empty string", http.StatusBadRequest)
-				return
-			}
-			matcherType = labels.MatchRegexp
-		}
+	return requireFormContentType(req)
+}
+
+// requireFormContentType is like checkFormContentType but it applies
+// regardless of the behavior version.
+func requireFormContentType(req *http.Request) error {
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil
+	}
+
+	ct := req.Header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || mt != "application/x-www-form-urlencoded" {
+		return fmt.Errorf("%w %q: only application/x-www-form-urlencoded is supported", errUnsupportedMediaType, ct)
+	}
+
+	return nil
+}
+
+// newPromQLEnforcer returns the default enforcer of the query endpoints.
+func (r *routes) newPromQLEnforcer(errorOnReplace bool, ms ...*labels.Matcher) Enforcer {
+	e := NewPromQLEnforcerWithParser(r.promQLParser, errorOnReplace, ms...)
+	e.stripAbsentLabels = r.stripAbsentLabels
+	e.deniedMetricNames = r.deniedMetricNames
+
+	return e
+}
+
+// queryInstant proxies the requests to the /api/v1/query endpoint.
+func (r *routes) queryInstant(w http.ResponseWriter, req *http.Request) {
+	r.query(w, req)
+}
+
+// queryRange proxies the requests to the /api/v1/query_range endpoint. It
+// enforces the range limits before the query.
+func (r *routes) queryRange(w http.ResponseWriter, req *http.Request) {
+	if err := r.limitQueryRange(req); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.query(w, req)
+}
+
+// query enforces the label matchers in the query parameter(s) of the URL and
+// the body. It is the common core of the query endpoints.
+func (r *routes) query(w http.ResponseWriter, req *http.Request) {
+	if err := r.checkFormContentType(req); err != nil && !isJSONBody(req) {
+		prometheusAPIError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
 
-		matcher = &labels.Matcher{
-			Name:  r.label,
-			Type:  matcherType,
-			Value: matcherValue,
+	matchers, err := r.newLabelMatchers(req.Context())
+	if err != nil {
+		if !r.rejectMatcherRoundTripError(w, err) {
+			r.countLabelMatchersRejection(req, err)
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), http.StatusBadRequest)
 		}
+		return
 	}
 
-	e := NewPromQLEnforcer(r.errorOnReplace, matcher)
+	r.setInjectedLabelHeader(w, matchers)
+
+	e := r.newEnforcer(r.errorOnReplace, matchers...)
+	if r.queryRewriteHeader {
+		qr := &queryRewrite{Enforcer: e}
+		req = req.WithContext(context.WithValue(req.Context(), keyQueryRewrite, qr))
+		e = qr
+	}
 
 	// The `query` can come in the URL query string and/or the POST body.
 	// For this reason, we need to try to enforcing in both places.
 	// Note: a POST request may include some values in the URL query string
 	// and others in the body. If both locations include a `query`, then
 	// enforce in both places.
-	q, found1, err := enforceQueryValues(e, req.URL.Query())
-	if err != nil {
-		switch {
-		case errors.Is(err, ErrIllegalLabelMatcher):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, ErrQueryParse):
-			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-		case errors.Is(err, ErrEnforceLabel):
-			prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
-		}
+	values := req.URL.Query()
+	if err := r.limitLookbackDelta(values); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	q, found1, err := r.enforceQueryValues(e, values)
+	if err != nil {
+		r.rejectQuery(w, req, err)
 		return
 	}
+	if r.preserveParameterOrder {
+		q = encodeInOrder(req.URL.RawQuery, values)
+	}
 	req.URL.RawQuery = q
 
-	var found2 bool
+	var (
+		found2 bool
+		body   string
+	)
 	// Enforce the query in the POST body if needed.
-	if req.Method == http.MethodPost {
+	switch {
+	case isJSONBody(req):
+		body, found2, err = r.enforceJSONBody(e, req)
+		if err != nil {
+			r.rejectQuery(w, req, err)
+			return
+		}
+	case req.Method == http.MethodPost:
+		var raw []byte
+		if r.preserveParameterOrder && req.PostForm == nil {
+			if raw, err = readBody(req); err != nil {
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		if err := req.ParseForm(); err != nil {
 			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.limitLookbackDelta(req.PostForm); err != nil {
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		q, found2, err = enforceQueryValues(e, req.PostForm)
+		q, found2, err = r.enforceQueryValues(e, req.PostForm)
 		if err != nil {
-			switch {
-			case errors.Is(err, ErrIllegalLabelMatcher):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-			case errors.Is(err, ErrQueryParse):
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-			case errors.Is(err, ErrEnforceLabel):
-				prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
-			}
-
+			r.rejectQuery(w, req, err)
 			return
 		}
+		if raw != nil {
+			q = encodeInOrder(string(raw), req.PostForm)
+		}
 
 		// We are replacing request body, close previous one (ParseForm ensures it is read fully and not nil).
 		_ = req.Body.Close()
 		req.Body = io.NopCloser(strings.NewReader(q))
 		req.ContentLength = int64(len(q))
+		body = q
 	}
 
 	// If no query was found, return early.
@@ -644,44 +3204,250 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if r.coalescer != nil {
+		r.coalescer.serve(w, req, coalescingKey(req, body), r.handler)
+		return
+	}
+
 	r.handler.ServeHTTP(w, req)
 }
 
-func enforceQueryValues(e *PromQLEnforcer, v url.Values) (values string, noQuery bool, err error) {
-	// If no values were given or no query is present,
-	// e.g. because the query came in the POST body
-	// but the URL query string was passed, then finish early.
-	if v.Get(queryParam) == "" {
-		return v.Encode(), false, nil
+// rejectQuery replies to the client with the error returned by the
+// enforcement of the query.
+func (r *routes) rejectQuery(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrIllegalLabelMatcher):
+		r.countRejection(req, rejectionIllegalMatcher)
+		prometheusAPIError(w, err.Error(), r.replaceRejectionStatus)
+	case errors.Is(err, ErrQueryParse):
+		r.countRejection(req, rejectionQueryParse)
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrDeniedMetricName):
+		r.countRejection(req, rejectionDeniedMetricName)
+		prometheusAPIError(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrEnforceLabel):
+		prometheusAPIError(w, err.Error(), http.StatusInternalServerError)
+	default:
+		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// enforceQueryValues enforces all the values of the query parameter and its
+// aliases. The upstream only evaluates the first one but forwarding the
+// others unmodified would leak them to any other component reading the
+// parameter.
+func (r *routes) enforceQueryValues(e Enforcer, v url.Values) (values string, noQuery bool, err error) {
+	var found bool
+	for _, name := range r.queryParams {
+		for i, q := range v[name] {
+			// Empty values are forwarded as-is, e.g. because the query came in
+			// the POST body but the URL query string was passed.
+			if q == "" {
+				continue
+			}
+
+			if v[name][i], err = e.Enforce(q); err != nil {
+				return "", true, err
+			}
+			found = true
+		}
+	}
+
+	return v.Encode(), found, nil
+}
+
+// setInjectedLabelHeader sets the response header reporting the injected
+// label matchers if configured.
+func (r *routes) setInjectedLabelHeader(w http.ResponseWriter, matchers []*labels.Matcher) {
+	if r.injectedLabelHeader == "" {
+		return
+	}
+
+	ms := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		ms = append(ms, m.String())
+	}
+	w.Header().Set(r.injectedLabelHeader, strings.Join(ms, ","))
+}
+
+// newLabelMatchers returns the matchers for all the enforced labels.
+func (r *routes) newLabelMatchers(ctx context.Context) ([]*labels.Matcher, error) {
+	ms := make([]*labels.Matcher, 0, len(r.labelNames))
+	for _, name := range r.labelNames {
+		m, err := r.newLabelMatcher(name, MustLabelValuesFor(ctx, name)...)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.matcherRoundTrip {
+			if err := r.verifyMatcherRoundTrip(m); err != nil {
+				return nil, err
+			}
+		}
+
+		ms = append(ms, m)
+	}
+
+	return ms, nil
+}
+
+// errMatcherRoundTrip is returned when the string representation of an
+// injected label matcher doesn't parse back into the same matcher.
+var errMatcherRoundTrip = errors.New("label matcher round-trip failed")
+
+// verifyMatcherRoundTrip returns an error if the string representation of the
+// matcher doesn't parse back into exactly the same matcher.
+func (r *routes) verifyMatcherRoundTrip(m *labels.Matcher) error {
+	ms, err := r.promQLParser.ParseMetricSelector("{" + m.String() + "}")
+	if err != nil {
+		return fmt.Errorf("%w for %s: %v", errMatcherRoundTrip, m, err)
+	}
+
+	if len(ms) != 1 || ms[0].Name != m.Name || ms[0].Type != m.Type || ms[0].Value != m.Value {
+		return fmt.Errorf("%w for %s: got %v", errMatcherRoundTrip, m, ms)
+	}
+
+	return nil
+}
+
+// rejectMatcherRoundTripError logs the error and writes a "500 Internal Server
+// Error" response if the label matcher round-trip failed. It returns false
+// otherwise.
+func (r *routes) rejectMatcherRoundTripError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errMatcherRoundTrip) {
+		return false
+	}
+
+	r.logger.Error("rejecting request", "err", err)
+	prometheusAPIError(w, "internal server error", http.StatusInternalServerError)
+
+	return true
+}
+
+// newLabelMatcher returns the matcher for the given label and values
+// according to the configured match type.
+func (r *routes) newLabelMatcher(name string, vals ...string) (*labels.Matcher, error) {
+	m, err := r.newPositiveLabelMatcher(name, vals...)
+	if err != nil {
+		return nil, err
+	}
+
+	t := m.Type
+	if (r.matchType == labels.MatchRegexp || r.matchType == labels.MatchNotRegexp) && t == labels.MatchEqual {
+		t = labels.MatchRegexp
+		m.Value = regexp.QuoteMeta(m.Value)
+	}
+
+	if r.orAbsent {
+		// The empty alternative matches the series without the label.
+		if t == labels.MatchEqual {
+			m.Value = regexp.QuoteMeta(m.Value) + "|"
+		} else {
+			m.Value = "(?:" + m.Value + ")|"
+		}
+		t = labels.MatchRegexp
+	}
+
+	if isNegativeMatchType(r.matchType) {
+		switch t {
+		case labels.MatchEqual:
+			t = labels.MatchNotEqual
+		case labels.MatchRegexp:
+			t = labels.MatchNotRegexp
+		}
+	}
+
+	if t == m.Type && !r.orAbsent {
+		return m, nil
 	}
 
-	q, err := e.Enforce(v.Get(queryParam))
+	return labels.NewMatcher(t, m.Name, m.Value)
+}
+
+// isNegativeMatchType returns true for the negative match types.
+func isNegativeMatchType(t labels.MatchType) bool {
+	return t == labels.MatchNotEqual || t == labels.MatchNotRegexp
+}
+
+// errRegexMatchesEmpty is returned when the regexp label value matches the
+// empty string (and thus the series without the label).
+var errRegexMatchesEmpty = errors.New("regex should not match empty string")
+
+// startsWithWildcard returns true unless each top-level alternative of the
+// regexp starts with a non-empty literal prefix (e.g. "team-.+|other"). The
+// regexps which can match a value with any prefix such as ".*foo", "[^-]*foo"
+// or "(bar|.+foo)" are thus reported.
+func startsWithWildcard(re string) bool {
+	parsed, err := syntax.Parse(re, syntax.Perl)
 	if err != nil {
-		return "", true, err
+		// The error is reported when the regexp is compiled.
+		return false
 	}
 
-	v.Set(queryParam, q)
+	// The alternatives matching only the empty string (e.g. "team|") are
+	// always accepted: the empty matches are checked separately.
+	var (
+		alternatives []*syntax.Regexp
+		queue        = []*syntax.Regexp{parsed.Simplify()}
+	)
+	for len(queue) > 0 {
+		re := queue[0]
+		queue = queue[1:]
+
+		switch re.Op {
+		case syntax.OpCapture, syntax.OpQuest:
+			// "x?" is equivalent to "x|".
+			queue = append(queue, re.Sub[0])
+		case syntax.OpAlternate:
+			queue = append(queue, re.Sub...)
+		case syntax.OpEmptyMatch:
+		default:
+			alternatives = append(alternatives, re)
+		}
+	}
+
+	for _, alt := range alternatives {
+		compiled, err := regexp.Compile(alt.String())
+		if err != nil {
+			return true
+		}
+
+		if prefix, _ := compiled.LiteralPrefix(); prefix == "" {
+			return true
+		}
+	}
 
-	return v.Encode(), true, nil
+	return false
 }
 
-func (r *routes) newLabelMatcher(vals ...string) (*labels.Matcher, error) {
+// errRegexUnanchoredWildcard is returned when the regexp label value starts
+// with a wildcard and regex anchoring is enabled.
+var errRegexUnanchoredWildcard = errors.New("regex should not start with a wildcard")
+
+func (r *routes) newPositiveLabelMatcher(name string, vals ...string) (*labels.Matcher, error) {
 	if r.regexMatch {
 		if len(vals) != 1 {
 			return nil, errors.New("only one label value allowed with regex match")
 		}
 
 		re := vals[0]
+		if r.regexAnchoring {
+			if startsWithWildcard(re) {
+				return nil, errRegexUnanchoredWildcard
+			}
+			re = "^(?:" + re + ")$"
+		}
+
 		compiledRegex, err := regexp.Compile(re)
 		if err != nil {
 			return nil, fmt.Errorf("invalid regex: %w", err)
 		}
 
-		if compiledRegex.MatchString("") {
-			return nil, errors.New("regex should not match empty string")
+		if !r.allowEmptyMatchingRegex && compiledRegex.MatchString("") {
+			return nil, errRegexMatchesEmpty
 		}
 
-		m, err := labels.NewMatcher(labels.MatchRegexp, r.label, re)
+		m, err := labels.NewMatcher(labels.MatchRegexp, name, re)
 		if err != nil {
 			return nil, err
 		}
@@ -691,13 +3457,13 @@ func (r *routes) newLabelMatcher(vals ...string) (*labels.Matcher, error) {
 
 	if len(vals) == 1 {
 		return &labels.Matcher{
-			Name:  r.label,
+			Name:  name,
 			Type:  labels.MatchEqual,
 			Value: vals[0],
 		}, nil
 	}
 
-	m, err := labels.NewMatcher(labels.MatchRegexp, r.label, labelValuesToRegexpString(vals))
+	m, err := labels.NewMatcher(labels.MatchRegexp, name, labelValuesToRegexpString(vals))
 	if err != nil {
 		return nil, err
 	}
@@ -712,26 +3478,41 @@ func (r *routes) newLabelMatcher(vals ...string) (*labels.Matcher, error) {
 // multiple matchers.
 // See e.g https://prometheus.io/docs/prometheus/latest/querying/api/#querying-metadata
 func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
-	matcher, err := r.newLabelMatcher(MustLabelValues(req.Context())...)
+	// Prometheus only accepts form-encoded bodies for the series and labels
+	// APIs. The matchers of other formats can't be enforced so the request is
+	// always rejected, whatever the behavior version.
+	if err := requireFormContentType(req); err != nil {
+		prometheusAPIError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	matchers, err := r.newLabelMatchers(req.Context())
 	if err != nil {
-		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		if !r.rejectMatcherRoundTripError(w, err) {
+			r.countLabelMatchersRejection(req, err)
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
 
+	r.setInjectedLabelHeader(w, matchers)
+
 	q := req.URL.Query()
-	if err := injectMatcher(q, matcher); err != nil {
-		prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+	if err := r.injectMatcher(q, matchers...); err != nil {
+		r.rejectMatchers(w, req, err)
 		return
 	}
 
 	req.URL.RawQuery = q.Encode()
 	if req.Method == http.MethodPost {
 		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, fmt.Sprintf("Failed to parse the PostForm: %v", err), http.StatusBadRequest)
 			return
 		}
 
 		q = req.PostForm
-		if err := injectMatcher(q, matcher); err != nil {
+		if err := r.injectMatcher(q, matchers...); err != nil {
+			r.rejectMatchers(w, req, err)
 			return
 		}
 
@@ -745,27 +3526,67 @@ func (r *routes) matcher(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
-func injectMatcher(q url.Values, matcher *labels.Matcher) error {
+// injectMatcher injects the enforced matchers into all the match[] values of
+// q. If none was provided, the enforced matchers are added as a standalone
+// selector.
+func (r *routes) injectMatcher(q url.Values, enforced ...*labels.Matcher) error {
 	matchers := q[matchersParam]
 	if len(matchers) == 0 {
-		q.Set(matchersParam, matchersToString(matcher))
+		// The standalone selector has no metric name.
+		if err := checkMetricName(r.deniedMetricNames, enforced); err != nil {
+			return err
+		}
+
+		q.Set(matchersParam, matchersToString(enforced...))
 		return nil
 	}
 
 	// Inject label into existing matchers.
 	for i, m := range matchers {
-		ms, err := parser.ParseMetricSelector(m)
+		ms, err := r.promQLParser.ParseMetricSelector(m)
 		if err != nil {
+			if !r.lenientMatchSelectors {
+				return err
+			}
+
+			// The value isn't a bare selector: enforce the label in all
+			// the selectors of the expression instead.
+			e, perr := r.newPromQLEnforcer(false, enforced...).Enforce(m)
+			if errors.Is(perr, ErrDeniedMetricName) {
+				return perr
+			}
+			if perr != nil {
+				return err
+			}
+
+			matchers[i] = e
+			continue
+		}
+
+		if err := checkMetricName(r.deniedMetricNames, ms); err != nil {
 			return err
 		}
 
-		matchers[i] = matchersToString(append(ms, matcher)...)
+		matchers[i] = matchersToString(append(ms, enforced...)...)
 	}
 	q[matchersParam] = matchers
 
 	return nil
 }
 
+// rejectMatchers replies to the client with the error returned by
+// injectMatcher.
+func (r *routes) rejectMatchers(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, ErrDeniedMetricName) {
+		r.countRejection(req, rejectionDeniedMetricName)
+		prometheusAPIError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	r.countRejection(req, rejectionQueryParse)
+	prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+}
+
 func matchersToString(ms ...*labels.Matcher) string {
 	var el []string
 	for _, m := range ms {
@@ -784,33 +3605,65 @@ func humanFriendlyErrorMessage(err error) string {
 	return fmt.Sprintf("%s%s.", strings.ToUpper(errMsg[:1]), errMsg[1:])
 }
 
-func splitValues(slice []string, sep string) []string {
-	for i := 0; i < len(slice); {
-		splitResult := strings.Split(slice[i], sep)
-
-		slice = append(slice[:i], append(splitResult, slice[i+1:]...)...)
+// splitValues splits the values at each occurrence of sep outside of
+// double quotes. The unquoted whitespace around the values is trimmed, the
+// quotes are removed and the backslash escapes inside quotes are resolved.
+// The input slice isn't modified.
+func splitValues(slice []string, sep string) ([]string, error) {
+	var values []string
+	for _, s := range slice {
+		var (
+			b      strings.Builder
+			quoted bool
+			// end is the length of b without the trailing unquoted whitespace.
+			end int
+		)
+		for i := 0; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case quoted && c == '\\':
+				i++
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated escape sequence in %q", s)
+				}
+				b.WriteByte(s[i])
+				end = b.Len()
+			case c == '"':
+				quoted = !quoted
+				end = b.Len()
+			case !quoted && strings.HasPrefix(s[i:], sep):
+				values = append(values, b.String()[:end])
+				b.Reset()
+				end = 0
+				i += len(sep) - 1
+			case !quoted && (c == ' ' || c == '\t'):
+				if b.Len() > 0 {
+					b.WriteByte(c)
+				}
+			default:
+				b.WriteByte(c)
+				end = b.Len()
+			}
+		}
 
-		i += len(splitResult)
+		if quoted {
+			return nil, fmt.Errorf("unterminated quoted value in %q", s)
+		}
+		values = append(values, b.String()[:end])
 	}
 
-	return slice
+	return values, nil
 }
 
+// removeEmptyValues returns the non-empty values. The input slice (e.g. the
+// values of a request header) isn't modified.
 func removeEmptyValues(slice []string) []string {
-	for i := 0; i < len(slice); i++ {
-		if slice[i] == "" {
-			slice = append(slice[:i], slice[i+1:]...)
-			i--
+	values := make([]string, 0, len(slice))
+	for _, v := range slice {
+		if v != "" {
+			values = append(values, v)
 		}
 	}
 
-	return slice
-}
-
-func trimValues(slice []string) []string {
-	for i := 0; i < len(slice); i++ {
-		slice[i] = strings.TrimSpace(slice[i])
-	}
-
-	return slice
+	return values
 }
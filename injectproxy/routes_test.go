@@ -14,15 +14,31 @@
 package injectproxy
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var okResponse = []byte(`ok`)
@@ -212,6 +228,16 @@ func TestWithPassthroughPaths(t *testing.T) {
 		if err == nil {
 			t.Fatal("expected error")
 		}
+		// // resolves to the root path.
+		_, err = NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughPaths([]string{"/api1", "//"}))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		// /federate// is the same as /federate.
+		_, err = NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughPaths([]string{"/api1", "/federate//"}))
+		if err == nil {
+			t.Fatal("expected error")
+		}
 	})
 	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughPaths([]string{"/api1", "/api2/something", "/graph/"}))
 	if err != nil {
@@ -261,1140 +287,5781 @@ func TestWithPassthroughPaths(t *testing.T) {
 	}
 }
 
-func TestMatch(t *testing.T) {
+func TestThanosQueries(t *testing.T) {
 	for _, tc := range []struct {
-		labelv  []string
-		matches []string
-		opts    []Option
+		name  string
+		query string
 
-		expCode  int
-		expMatch []string
-		expBody  []byte
+		expPromQuery string
 	}{
 		{
-			// No "namespace" parameter returns an error.
-			expCode: http.StatusBadRequest,
-		},
-		{
-			// No "match" parameter.
-			labelv:   []string{"default"},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{namespace="default"}`},
-			expBody:  okResponse,
-		},
-		{
-			// Single "match" parameters.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
-			expBody:  okResponse,
-		},
-		{
-			// Single "match" parameters with multiple label values.
-			labelv:   []string{"default", "something"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|something"}`},
-			expBody:  okResponse,
-		},
-		{
-			// Check that label values are correctly escaped.
-			labelv:   []string{"default", "some|thing"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|some\\|thing"}`},
-			expBody:  okResponse,
-		},
-		{
-			// Single "match" parameters with label dup name.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default",namespace="default"}`},
-			expBody:  okResponse,
-		},
-		{
-			// Many "match" parameters.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus"}`, `{__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",namespace="default"}`, `{__name__=~"job:.*",namespace="default"}`},
-			expBody:  okResponse,
+			name:         "@ modifier",
+			query:        `rate(http_requests[5m] @ end())`,
+			expPromQuery: `rate(http_requests{namespace="ns1"}[5m] @ end())`,
 		},
 		{
-			// Many "match" parameters with multiple label values.
-			labelv: []string{"default", "something"},
-			matches: []string{
-				`{job="prometheus"}`,
-				`{__name__=~"job:.*"}`,
-				`{namespace="something"}`,
-			},
-			expCode: http.StatusOK,
-			expMatch: []string{
-				`{job="prometheus",namespace=~"default|something"}`,
-				`{__name__=~"job:.*",namespace=~"default|something"}`,
-				`{namespace="something",namespace=~"default|something"}`,
-			},
-			expBody: okResponse,
+			name:         "subquery with @ modifier and offset",
+			query:        `max_over_time(rate(http_requests[1m])[1h:5m] @ start() offset 1h)`,
+			expPromQuery: `max_over_time(rate(http_requests{namespace="ns1"}[1m])[1h:5m] @ start() offset 1h)`,
 		},
-		{
-			// Many "match" parameters with a single regex value.
-			labelv: []string{".+-monitoring"},
-			matches: []string{
-				`{job="prometheus"}`,
-				`{__name__=~"job:.*"}`,
-				`{namespace="something"}`,
-			},
-			opts: []Option{WithRegexMatch()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next := checkQueryHandler("", queryParam, tc.expPromQuery)
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// The Thanos parameters are forwarded untouched.
+				q := req.URL.Query()
+				if q.Get("dedup") != "false" || q.Get("partial_response") != "true" {
+					prometheusAPIError(w, fmt.Sprintf("unexpected Thanos parameters: %v", q), http.StatusInternalServerError)
+					return
+				}
+				next.ServeHTTP(w, req)
+			}))
+			defer m.Close()
 
-			expCode: http.StatusOK,
-			expMatch: []string{
-				`{job="prometheus",namespace=~".+-monitoring"}`,
-				`{__name__=~"job:.*",namespace=~".+-monitoring"}`,
-				`{namespace="something",namespace=~".+-monitoring"}`,
-			},
-			expBody: okResponse,
-		},
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {tc.query}, proxyLabel: {"ns1"}, "dedup": {"false"}, "partial_response": {"true"}}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithExactPassthroughPaths(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write([]byte(req.URL.Path)) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCodes map[string]int
+	}{
 		{
-			// A single "match" parameter with multiple regex values.
-			labelv: []string{"default", "something"},
-			matches: []string{
-				`{job="prometheus"}`,
+			name: "sub-paths forwarded by default",
+			expCodes: map[string]int{
+				"/api1":     http.StatusOK,
+				"/api1/":    http.StatusOK,
+				"/api1/foo": http.StatusOK,
+				"/api2":     http.StatusOK,
+				"/api2/foo": http.StatusOK,
+				"/api3/":    http.StatusOK,
+				"/api1foo":  http.StatusNotFound,
 			},
-			opts:    []Option{WithRegexMatch()},
-			expCode: http.StatusBadRequest,
 		},
 		{
-			// A single "match" parameter with a regex value matching the empty string.
-			labelv: []string{".*"},
-			matches: []string{
-				`{job="prometheus"}`,
+			name: "exact paths",
+			opts: []Option{WithExactPassthroughPaths()},
+			expCodes: map[string]int{
+				"/api1":     http.StatusOK,
+				"/api1/":    http.StatusNotFound,
+				"/api1/foo": http.StatusNotFound,
+				"/api2":     http.StatusOK,
+				"/api2/foo": http.StatusNotFound,
+				"/api3":     http.StatusOK,
+				"/api3/":    http.StatusNotFound,
 			},
-			opts:    []Option{WithRegexMatch()},
-			expCode: http.StatusBadRequest,
 		},
 	} {
-		for _, u := range []string{
-			"http://prometheus.example.com/federate",
-			"http://prometheus.example.com/api/v1/labels",
-			"http://prometheus.example.com/api/v1/label/some_label/values",
-		} {
-			t.Run(fmt.Sprintf("%s?match[]=%s", u, strings.Join(tc.matches, "&")), func(t *testing.T) {
-				m := newMockUpstream(
-					checkParameterAbsent(
-						proxyLabel,
-						checkQueryHandler("", matchersParam, tc.expMatch...),
-					),
-				)
-				defer m.Close()
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts,
+				WithPassthroughPaths([]string{"/api1"}),
+				WithPassthroughPathsMethods(map[string][]string{"/api2": {http.MethodGet}}),
+				WithStreamingPassthroughPaths([]string{"/api3"}),
+			)...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-				r, err := NewRoutes(
-					m.url,
-					proxyLabel,
-					HTTPFormEnforcer{ParameterName: proxyLabel},
-					append([]Option{WithEnabledLabelsAPI()}, tc.opts...)...,
-				)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
+			for path, expCode := range tc.expCodes {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+path, nil))
+				if w.Code != expCode {
+					t.Fatalf("%s: expected status code %d, got %d", path, expCode, w.Code)
 				}
+			}
+		})
+	}
+}
 
-				u, err := url.Parse(u)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				q := u.Query()
-				for _, m := range tc.matches {
-					q.Add(matchersParam, m)
-				}
-				for _, lv := range tc.labelv {
-					q.Add(proxyLabel, lv)
-				}
-				u.RawQuery = q.Encode()
+func TestWithStreamingPassthroughPaths(t *testing.T) {
+	release := make(chan struct{})
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("event 1\n"))
+		w.(http.Flusher).Flush()
 
-				w := httptest.NewRecorder()
-				req := httptest.NewRequest("GET", u.String(), nil)
-				r.ServeHTTP(w, req)
+		<-release
+		w.Write([]byte("event 2\n"))
+	}))
+	defer m.Close()
 
-				resp := w.Result()
-				body, _ := io.ReadAll(resp.Body)
-				defer resp.Body.Close()
+	for _, paths := range [][]string{{"/"}, {"/api/v1/query"}, {"/api/v1/live?x"}} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStreamingPassthroughPaths(paths)); err == nil {
+			t.Fatalf("expected error for %v", paths)
+		}
+	}
 
-				if resp.StatusCode != tc.expCode {
-					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
-					t.Logf("%s", string(body))
-					t.FailNow()
-				}
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithStreamingPassthroughPaths([]string{"/api/v1/live"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
 
-				if string(body) != string(tc.expBody) {
-					t.Fatalf("expected body %q, got %q", string(tc.expBody), string(body))
-				}
-			})
-		}
+	resp, err := http.Get(srv.URL + "/api/v1/live")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", resp.StatusCode)
+	}
+
+	// The first event is received before the upstream completes the response.
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if line != "event 1\n" {
+		t.Fatalf("expected %q, got %q", "event 1\n", line)
+	}
+
+	close(release)
+	rest, _ := io.ReadAll(br)
+	if string(rest) != "event 2\n" {
+		t.Fatalf("expected %q, got %q", "event 2\n", string(rest))
 	}
 }
 
-func TestMatchWithPost(t *testing.T) {
-	for _, tc := range []struct {
-		labelv  []string
-		matches []string
+func TestWithPassthroughPathsMethods(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
 
-		expCode  int
-		expMatch []string
-		expBody  []byte
+	for _, tc := range []struct {
+		name  string
+		paths map[string][]string
+		opts  []Option
 	}{
 		{
-			// No "namespace" parameter returns an error.
-			expCode: http.StatusBadRequest,
+			name:  "no method",
+			paths: map[string][]string{"/api1": nil},
 		},
 		{
-			// No "match" parameter.
-			labelv:   []string{"default"},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{namespace="default"}`},
-			expBody:  okResponse,
+			name:  "root path",
+			paths: map[string][]string{"/": {http.MethodGet}},
 		},
 		{
-			// Single "match" parameters.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
-			expBody:  okResponse,
+			name:  "enforced path",
+			paths: map[string][]string{"/federate": {http.MethodGet}},
 		},
 		{
-			// Single "match" parameters with multiple label values.
-			labelv:   []string{"default", "something"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|something"}`},
-			expBody:  okResponse,
+			name:  "duplicated with WithPassthroughPaths",
+			paths: map[string][]string{"/api1": {http.MethodGet}},
+			opts:  []Option{WithPassthroughPaths([]string{"/api1"})},
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithPassthroughPathsMethods(tc.paths))...)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	r, err := NewRoutes(
+		m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithPassthroughPaths([]string{"/api1"}),
+		WithPassthroughPathsMethods(map[string][]string{
+			"/api/v1/targets": {http.MethodGet, http.MethodHead},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tcase := range []struct {
+		method  string
+		url     string
+		expCode int
+	}{
+		{method: http.MethodGet, url: "http://prometheus.example.com/api/v1/targets", expCode: http.StatusOK},
+		{method: http.MethodHead, url: "http://prometheus.example.com/api/v1/targets", expCode: http.StatusOK},
+		{method: http.MethodPost, url: "http://prometheus.example.com/api/v1/targets", expCode: http.StatusNotFound},
+		{method: http.MethodDelete, url: "http://prometheus.example.com/api/v1/targets", expCode: http.StatusNotFound},
+		{method: http.MethodPost, url: "http://prometheus.example.com/api1", expCode: http.StatusOK},
+	} {
+		t.Run(tcase.method+" "+tcase.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tcase.method, tcase.url, nil))
+			if resp := w.Result(); resp.StatusCode != tcase.expCode {
+				t.Fatalf("expected status code %d, got %d", tcase.expCode, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestExtractLabelerValidation(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+
+	for _, tc := range []struct {
+		name string
+		el   ExtractLabeler
+
+		expErr bool
+	}{
 		{
-			// Check that label values are correctly escaped.
-			labelv:   []string{"default", "some|thing"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|some\\|thing"}`},
-			expBody:  okResponse,
+			name:   "empty static enforcer",
+			el:     StaticLabelEnforcer{},
+			expErr: true,
 		},
 		{
-			// Single "match" parameters with label dup name.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default",namespace="default"}`},
-			expBody:  okResponse,
+			name:   "nil static enforcer",
+			el:     StaticLabelEnforcer(nil),
+			expErr: true,
 		},
 		{
-			// Many "match" parameters.
-			labelv:   []string{"default"},
-			matches:  []string{`{job="prometheus"}`, `{__name__=~"job:.*"}`},
-			expCode:  http.StatusOK,
-			expMatch: []string{`{job="prometheus",namespace="default"}`, `{__name__=~"job:.*",namespace="default"}`},
-			expBody:  okResponse,
+			name:   "static enforcer with only empty values",
+			el:     StaticLabelEnforcer{"", ""},
+			expErr: true,
 		},
 		{
-			// Many "match" parameters with multiple label values.
-			labelv: []string{"default", "something"},
-			matches: []string{
-				`{job="prometheus"}`,
-				`{__name__=~"job:.*"}`,
-				`{namespace="something"}`,
-			},
-			expCode: http.StatusOK,
-			expMatch: []string{
-				`{job="prometheus",namespace=~"default|something"}`,
-				`{__name__=~"job:.*",namespace=~"default|something"}`,
-				`{namespace="something",namespace=~"default|something"}`,
-			},
-			expBody: okResponse,
+			name:   "static enforcer with one empty value",
+			el:     StaticLabelEnforcer{"default", ""},
+			expErr: true,
 		},
-	} {
-		for _, u := range []string{
-			"http://prometheus.example.com/api/v1/labels",
-		} {
-			t.Run(fmt.Sprintf("%s?match[]=%s", u, strings.Join(tc.matches, "&")), func(t *testing.T) {
-				m := newMockUpstream(
-					checkFormParameterAbsent(
-						proxyLabel,
-						checkFormHandler(matchersParam, tc.expMatch...),
-					),
-				)
-				defer m.Close()
-				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithEnabledLabelsAPI())
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-
-				u, err := url.Parse(u)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				q := url.Values{}
-				for _, m := range tc.matches {
-					q.Add(matchersParam, m)
-				}
-				for _, lv := range tc.labelv {
-					q.Add(proxyLabel, lv)
-				}
-
-				w := httptest.NewRecorder()
-				req := httptest.NewRequest(http.MethodPost, u.String(), strings.NewReader(q.Encode()))
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-				r.ServeHTTP(w, req)
-
-				resp := w.Result()
-				body, _ := io.ReadAll(resp.Body)
-				defer resp.Body.Close()
-
-				if resp.StatusCode != tc.expCode {
-					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
-					t.Logf("%s", string(body))
-					t.FailNow()
-				}
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
-
-				if string(body) != string(tc.expBody) {
-					t.Fatalf("expected body %q, got %q", string(tc.expBody), string(body))
-				}
-			})
-		}
-	}
-}
-
-func TestSeries(t *testing.T) {
-	for _, tc := range []struct {
-		name        string
-		labelv      []string
-		promQuery   string
-		expResponse []byte
-		expCode     int
-		expMatch    []string
-		expBody     []byte
-	}{
 		{
-			name:    `No "namespace" parameter returns an error`,
-			expCode: http.StatusBadRequest,
+			name: "valid static enforcer",
+			el:   StaticLabelEnforcer{"default", "other"},
 		},
 		{
-			name:    `No "namespace" parameter returns an error for POSTs`,
-			expCode: http.StatusBadRequest,
+			name:   "form enforcer without parameter name",
+			el:     HTTPFormEnforcer{},
+			expErr: true,
 		},
 		{
-			name:        `No "match[]" parameter returns 200 with empty body`,
-			labelv:      []string{"default"},
-			expMatch:    []string{`{namespace="default"}`},
-			expResponse: okResponse,
-			expCode:     http.StatusOK,
+			name:   "form enforcer with empty alias",
+			el:     HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{""}},
+			expErr: true,
 		},
 		{
-			name:        `No "match[]" parameter returns 200 with empty body for POSTs`,
-			labelv:      []string{"default"},
-			expMatch:    []string{`{namespace="default"}`},
-			expResponse: okResponse,
-			expCode:     http.StatusOK,
+			name:   "form enforcer with alias equal to the parameter name",
+			el:     HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{"tenant"}},
+			expErr: true,
 		},
 		{
-			name:        `Series`,
-			labelv:      []string{"default"},
-			promQuery:   "up",
-			expCode:     http.StatusOK,
-			expMatch:    []string{`{__name__="up",namespace="default"}`},
-			expResponse: okResponse,
+			name:   "form enforcer with duplicate aliases",
+			el:     HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{"namespace", "namespace"}},
+			expErr: true,
 		},
 		{
-			name:        `Series with multiple label values`,
-			labelv:      []string{"default", "something"},
-			promQuery:   "up",
-			expCode:     http.StatusOK,
-			expMatch:    []string{`{__name__="up",namespace=~"default|something"}`},
-			expResponse: okResponse,
+			name: "valid form enforcer with aliases",
+			el:   HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{"namespace"}},
 		},
 		{
-			name:        `Series: check that label values are correctly escaped`,
-			labelv:      []string{"default", "some|thing"},
-			promQuery:   "up",
-			expCode:     http.StatusOK,
-			expMatch:    []string{`{__name__="up",namespace=~"default|some\\|thing"}`},
-			expResponse: okResponse,
+			name:   "header enforcer without header name",
+			el:     HTTPHeaderEnforcer{},
+			expErr: true,
 		},
 		{
-			name:        `Series with multiple labels`,
-			labelv:      []string{"default"},
-			promQuery:   `up{instance="localhost:9090"}`,
-			expCode:     http.StatusOK,
-			expMatch:    []string{`{instance="localhost:9090",__name__="up",namespace="default"}`},
-			expResponse: okResponse,
+			name:   "path enforcer without regexp",
+			el:     PathParameterEnforcer{Name: "tenant"},
+			expErr: true,
 		},
 		{
-			name:        `Series with multiple label values and existing matcher`,
-			labelv:      []string{"default", "something"},
-			promQuery:   `up{instance="localhost:9090",namespace="something"}`,
-			expCode:     http.StatusOK,
-			expMatch:    []string{`{instance="localhost:9090",namespace="something",__name__="up",namespace=~"default|something"}`},
-			expResponse: okResponse,
+			name:   "path enforcer without capture group name",
+			el:     PathParameterEnforcer{Regexp: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)`)},
+			expErr: true,
+		},
+		{
+			name:   "path enforcer with unknown capture group",
+			el:     PathParameterEnforcer{Regexp: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)`), Name: "namespace"},
+			expErr: true,
+		},
+		{
+			name: "valid path enforcer",
+			el:   PathParameterEnforcer{Regexp: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)`), Name: "tenant"},
 		},
 	} {
-		for _, endpoint := range []string{"series"} {
-			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
-				m := newMockUpstream(
-					checkParameterAbsent(
-						proxyLabel,
-						checkQueryHandler("", matchersParam, tc.expMatch...),
-					),
-				)
-				defer m.Close()
-
-				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRoutes(u, proxyLabel, tc.el)
+			if tc.expErr && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.expErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
 
-				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				q := u.Query()
-				if tc.promQuery != "" {
-					q.Add(matchersParam, tc.promQuery)
-				}
-				for _, lv := range tc.labelv {
-					q.Add(proxyLabel, lv)
-				}
-				u.RawQuery = q.Encode()
+func TestMetadataPassthrough(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Has(proxyLabel) {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		w.Write(okResponse)
+	}))
+	defer m.Close()
 
-				w := httptest.NewRecorder()
-				req := httptest.NewRequest("GET", u.String(), nil)
-				r.ServeHTTP(w, req)
+	for _, tc := range []struct {
+		name   string
+		url    string
+		method string
+		opts   []Option
 
-				resp := w.Result()
+		expCode int
+	}{
+		{
+			name:    "without the option",
+			url:     "http://prometheus.example.com/api/v1/metadata?namespace=ns1",
+			method:  http.MethodGet,
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "GET request",
+			url:     "http://prometheus.example.com/api/v1/metadata?metric=up&namespace=ns1",
+			method:  http.MethodGet,
+			opts:    []Option{WithMetadataPassthrough()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "POST request",
+			url:     "http://prometheus.example.com/api/v1/metadata?namespace=ns1",
+			method:  http.MethodPost,
+			opts:    []Option{WithMetadataPassthrough()},
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "missing label value",
+			url:     "http://prometheus.example.com/api/v1/metadata",
+			method:  http.MethodGet,
+			opts:    []Option{WithMetadataPassthrough()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-				body, err := io.ReadAll(resp.Body)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
 
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				defer resp.Body.Close()
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+		})
+	}
 
-				if resp.StatusCode != tc.expCode {
-					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
-					t.Logf("%s", string(body))
-					t.FailNow()
-				}
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
-				if string(body) != string(tc.expResponse) {
-					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
-				}
-			})
+	t.Run("conflicting passthrough path", func(t *testing.T) {
+		_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMetadataPassthrough(), WithPassthroughPaths([]string{"/api/v1/metadata"}))
+		if err == nil {
+			t.Fatal("expected error")
 		}
-	}
+	})
 }
 
-func TestSeriesWithPost(t *testing.T) {
+func TestHealthz(t *testing.T) {
 	for _, tc := range []struct {
-		name          string
-		labelv        []string
-		promQueryBody string
-		expResponse   []byte
-		method        string
-		expCode       int
-		expMatch      []string
-		expBody       []byte
+		name     string
+		opts     []Option
+		upstream http.HandlerFunc
+
+		expCode int
+		expBody string
 	}{
 		{
-			name:    `No "namespace" parameter returns an error`,
-			expCode: http.StatusBadRequest,
+			name:     "without upstream health check",
+			upstream: func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			expCode:  http.StatusOK,
+			expBody:  `{"ok":true}`,
 		},
 		{
-			name:    `No "namespace" parameter returns an error for POSTs`,
-			expCode: http.StatusBadRequest,
-			method:  http.MethodPost,
+			name: "healthy upstream",
+			opts: []Option{WithUpstreamHealthCheck("/-/ready")},
+			upstream: func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/-/ready" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write(okResponse)
+			},
+			expCode: http.StatusOK,
+			expBody: `{"ok":true}`,
 		},
 		{
-			name:        `No "match[]" parameter returns 200 with empty body`,
-			labelv:      []string{"default"},
-			method:      http.MethodPost,
-			expMatch:    []string{`{namespace="default"}`},
-			expResponse: okResponse,
-			expCode:     http.StatusOK,
-		},
-		{
-			name:        `No "match[]" parameter returns 200 with empty body for POSTs`,
-			method:      http.MethodPost,
-			labelv:      []string{"default"},
-			expMatch:    []string{`{namespace="default"}`},
-			expResponse: okResponse,
-			expCode:     http.StatusOK,
+			name:     "unhealthy upstream",
+			opts:     []Option{WithUpstreamHealthCheck("/-/ready")},
+			upstream: func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+			expCode:  http.StatusServiceUnavailable,
+			expBody:  `{"ok":false}`,
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, endpoint := range []string{"/healthz", "/readyz"} {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+endpoint, nil))
+
+				resp := w.Result()
+				if resp.StatusCode != tc.expCode {
+					t.Fatalf("%s: expected status code %d, got %d", endpoint, tc.expCode, resp.StatusCode)
+				}
+
+				body, _ := io.ReadAll(resp.Body)
+				if got := strings.TrimSpace(string(body)); got != tc.expBody {
+					t.Fatalf("%s: expected body %q, got %q", endpoint, tc.expBody, got)
+				}
+			}
+
+			// The liveness endpoint doesn't depend on the upstream.
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/livez", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("/livez: expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(okResponse) }))
+		m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamHealthCheck("/-/ready"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/healthz", nil))
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	})
+}
+
+func TestTrailers(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithPassthroughPaths([]string{"/api/v1/status/config"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Trailers are only sent over a real connection.
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path string
+
+		expTrailer string
+	}{
 		{
-			name:          `Series POST`,
-			labelv:        []string{"default"},
-			promQueryBody: "up",
-			method:        http.MethodPost,
-			expCode:       http.StatusOK,
-			expMatch:      []string{`{__name__="up",namespace="default"}`},
-			expResponse:   okResponse,
+			path:       "/api/v1/status/config",
+			expTrailer: "abc",
 		},
 		{
-			name:          `Series POST with multiple label values`,
-			labelv:        []string{"default", "something"},
-			promQueryBody: "up",
-			method:        http.MethodPost,
-			expCode:       http.StatusOK,
-			expMatch:      []string{`{__name__="up",namespace=~"default|something"}`},
-			expResponse:   okResponse,
+			path:       "/api/v1/query?query=up&namespace=ns1",
+			expTrailer: "abc",
 		},
 		{
-			name:          `Series POST: check that label values are correctly escaped`,
-			labelv:        []string{"default", "some|thing"},
-			promQueryBody: "up",
-			method:        http.MethodPost,
-			expCode:       http.StatusOK,
-			expMatch:      []string{`{__name__="up",namespace=~"default|some\\|thing"}`},
-			expResponse:   okResponse,
+			// The filtered responses don't carry trailers.
+			path: "/api/v1/rules?namespace=ns1",
 		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + tc.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			// Trailers are available once the body has been read.
+			if _, err := io.ReadAll(resp.Body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := resp.Trailer.Get("X-Checksum"); got != tc.expTrailer {
+				t.Fatalf("expected trailer %q, got %q", tc.expTrailer, got)
+			}
+			if tc.expTrailer == "" && resp.Header.Get("Trailer") != "" {
+				t.Fatalf("expected no announced trailer, got %q", resp.Header.Get("Trailer"))
+			}
+		})
+	}
+}
+
+func TestUpstreamDuration(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(okResponse)
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCounts map[string]uint64
+	}{
 		{
-			name:          `Series with labels POST`,
-			labelv:        []string{"default"},
-			promQueryBody: `up{instance="localhost:9090"}`,
-			method:        http.MethodPost,
-			expCode:       http.StatusOK,
-			expMatch:      []string{`{instance="localhost:9090",__name__="up",namespace="default"}`},
-			expResponse:   okResponse,
+			name: "per path",
+			expCounts: map[string]uint64{
+				`path="/api/v1/label"`: 1,
+				`path="/api/v1/query"`: 2,
+			},
 		},
 		{
-			name:          `Series POST with multiple label values and existing matcher`,
-			labelv:        []string{"default", "something"},
-			promQueryBody: `up{instance="localhost:9090",namespace="something"}`,
-			method:        http.MethodPost,
-			expCode:       http.StatusOK,
-			expMatch:      []string{`{instance="localhost:9090",namespace="something",__name__="up",namespace=~"default|something"}`},
-			expResponse:   okResponse,
+			name: "per path and tenant",
+			opts: []Option{WithUpstreamDurationTenantLabel()},
+			expCounts: map[string]uint64{
+				`path="/api/v1/label",tenant="ns1"`: 1,
+				`path="/api/v1/query",tenant="ns1"`: 1,
+				`path="/api/v1/query",tenant="ns2"`: 1,
+			},
 		},
 	} {
-		for _, endpoint := range []string{"series"} {
-			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
-				m := newMockUpstream(
-					checkParameterAbsent(
-						proxyLabel,
-						checkFormHandler(matchersParam, tc.expMatch...),
-					),
-				)
-				defer m.Close()
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithEnabledLabelsAPI(), WithPrometheusRegistry(reg))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
+			for _, u := range []string{
+				"http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+				"http://prometheus.example.com/api/v1/query?query=up&namespace=ns2",
+				"http://prometheus.example.com/api/v1/label/job/values?namespace=ns1",
+				// The rejected requests aren't sent to the upstream.
+				"http://prometheus.example.com/api/v1/query?query=up",
+			} {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+			}
 
-				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				q := u.Query()
-				for _, lv := range tc.labelv {
-					q.Add(proxyLabel, lv)
-				}
-				u.RawQuery = q.Encode()
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-				var b io.Reader = nil
-				if tc.promQueryBody != "" {
-					b = strings.NewReader(url.Values(map[string][]string{"match[]": {tc.promQueryBody}}).Encode())
+			counts := map[string]uint64{}
+			for _, mf := range mfs {
+				if mf.GetName() != "proxy_upstream_duration_seconds" {
+					continue
 				}
-				w := httptest.NewRecorder()
-				req := httptest.NewRequest(tc.method, u.String(), b)
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-				r.ServeHTTP(w, req)
-
-				resp := w.Result()
-
-				body, err := io.ReadAll(resp.Body)
 
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
+				for _, metric := range mf.GetMetric() {
+					var lbls []string
+					for _, lp := range metric.GetLabel() {
+						lbls = append(lbls, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+					}
+					counts[strings.Join(lbls, ",")] = metric.GetHistogram().GetSampleCount()
 				}
-				defer resp.Body.Close()
+			}
 
-				if resp.StatusCode != tc.expCode {
-					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
-					t.Logf("%s", string(body))
-					t.FailNow()
-				}
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
-				if string(body) != string(tc.expResponse) {
-					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
-				}
-			})
-		}
+			if !reflect.DeepEqual(counts, tc.expCounts) {
+				t.Fatalf("expected %v, got %v", tc.expCounts, counts)
+			}
+		})
 	}
 }
 
-func TestQuery(t *testing.T) {
+func TestMatch(t *testing.T) {
 	for _, tc := range []struct {
-		name           string
-		labelv         []string
-		headers        http.Header
-		headerName     string
-		queryParam     string
-		staticLabelVal []string
-		promQuery      string
-		promQueryBody  string
-		method         string
+		labelv  []string
+		matches []string
+		opts    []Option
 
-		expCode              int
-		expPromQuery         string
-		expPromQueryBody     string
-		expResponse          []byte
-		errorOnReplace       bool
-		regexMatch           bool
-		headerUsesListSyntax bool
+		expCode  int
+		expMatch []string
+		expBody  []byte
 	}{
 		{
-			name:    `No "namespace" parameter returns an error`,
-			expCode: http.StatusBadRequest,
-		},
-		{
-			name:    `No "namespace" parameter returns an error for POSTs`,
+			// No "namespace" parameter returns an error.
 			expCode: http.StatusBadRequest,
-			method:  http.MethodPost,
-		},
-		{
-			labelv:  []string{"default", ""},
-			name:    `One of the "namespace" parameters empty returns 200`,
-			expCode: http.StatusOK,
 		},
 		{
-			labelv:  []string{"default", ""},
-			name:    `One of the "namespace" parameters empty returns 200 for POSTs`,
-			expCode: http.StatusOK,
-			method:  http.MethodPost,
+			// No "match" parameter.
+			labelv:   []string{"default"},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="default"}`},
+			expBody:  okResponse,
 		},
 		{
-			name:    `No "query" parameter returns 200 with empty body`,
-			labelv:  []string{"default"},
-			expCode: http.StatusOK,
+			// Single "match" parameters.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
+			expBody:  okResponse,
 		},
 		{
-			name:    `No "query" parameter returns 200 with empty body for POSTs`,
-			labelv:  []string{"default"},
-			expCode: http.StatusOK,
-			method:  http.MethodPost,
+			// Single "match" parameters with multiple label values.
+			labelv:   []string{"default", "something"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|something"}`},
+			expBody:  okResponse,
 		},
 		{
-			name:         `Query without a vector selector`,
-			labelv:       []string{"default"},
-			promQuery:    "up",
-			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace="default"}`,
-			expResponse:  okResponse,
+			// Check that label values are correctly escaped.
+			labelv:   []string{"default", "some|thing"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|some\\|thing"}`},
+			expBody:  okResponse,
 		},
 		{
-			name:         `Query: check that label values are correctly escaped`,
-			labelv:       []string{"de|fault", "something"},
-			promQuery:    "up",
-			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace=~"de\\|fault|something"}`,
-			expResponse:  okResponse,
+			// Single "match" parameters with label dup name.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default",namespace="default"}`},
+			expBody:  okResponse,
 		},
 		{
-			name:         `Query: check that label values are not escaped for single label values`,
-			labelv:       []string{"de|fault"},
-			promQuery:    "up",
-			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace="de|fault"}`,
-			expResponse:  okResponse,
+			// Many "match" parameters.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus"}`, `{__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",namespace="default"}`, `{__name__=~"job:.*",namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Many "match" parameters with multiple label values.
+			labelv: []string{"default", "something"},
+			matches: []string{
+				`{job="prometheus"}`,
+				`{__name__=~"job:.*"}`,
+				`{namespace="something"}`,
+			},
+			expCode: http.StatusOK,
+			expMatch: []string{
+				`{job="prometheus",namespace=~"default|something"}`,
+				`{__name__=~"job:.*",namespace=~"default|something"}`,
+				`{namespace="something",namespace=~"default|something"}`,
+			},
+			expBody: okResponse,
+		},
+		{
+			// Many "match" parameters with a single regex value.
+			labelv: []string{".+-monitoring"},
+			matches: []string{
+				`{job="prometheus"}`,
+				`{__name__=~"job:.*"}`,
+				`{namespace="something"}`,
+			},
+			opts: []Option{WithRegexMatch()},
+
+			expCode: http.StatusOK,
+			expMatch: []string{
+				`{job="prometheus",namespace=~".+-monitoring"}`,
+				`{__name__=~"job:.*",namespace=~".+-monitoring"}`,
+				`{namespace="something",namespace=~".+-monitoring"}`,
+			},
+			expBody: okResponse,
+		},
+		{
+			// A single "match" parameter with multiple regex values.
+			labelv: []string{"default", "something"},
+			matches: []string{
+				`{job="prometheus"}`,
+			},
+			opts:    []Option{WithRegexMatch()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// A single "match" parameter with a regex value matching the empty string.
+			labelv: []string{".*"},
+			matches: []string{
+				`{job="prometheus"}`,
+			},
+			opts:    []Option{WithRegexMatch()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		for _, u := range []string{
+			"http://prometheus.example.com/federate",
+			"http://prometheus.example.com/api/v1/labels",
+			"http://prometheus.example.com/api/v1/label/some_label/values",
+		} {
+			t.Run(fmt.Sprintf("%s?match[]=%s", u, strings.Join(tc.matches, "&")), func(t *testing.T) {
+				m := newMockUpstream(
+					checkParameterAbsent(
+						proxyLabel,
+						checkQueryHandler("", matchersParam, tc.expMatch...),
+					),
+				)
+				defer m.Close()
+
+				r, err := NewRoutes(
+					m.url,
+					proxyLabel,
+					HTTPFormEnforcer{ParameterName: proxyLabel},
+					append([]Option{WithEnabledLabelsAPI()}, tc.opts...)...,
+				)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse(u)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := u.Query()
+				for _, m := range tc.matches {
+					q.Add(matchersParam, m)
+				}
+				for _, lv := range tc.labelv {
+					q.Add(proxyLabel, lv)
+				}
+				u.RawQuery = q.Encode()
+
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", u.String(), nil)
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				body, _ := io.ReadAll(resp.Body)
+				defer resp.Body.Close()
+
+				if resp.StatusCode != tc.expCode {
+					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+					t.Logf("%s", string(body))
+					t.FailNow()
+				}
+
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+
+				if string(body) != string(tc.expBody) {
+					t.Fatalf("expected body %q, got %q", string(tc.expBody), string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestMatchWithPost(t *testing.T) {
+	for _, tc := range []struct {
+		labelv  []string
+		matches []string
+
+		expCode  int
+		expMatch []string
+		expBody  []byte
+	}{
+		{
+			// No "namespace" parameter returns an error.
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// No "match" parameter.
+			labelv:   []string{"default"},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Single "match" parameters.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Single "match" parameters with multiple label values.
+			labelv:   []string{"default", "something"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|something"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Check that label values are correctly escaped.
+			labelv:   []string{"default", "some|thing"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace=~"default|some\\|thing"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Single "match" parameters with label dup name.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus",__name__=~"job:.*",namespace="default"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",__name__=~"job:.*",namespace="default",namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Many "match" parameters.
+			labelv:   []string{"default"},
+			matches:  []string{`{job="prometheus"}`, `{__name__=~"job:.*"}`},
+			expCode:  http.StatusOK,
+			expMatch: []string{`{job="prometheus",namespace="default"}`, `{__name__=~"job:.*",namespace="default"}`},
+			expBody:  okResponse,
+		},
+		{
+			// Many "match" parameters with multiple label values.
+			labelv: []string{"default", "something"},
+			matches: []string{
+				`{job="prometheus"}`,
+				`{__name__=~"job:.*"}`,
+				`{namespace="something"}`,
+			},
+			expCode: http.StatusOK,
+			expMatch: []string{
+				`{job="prometheus",namespace=~"default|something"}`,
+				`{__name__=~"job:.*",namespace=~"default|something"}`,
+				`{namespace="something",namespace=~"default|something"}`,
+			},
+			expBody: okResponse,
+		},
+	} {
+		for _, u := range []string{
+			"http://prometheus.example.com/api/v1/labels",
+		} {
+			t.Run(fmt.Sprintf("%s?match[]=%s", u, strings.Join(tc.matches, "&")), func(t *testing.T) {
+				m := newMockUpstream(
+					checkFormParameterAbsent(
+						proxyLabel,
+						checkFormHandler(matchersParam, tc.expMatch...),
+					),
+				)
+				defer m.Close()
+				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithEnabledLabelsAPI())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse(u)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := url.Values{}
+				for _, m := range tc.matches {
+					q.Add(matchersParam, m)
+				}
+				for _, lv := range tc.labelv {
+					q.Add(proxyLabel, lv)
+				}
+
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, u.String(), strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				body, _ := io.ReadAll(resp.Body)
+				defer resp.Body.Close()
+
+				if resp.StatusCode != tc.expCode {
+					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+					t.Logf("%s", string(body))
+					t.FailNow()
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+
+				if string(body) != string(tc.expBody) {
+					t.Fatalf("expected body %q, got %q", string(tc.expBody), string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestFederateStreaming(t *testing.T) {
+	const (
+		chunk1 = "up{namespace=\"ns1\",job=\"a\"} 1\n"
+		chunk2 = "up{namespace=\"ns1\",job=\"b\"} 1\n"
+	)
+
+	release := make(chan struct{})
+	defer close(release)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.URL.Query()[matchersParam]; !reflect.DeepEqual(got, []string{`{job="a",namespace="ns1"}`}) {
+			prometheusAPIError(w, fmt.Sprintf("unexpected matchers %q", got), http.StatusBadRequest)
+			return
+		}
+
+		// A known content length doesn't prevent the response from being
+		// flushed.
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(chunk1)+len(chunk2)))
+		w.Write([]byte(chunk1))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		w.Write([]byte(chunk2))
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{
+			name: "default",
+		},
+		{
+			// The response writers wrapped by these options must support
+			// flushing.
+			name: "with response writer wrappers",
+			opts: []Option{
+				WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+				WithServerTimingHeader(),
+				WithHTMLErrorPages(),
+				WithErrorResponseDecorator(func(*http.Request, int, map[string]any) {}),
+				WithRequestTimeout(time.Minute),
+				WithCircuitBreaker(1, time.Minute),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/federate?namespace=ns1&match[]="+url.QueryEscape(`{job="a"}`), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, string(b))
+			}
+
+			// The first samples are received before the upstream completes
+			// the response.
+			line, err := bufio.NewReader(resp.Body).ReadString('\n')
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if line != chunk1 {
+				t.Fatalf("expected %q, got %q", chunk1, line)
+			}
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		labelv      []string
+		promQuery   string
+		expResponse []byte
+		expCode     int
+		expMatch    []string
+		expBody     []byte
+	}{
+		{
+			name:    `No "namespace" parameter returns an error`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    `No "namespace" parameter returns an error for POSTs`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:        `No "match[]" parameter returns 200 with empty body`,
+			labelv:      []string{"default"},
+			expMatch:    []string{`{namespace="default"}`},
+			expResponse: okResponse,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        `No "match[]" parameter returns 200 with empty body for POSTs`,
+			labelv:      []string{"default"},
+			expMatch:    []string{`{namespace="default"}`},
+			expResponse: okResponse,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        `Series`,
+			labelv:      []string{"default"},
+			promQuery:   "up",
+			expCode:     http.StatusOK,
+			expMatch:    []string{`{__name__="up",namespace="default"}`},
+			expResponse: okResponse,
+		},
+		{
+			name:        `Series with multiple label values`,
+			labelv:      []string{"default", "something"},
+			promQuery:   "up",
+			expCode:     http.StatusOK,
+			expMatch:    []string{`{__name__="up",namespace=~"default|something"}`},
+			expResponse: okResponse,
+		},
+		{
+			name:        `Series: check that label values are correctly escaped`,
+			labelv:      []string{"default", "some|thing"},
+			promQuery:   "up",
+			expCode:     http.StatusOK,
+			expMatch:    []string{`{__name__="up",namespace=~"default|some\\|thing"}`},
+			expResponse: okResponse,
+		},
+		{
+			name:        `Series with multiple labels`,
+			labelv:      []string{"default"},
+			promQuery:   `up{instance="localhost:9090"}`,
+			expCode:     http.StatusOK,
+			expMatch:    []string{`{instance="localhost:9090",__name__="up",namespace="default"}`},
+			expResponse: okResponse,
+		},
+		{
+			name:        `Series with multiple label values and existing matcher`,
+			labelv:      []string{"default", "something"},
+			promQuery:   `up{instance="localhost:9090",namespace="something"}`,
+			expCode:     http.StatusOK,
+			expMatch:    []string{`{instance="localhost:9090",namespace="something",__name__="up",namespace=~"default|something"}`},
+			expResponse: okResponse,
+		},
+	} {
+		for _, endpoint := range []string{"series"} {
+			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+				m := newMockUpstream(
+					checkParameterAbsent(
+						proxyLabel,
+						checkQueryHandler("", matchersParam, tc.expMatch...),
+					),
+				)
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := u.Query()
+				if tc.promQuery != "" {
+					q.Add(matchersParam, tc.promQuery)
+				}
+				for _, lv := range tc.labelv {
+					q.Add(proxyLabel, lv)
+				}
+				u.RawQuery = q.Encode()
+
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest("GET", u.String(), nil)
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+
+				body, err := io.ReadAll(resp.Body)
+
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != tc.expCode {
+					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+					t.Logf("%s", string(body))
+					t.FailNow()
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+				if string(body) != string(tc.expResponse) {
+					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestWithLenientMatchSelectors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		match   []string
+		lenient bool
+
+		expCode  int
+		expMatch []string
+	}{
+		{
+			name:    "expression rejected by default",
+			match:   []string{`rate(http_requests_total{job="a"}[5m]) / on(pod) kube_pod_info`},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "expression",
+			match:    []string{`rate(http_requests_total{job="a"}[5m]) / on(pod) kube_pod_info`},
+			lenient:  true,
+			expCode:  http.StatusOK,
+			expMatch: []string{`rate(http_requests_total{job="a",namespace="ns1"}[5m]) / on (pod) kube_pod_info{namespace="ns1"}`},
+		},
+		{
+			name:     "expression overriding the label",
+			match:    []string{`sum(up{namespace="other"})`},
+			lenient:  true,
+			expCode:  http.StatusOK,
+			expMatch: []string{`sum(up{namespace="ns1"})`},
+		},
+		{
+			name:     "selector and expression",
+			match:    []string{`up`, `max_over_time(up[5m])`},
+			lenient:  true,
+			expCode:  http.StatusOK,
+			expMatch: []string{`{__name__="up",namespace="ns1"}`, `max_over_time(up{namespace="ns1"}[5m])`},
+		},
+		{
+			name:    "invalid expression",
+			match:   []string{`rate(up[5m]`},
+			lenient: true,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", matchersParam, tc.expMatch...))
+			defer m.Close()
+
+			var opts []Option
+			if tc.lenient {
+				opts = append(opts, WithLenientMatchSelectors())
+			}
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{matchersParam: tc.match, proxyLabel: {"ns1"}}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/series?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSeriesWithPost(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		labelv        []string
+		promQueryBody string
+		expResponse   []byte
+		method        string
+		expCode       int
+		expMatch      []string
+		expBody       []byte
+	}{
+		{
+			name:    `No "namespace" parameter returns an error`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    `No "namespace" parameter returns an error for POSTs`,
+			expCode: http.StatusBadRequest,
+			method:  http.MethodPost,
+		},
+		{
+			name:        `No "match[]" parameter returns 200 with empty body`,
+			labelv:      []string{"default"},
+			method:      http.MethodPost,
+			expMatch:    []string{`{namespace="default"}`},
+			expResponse: okResponse,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:        `No "match[]" parameter returns 200 with empty body for POSTs`,
+			method:      http.MethodPost,
+			labelv:      []string{"default"},
+			expMatch:    []string{`{namespace="default"}`},
+			expResponse: okResponse,
+			expCode:     http.StatusOK,
+		},
+		{
+			name:          `Series POST`,
+			labelv:        []string{"default"},
+			promQueryBody: "up",
+			method:        http.MethodPost,
+			expCode:       http.StatusOK,
+			expMatch:      []string{`{__name__="up",namespace="default"}`},
+			expResponse:   okResponse,
+		},
+		{
+			name:          `Series POST with multiple label values`,
+			labelv:        []string{"default", "something"},
+			promQueryBody: "up",
+			method:        http.MethodPost,
+			expCode:       http.StatusOK,
+			expMatch:      []string{`{__name__="up",namespace=~"default|something"}`},
+			expResponse:   okResponse,
+		},
+		{
+			name:          `Series POST: check that label values are correctly escaped`,
+			labelv:        []string{"default", "some|thing"},
+			promQueryBody: "up",
+			method:        http.MethodPost,
+			expCode:       http.StatusOK,
+			expMatch:      []string{`{__name__="up",namespace=~"default|some\\|thing"}`},
+			expResponse:   okResponse,
+		},
+		{
+			name:          `Series with labels POST`,
+			labelv:        []string{"default"},
+			promQueryBody: `up{instance="localhost:9090"}`,
+			method:        http.MethodPost,
+			expCode:       http.StatusOK,
+			expMatch:      []string{`{instance="localhost:9090",__name__="up",namespace="default"}`},
+			expResponse:   okResponse,
+		},
+		{
+			name:          `Series POST with multiple label values and existing matcher`,
+			labelv:        []string{"default", "something"},
+			promQueryBody: `up{instance="localhost:9090",namespace="something"}`,
+			method:        http.MethodPost,
+			expCode:       http.StatusOK,
+			expMatch:      []string{`{instance="localhost:9090",namespace="something",__name__="up",namespace=~"default|something"}`},
+			expResponse:   okResponse,
+		},
+	} {
+		for _, endpoint := range []string{"series"} {
+			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+				m := newMockUpstream(
+					checkParameterAbsent(
+						proxyLabel,
+						checkFormHandler(matchersParam, tc.expMatch...),
+					),
+				)
+				defer m.Close()
+
+				r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := u.Query()
+				for _, lv := range tc.labelv {
+					q.Add(proxyLabel, lv)
+				}
+				u.RawQuery = q.Encode()
+
+				var b io.Reader = nil
+				if tc.promQueryBody != "" {
+					b = strings.NewReader(url.Values(map[string][]string{"match[]": {tc.promQueryBody}}).Encode())
+				}
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(tc.method, u.String(), b)
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+
+				body, err := io.ReadAll(resp.Body)
+
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != tc.expCode {
+					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+					t.Logf("%s", string(body))
+					t.FailNow()
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+				if string(body) != string(tc.expResponse) {
+					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		labelv         []string
+		headers        http.Header
+		headerName     string
+		queryParam     string
+		staticLabelVal []string
+		promQuery      string
+		promQueryBody  string
+		method         string
+
+		expCode              int
+		expPromQuery         string
+		expPromQueryBody     string
+		expResponse          []byte
+		errorOnReplace       bool
+		regexMatch           bool
+		headerUsesListSyntax bool
+	}{
+		{
+			name:    `No "namespace" parameter returns an error`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    `No "namespace" parameter returns an error for POSTs`,
+			expCode: http.StatusBadRequest,
+			method:  http.MethodPost,
+		},
+		{
+			labelv:  []string{"default", ""},
+			name:    `One of the "namespace" parameters empty returns 200`,
+			expCode: http.StatusOK,
+		},
+		{
+			labelv:  []string{"default", ""},
+			name:    `One of the "namespace" parameters empty returns 200 for POSTs`,
+			expCode: http.StatusOK,
+			method:  http.MethodPost,
+		},
+		{
+			name:    `No "query" parameter returns 200 with empty body`,
+			labelv:  []string{"default"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    `No "query" parameter returns 200 with empty body for POSTs`,
+			labelv:  []string{"default"},
+			expCode: http.StatusOK,
+			method:  http.MethodPost,
+		},
+		{
+			name:         `Query without a vector selector`,
+			labelv:       []string{"default"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `Query: check that label values are correctly escaped`,
+			labelv:       []string{"de|fault", "something"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"de\\|fault|something"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `Query: check that label values are not escaped for single label values`,
+			labelv:       []string{"de|fault"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="de|fault"}`,
+			expResponse:  okResponse,
 		},
 		{
 			name:         `Query without a vector selector with multiple label values`,
 			labelv:       []string{"default", "second"},
 			promQuery:    "up",
 			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace=~"default|second"}`,
-			expResponse:  okResponse,
+			expPromQuery: `up{namespace=~"default|second"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:             `Query without a vector selector in POST body`,
+			labelv:           []string{"default"},
+			promQueryBody:    "up",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `up{namespace="default"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Query without a vector selector in POST body with multiple label values`,
+			labelv:           []string{"default", "second"},
+			promQueryBody:    "up",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `up{namespace=~"default|second"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Tricky: Query without a vector selector in GET body (yes, that's possible)'`,
+			labelv:           []string{"default"},
+			promQueryBody:    "up",
+			method:           http.MethodGet,
+			expCode:          http.StatusOK,
+			expPromQueryBody: ``, // We should finish request without forwarding. Form should not parse this value for GET.
+		},
+		{
+			name:             `Query without a vector selector in POST body or query`,
+			labelv:           []string{"default"},
+			promQuery:        "up",
+			promQueryBody:    "up",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQuery:     `up{namespace="default"}`,
+			expPromQueryBody: `up{namespace="default"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Query without a vector selector in POST body or query with multiple label values`,
+			labelv:           []string{"default", "second"},
+			promQuery:        "up",
+			promQueryBody:    "up",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQuery:     `up{namespace=~"default|second"}`,
+			expPromQueryBody: `up{namespace=~"default|second"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Query without a vector selector in POST body or query different`,
+			labelv:           []string{"default"},
+			promQuery:        "up",
+			promQueryBody:    "foo",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQuery:     `up{namespace="default"}`,
+			expPromQueryBody: `foo{namespace="default"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Query without a vector selector in POST body or query different with multiple label values`,
+			labelv:           []string{"default", "second"},
+			promQuery:        "up",
+			promQueryBody:    "foo",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQuery:     `up{namespace=~"default|second"}`,
+			expPromQueryBody: `foo{namespace=~"default|second"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:         `Query with a vector selector`,
+			labelv:       []string{"default"},
+			promQuery:    `up{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `Query with a vector selector with multiple label values`,
+			labelv:       []string{"default", "second"},
+			promQuery:    `up{namespace="second"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="second",namespace=~"default|second"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `Query with a vector selector with empty label values`,
+			labelv:       []string{"default", ""},
+			promQuery:    `up{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:             `Query with a vector selector in POST body`,
+			labelv:           []string{"default"},
+			promQueryBody:    `up{namespace="other"}`,
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `up{namespace="default"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:             `Query with a vector selector in POST body with multiple label values`,
+			labelv:           []string{"default", "second"},
+			promQueryBody:    `up{namespace="second"}`,
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `up{namespace="second",namespace=~"default|second"}`,
+			expResponse:      okResponse,
+		},
+		{
+			name:           `Query with a vector selector and errorOnReplace`,
+			labelv:         []string{"default"},
+			promQuery:      `up{namespace="other"}`,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+			expResponse:    nil,
+		},
+		{
+			name:           `Query with a vector selector in POST body and errorOnReplace`,
+			labelv:         []string{"default"},
+			promQueryBody:  `up{namespace="other"}`,
+			method:         http.MethodPost,
+			errorOnReplace: true,
+			expCode:        http.StatusBadRequest,
+			expResponse:    nil,
+		},
+		{
+			name:         `Query with a scalar`,
+			labelv:       []string{"default"},
+			promQuery:    "1",
+			expCode:      http.StatusOK,
+			expPromQuery: `1`,
+			expResponse:  okResponse,
+		},
+		{
+			name:             `Query with a scalar in POST body`,
+			labelv:           []string{"default"},
+			promQueryBody:    "1",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `1`,
+			expResponse:      okResponse,
+		},
+		{
+			name:         `Query with a function`,
+			labelv:       []string{"default"},
+			promQuery:    "time()",
+			expCode:      http.StatusOK,
+			expPromQuery: `time()`,
+			expResponse:  okResponse,
+		},
+		{
+			name:             `Query with a function in POST body`,
+			labelv:           []string{"default"},
+			promQueryBody:    "time()",
+			method:           http.MethodPost,
+			expCode:          http.StatusOK,
+			expPromQueryBody: `time()`,
+			expResponse:      okResponse,
+		},
+		{
+			name:      `An invalid expression returns 400 with error response`,
+			labelv:    []string{"default"},
+			promQuery: "up +",
+			expCode:   http.StatusBadRequest,
+		},
+		{
+			name:          `An invalid expression in POST body returns 400 with error response`,
+			labelv:        []string{"default"},
+			promQueryBody: "up +",
+			method:        http.MethodPost,
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:         `Binary expression`,
+			labelv:       []string{"default"},
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `Binary expression with multiple label values`,
+			labelv:       []string{"default", "second"},
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:           `Static label value`,
+			staticLabelVal: []string{"default"},
+			promQuery:      `up{instance="localhost:9090"} + foo{namespace="default"}`,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:           `Multiple static label values`,
+			staticLabelVal: []string{"default", "second"},
+			promQuery:      `up{instance="localhost:9090"} + foo{namespace="second"}`,
+			expCode:        http.StatusOK,
+			expPromQuery:   `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
+			expResponse:    okResponse,
+		},
+		{
+			name:         `HTTP header label value`,
+			headers:      http.Header{"namespace": []string{"default"}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `multiple HTTP header label values`,
+			headers:      http.Header{"namespace": []string{"default", "second"}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `HTTP header label with comma-separated values and list parsing disabled`,
+			headers:      http.Header{"namespace": []string{"default, second", "third"}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"default, second|third"} + foo{namespace="second",namespace=~"default, second|third"}`,
+			expResponse:  okResponse,
+
+			headerUsesListSyntax: false,
+		},
+		{
+			name:         `HTTP header label with comma-separated values and list parsing enabled`,
+			headers:      http.Header{"namespace": []string{"default, second", "third"}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second|third"} + foo{namespace="second",namespace=~"default|second|third"}`,
+			expResponse:  okResponse,
+
+			headerUsesListSyntax: true,
+		},
+		{
+			name:         `HTTP header label with quoted comma-separated values and list parsing enabled`,
+			headers:      http.Header{"namespace": []string{`"default,second", third`}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"default,second|third"}`,
+			expResponse:  okResponse,
+
+			headerUsesListSyntax: true,
+		},
+		{
+			name:       `HTTP header label with unterminated quoted value and list parsing enabled`,
+			headers:    http.Header{"namespace": []string{`"default, second`}},
+			headerName: "namespace",
+			promQuery:  `up{instance="localhost:9090"}`,
+			expCode:    http.StatusBadRequest,
+
+			headerUsesListSyntax: true,
+		},
+		{
+			name:         `multiple HTTP header with empty label value`,
+			headers:      http.Header{"namespace": []string{"default", ""}},
+			headerName:   "namespace",
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `query param label value`,
+			queryParam:   "namespace2",
+			labelv:       []string{"default"},
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `HTTP header as regexp`,
+			headers:      http.Header{"namespace": []string{"tenant1-.*"}},
+			headerName:   "namespace",
+			regexMatch:   true,
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="other",namespace=~"tenant1-.*"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `query param as regexp`,
+			queryParam:   "namespace",
+			labelv:       []string{"tenant1-.*"},
+			regexMatch:   true,
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="other",namespace=~"tenant1-.*"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:         `HTTP header as regexp with same regexp in query`,
+			headers:      http.Header{"namespace": []string{"tenant1-.*"}},
+			headerName:   "namespace",
+			regexMatch:   true,
+			promQuery:    `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="tenant1-.*",namespace=~"tenant1-.*"}`,
+			expResponse:  okResponse,
+		},
+		{
+			name:       `HTTP header with invalid regexp with same regexp in query`,
+			headers:    http.Header{"namespace": []string{"tenant1-(.*"}},
+			headerName: "namespace",
+			regexMatch: true,
+			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
+			expCode:    http.StatusBadRequest,
+		},
+		{
+			name:       `Multiple regexp HTTP headers is invalid`,
+			headers:    http.Header{"namespace": []string{"tenant1", "tenant2"}},
+			headerName: "namespace",
+			regexMatch: true,
+			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
+			expCode:    http.StatusBadRequest,
+		},
+		{
+			name:       `Regex should not match empty string`,
+			headers:    http.Header{"namespace": []string{".*"}},
+			headerName: "namespace",
+			regexMatch: true,
+			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
+			expCode:    http.StatusBadRequest,
+		},
+	} {
+		for _, endpoint := range []string{"query", "query_range", "query_exemplars", "format_query", "parse_query"} {
+			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
+				var expBody string
+				if tc.expPromQueryBody != "" {
+					expBody = url.Values(map[string][]string{"query": {tc.expPromQueryBody}}).Encode()
+				}
+
+				mockHandler := checkQueryHandler(expBody, queryParam, tc.expPromQuery)
+				if (len(tc.staticLabelVal) == 0) != (tc.headers == nil) {
+					mockHandler = checkParameterAbsent(proxyLabel, mockHandler)
+				}
+				m := newMockUpstream(mockHandler)
+				defer m.Close()
+				var opts []Option
+
+				if tc.errorOnReplace {
+					opts = append(opts, WithErrorOnReplace())
+				}
+				if tc.regexMatch {
+					opts = append(opts, WithRegexMatch())
+				}
+
+				var labelEnforcer ExtractLabeler
+				if len(tc.staticLabelVal) > 0 {
+					labelEnforcer = StaticLabelEnforcer(tc.staticLabelVal)
+				} else if tc.headerName != "" {
+					labelEnforcer = HTTPHeaderEnforcer{Name: tc.headerName, ParseListSyntax: tc.headerUsesListSyntax}
+				} else if tc.queryParam != "" {
+					labelEnforcer = HTTPFormEnforcer{ParameterName: tc.queryParam}
+				} else {
+					labelEnforcer = HTTPFormEnforcer{ParameterName: proxyLabel}
+				}
+
+				r, err := NewRoutes(m.url, proxyLabel, labelEnforcer, opts...)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				q := u.Query()
+				q.Set(queryParam, tc.promQuery)
+				if tc.queryParam != "" {
+					for _, lv := range tc.labelv {
+						q.Add(tc.queryParam, lv)
+					}
+				} else if len(tc.staticLabelVal) == 0 && tc.headerName == "" && len(tc.labelv) > 0 {
+					for _, lv := range tc.labelv {
+						q.Add(proxyLabel, lv)
+					}
+				}
+
+				u.RawQuery = q.Encode()
+
+				var b io.Reader = nil
+				if tc.promQueryBody != "" {
+					b = strings.NewReader(url.Values(map[string][]string{"query": {tc.promQueryBody}}).Encode())
+				}
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(tc.method, u.String(), b)
+				if tc.headers != nil {
+					req.Header = tc.headers
+				}
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != tc.expCode {
+					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+					t.Logf("%s", string(body))
+					t.FailNow()
+				}
+				if resp.StatusCode != http.StatusOK {
+					return
+				}
+				if string(body) != string(tc.expResponse) {
+					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
+				}
+			})
+		}
+	}
+}
+
+func TestSplitValues(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		sep    string
+
+		exp    []string
+		expErr bool
+	}{
+		{
+			name:   "unquoted values",
+			values: []string{"team-a, team-b", "team-c"},
+			sep:    ",",
+			exp:    []string{"team-a", "team-b", "team-c"},
+		},
+		{
+			name:   "quoted value containing the delimiter",
+			values: []string{`"team,a",team-b`},
+			sep:    ",",
+			exp:    []string{"team,a", "team-b"},
+		},
+		{
+			name:   "quoted value with surrounding whitespace",
+			values: []string{` " team a " , team-b`},
+			sep:    ",",
+			exp:    []string{" team a ", "team-b"},
+		},
+		{
+			name:   "escaped characters inside quotes",
+			values: []string{`"team\"a\\",team-b`},
+			sep:    ",",
+			exp:    []string{`team"a\`, "team-b"},
+		},
+		{
+			name:   "custom delimiter",
+			values: []string{`team-a;"team;b";team,c`},
+			sep:    ";",
+			exp:    []string{"team-a", "team;b", "team,c"},
+		},
+		{
+			name:   "empty values",
+			values: []string{`,"",team-a`},
+			sep:    ",",
+			exp:    []string{"", "", "team-a"},
+		},
+		{
+			name:   "unterminated quoted value",
+			values: []string{`"team,a`},
+			sep:    ",",
+			expErr: true,
+		},
+		{
+			name:   "unterminated escape sequence",
+			values: []string{`"team\`},
+			sep:    ",",
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := splitValues(tc.values, tc.sep)
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Fatalf("expected %q, got %q", tc.exp, got)
+			}
+		})
+	}
+}
+
+func TestHTTPHeaderEnforcerDoesNotModifyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		hhe    HTTPHeaderEnforcer
+
+		exp []string
+	}{
+		{
+			name:   "empty values",
+			values: []string{"", "team-a", "", "team-b"},
+			hhe:    HTTPHeaderEnforcer{Name: "X-Tenant"},
+			exp:    []string{"team-a", "team-b"},
+		},
+		{
+			name:   "list syntax",
+			values: []string{"team-a, team-b", "", `"team,c"`},
+			hhe:    HTTPHeaderEnforcer{Name: "X-Tenant", ParseListSyntax: true},
+			exp:    []string{"team,c", "team-a", "team-b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query", nil)
+			req.Header["X-Tenant"] = slices.Clone(tc.values)
+
+			var got []string
+			tc.hhe.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+				got = MustLabelValues(req.Context())
+			}).ServeHTTP(httptest.NewRecorder(), req)
+
+			if !reflect.DeepEqual(got, tc.exp) {
+				t.Fatalf("expected label values %q, got %q", tc.exp, got)
+			}
+
+			if !reflect.DeepEqual(req.Header["X-Tenant"], tc.values) {
+				t.Fatalf("expected header values %q to be unchanged, got %q", tc.values, req.Header["X-Tenant"])
+			}
+		})
+	}
+}
+
+func TestQueryRepeatedParameter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		query  url.Values
+		body   url.Values
+
+		expQuery []string
+		expBody  string
+	}{
+		{
+			name:     "URL query string",
+			method:   http.MethodGet,
+			query:    url.Values{"query": {"up", `secret{namespace="other"}`}},
+			expQuery: []string{`up{namespace="default"}`, `secret{namespace="default"}`},
+		},
+		{
+			name:     "empty first value",
+			method:   http.MethodGet,
+			query:    url.Values{"query": {"", "up"}},
+			expQuery: []string{"", `up{namespace="default"}`},
+		},
+		{
+			name:    "POST body",
+			method:  http.MethodPost,
+			body:    url.Values{"query": {"up", "secret"}},
+			expBody: url.Values{"query": {`up{namespace="default"}`, `secret{namespace="default"}`}}.Encode(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler(tc.expBody, queryParam, tc.expQuery...))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var b io.Reader
+			if tc.body != nil {
+				b = strings.NewReader(tc.body.Encode())
+			}
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?"+tc.query.Encode(), b)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, string(body))
+			}
+			if string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+}
+
+func TestReplaceRejectionStatus(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	t.Run("invalid status", func(t *testing.T) {
+		for _, code := range []int{http.StatusOK, http.StatusBadGateway} {
+			if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithReplaceRejectionStatus(code)); err == nil {
+				t.Fatalf("expected error for status %d", code)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		method string
+
+		expCode int
+	}{
+		{
+			name:    "default",
+			opts:    []Option{WithErrorOnReplace()},
+			method:  http.MethodGet,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "forbidden",
+			opts:    []Option{WithErrorOnReplace(), WithReplaceRejectionStatus(http.StatusForbidden)},
+			method:  http.MethodGet,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "forbidden with POST",
+			opts:    []Option{WithErrorOnReplace(), WithReplaceRejectionStatus(http.StatusForbidden)},
+			method:  http.MethodPost,
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "without errorOnReplace",
+			opts:    []Option{WithReplaceRejectionStatus(http.StatusForbidden)},
+			method:  http.MethodGet,
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {`up{namespace="ns2"}`}, proxyLabel: {"ns1"}}
+			req := httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(tc.method, "http://prometheus.example.com/api/v1/query", strings.NewReader(q.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
+			}
+
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+
+			var res map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res["status"] != "error" || !strings.Contains(res["error"], "conflicting label matcher") {
+				t.Fatalf("unexpected error response: %v", res)
+			}
+		})
+	}
+}
+
+func TestMatchType(t *testing.T) {
+	t.Run("invalid match type", func(t *testing.T) {
+		u, _ := url.Parse("http://prometheus.example.com")
+		if _, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMatchType(labels.MatchType(42))); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	for _, tc := range []struct {
+		name           string
+		matchType      labels.MatchType
+		labelv         []string
+		errorOnReplace bool
+		endpoint       string
+		query          string
+
+		expCode  int
+		expParam string
+		expValue string
+	}{
+		{
+			name:      "not equal",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal"},
+			endpoint:  "/api/v1/query",
+			query:     `up`,
+			expCode:   http.StatusOK,
+			expParam:  queryParam,
+			expValue:  `up{namespace!="internal"}`,
+		},
+		{
+			name:      "not equal with multiple values",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal", "kube-system"},
+			endpoint:  "/api/v1/query",
+			query:     `up`,
+			expCode:   http.StatusOK,
+			expParam:  queryParam,
+			expValue:  `up{namespace!~"internal|kube-system"}`,
+		},
+		{
+			name:      "not regexp",
+			matchType: labels.MatchNotRegexp,
+			labelv:    []string{"internal.svc"},
+			endpoint:  "/api/v1/query",
+			query:     `up`,
+			expCode:   http.StatusOK,
+			expParam:  queryParam,
+			expValue:  `up{namespace!~"internal\\.svc"}`,
+		},
+		{
+			name:      "regexp",
+			matchType: labels.MatchRegexp,
+			labelv:    []string{"default"},
+			endpoint:  "/api/v1/query",
+			query:     `up`,
+			expCode:   http.StatusOK,
+			expParam:  queryParam,
+			expValue:  `up{namespace=~"default"}`,
+		},
+		{
+			name:      "not equal merged with the existing matcher",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal"},
+			endpoint:  "/api/v1/query",
+			query:     `up{namespace=~"team-.+"}`,
+			expCode:   http.StatusOK,
+			expParam:  queryParam,
+			expValue:  `up{namespace!="internal",namespace=~"team-.+"}`,
+		},
+		{
+			name:           "not equal with compatible matcher and errorOnReplace",
+			matchType:      labels.MatchNotEqual,
+			labelv:         []string{"internal"},
+			errorOnReplace: true,
+			endpoint:       "/api/v1/query",
+			query:          `up{namespace="default"}`,
+			expCode:        http.StatusOK,
+			expParam:       queryParam,
+			expValue:       `up{namespace!="internal",namespace="default"}`,
+		},
+		{
+			name:           "not equal with conflicting matcher and errorOnReplace",
+			matchType:      labels.MatchNotEqual,
+			labelv:         []string{"internal"},
+			errorOnReplace: true,
+			endpoint:       "/api/v1/query",
+			query:          `up{namespace="internal"}`,
+			expCode:        http.StatusBadRequest,
+		},
+		{
+			name:      "not equal on series",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal"},
+			endpoint:  "/api/v1/series",
+			query:     `up`,
+			expCode:   http.StatusOK,
+			expParam:  matchersParam,
+			expValue:  `{__name__="up",namespace!="internal"}`,
+		},
+		{
+			name:      "not equal on labels",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal"},
+			endpoint:  "/api/v1/labels",
+			expCode:   http.StatusOK,
+			expParam:  matchersParam,
+			expValue:  `{namespace!="internal"}`,
+		},
+		{
+			name:      "not equal on silences",
+			matchType: labels.MatchNotEqual,
+			labelv:    []string{"internal"},
+			endpoint:  "/api/v2/silences",
+			expCode:   http.StatusNotImplemented,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", tc.expParam, tc.expValue))
+			defer m.Close()
+
+			opts := []Option{WithMatchType(tc.matchType), WithEnabledLabelsAPI()}
+			if tc.errorOnReplace {
+				opts = append(opts, WithErrorOnReplace())
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.labelv}
+			switch {
+			case tc.query == "":
+			case tc.endpoint == "/api/v1/query":
+				q.Set(queryParam, tc.query)
+			default:
+				q.Set(matchersParam, tc.query)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.endpoint+"?"+q.Encode(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestBypassQueries(t *testing.T) {
+	// Test bypass functionality by creating a full routes setup
+	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		t.Logf("Mock handler called with query: %s", query)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(query)) // Return the query so we can check it
+	})
+
+	// Create a mock upstream
+	m := newMockUpstream(mockHandler)
+	defer m.Close()
+
+	enforcer := HTTPFormEnforcer{ParameterName: "tenant"}
+	bypassQueries := []string{"1+1", "up"}
+
+	t.Logf("Creating routes with bypass queries: %v", bypassQueries)
+
+	// Create routes with bypass queries
+	routes, err := NewRoutes(m.url, "namespace", enforcer, WithBypassQueries(bypassQueries))
+	if err != nil {
+		t.Fatalf("Failed to create routes: %v", err)
+	}
+
+	endpoints := []string{"/api/v1/query", "/api/v1/query_range"}
+
+	for _, endpoint := range endpoints {
+		t.Run(endpoint, func(t *testing.T) {
+			// Test bypass queries - should NOT have label injection
+			for _, bypassQuery := range bypassQueries {
+				t.Logf("Testing bypass query: %s", bypassQuery)
+				req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s&tenant=%s", endpoint, url.QueryEscape(bypassQuery), enforcer.ParameterName), nil)
+				w := httptest.NewRecorder()
+				routes.ServeHTTP(w, req)
+
+				t.Logf("Response status: %d, body: %s", w.Code, w.Body.String())
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected status OK, got %d", w.Code)
+				}
+				body := w.Body.String()
+				if body != bypassQuery {
+					t.Errorf("Expected '%s' (bypassed query), got '%s'", bypassQuery, body)
+				}
+			}
+
+			// Test non-bypass query - should have label injection
+			t.Logf("Testing non-bypass query: rate(http_requests_total[5m])")
+			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=rate(http_requests_total[5m])&tenant=test", endpoint), nil)
+			w := httptest.NewRecorder()
+			routes.ServeHTTP(w, req)
+
+			t.Logf("Response status: %d, body: %s", w.Code, w.Body.String())
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status OK, got %d", w.Code)
+			}
+
+			body := w.Body.String()
+			if !strings.Contains(body, `namespace="test"`) {
+				t.Errorf("Expected query with label injection containing 'namespace=\"test\"', got '%s'", body)
+			}
+		})
+	}
+}
+
+func TestBypassMatchers(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("query")))
+	}))
+	defer m.Close()
+
+	t.Run("invalid selector", func(t *testing.T) {
+		_, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithBypassMatchers([]string{`up{`}))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithBypassMatchers([]string{`up{job="prometheus",instance="localhost:9090"}`, `{__name__="node_boot_time_seconds"}`}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+
+		expQuery string
+	}{
+		{
+			query:    `up{job="prometheus",instance="localhost:9090"}`,
+			expQuery: `up{job="prometheus",instance="localhost:9090"}`,
+		},
+		{
+			// Whitespaces and label ordering don't matter.
+			query:    `up{ instance="localhost:9090", job="prometheus" }`,
+			expQuery: `up{ instance="localhost:9090", job="prometheus" }`,
+		},
+		{
+			// Additional matchers select a subset of the series.
+			query:    `sum(rate(up{instance="localhost:9090",job="prometheus",code="200"}[5m])) / node_boot_time_seconds`,
+			expQuery: `sum(rate(up{instance="localhost:9090",job="prometheus",code="200"}[5m])) / node_boot_time_seconds`,
+		},
+		{
+			// Missing matcher.
+			query:    `up{job="prometheus"}`,
+			expQuery: `up{job="prometheus",namespace="ns1"}`,
+		},
+		{
+			// Different matcher type.
+			query:    `up{job=~"prometheus",instance="localhost:9090"}`,
+			expQuery: `up{instance="localhost:9090",job=~"prometheus",namespace="ns1"}`,
+		},
+		{
+			// One of the selectors isn't bypassed.
+			query:    `node_boot_time_seconds + foo`,
+			expQuery: `node_boot_time_seconds{namespace="ns1"} + foo{namespace="ns1"}`,
+		},
+		{
+			// No selector.
+			query:    `1+1`,
+			expQuery: `1 + 1`,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{queryParam: {tc.query}, proxyLabel: {"ns1"}}.Encode(), nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, w.Code)
+			}
+
+			if got := w.Body.String(); got != tc.expQuery {
+				t.Fatalf("expected query %q, got %q", tc.expQuery, got)
+			}
+		})
+	}
+}
+
+func TestWithQueryParamAliases(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			prometheusAPIError(w, fmt.Sprintf("unexpected error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "query=%q g0.expr=%q", req.Form["query"], req.Form["g0.expr"])
+	}))
+	defer m.Close()
+
+	for _, aliases := range [][]string{{""}, {"query"}} {
+		if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithQueryParamAliases(aliases)); err == nil {
+			t.Fatalf("expected error for aliases %q", aliases)
+		}
+	}
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithQueryParamAliases([]string{"g0.expr"}),
+		WithBypassQueries([]string{"up"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		body   url.Values
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "alias without query",
+			url:     "/api/v1/query?g0.expr=foo&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: `query=[] g0.expr=["foo{namespace=\"ns1\"}"]`,
+		},
+		{
+			name:    "alias and query",
+			url:     "/api/v1/query_range?query=foo&g0.expr=bar&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: `query=["foo{namespace=\"ns1\"}"] g0.expr=["bar{namespace=\"ns1\"}"]`,
+		},
+		{
+			name:    "alias in the POST body",
+			method:  http.MethodPost,
+			url:     "/api/v1/query?namespace=ns1",
+			body:    url.Values{"g0.expr": []string{"foo"}},
+			expCode: http.StatusOK,
+			expBody: `query=[] g0.expr=["foo{namespace=\"ns1\"}"]`,
+		},
+		{
+			name:    "bypassed alias",
+			url:     "/api/v1/query?g0.expr=up&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: `query=[] g0.expr=["up"]`,
+		},
+		{
+			name:    "bypassed query with alias",
+			url:     "/api/v1/query?query=up&g0.expr=foo&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: `query=["up{namespace=\"ns1\"}"] g0.expr=["foo{namespace=\"ns1\"}"]`,
+		},
+		{
+			name:    "bypassed query in the URL and query in the POST body",
+			method:  http.MethodPost,
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			body:    url.Values{"query": []string{"foo"}},
+			expCode: http.StatusOK,
+			expBody: `query=["foo{namespace=\"ns1\"}" "up{namespace=\"ns1\"}"] g0.expr=[]`,
+		},
+		{
+			name:    "bypassed query in the URL and alias in the POST body",
+			method:  http.MethodPost,
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			body:    url.Values{"g0.expr": []string{"foo"}},
+			expCode: http.StatusOK,
+			expBody: `query=["up{namespace=\"ns1\"}"] g0.expr=["foo{namespace=\"ns1\"}"]`,
+		},
+		{
+			name:    "bypassed query repeated with another query",
+			url:     "/api/v1/query?query=up&query=foo&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: `query=["up{namespace=\"ns1\"}" "foo{namespace=\"ns1\"}"] g0.expr=[]`,
+		},
+		{
+			name:    "bypassed query and alias",
+			method:  http.MethodPost,
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			body:    url.Values{"g0.expr": []string{"up"}},
+			expCode: http.StatusOK,
+			expBody: `query=["up"] g0.expr=["up"]`,
+		},
+		{
+			name:    "invalid alias",
+			url:     "/api/v1/query?g0.expr=foo{&namespace=ns1",
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := http.MethodGet
+			if tc.method != "" {
+				method = tc.method
+			}
+
+			req := httptest.NewRequest(method, "http://prometheus.example.com"+tc.url, strings.NewReader(tc.body.Encode()))
+			if tc.body != nil {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expBody != "" && w.Body.String() != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStrictContentLength(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler(url.Values{"query": {`up{namespace="default"}`}}.Encode(), queryParam))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithStrictContentLength())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	body := url.Values{"query": {"up"}}.Encode()
+	for _, tc := range []struct {
+		name          string
+		contentLength int64
+		expCode       int
+	}{
+		{
+			name:          "matching Content-Length",
+			contentLength: int64(len(body)),
+			expCode:       http.StatusOK,
+		},
+		{
+			name:          "Content-Length smaller than body",
+			contentLength: int64(len(body)) - 1,
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:          "Content-Length larger than body",
+			contentLength: int64(len(body)) + 1,
+			expCode:       http.StatusBadRequest,
+		},
+		{
+			name:          "unknown Content-Length",
+			contentLength: -1,
+			expCode:       http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.ContentLength = tc.contentLength
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestLabelValuesToRegexpStringSetMatches(t *testing.T) {
+	for _, n := range []int{2, 10, 100, 256} {
+		t.Run(fmt.Sprintf("%d values", n), func(t *testing.T) {
+			values := make([]string, n)
+			for i := range values {
+				values[i] = fmt.Sprintf("team-%d.some|thing", i)
+			}
+
+			m, err := labels.NewMatcher(labels.MatchRegexp, proxyLabel, labelValuesToRegexpString(values))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The set matches are only available when Prometheus optimizes
+			// the regexp into a list of literal values.
+			got := m.SetMatches()
+			sort.Strings(got)
+			sort.Strings(values)
+			if !slices.Equal(got, values) {
+				t.Fatalf("expected set matches %v, got %v", values, got)
+			}
+
+			if m.Matches("team-0-some|thing") || m.Matches("xteam-0.some|thing") {
+				t.Fatal("expected the matcher to match only the literal values")
+			}
+		})
+	}
+}
+
+func BenchmarkLabelValuesMatcher(b *testing.B) {
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = fmt.Sprintf("team-%d", i)
+	}
+
+	m, err := labels.NewMatcher(labels.MatchRegexp, proxyLabel, labelValuesToRegexpString(values))
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Matches(values[i%len(values)])
+	}
+}
+
+func TestUnsupportedMediaType(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request forwarded to the upstream: %s", req.URL.String())
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithEnabledLabelsAPI())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		// JSON bodies are supported by the query endpoints.
+		matchersOnly bool
+	}{
+		{
+			contentType:  "application/json",
+			body:         `{"query":"up"}`,
+			matchersOnly: true,
+		},
+		{
+			contentType: "application/grpc-web+proto",
+			body:        "\x00\x00\x00\x00\x02up",
+		},
+		{
+			contentType: "application/grpc-web-text",
+			body:        "AAAAAAJ1cA==",
+		},
+		{
+			contentType: "",
+			body:        "query=up",
+		},
+		{
+			contentType: "multipart/form-data; boundary=xxx",
+			body:        "--xxx\r\nContent-Disposition: form-data; name=\"query\"\r\n\r\nup\r\n--xxx--\r\n",
+		},
+	} {
+		for _, endpoint := range []string{"/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/labels"} {
+			if tc.matchersOnly && strings.HasPrefix(endpoint, "/api/v1/query") {
+				continue
+			}
+
+			t.Run(endpoint+"/"+tc.contentType, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+endpoint, strings.NewReader(tc.body))
+				if tc.contentType != "" {
+					req.Header.Set("Content-Type", tc.contentType)
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				if resp.StatusCode != http.StatusUnsupportedMediaType {
+					b, _ := io.ReadAll(resp.Body)
+					t.Fatalf("expected status code %d, got %d: %s", http.StatusUnsupportedMediaType, resp.StatusCode, string(b))
+				}
+			})
+		}
+	}
+}
+
+func TestBehaviorVersion(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	t.Run("invalid version", func(t *testing.T) {
+		for _, v := range []int{-1, LatestBehaviorVersion + 1} {
+			if _, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithBehaviorVersion(v)); err == nil {
+				t.Fatalf("expected error for version %d", v)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expCode int
+	}{
+		{
+			name:    "default",
+			expCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "version 1",
+			opts:    []Option{WithBehaviorVersion(BehaviorVersion1)},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "version 2",
+			opts:    []Option{WithBehaviorVersion(BehaviorVersion2)},
+			expCode: http.StatusUnsupportedMediaType,
+		},
+	} {
+		r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, tc.opts...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, endpoint := range []string{"/api/v1/query", "/api/v1/query_range"} {
+			t.Run(tc.name+endpoint, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+endpoint, strings.NewReader(`query=up`))
+				req.Header.Set("Content-Type", "text/plain")
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				if resp.StatusCode != tc.expCode {
+					b, _ := io.ReadAll(resp.Body)
+					t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+				}
+			})
+		}
+	}
+
+	t.Run("enforcement fixes apply to version 1", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%q", req.URL.Query()[queryParam])
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithBehaviorVersion(BehaviorVersion1))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&query=foo", nil))
+
+		if exp := `["up{namespace=\"default\"}" "foo{namespace=\"default\"}"]`; w.Body.String() != exp {
+			t.Fatalf("expected %s, got %s", exp, w.Body.String())
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/series", strings.NewReader(`{"match[]":["up"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusUnsupportedMediaType, w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestQueryJSONBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		body string
+		opts []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "query",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up","time":"1700000000"}`,
+			expCode: http.StatusOK,
+			expBody: `{"query":"up{namespace=\"default\"}","time":"1700000000"}`,
+		},
+		{
+			name:    "query range",
+			url:     "http://prometheus.example.com/api/v1/query_range",
+			body:    `{"query":"sum(rate(http_requests_total{job=\"api\"}[5m]))","start":1700000000,"end":1700003600,"step":"1m"}`,
+			expCode: http.StatusOK,
+			expBody: `{"end":1700003600,"query":"sum(rate(http_requests_total{job=\"api\",namespace=\"default\"}[5m]))","start":1700000000,"step":"1m"}`,
+		},
+		{
+			name:    "lookback delta clamped",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up","lookback_delta":"1h"}`,
+			opts:    []Option{WithMaxLookbackDelta(5*time.Minute, LookbackDeltaClamp)},
+			expCode: http.StatusOK,
+			expBody: `{"lookback_delta":"5m","query":"up{namespace=\"default\"}"}`,
+		},
+		{
+			name:    "conflicting matcher",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up{namespace=\"other\"}"}`,
+			opts:    []Option{WithErrorOnReplace()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "query isn't a string",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":["up"]}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "field name differing by case",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up","Query":"secret"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "only field name differing by case",
+			url:     "http://prometheus.example.com/api/v1/query?query=up",
+			body:    `{"QUERY":"secret"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "range parameter differing by case",
+			url:     "http://prometheus.example.com/api/v1/query_range",
+			body:    `{"query":"up","start":"0","end":"60","step":"1s","Start":"-1e9"}`,
+			opts:    []Option{WithRangeLimits(time.Hour, 0)},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid JSON",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up"`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid query",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up{"}`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(b) != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, string(b))
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestQueryJSONBatchBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		body string
+		opts []Option
+
+		expCode  int
+		expBody  string
+		expError string
+	}{
+		{
+			name:    "batch",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `[{"expr":"up","refId":"A"},{"expr":"sum(rate(http_requests_total[5m]))","refId":"B"}]`,
+			expCode: http.StatusOK,
+			expBody: `[{"expr":"up{namespace=\"default\"}","refId":"A"},{"expr":"sum(rate(http_requests_total{namespace=\"default\"}[5m]))","refId":"B"}]`,
+		},
+		{
+			name:    "single object",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up"}`,
+			expCode: http.StatusOK,
+			expBody: `{"query":"up{namespace=\"default\"}"}`,
+		},
+		{
+			name:     "conflicting matcher",
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     `[{"expr":"up"},{"expr":"up{namespace=\"other\"}"}]`,
+			opts:     []Option{WithErrorOnReplace()},
+			expCode:  http.StatusBadRequest,
+			expError: "batch query 1: ",
+		},
+		{
+			name:     "missing field",
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     `[{"expr":"up"},{"query":"up"}]`,
+			expCode:  http.StatusBadRequest,
+			expError: "batch query 1: ",
+		},
+		{
+			name:     "not an object",
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     `[{"expr":"up"},"up"]`,
+			expCode:  http.StatusBadRequest,
+			expError: "can't decode JSON batch body",
+		},
+		{
+			name:     "invalid query",
+			url:      "http://prometheus.example.com/api/v1/query",
+			body:     `[{"expr":"up{"}]`,
+			expCode:  http.StatusBadRequest,
+			expError: "batch query 0: ",
+		},
+		{
+			name:     "range limits",
+			url:      "http://prometheus.example.com/api/v1/query_range",
+			body:     `[{"expr":"up","start":"0","end":"3600","step":"60"},{"expr":"up","start":"0","end":"315360000","step":"60"}]`,
+			opts:     []Option{WithRangeLimits(24*time.Hour, 0)},
+			expCode:  http.StatusBadRequest,
+			expError: "batch query 1: ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(b) != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, string(b))
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, append(tc.opts, WithBatchQueryField("expr"))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			b, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+			if !strings.Contains(string(b), tc.expError) {
+				t.Fatalf("expected error %q, got %s", tc.expError, string(b))
+			}
+		})
+	}
+}
+
+func TestHTTPFormEnforcerJSONBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		body string
+		opts []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "parameter removed from the JSON body",
+			url:     "http://prometheus.example.com/api/v1/query?namespace=default",
+			body:    `{"query":"up","namespace":"other"}`,
+			expCode: http.StatusOK,
+			expBody: `{"query":"up{namespace=\"default\"}"}`,
+		},
+		{
+			name:    "alias removed from the JSON body",
+			url:     "http://prometheus.example.com/api/v1/query_range?namespace=default",
+			body:    `{"query":"up","tenant":"other","step":"1m"}`,
+			expCode: http.StatusOK,
+			expBody: `{"query":"up{namespace=\"default\"}","step":"1m"}`,
+		},
+		{
+			name:    "parameter removed from the JSON batch body",
+			url:     "http://prometheus.example.com/api/v1/query?tenant=default",
+			body:    `[{"expr":"up","namespace":"other"},{"expr":"up","refId":"B"}]`,
+			opts:    []Option{WithBatchQueryField("expr")},
+			expCode: http.StatusOK,
+			expBody: `[{"expr":"up{namespace=\"default\"}"},{"expr":"up{namespace=\"default\"}","refId":"B"}]`,
+		},
+		{
+			name:    "parameter only in the JSON body",
+			url:     "http://prometheus.example.com/api/v1/query",
+			body:    `{"query":"up","namespace":"default"}`,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid JSON",
+			url:     "http://prometheus.example.com/api/v1/query?namespace=default",
+			body:    `{"query":"up"`,
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if string(b) != tc.expBody {
+					t.Errorf("expected body %s, got %s", tc.expBody, string(b))
+				}
+				w.Write(okResponse)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel, Aliases: []string{"tenant"}}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestMatcherUnsupportedMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+
+		expCode int
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"match[]":["up"]}`,
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "missing content type",
+			body:    "match[]=up",
+			expCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "form-encoded",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "match[]=up",
+			expCode:     http.StatusOK,
+		},
+	} {
+		for _, endpoint := range []string{"/api/v1/series", "/api/v1/labels"} {
+			t.Run(tc.name+endpoint, func(t *testing.T) {
+				m := newMockUpstream(checkFormHandler(matchersParam, `{__name__="up",namespace="default"}`))
+				defer m.Close()
+
+				// The matcher endpoints reject the request even with the
+				// first behavior version.
+				r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithEnabledLabelsAPI(), WithBehaviorVersion(BehaviorVersion1))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+endpoint, strings.NewReader(tc.body))
+				if tc.contentType != "" {
+					req.Header.Set("Content-Type", tc.contentType)
+				}
+
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+
+				resp := w.Result()
+				if resp.StatusCode != tc.expCode {
+					b, _ := io.ReadAll(resp.Body)
+					t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+				}
+			})
+		}
+	}
+}
+
+func TestHTMLErrorPages(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		accept string
+		opts   []Option
+
+		expContentType string
+	}{
+		{
+			name:           "browser",
+			accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			opts:           []Option{WithHTMLErrorPages()},
+			expContentType: "text/html; charset=utf-8",
+		},
+		{
+			name:           "browser without the option",
+			accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			expContentType: "application/json; charset=utf-8",
+		},
+		{
+			name:           "JSON client",
+			accept:         "application/json",
+			opts:           []Option{WithHTMLErrorPages()},
+			expContentType: "application/json; charset=utf-8",
+		},
+		{
+			name:           "any content type",
+			accept:         "*/*",
+			opts:           []Option{WithHTMLErrorPages()},
+			expContentType: "application/json; charset=utf-8",
+		},
+		{
+			name:           "no Accept header",
+			opts:           []Option{WithHTMLErrorPages()},
+			expContentType: "application/json; charset=utf-8",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The namespace parameter is missing.
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+
+			if got := resp.Header.Get("Content-Type"); got != tc.expContentType {
+				t.Fatalf("expected content type %q, got %q", tc.expContentType, got)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), "query parameter must be provided.") {
+				t.Fatalf("expected the error message in the body, got %q", string(body))
+			}
+		})
+	}
+
+	t.Run("successful request from browser", func(t *testing.T) {
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithHTMLErrorPages())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil)
+		req.Header.Set("Accept", "text/html")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK || w.Body.String() != string(okResponse) {
+			t.Fatalf("expected upstream response, got %d: %q", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestWithErrorResponseDecorator(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	decorator := func(req *http.Request, code int, body map[string]any) {
+		body["requestId"] = req.Header.Get("X-Request-Id")
+		if code == http.StatusBadRequest {
+			body["errorType"] = "bad_data"
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expBody string
+	}{
+		{
+			name:    "default",
+			expBody: `{"error":"The \"namespace\" query parameter must be provided.","errorType":"prom-label-proxy","status":"error"}` + "\n",
+		},
+		{
+			name:    "decorated",
+			opts:    []Option{WithErrorResponseDecorator(decorator)},
+			expBody: `{"error":"The \"namespace\" query parameter must be provided.","errorType":"bad_data","requestId":"abc","status":"error"}` + "\n",
+		},
+		{
+			name:    "decorated with HTML error pages",
+			opts:    []Option{WithErrorResponseDecorator(decorator), WithHTMLErrorPages()},
+			expBody: `{"error":"The \"namespace\" query parameter must be provided.","errorType":"bad_data","requestId":"abc","status":"error"}` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The namespace parameter is missing.
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.Header.Set("X-Request-Id", "abc")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, w.Code)
+			}
+
+			if got := w.Body.String(); got != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestMultiLabelRoutes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if v := q.Get("query"); v != "" {
+			w.Write([]byte(v))
+			return
+		}
+		w.Write([]byte(strings.Join(append(q["match[]"], q["filter"]...), " ")))
+	}))
+	defer m.Close()
+
+	t.Run("invalid labels", func(t *testing.T) {
+		for _, enforcedLabels := range [][]EnforcedLabel{
+			nil,
+			{{Name: "", ExtractLabeler: StaticLabelEnforcer{"a"}}},
+			{{Name: "namespace"}},
+			{
+				{Name: "namespace", ExtractLabeler: StaticLabelEnforcer{"a"}},
+				{Name: "namespace", ExtractLabeler: StaticLabelEnforcer{"b"}},
+			},
+		} {
+			if _, err := NewMultiLabelRoutes(m.url, enforcedLabels); err == nil {
+				t.Fatalf("expected error for %v", enforcedLabels)
+			}
+		}
+	})
+
+	r, err := NewMultiLabelRoutes(m.url, []EnforcedLabel{
+		{Name: "namespace", ExtractLabeler: HTTPFormEnforcer{ParameterName: "namespace"}},
+		{Name: "cluster", ExtractLabeler: HTTPHeaderEnforcer{Name: "X-Cluster"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		cluster []string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "query",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			cluster: []string{"eu"},
+			expCode: http.StatusOK,
+			expBody: `up{cluster="eu",namespace="ns1"}`,
+		},
+		{
+			name:    "query with multiple values",
+			url:     "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			cluster: []string{"eu"},
+			expCode: http.StatusOK,
+			expBody: `up{cluster="eu",namespace=~"ns1|ns2"}`,
+		},
+		{
+			name:    "query without cluster",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "query without namespace",
+			url:     "/api/v1/query?query=up",
+			cluster: []string{"eu"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "series",
+			url:     "/api/v1/series?match[]=up&namespace=ns1",
+			cluster: []string{"eu", "us"},
+			expCode: http.StatusOK,
+			expBody: `{__name__="up",namespace="ns1",cluster=~"eu|us"}`,
+		},
+		{
+			name:    "silences",
+			url:     "/api/v2/silences?namespace=ns1&filter=" + url.QueryEscape(`cluster="us"`),
+			cluster: []string{"eu"},
+			expCode: http.StatusOK,
+			expBody: `namespace="ns1" cluster="eu"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			for _, v := range tc.cluster {
+				req.Header.Add("X-Cluster", v)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := w.Body.String(); got != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestInjectedLabelResponseHeader(t *testing.T) {
+	const header = "X-Prom-Label-Proxy-Injected"
+
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		opts   []Option
+		header string
+
+		expHeader []string
+	}{
+		{
+			name:      "query with single value",
+			url:       "/api/v1/query?query=up&namespace=team-a",
+			opts:      []Option{WithInjectedLabelResponseHeader(header)},
+			expHeader: []string{`namespace="team-a"`},
+		},
+		{
+			name:      "query with multiple values",
+			url:       "/api/v1/query_range?query=up&namespace=team-a&namespace=team-b",
+			opts:      []Option{WithInjectedLabelResponseHeader(header)},
+			expHeader: []string{`namespace=~"team-a|team-b"`},
+		},
+		{
+			name:      "query with regexp",
+			url:       "/api/v1/query?query=up&namespace=team-.%2B",
+			opts:      []Option{WithInjectedLabelResponseHeader(header), WithRegexMatch()},
+			expHeader: []string{`namespace=~"team-.+"`},
+		},
+		{
+			name:      "series",
+			url:       "/api/v1/series?match[]=up&namespace=team-a",
+			opts:      []Option{WithInjectedLabelResponseHeader(header)},
+			expHeader: []string{`namespace="team-a"`},
+		},
+		{
+			name: "option unset",
+			url:  "/api/v1/query?query=up&namespace=team-a",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			if got := resp.Header.Values(header); !slices.Equal(got, tc.expHeader) {
+				t.Fatalf("expected header %q, got %q", tc.expHeader, got)
+			}
+		})
+	}
+}
+
+func TestQueryExemplarsAdversarial(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    url.Values
+		body     url.Values
+		labelEnf ExtractLabeler
+
+		expCode    int
+		expQueries []string
+		expBody    string
+	}{
+		{
+			name:       "name regexp with another tenant's label",
+			query:      url.Values{queryParam: {`{__name__=~".+",namespace="ns2"}`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`{__name__=~".+",namespace="ns1"}`},
+		},
+		{
+			name:       "quoted label names",
+			query:      url.Values{queryParam: {`{"__name__"="up","namespace"="ns2"}`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`{__name__="up",namespace="ns1"}`},
+		},
+		{
+			name:       "negative matcher on the enforced label",
+			query:      url.Values{queryParam: {`{__name__="up",namespace!="ns1"}`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`{__name__="up",namespace="ns1"}`},
+		},
+		{
+			name:       "label_replace() rewriting the enforced label",
+			query:      url.Values{queryParam: {`label_replace(up{namespace="ns2"}, "namespace", "ns1", "", "")`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`label_replace(up{namespace="ns1"}, "namespace", "ns1", "", "")`},
+		},
+		{
+			name:       "selectors in binary expression",
+			query:      url.Values{queryParam: {`up or {__name__=~"up|foo",namespace=~".*"}`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`up{namespace="ns1"} or {__name__=~"up|foo",namespace="ns1"}`},
+		},
+		{
+			name:       "duplicated query parameter",
+			query:      url.Values{queryParam: {`up`, `{namespace="ns2"}`}, proxyLabel: {"ns1"}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`up{namespace="ns1"}`, `{namespace="ns1"}`},
+		},
+		{
+			name:       "query in both the URL and the body",
+			query:      url.Values{queryParam: {`up`}, proxyLabel: {"ns1"}},
+			body:       url.Values{queryParam: {`{__name__="up",namespace="ns2"}`}},
+			expCode:    http.StatusOK,
+			expQueries: []string{`up{namespace="ns1"}`},
+			expBody:    url.Values{queryParam: {`{__name__="up",namespace="ns1"}`}}.Encode(),
+		},
+		{
+			name:     "invalid body",
+			query:    url.Values{queryParam: {`up`}},
+			labelEnf: StaticLabelEnforcer{"ns1"},
+			expCode:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkParameterAbsent(proxyLabel, checkQueryHandler(tc.expBody, queryParam, tc.expQueries...)))
+			defer m.Close()
+
+			labelEnf := tc.labelEnf
+			if labelEnf == nil {
+				labelEnf = HTTPFormEnforcer{ParameterName: proxyLabel}
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, labelEnf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method, body := http.MethodGet, io.Reader(nil)
+			switch {
+			case tc.body != nil:
+				method, body = http.MethodPost, strings.NewReader(tc.body.Encode())
+			case tc.labelEnf != nil:
+				method, body = http.MethodPost, strings.NewReader("query=%zz")
+			}
+
+			req := httptest.NewRequest(method, "http://prometheus.example.com/api/v1/query_exemplars?"+tc.query.Encode(), body)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+func TestDefaultLabelValue(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		el     ExtractLabeler
+		opts   []Option
+		header []string
+		labelv []string
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:    "missing header without default",
+			el:      HTTPHeaderEnforcer{Name: "X-Namespace"},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:     "missing header with default",
+			el:       HTTPHeaderEnforcer{Name: "X-Namespace"},
+			opts:     []Option{WithDefaultLabelValue("default")},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "present header with default",
+			el:       HTTPHeaderEnforcer{Name: "X-Namespace"},
+			opts:     []Option{WithDefaultLabelValue("default")},
+			header:   []string{"team-a"},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-a"}`,
+		},
+		{
+			name:     "missing parameter with default",
+			el:       HTTPFormEnforcer{ParameterName: proxyLabel},
+			opts:     []Option{WithDefaultLabelValue("default")},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "empty parameter with default",
+			el:       HTTPFormEnforcer{ParameterName: proxyLabel},
+			opts:     []Option{WithDefaultLabelValue("default")},
+			labelv:   []string{""},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:    "invalid header with default",
+			el:      HTTPHeaderEnforcer{Name: "X-Namespace", ParseListSyntax: true},
+			opts:    []Option{WithDefaultLabelValue("default")},
+			header:  []string{`"team-a`},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "too many values with default",
+			el:      HTTPFormEnforcer{ParameterName: proxyLabel},
+			opts:    []Option{WithDefaultLabelValue("public"), WithSingleValueOnly()},
+			labelv:  []string{"a", "b"},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", "query", tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.el, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{"query": {"up"}, proxyLabel: tc.labelv}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			for _, v := range tc.header {
+				req.Header.Add("X-Namespace", v)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := w.Body.String(); got != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), got)
+			}
+		})
+	}
+}
+
+func TestHTTPFormEnforcerParameterNames(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		el     HTTPFormEnforcer
+		method string
+		params url.Values
+
+		expCode   int
+		expValues []string
+	}{
+		{
+			name:      "parameter name different from the label",
+			el:        HTTPFormEnforcer{ParameterName: "tenant"},
+			params:    url.Values{"tenant": []string{"foo"}},
+			expCode:   http.StatusOK,
+			expValues: []string{"foo"},
+		},
+		{
+			name:    "label name isn't accepted as parameter",
+			el:      HTTPFormEnforcer{ParameterName: "tenant"},
+			params:  url.Values{proxyLabel: []string{"foo"}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:      "alias",
+			el:        HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{proxyLabel}},
+			params:    url.Values{proxyLabel: []string{"foo"}},
+			expCode:   http.StatusOK,
+			expValues: []string{"foo"},
+		},
+		{
+			name:      "parameter and alias",
+			el:        HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{proxyLabel}},
+			params:    url.Values{"tenant": []string{"foo"}, proxyLabel: []string{"bar"}},
+			expCode:   http.StatusOK,
+			expValues: []string{"bar", "foo"},
+		},
+		{
+			name:      "alias with POST",
+			el:        HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{proxyLabel}},
+			method:    http.MethodPost,
+			params:    url.Values{proxyLabel: []string{"foo"}},
+			expCode:   http.StatusOK,
+			expValues: []string{"foo"},
+		},
+		{
+			name:    "missing parameter and alias",
+			el:      HTTPFormEnforcer{ParameterName: "tenant", Aliases: []string{proxyLabel}},
+			params:  url.Values{"other": []string{"foo"}},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				gotValues []string
+				gotParams url.Values
+			)
+			h := tc.el.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+				gotValues = MustLabelValues(req.Context())
+
+				// Only the URL and the body are forwarded upstream.
+				gotParams = req.URL.Query()
+				b, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				form, err := url.ParseQuery(string(b))
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				for k, v := range form {
+					gotParams[k] = append(gotParams[k], v...)
+				}
+			})
+
+			var req *http.Request
+			if tc.method == http.MethodPost {
+				req = httptest.NewRequest(http.MethodPost, "http://prometheus.example.com/api/v1/query", strings.NewReader(tc.params.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			} else {
+				req = httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+tc.params.Encode(), nil)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if !reflect.DeepEqual(gotValues, tc.expValues) {
+				t.Fatalf("expected label values %v, got %v", tc.expValues, gotValues)
+			}
+
+			for _, name := range append([]string{tc.el.ParameterName}, tc.el.Aliases...) {
+				if gotParams.Has(name) {
+					t.Fatalf("expected parameter %q to be removed, got %v", name, gotParams)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictMux(t *testing.T) {
+	handlerFor := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		patterns []string
+		exact    bool
+
+		expErr []bool
+		// Maps request paths to the name of the expected handler. An empty
+		// value means that no handler should match.
+		expRoutes map[string]string
+	}{
+		{
+			name:     "single pattern",
+			patterns: []string{"/foo"},
+			expErr:   []bool{false},
+			expRoutes: map[string]string{
+				"/foo":     "/foo",
+				"/foo/":    "/foo",
+				"/foo/bar": "/foo",
+				"/foobar":  "",
+				"/":        "",
+			},
+		},
+		{
+			name:     "same pattern with trailing slash",
+			patterns: []string{"/foo", "/foo/"},
+			expErr:   []bool{false, true},
+		},
+		{
+			name:     "same pattern with multiple trailing slashes",
+			patterns: []string{"/foo", "/foo//"},
+			expErr:   []bool{false, true},
+		},
+		{
+			name:     "pattern with multiple trailing slashes first",
+			patterns: []string{"/foo//", "/foo"},
+			expErr:   []bool{false, true},
+			expRoutes: map[string]string{
+				"/foo":  "/foo//",
+				"/foo/": "/foo//",
+			},
+		},
+		{
+			name:     "pattern with embedded slashes",
+			patterns: []string{"/foo//bar", "/foo/bar"},
+			expErr:   []bool{false, true},
+			expRoutes: map[string]string{
+				"/foo/bar":  "/foo//bar",
+				"/foo/bar/": "/foo//bar",
+				"/foo":      "",
+			},
+		},
+		{
+			name:     "sub-path of a registered pattern",
+			patterns: []string{"/foo", "/foo/bar", "/foo//bar"},
+			expErr:   []bool{false, true, true},
+		},
+		{
+			name:     "parent of a registered pattern",
+			patterns: []string{"/foo/bar", "/foo"},
+			expErr:   []bool{false, false},
+			expRoutes: map[string]string{
+				"/foo/bar": "/foo/bar",
+				"/foo/baz": "/foo",
+			},
+		},
+		{
+			name:     "pattern sharing a prefix",
+			patterns: []string{"/foo", "/foobar"},
+			expErr:   []bool{false, false},
+			expRoutes: map[string]string{
+				"/foo":     "/foo",
+				"/foo/":    "/foo",
+				"/foobar":  "/foobar",
+				"/foobar/": "/foobar",
+				"/foob":    "",
+			},
+		},
+		{
+			name:     "pattern sharing a prefix registered first",
+			patterns: []string{"/foobar", "/foo"},
+			expErr:   []bool{false, false},
+		},
+		{
+			name:     "root patterns",
+			patterns: []string{"/", "//", "///", "", "foo", "/foo/.."},
+			expErr:   []bool{true, true, true, true, true, true},
+			expRoutes: map[string]string{
+				"/":    "",
+				"/foo": "",
+			},
+		},
+		{
+			name:     "pattern with dot segments",
+			patterns: []string{"/foo", "/bar/../foo"},
+			expErr:   []bool{false, true},
+		},
+		{
+			name:     "exact pattern",
+			patterns: []string{"/foo//"},
+			exact:    true,
+			expErr:   []bool{false},
+			expRoutes: map[string]string{
+				"/foo":     "/foo//",
+				"/foo/":    "",
+				"/foo/bar": "",
+			},
+		},
+		{
+			name:     "sub-path of an exact pattern",
+			patterns: []string{"/foo", "/foo/bar"},
+			exact:    true,
+			expErr:   []bool{false, true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newStrictMux(http.NewServeMux())
+			handle := m.Handle
+			if tc.exact {
+				handle = m.HandleExact
+			}
+			for i, p := range tc.patterns {
+				err := handle(p, handlerFor(p))
+				if tc.expErr[i] {
+					if err == nil {
+						t.Fatalf("expected error for pattern %q, got none", p)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("unexpected error for pattern %q: %v", p, err)
+				}
+			}
+
+			for p, exp := range tc.expRoutes {
+				w := httptest.NewRecorder()
+				m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com"+p, nil))
+
+				if exp == "" {
+					if w.Code != http.StatusNotFound {
+						t.Fatalf("%s: expected status code %d, got %d", p, http.StatusNotFound, w.Code)
+					}
+					continue
+				}
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: expected status code %d, got %d", p, http.StatusOK, w.Code)
+				}
+
+				if got := w.Body.String(); got != exp {
+					t.Fatalf("%s: expected handler %q, got %q", p, exp, got)
+				}
+			}
+		})
+	}
+}
+
+func TestPathParameterEnforcer(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.URL.Path + " " + req.URL.Query().Get("query")))
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(
+		m.url,
+		proxyLabel,
+		PathParameterEnforcer{Regexp: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)/`), Name: "tenant"},
+		WithPassthroughPaths([]string{"/graph"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		url  string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "query",
+			url:     "/tenants/team-a/api/v1/query?query=up",
+			expCode: http.StatusOK,
+			expBody: `/api/v1/query up{namespace="team-a"}`,
+		},
+		{
+			name:    "query with escaped tenant",
+			url:     "/tenants/team%20a/api/v1/query?query=up",
+			expCode: http.StatusOK,
+			expBody: `/api/v1/query up{namespace="team a"}`,
+		},
+		{
+			name:    "passthrough path",
+			url:     "/tenants/team-a/graph",
+			expCode: http.StatusOK,
+			expBody: "/graph ",
+		},
+		{
+			name:    "missing tenant prefix",
+			url:     "/api/v1/query?query=up",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "non-matching prefix",
+			url:     "/other/team-a/api/v1/query?query=up",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "tenant without path",
+			url:     "/tenants/team-a",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "health endpoint without tenant prefix",
+			url:     "/healthz",
+			expCode: http.StatusOK,
+			expBody: `{"ok":true}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := strings.TrimSpace(w.Body.String()); got != strings.TrimSpace(tc.expBody) {
+				t.Fatalf("expected body %q, got %q", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestGzipEncodedRequestBody(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, _ = gw.Write([]byte(s))
+		_ = gw.Close()
+		return buf.Bytes()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		body     []byte
+		encoding string
+		opts     []Option
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:     "gzip-encoded query",
+			url:      "/api/v1/query?namespace=default",
+			body:     gzipped(`query=up`),
+			encoding: "gzip",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "gzip-encoded range query",
+			url:      "/api/v1/query_range?namespace=default",
+			body:     gzipped(`query=up&start=0&end=1&step=1`),
+			encoding: "GZIP",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "gzip-encoded query with label value in the body",
+			url:      "/api/v1/query",
+			body:     gzipped(`query=up&namespace=default`),
+			encoding: "gzip",
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "gzip-encoded bypass query",
+			url:      "/api/v1/query?namespace=default",
+			body:     gzipped(`query=vector(1)`),
+			encoding: "gzip",
+			opts:     []Option{WithBypassQueries([]string{"vector(1)"})},
+			expCode:  http.StatusOK,
+			expQuery: `vector(1)`,
+		},
+		{
+			name:     "gzip-encoded query with strict content length",
+			url:      "/api/v1/query?namespace=default",
+			body:     gzipped(`query=up`),
+			encoding: "gzip",
+			opts:     []Option{WithStrictContentLength()},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "uncompressed query",
+			url:      "/api/v1/query?namespace=default",
+			body:     []byte(`query=up`),
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="default"}`,
+		},
+		{
+			name:     "invalid gzip payload",
+			url:      "/api/v1/query?namespace=default",
+			body:     []byte(`query=up`),
+			encoding: "gzip",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "truncated gzip payload",
+			url:      "/api/v1/query?namespace=default",
+			body:     gzipped(`query=up`)[:15],
+			encoding: "gzip",
+			expCode:  http.StatusBadRequest,
+		},
+		{
+			name:     "decompressed payload too large",
+			url:      "/api/v1/query?namespace=default",
+			body:     gzipped(`query=up&foo=` + strings.Repeat("a", maxDecompressedBodySize)),
+			encoding: "gzip",
+			expCode:  http.StatusRequestEntityTooLarge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if enc := req.Header.Get("Content-Encoding"); enc != "" {
+					prometheusAPIError(w, fmt.Sprintf("unexpected Content-Encoding header %q", enc), http.StatusInternalServerError)
+					return
+				}
+
+				checkFormHandler("query", tc.expQuery).ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.url, bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.encoding != "" {
+				req.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := w.Body.String(); got != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), got)
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		endpoint string
+		body     string
+		chunked  bool
+
+		expCode int
+	}{
+		{
+			name:     "query within the limit",
+			opts:     []Option{WithMaxBodyBytes(64)},
+			endpoint: "/api/v1/query",
+			body:     "query=up",
+			expCode:  http.StatusOK,
+		},
+		{
+			name:     "query exceeding the limit",
+			opts:     []Option{WithMaxBodyBytes(64)},
+			endpoint: "/api/v1/query",
+			body:     "query=up&foo=" + strings.Repeat("a", 64),
+			expCode:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "chunked query exceeding the limit",
+			opts:     []Option{WithMaxBodyBytes(64)},
+			endpoint: "/api/v1/query",
+			body:     "query=up&foo=" + strings.Repeat("a", 64),
+			chunked:  true,
+			expCode:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "series exceeding the limit",
+			opts:     []Option{WithMaxBodyBytes(64)},
+			endpoint: "/api/v1/series",
+			body:     "match[]=up&foo=" + strings.Repeat("a", 64),
+			expCode:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "default limit",
+			endpoint: "/api/v1/query",
+			body:     "query=up&foo=" + strings.Repeat("a", defaultMaxBodyBytes),
+			expCode:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "limit disabled",
+			opts:     []Option{WithMaxBodyBytes(-1)},
+			endpoint: "/api/v1/query",
+			body:     "query=up&foo=" + strings.Repeat("a", 1024),
+			expCode:  http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var body io.Reader = strings.NewReader(tc.body)
+			if tc.chunked {
+				// Hide the length of the body.
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "http://prometheus.example.com"+tc.endpoint, body)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				b, _ := io.ReadAll(resp.Body)
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(b))
+			}
+		})
+	}
+}
+
+// lossyPromQLParser simulates a parser which doesn't unescape the label
+// values.
+type lossyPromQLParser struct {
+	DefaultPromQLParser
+}
+
+func (p lossyPromQLParser) ParseMetricSelector(input string) ([]*labels.Matcher, error) {
+	ms, err := p.DefaultPromQLParser.ParseMetricSelector(input)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range ms {
+		m.Value = strings.ReplaceAll(m.Value, "\n", `\n`)
+	}
+
+	return ms, nil
+}
+
+func TestMatcherRoundTripValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		path   string
+		values []string
+		opts   []Option
+
+		expCode  int
+		expQuery string
+		expMatch string
+	}{
+		{
+			name:     "query with double quotes",
+			path:     "/api/v1/query",
+			values:   []string{`team"a`},
+			opts:     []Option{WithMatcherRoundTripValidation()},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team\"a"}`,
+		},
+		{
+			name:     "query with backslashes",
+			path:     "/api/v1/query",
+			values:   []string{`team\a\\`},
+			opts:     []Option{WithMatcherRoundTripValidation()},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team\\a\\\\"}`,
+		},
+		{
+			name:     "query with newline",
+			path:     "/api/v1/query",
+			values:   []string{"team\na"},
+			opts:     []Option{WithMatcherRoundTripValidation()},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team\na"}`,
+		},
+		{
+			name:     "query with multiple values",
+			path:     "/api/v1/query",
+			values:   []string{`team"a`, "team\nb", `team\c`},
+			opts:     []Option{WithMatcherRoundTripValidation()},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"team\nb|team\"a|team\\\\c"}`,
+		},
+		{
+			name:     "query with regexp match type",
+			path:     "/api/v1/query",
+			values:   []string{`team"a.b`},
+			opts:     []Option{WithMatcherRoundTripValidation(), WithMatchType(labels.MatchRegexp)},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace=~"team\"a\\.b"}`,
+		},
+		{
+			name:     "series with quotes, backslashes and newline",
+			path:     "/api/v1/series",
+			values:   []string{"\"team\\\na"},
+			opts:     []Option{WithMatcherRoundTripValidation()},
+			expCode:  http.StatusOK,
+			expMatch: `{__name__="up",namespace="\"team\\\na"}`,
+		},
+		{
+			name:    "query with failed round-trip",
+			path:    "/api/v1/query",
+			values:  []string{"team\na"},
+			opts:    []Option{WithMatcherRoundTripValidation(), WithPromQLParser(lossyPromQLParser{})},
+			expCode: http.StatusInternalServerError,
+		},
+		{
+			name:    "series with failed round-trip",
+			path:    "/api/v1/series",
+			values:  []string{"team\na"},
+			opts:    []Option{WithMatcherRoundTripValidation(), WithPromQLParser(lossyPromQLParser{})},
+			expCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "query with lossy parser without validation",
+			path:     "/api/v1/query",
+			values:   []string{"team\na"},
+			opts:     []Option{WithPromQLParser(lossyPromQLParser{})},
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team\na"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := checkQueryHandler("", "query", tc.expQuery)
+			if tc.expMatch != "" {
+				h = checkQueryHandler("", "match[]", tc.expMatch)
+			}
+			m := newMockUpstream(h)
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{proxyLabel: tc.values}
+			if tc.path == "/api/v1/series" {
+				q.Set("match[]", "up")
+			} else {
+				q.Set("query", "up")
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			if got := w.Body.String(); got != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), got)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := newMockUpstream(checkQueryHandler("", "query", `up{namespace="default"}`))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPHeaderEnforcer{Name: "X-Namespace"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Authenticate the requests and register the proxy under a sub-path.
+	h := r.Handler()
+	mux := http.NewServeMux()
+	mux.Handle("/prometheus/", http.StripPrefix("/prometheus", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req.Header.Set("X-Namespace", "default")
+		h.ServeHTTP(w, req)
+	})))
+
+	for _, tc := range []struct {
+		name  string
+		url   string
+		token string
+
+		expCode int
+	}{
+		{
+			name:    "authorized request",
+			url:     "/prometheus/api/v1/query?query=up",
+			token:   "secret",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "unauthorized request",
+			url:     "/prometheus/api/v1/query?query=up",
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "request outside of the sub-path",
+			url:     "/api/v1/query?query=up",
+			token:   "secret",
+			expCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// countingRoundTripper counts the requests before delegating them to the
+// default transport.
+type countingRoundTripper struct {
+	rt    http.RoundTripper
+	paths []string
+}
+
+func (c *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.paths = append(c.paths, req.URL.Path)
+	return c.rt.RoundTrip(req)
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	t.Run("default transport", func(t *testing.T) {
+		tr := newDefaultUpstreamTransport()
+		if tr.ResponseHeaderTimeout != defaultUpstreamResponseHeaderTimeout {
+			t.Fatalf("expected response header timeout %v, got %v", defaultUpstreamResponseHeaderTimeout, tr.ResponseHeaderTimeout)
+		}
+		if tr.MaxIdleConnsPerHost != defaultUpstreamMaxIdleConnsPerHost {
+			t.Fatalf("expected %d max idle connections per host, got %d", defaultUpstreamMaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+		}
+		if tr == http.DefaultTransport {
+			t.Fatal("expected a copy of the default transport")
+		}
+	})
+
+	t.Run("custom transport", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write(okResponse)
+		}))
+		defer m.Close()
+
+		rt := &countingRoundTripper{rt: http.DefaultTransport}
+		r, err := NewRoutes(
+			m.url,
+			proxyLabel,
+			HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithUpstreamTransport(rt),
+			WithUpstreamHealthCheck("/-/ready"),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, u := range []string{"/api/v1/query?query=up&namespace=default", "/healthz"} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+u, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status code %d, got %d: %s", u, http.StatusOK, w.Code, w.Body.String())
+			}
+		}
+
+		if exp := []string{"/api/v1/query", "/-/ready"}; !slices.Equal(rt.paths, exp) {
+			t.Fatalf("expected requests to %v, got %v", exp, rt.paths)
+		}
+	})
+
+	t.Run("custom transport for the silence lookups", func(t *testing.T) {
+		m := newMockUpstream(&chainedHandlers{
+			handlers: []http.Handler{
+				getSilenceWithLabel("default"),
+				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					_, _ = w.Write([]byte("ok"))
+				}),
+			},
+		})
+		defer m.Close()
+
+		rt := &countingRoundTripper{rt: http.DefaultTransport}
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamTransport(rt))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "http://alertmanager.example.com/api/v2/silence/"+silID+"?namespace=default", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		if exp := []string{"/api/v2/silence/" + silID, "/api/v2/silence/" + silID}; !slices.Equal(rt.paths, exp) {
+			t.Fatalf("expected requests to %v, got %v", exp, rt.paths)
+		}
+	})
+
+	t.Run("response header timeout", func(t *testing.T) {
+		done := make(chan struct{})
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-done:
+			case <-req.Context().Done():
+			}
+			_, _ = w.Write(okResponse)
+		}))
+		defer m.Close()
+		defer close(done)
+
+		tr := newDefaultUpstreamTransport()
+		tr.ResponseHeaderTimeout = 10 * time.Millisecond
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithUpstreamTransport(tr))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=default", nil))
+		if w.Code == http.StatusOK {
+			t.Fatalf("expected an error, got status code %d", w.Code)
+		}
+	})
+}
+
+func TestEnforcementRejectionsMetric(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		opts []Option
+
+		expReason string
+		expPath   string
+	}{
+		{
+			name:      "missing label",
+			url:       "/api/v1/query?query=up",
+			expReason: "missing_label",
+			expPath:   "/api/v1/query",
+		},
+		{
+			name:      "illegal matcher",
+			url:       `/api/v1/query?query=up{namespace="other"}&namespace=default`,
+			opts:      []Option{WithErrorOnReplace()},
+			expReason: "illegal_matcher",
+			expPath:   "/api/v1/query",
+		},
+		{
+			name:      "query parse",
+			url:       "/api/v1/query_range?query=up{&namespace=default",
+			expReason: "query_parse",
+			expPath:   "/api/v1/query_range",
+		},
+		{
+			name:      "invalid matcher",
+			url:       "/api/v1/series?match[]=up{&namespace=default",
+			expReason: "query_parse",
+			expPath:   "/api/v1/series",
+		},
+		{
+			name:      "regexp matching the empty string",
+			url:       "/api/v1/series?match[]=up&namespace=.*",
+			opts:      []Option{WithRegexMatch()},
+			expReason: "regex_empty",
+			expPath:   "/api/v1/series",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				t.Errorf("unexpected request forwarded to the upstream: %s", req.URL.String())
+			}))
+			defer m.Close()
+
+			reg := prometheus.NewRegistry()
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithPrometheusRegistry(reg))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse("http://prometheus.example.com" + tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			u.RawQuery = u.Query().Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+
+			if got := testutil.ToFloat64(r.rejections.WithLabelValues(tc.expReason, tc.expPath)); got != 1 {
+				t.Fatalf("expected 1 rejection for reason %q and path %q, got %v", tc.expReason, tc.expPath, got)
+			}
+
+			if got := testutil.CollectAndCount(r.rejections); got != 1 {
+				t.Fatalf("expected 1 series, got %d", got)
+			}
+		})
+	}
+}
+
+func TestRegexAnchoring(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	if _, err := NewRoutes(u, proxyLabel, StaticLabelEnforcer{"team"}, WithRegexAnchoring()); err == nil {
+		t.Fatal("expected error without regex match")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labelv string
+		opts   []Option
+
+		expCode      int
+		expPromQuery string
+		// Label values which the enforced matcher must (not) match.
+		matching    []string
+		notMatching []string
+	}{
+		{
+			name:         "regex match",
+			labelv:       "team",
+			opts:         []Option{WithRegexMatch()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"team"}`,
+			matching:     []string{"team"},
+			notMatching:  []string{"team-secret", "my-team"},
+		},
+		{
+			name:         "regex match with anchoring",
+			labelv:       "team",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"^(?:team)$"}`,
+			matching:     []string{"team"},
+			notMatching:  []string{"team-secret", "my-team"},
+		},
+		{
+			name:         "alternation with anchoring",
+			labelv:       "team-a|team-b",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"^(?:team-a|team-b)$"}`,
+			matching:     []string{"team-a", "team-b"},
+			notMatching:  []string{"team-a-secret", "team-c"},
+		},
+		{
+			name:         "suffix wildcard with anchoring",
+			labelv:       "team-.+",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"^(?:team-.+)$"}`,
+			matching:     []string{"team-a", "team-secret"},
+			notMatching:  []string{"my-team-a"},
+		},
+		{
+			name:         "prefix wildcard without anchoring",
+			labelv:       ".*team",
+			opts:         []Option{WithRegexMatch()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~".*team"}`,
+			matching:     []string{"team", "my-team"},
+		},
+		{
+			name:    "prefix wildcard with anchoring",
+			labelv:  ".*team",
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "anchored prefix wildcard with anchoring",
+			labelv:  "^.+team",
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "prefix wildcard in alternation with anchoring",
+			labelv:  "team|(.*-team)",
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "optional character before the wildcard with anchoring",
+			labelv:  `.?.*team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "repeated character before the wildcard with anchoring",
+			labelv:  `a*.*team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "character class wildcard with anchoring",
+			labelv:  `[\s\S]*team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "any byte wildcard with anchoring",
+			labelv:  `\C*team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "repeated capture group wildcard with anchoring",
+			labelv:  `(.*)+team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "optional prefix wildcard with anchoring",
+			labelv:  `team|(.*-team)?`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring(), WithAllowEmptyMatchingRegex()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "negated character class with anchoring",
+			labelv:  `[^-]+-team`,
+			opts:    []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:         "common literal prefix with anchoring",
+			labelv:       "team-(a|b.*)",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"^(?:team-(a|b.*))$"}`,
+			matching:     []string{"team-a", "team-b-secret"},
+			notMatching:  []string{"my-team-a"},
+		},
+		{
+			name:         "literal prefixes in alternation with anchoring",
+			labelv:       "team.*|other",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"^(?:team.*|other)$"}`,
+			matching:     []string{"team-a", "other"},
+			notMatching:  []string{"my-team", "another"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: []string{"up"}, proxyLabel: []string{tc.labelv}}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			// Verify the semantics of the injected matcher.
+			ms, err := parser.ParseMetricSelector(tc.expPromQuery)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, m := range ms {
+				if m.Name != proxyLabel {
+					continue
+				}
+
+				for _, v := range tc.matching {
+					if !m.Matches(v) {
+						t.Errorf("expected %s to match %q", m, v)
+					}
+				}
+				for _, v := range tc.notMatching {
+					if m.Matches(v) {
+						t.Errorf("expected %s to not match %q", m, v)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("alertmanager filters", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if got, exp := req.URL.Query()["filter"], []string{`namespace=~"^(?:team-.*)$"`}; !slices.Equal(got, exp) {
+				t.Errorf("expected filter %q, got %q", exp, got)
+			}
+			w.Write([]byte(`[]`))
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRegexMatch(), WithRegexAnchoring())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, path := range []string{"/api/v2/alerts", "/api/v2/alerts/groups"} {
+			for _, tc := range []struct {
+				labelv  string
+				expCode int
+			}{
+				{labelv: "team-.*", expCode: http.StatusOK},
+				{labelv: ".*team", expCode: http.StatusBadRequest},
+			} {
+				q := url.Values{proxyLabel: []string{tc.labelv}}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://alertmanager.example.com"+path+"?"+q.Encode(), nil))
+
+				if w.Code != tc.expCode {
+					t.Fatalf("%s with %q: expected status code %d, got %d: %s", path, tc.labelv, tc.expCode, w.Code, w.Body.String())
+				}
+			}
+		}
+	})
+}
+
+func TestOrAbsent(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	if _, err := NewRoutes(u, proxyLabel, StaticLabelEnforcer{"default"}, WithOrAbsent(), WithMatchType(labels.MatchNotEqual)); err == nil {
+		t.Fatal("expected error with negative match type")
+	}
+
+	for _, tc := range []struct {
+		name      string
+		labelv    []string
+		promQuery string
+		opts      []Option
+
+		expCode      int
+		expPromQuery string
+	}{
+		{
+			name:         "single value",
+			labelv:       []string{"default"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"default|"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body`,
-			labelv:           []string{"default"},
-			promQueryBody:    "up",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `up{namespace="default"}`,
-			expResponse:      okResponse,
+			name:         "value with special characters",
+			labelv:       []string{"team.a"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"team\\.a|"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body with multiple label values`,
-			labelv:           []string{"default", "second"},
-			promQueryBody:    "up",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `up{namespace=~"default|second"}`,
-			expResponse:      okResponse,
+			name:         "multiple values",
+			labelv:       []string{"a", "b"},
+			promQuery:    "up",
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"(?:a|b)|"}`,
 		},
 		{
-			name:             `Tricky: Query without a vector selector in GET body (yes, that's possible)'`,
-			labelv:           []string{"default"},
-			promQueryBody:    "up",
-			method:           http.MethodGet,
-			expCode:          http.StatusOK,
-			expPromQueryBody: ``, // We should finish request without forwarding. Form should not parse this value for GET.
+			name:         "regex match",
+			labelv:       []string{"team-.+"},
+			promQuery:    "up",
+			opts:         []Option{WithRegexMatch()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"(?:team-.+)|"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body or query`,
-			labelv:           []string{"default"},
-			promQuery:        "up",
-			promQueryBody:    "up",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQuery:     `up{namespace="default"}`,
-			expPromQueryBody: `up{namespace="default"}`,
-			expResponse:      okResponse,
+			name:         "existing matcher is preserved",
+			labelv:       []string{"default"},
+			promQuery:    `up{namespace="default"}`,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="default",namespace=~"default|"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body or query with multiple label values`,
-			labelv:           []string{"default", "second"},
-			promQuery:        "up",
-			promQueryBody:    "up",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQuery:     `up{namespace=~"default|second"}`,
-			expPromQueryBody: `up{namespace=~"default|second"}`,
-			expResponse:      okResponse,
+			name:         "absent label with error on replace",
+			labelv:       []string{"default"},
+			promQuery:    `up{namespace=""}`,
+			opts:         []Option{WithErrorOnReplace()},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="",namespace=~"default|"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body or query different`,
-			labelv:           []string{"default"},
-			promQuery:        "up",
-			promQueryBody:    "foo",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQuery:     `up{namespace="default"}`,
-			expPromQueryBody: `foo{namespace="default"}`,
-			expResponse:      okResponse,
+			name:      "conflicting matcher with error on replace",
+			labelv:    []string{"default"},
+			promQuery: `up{namespace="other"}`,
+			opts:      []Option{WithErrorOnReplace()},
+			expCode:   http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer(tc.labelv), append(tc.opts, WithOrAbsent())...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+url.Values{queryParam: {tc.promQuery}}.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+
+	t.Run("query results verification", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[` +
+				`{"metric":{"__name__":"up","namespace":"other"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]},` +
+				`{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{"default"}, WithOrAbsent(), WithVerifyQueryResults(VerifyQueryResultsDrop))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil))
+
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code 200, got %d: %s", resp.StatusCode, string(body))
+		}
+
+		exp := `{"status":"success","data":{"result":[{"metric":{"__name__":"up","namespace":"default"},"value":[1,"1"]},{"metric":{"__name__":"up"},"value":[1,"1"]}],"resultType":"vector"}}`
+		if got := strings.TrimSpace(string(body)); got != exp {
+			t.Fatalf("expected body %s, got %s", exp, got)
+		}
+	})
+}
+
+func TestWithLabelValueMapper(t *testing.T) {
+	tenants := map[string]string{"org-1": "team-a", "org-2": "team-b"}
+	mapper := func(_ context.Context, values []string) ([]string, error) {
+		mapped := make([]string, 0, len(values))
+		for _, v := range values {
+			tenant, found := tenants[strings.ToLower(v)]
+			if !found {
+				return nil, fmt.Errorf("unknown organization %q", v)
+			}
+			mapped = append(mapped, tenant)
+		}
+		return mapped, nil
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		mapper func(context.Context, []string) ([]string, error)
+		opts   []Option
+
+		expCode      int
+		expPromQuery string
+	}{
+		{
+			name:         "single value",
+			labelv:       []string{"ORG-1"},
+			mapper:       mapper,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="team-a"}`,
 		},
 		{
-			name:             `Query without a vector selector in POST body or query different with multiple label values`,
-			labelv:           []string{"default", "second"},
-			promQuery:        "up",
-			promQueryBody:    "foo",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQuery:     `up{namespace=~"default|second"}`,
-			expPromQueryBody: `foo{namespace=~"default|second"}`,
-			expResponse:      okResponse,
+			name:         "multiple values",
+			labelv:       []string{"org-1", "org-2"},
+			mapper:       mapper,
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"team-a|team-b"}`,
 		},
 		{
-			name:         `Query with a vector selector`,
-			labelv:       []string{"default"},
-			promQuery:    `up{namespace="other"}`,
+			name:    "mapper error",
+			labelv:  []string{"org-3"},
+			mapper:  mapper,
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:   "no value after mapping",
+			labelv: []string{"org-1"},
+			mapper: func(context.Context, []string) ([]string, error) {
+				return nil, nil
+			},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:         "default label value",
+			mapper:       mapper,
+			opts:         []Option{WithDefaultLabelValue("org-2")},
 			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace="default"}`,
-			expResponse:  okResponse,
+			expPromQuery: `up{namespace="team-b"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithLabelValueMapper(tc.mapper))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: tc.labelv}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+}
+
+func TestWithAllowedAndDeniedLabelValues(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		opts   []Option
+
+		expCode      int
+		expPromQuery string
+	}{
+		{
+			name:         "allowed value",
+			labelv:       []string{"team-a"},
+			opts:         []Option{WithAllowedLabelValues([]string{"team-a", "team-b"})},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="team-a"}`,
 		},
 		{
-			name:         `Query with a vector selector with multiple label values`,
-			labelv:       []string{"default", "second"},
-			promQuery:    `up{namespace="second"}`,
+			name:         "allowed values",
+			labelv:       []string{"team-a", "team-b"},
+			opts:         []Option{WithAllowedLabelValues([]string{"team-a", "team-b"})},
 			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace="second",namespace=~"default|second"}`,
-			expResponse:  okResponse,
+			expPromQuery: `up{namespace=~"team-a|team-b"}`,
 		},
 		{
-			name:         `Query with a vector selector with empty label values`,
-			labelv:       []string{"default", ""},
-			promQuery:    `up{namespace="other"}`,
+			name:    "value not allowed",
+			labelv:  []string{"team-a", "team-c"},
+			opts:    []Option{WithAllowedLabelValues([]string{"team-a", "team-b"})},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "denied value",
+			labelv:  []string{"admin"},
+			opts:    []Option{WithDeniedLabelValues([]string{"admin"})},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:    "allowed but denied value",
+			labelv:  []string{"team-a"},
+			opts:    []Option{WithAllowedLabelValues([]string{"team-a"}), WithDeniedLabelValues([]string{"team-a"})},
+			expCode: http.StatusForbidden,
+		},
+		{
+			name:         "value not denied",
+			labelv:       []string{"team-a"},
+			opts:         []Option{WithDeniedLabelValues([]string{"admin"})},
 			expCode:      http.StatusOK,
-			expPromQuery: `up{namespace="default"}`,
-			expResponse:  okResponse,
+			expPromQuery: `up{namespace="team-a"}`,
 		},
 		{
-			name:             `Query with a vector selector in POST body`,
-			labelv:           []string{"default"},
-			promQueryBody:    `up{namespace="other"}`,
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `up{namespace="default"}`,
-			expResponse:      okResponse,
+			name:         "allowed values ignored with regex match",
+			labelv:       []string{"team-.*"},
+			opts:         []Option{WithRegexMatch(), WithAllowedLabelValues([]string{"team-a"})},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace=~"team-.*"}`,
 		},
 		{
-			name:             `Query with a vector selector in POST body with multiple label values`,
-			labelv:           []string{"default", "second"},
-			promQueryBody:    `up{namespace="second"}`,
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `up{namespace="second",namespace=~"default|second"}`,
-			expResponse:      okResponse,
+			name:    "denied regex",
+			labelv:  []string{".+"},
+			opts:    []Option{WithRegexMatch(), WithDeniedLabelValues([]string{".+"})},
+			expCode: http.StatusForbidden,
 		},
 		{
-			name:           `Query with a vector selector and errorOnReplace`,
-			labelv:         []string{"default"},
-			promQuery:      `up{namespace="other"}`,
-			errorOnReplace: true,
-			expCode:        http.StatusBadRequest,
-			expResponse:    nil,
+			name:    "mapped value not allowed",
+			labelv:  []string{"team-a"},
+			opts:    []Option{WithAllowedLabelValues([]string{"team-a"}), WithLabelValueMapper(func(_ context.Context, _ []string) ([]string, error) { return []string{"team-c"}, nil })},
+			expCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: tc.labelv}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+}
+
+func TestWithMaxLabelValues(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMaxLabelValues(-1)); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		labelv  []string
+		headers http.Header
+		el      ExtractLabeler
+		opts    []Option
+
+		expCode int
+	}{
+		{
+			name:    "form values under the limit",
+			labelv:  []string{"team-a", "team-b"},
+			expCode: http.StatusOK,
 		},
 		{
-			name:           `Query with a vector selector in POST body and errorOnReplace`,
-			labelv:         []string{"default"},
-			promQueryBody:  `up{namespace="other"}`,
-			method:         http.MethodPost,
-			errorOnReplace: true,
-			expCode:        http.StatusBadRequest,
-			expResponse:    nil,
+			name:    "form values over the limit",
+			labelv:  []string{"team-a", "team-b", "team-c"},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:         `Query with a scalar`,
-			labelv:       []string{"default"},
-			promQuery:    "1",
-			expCode:      http.StatusOK,
-			expPromQuery: `1`,
-			expResponse:  okResponse,
+			name:    "header values over the limit",
+			headers: http.Header{"X-Tenant": []string{"team-a, team-b", "team-c"}},
+			el:      HTTPHeaderEnforcer{Name: "X-Tenant", ParseListSyntax: true},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:             `Query with a scalar in POST body`,
-			labelv:           []string{"default"},
-			promQueryBody:    "1",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `1`,
-			expResponse:      okResponse,
+			name:    "default value",
+			opts:    []Option{WithDefaultLabelValue("default")},
+			expCode: http.StatusOK,
 		},
 		{
-			name:         `Query with a function`,
-			labelv:       []string{"default"},
-			promQuery:    "time()",
-			expCode:      http.StatusOK,
-			expPromQuery: `time()`,
-			expResponse:  okResponse,
+			name:    "form values over the limit with default value",
+			labelv:  []string{"team-a", "team-b", "team-c"},
+			opts:    []Option{WithDefaultLabelValue("default")},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:             `Query with a function in POST body`,
-			labelv:           []string{"default"},
-			promQueryBody:    "time()",
-			method:           http.MethodPost,
-			expCode:          http.StatusOK,
-			expPromQueryBody: `time()`,
-			expResponse:      okResponse,
+			name:   "mapped values over the limit",
+			labelv: []string{"team-a"},
+			opts: []Option{WithLabelValueMapper(func(_ context.Context, values []string) ([]string, error) {
+				return append(values, "team-b", "team-c"), nil
+			})},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:      `An invalid expression returns 400 with error response`,
-			labelv:    []string{"default"},
-			promQuery: "up +",
-			expCode:   http.StatusBadRequest,
+			name:   "mapped values under the limit",
+			labelv: []string{"team-a", "team-b", "team-c"},
+			opts: []Option{WithLabelValueMapper(func(_ context.Context, values []string) ([]string, error) {
+				return values[:1], nil
+			})},
+			expCode: http.StatusOK,
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			el := tc.el
+			if el == nil {
+				el = HTTPFormEnforcer{ParameterName: proxyLabel}
+			}
+
+			r, err := NewRoutes(m.url, proxyLabel, el, append(tc.opts, WithMaxLabelValues(2))...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: tc.labelv}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			for k, v := range tc.headers {
+				req.Header[k] = v
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithSingleValueOnly(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		labelv []string
+		opts   []Option
+
+		expCode int
+	}{
 		{
-			name:          `An invalid expression in POST body returns 400 with error response`,
-			labelv:        []string{"default"},
-			promQueryBody: "up +",
-			method:        http.MethodPost,
-			expCode:       http.StatusBadRequest,
+			name:    "query with single value",
+			url:     "http://prometheus.example.com/api/v1/query?query=up",
+			labelv:  []string{"team-a"},
+			expCode: http.StatusOK,
 		},
 		{
-			name:         `Binary expression`,
-			labelv:       []string{"default"},
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
-			expResponse:  okResponse,
+			name:    "query with multiple values",
+			url:     "http://prometheus.example.com/api/v1/query?query=up",
+			labelv:  []string{"team-a", "team-b"},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:         `Binary expression with multiple label values`,
-			labelv:       []string{"default", "second"},
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
-			expResponse:  okResponse,
+			name:    "series with multiple values",
+			url:     "http://prometheus.example.com/api/v1/series?match[]=up",
+			labelv:  []string{"team-a", "team-b"},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:           `Static label value`,
-			staticLabelVal: []string{"default"},
-			promQuery:      `up{instance="localhost:9090"} + foo{namespace="default"}`,
-			expCode:        http.StatusOK,
-			expPromQuery:   `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
-			expResponse:    okResponse,
+			name:    "rules with multiple values",
+			url:     "http://prometheus.example.com/api/v1/rules",
+			labelv:  []string{"team-a", "team-b"},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:           `Multiple static label values`,
-			staticLabelVal: []string{"default", "second"},
-			promQuery:      `up{instance="localhost:9090"} + foo{namespace="second"}`,
-			expCode:        http.StatusOK,
-			expPromQuery:   `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
-			expResponse:    okResponse,
+			name:    "precedence over max label values",
+			url:     "http://prometheus.example.com/api/v1/query?query=up",
+			labelv:  []string{"team-a", "team-b"},
+			opts:    []Option{WithMaxLabelValues(5)},
+			expCode: http.StatusBadRequest,
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, append(tc.opts, WithSingleValueOnly())...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			q := u.Query()
+			q[proxyLabel] = tc.labelv
+			u.RawQuery = q.Encode()
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.String(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithMetricNameDenylist(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMetricNameDenylist([]string{"apiserver_("})); err == nil {
+		t.Fatal("expected error")
+	}
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithMetricNameDenylist([]string{"apiserver_.*"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		query    string
+		matchers []string
+
+		expCode int
+	}{
+		{path: "/api/v1/query", query: `up`, expCode: http.StatusOK},
+		{path: "/api/v1/query", query: `sum(rate(apiserver_request_total[5m]))`, expCode: http.StatusForbidden},
+		{path: "/api/v1/query_range", query: `apiserver_request_total`, expCode: http.StatusForbidden},
+		{path: "/api/v1/query", query: `count({job="apiserver"})`, expCode: http.StatusForbidden},
+		{path: "/api/v1/query", query: `{__name__=~"api.+"}`, expCode: http.StatusForbidden},
+		{path: "/api/v1/series", matchers: []string{`up`, `{__name__="go_goroutines",job="x"}`}, expCode: http.StatusOK},
+		{path: "/api/v1/series", matchers: []string{`up`, `apiserver_request_total`}, expCode: http.StatusForbidden},
+		{path: "/api/v1/series", matchers: []string{`{job="apiserver"}`}, expCode: http.StatusForbidden},
+		{path: "/api/v1/series", matchers: []string{`{__name__!="up"}`}, expCode: http.StatusForbidden},
+		{path: "/federate", matchers: []string{`{__name__=~"apiserver_.+"}`}, expCode: http.StatusForbidden},
+		{path: "/federate", matchers: []string{`{__name__=~"up|go_goroutines"}`}, expCode: http.StatusOK},
+	} {
+		t.Run(tc.path+" "+tc.query+strings.Join(tc.matchers, ","), func(t *testing.T) {
+			q := url.Values{proxyLabel: {"ns1"}}
+			if tc.query != "" {
+				q.Set(queryParam, tc.query)
+			}
+			q[matchersParam] = tc.matchers
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.path+"?"+q.Encode(), nil))
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(r.rejections.WithLabelValues(rejectionDeniedMetricName, "/api/v1/query")); got != 3 {
+		t.Fatalf("expected 3 rejected requests, got %v", got)
+	}
+
+	if got := testutil.ToFloat64(r.rejections.WithLabelValues(rejectionDeniedMetricName, "/api/v1/series")); got != 3 {
+		t.Fatalf("expected 3 rejected requests, got %v", got)
+	}
+}
+
+func TestWithForwardOrgIDHeader(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	for _, tc := range []struct {
+		name   string
+		labels []EnforcedLabel
+		opts   []Option
+	}{
 		{
-			name:         `HTTP header label value`,
-			headers:      http.Header{"namespace": []string{"default"}},
-			headerName:   "namespace",
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
-			expResponse:  okResponse,
+			name: "multiple enforced labels",
+			labels: []EnforcedLabel{
+				{Name: "namespace", ExtractLabeler: StaticLabelEnforcer{"ns1"}},
+				{Name: "cluster", ExtractLabeler: StaticLabelEnforcer{"eu"}},
+			},
 		},
 		{
-			name:         `multiple HTTP header label values`,
-			headers:      http.Header{"namespace": []string{"default", "second"}},
-			headerName:   "namespace",
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second"} + foo{namespace="second",namespace=~"default|second"}`,
-			expResponse:  okResponse,
+			name:   "regex match",
+			labels: []EnforcedLabel{{Name: "namespace", ExtractLabeler: StaticLabelEnforcer{"ns.*"}}},
+			opts:   []Option{WithRegexMatch()},
 		},
-		{
-			name:         `HTTP header label with comma-separated values and list parsing disabled`,
-			headers:      http.Header{"namespace": []string{"default, second", "third"}},
-			headerName:   "namespace",
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"default, second|third"} + foo{namespace="second",namespace=~"default, second|third"}`,
-			expResponse:  okResponse,
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewMultiLabelRoutes(u, tc.labels, append(tc.opts, WithForwardOrgIDHeader("X-Scope-OrgID"))...); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
 
-			headerUsesListSyntax: false,
-		},
-		{
-			name:         `HTTP header label with comma-separated values and list parsing enabled`,
-			headers:      http.Header{"namespace": []string{"default, second", "third"}},
-			headerName:   "namespace",
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="second"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"default|second|third"} + foo{namespace="second",namespace=~"default|second|third"}`,
-			expResponse:  okResponse,
+	for _, tc := range []struct {
+		name   string
+		labelv []string
+		orgID  string
 
-			headerUsesListSyntax: true,
+		expCode  int
+		expOrgID string
+	}{
+		{
+			name:     "single value",
+			labelv:   []string{"ns1"},
+			expCode:  http.StatusOK,
+			expOrgID: "ns1",
 		},
 		{
-			name:         `multiple HTTP header with empty label value`,
-			headers:      http.Header{"namespace": []string{"default", ""}},
-			headerName:   "namespace",
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
-			expResponse:  okResponse,
+			name:     "header sent by the client is overwritten",
+			labelv:   []string{"ns1"},
+			orgID:    "ns2",
+			expCode:  http.StatusOK,
+			expOrgID: "ns1",
 		},
 		{
-			name:         `query param label value`,
-			queryParam:   "namespace2",
-			labelv:       []string{"default"},
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace="default"} + foo{namespace="default"}`,
-			expResponse:  okResponse,
+			name:    "multiple values",
+			labelv:  []string{"ns1", "ns2"},
+			expCode: http.StatusUnprocessableEntity,
 		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got := req.Header.Values("X-Scope-OrgID"); len(got) != 1 || got[0] != tc.expOrgID {
+					prometheusAPIError(w, fmt.Sprintf("expected X-Scope-OrgID header %q, got %q", tc.expOrgID, got), http.StatusInternalServerError)
+					return
+				}
+				checkQueryHandler("", queryParam, `up{namespace="`+tc.expOrgID+`"}`).ServeHTTP(w, req)
+			}))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithForwardOrgIDHeader("X-Scope-OrgID"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: tc.labelv}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			if tc.orgID != "" {
+				req.Header.Set("X-Scope-OrgID", tc.orgID)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+
+	t.Run("header removed from the passthrough requests", func(t *testing.T) {
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if got := req.Header.Values("X-Scope-OrgID"); len(got) != 0 {
+				prometheusAPIError(w, fmt.Sprintf("unexpected X-Scope-OrgID header %q", got), http.StatusInternalServerError)
+				return
+			}
+			w.Write(okResponse)
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithForwardOrgIDHeader("X-Scope-OrgID"),
+			WithPassthroughPaths([]string{"/api/v1/status/config"}),
+			WithPassthroughPathsMethods(map[string][]string{"/api/v1/status/flags": {http.MethodGet}}),
+			WithStreamingPassthroughPaths([]string{"/api/v1/live"}),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, path := range []string{"/api/v1/status/config", "/api/v1/status/flags", "/api/v1/live"} {
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+path, nil)
+			req.Header.Set("X-Scope-OrgID", "victim")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: expected status code %d, got %d: %s", path, http.StatusOK, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("header set on the requests of the proxy", func(t *testing.T) {
+		metadata := &metadataUpstream{t: t}
+		m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if got := req.Header.Values("X-Scope-OrgID"); len(got) != 1 || got[0] != "ns1" {
+				prometheusAPIError(w, fmt.Sprintf("expected X-Scope-OrgID header %q, got %q", "ns1", got), http.StatusUnauthorized)
+				return
+			}
+
+			switch {
+			case req.URL.Path != "/api/v2/silence/"+silID:
+				metadata.ServeHTTP(w, req)
+			case req.Method == http.MethodGet:
+				getSilenceWithLabel("ns1").ServeHTTP(w, req)
+			default:
+				w.Write(okResponse)
+			}
+		}))
+		defer m.Close()
+
+		r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+			WithForwardOrgIDHeader("X-Scope-OrgID"),
+			WithEmulatedMetadataFiltering(),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, req := range []*http.Request{
+			httptest.NewRequest(http.MethodDelete, "http://alertmanager.example.com/api/v2/silence/"+silID+"?namespace=ns1", nil),
+			httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/metadata?namespace=ns1", nil),
+		} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: expected status code %d, got %d: %s", req.Method, req.URL.Path, http.StatusOK, w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestWithAllowEmptyMatchingRegex(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	if _, err := NewRoutes(u, proxyLabel, StaticLabelEnforcer{"team-a|"}, WithAllowEmptyMatchingRegex()); err == nil {
+		t.Fatal("expected error without regex match")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labelv string
+		opts   []Option
+
+		expCode      int
+		expPromQuery string
+	}{
 		{
-			name:         `HTTP header as regexp`,
-			headers:      http.Header{"namespace": []string{"tenant1-.*"}},
-			headerName:   "namespace",
-			regexMatch:   true,
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
-			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="other",namespace=~"tenant1-.*"}`,
-			expResponse:  okResponse,
+			name:    "empty matching regex is rejected by default",
+			labelv:  "team-a|",
+			opts:    []Option{WithRegexMatch()},
+			expCode: http.StatusBadRequest,
 		},
 		{
-			name:         `query param as regexp`,
-			queryParam:   "namespace",
-			labelv:       []string{"tenant1-.*"},
-			regexMatch:   true,
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="other"}`,
+			name:         "empty matching regex",
+			labelv:       "team-a|",
+			opts:         []Option{WithRegexMatch(), WithAllowEmptyMatchingRegex()},
 			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="other",namespace=~"tenant1-.*"}`,
-			expResponse:  okResponse,
+			expPromQuery: `up{namespace=~"team-a|"}`,
 		},
 		{
-			name:         `HTTP header as regexp with same regexp in query`,
-			headers:      http.Header{"namespace": []string{"tenant1-.*"}},
-			headerName:   "namespace",
-			regexMatch:   true,
-			promQuery:    `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
+			name:         "empty matching regex with anchoring",
+			labelv:       "team-a|",
+			opts:         []Option{WithRegexMatch(), WithRegexAnchoring(), WithAllowEmptyMatchingRegex()},
 			expCode:      http.StatusOK,
-			expPromQuery: `up{instance="localhost:9090",namespace=~"tenant1-.*"} + foo{namespace="tenant1-.*",namespace=~"tenant1-.*"}`,
-			expResponse:  okResponse,
-		},
-		{
-			name:       `HTTP header with invalid regexp with same regexp in query`,
-			headers:    http.Header{"namespace": []string{"tenant1-(.*"}},
-			headerName: "namespace",
-			regexMatch: true,
-			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
-			expCode:    http.StatusBadRequest,
-		},
-		{
-			name:       `Multiple regexp HTTP headers is invalid`,
-			headers:    http.Header{"namespace": []string{"tenant1", "tenant2"}},
-			headerName: "namespace",
-			regexMatch: true,
-			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
-			expCode:    http.StatusBadRequest,
-		},
-		{
-			name:       `Regex should not match empty string`,
-			headers:    http.Header{"namespace": []string{".*"}},
-			headerName: "namespace",
-			regexMatch: true,
-			promQuery:  `up{instance="localhost:9090"} + foo{namespace="tenant1-.*"}`,
-			expCode:    http.StatusBadRequest,
+			expPromQuery: `up{namespace=~"^(?:team-a|)$"}`,
 		},
 	} {
-		for _, endpoint := range []string{"query", "query_range", "query_exemplars"} {
-			t.Run(endpoint+"/"+strings.ReplaceAll(tc.name, " ", "_"), func(t *testing.T) {
-				var expBody string
-				if tc.expPromQueryBody != "" {
-					expBody = url.Values(map[string][]string{"query": {tc.expPromQueryBody}}).Encode()
-				}
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
 
-				mockHandler := checkQueryHandler(expBody, queryParam, tc.expPromQuery)
-				if (len(tc.staticLabelVal) == 0) != (tc.headers == nil) {
-					mockHandler = checkParameterAbsent(proxyLabel, mockHandler)
-				}
-				m := newMockUpstream(mockHandler)
-				defer m.Close()
-				var opts []Option
+			r, err := NewRoutes(m.url, proxyLabel, StaticLabelEnforcer{tc.labelv}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-				if tc.errorOnReplace {
-					opts = append(opts, WithErrorOnReplace())
-				}
-				if tc.regexMatch {
-					opts = append(opts, WithRegexMatch())
-				}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil))
 
-				var labelEnforcer ExtractLabeler
-				if len(tc.staticLabelVal) > 0 {
-					labelEnforcer = StaticLabelEnforcer(tc.staticLabelVal)
-				} else if tc.headerName != "" {
-					labelEnforcer = HTTPHeaderEnforcer{Name: tc.headerName, ParseListSyntax: tc.headerUsesListSyntax}
-				} else if tc.queryParam != "" {
-					labelEnforcer = HTTPFormEnforcer{ParameterName: tc.queryParam}
-				} else {
-					labelEnforcer = HTTPFormEnforcer{ParameterName: proxyLabel}
-				}
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
+			}
+		})
+	}
+}
 
-				r, err := NewRoutes(m.url, proxyLabel, labelEnforcer, opts...)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
+func TestWithRequestTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get(queryParam) == `up{namespace="fast"}` {
+			w.Write(okResponse)
+			return
+		}
 
-				u, err := url.Parse("http://prometheus.example.com/api/v1/" + endpoint)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				q := u.Query()
-				q.Set(queryParam, tc.promQuery)
-				if tc.queryParam != "" {
-					for _, lv := range tc.labelv {
-						q.Add(tc.queryParam, lv)
-					}
-				} else if len(tc.staticLabelVal) == 0 && tc.headerName == "" && len(tc.labelv) > 0 {
-					for _, lv := range tc.labelv {
-						q.Add(proxyLabel, lv)
-					}
-				}
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+			w.Write(okResponse)
+		}
+	}))
+	defer m.Close()
 
-				u.RawQuery = q.Encode()
+	if _, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRequestTimeout(-time.Second)); err == nil {
+		t.Fatal("expected error")
+	}
 
-				var b io.Reader = nil
-				if tc.promQueryBody != "" {
-					b = strings.NewReader(url.Values(map[string][]string{"query": {tc.promQueryBody}}).Encode())
-				}
-				w := httptest.NewRecorder()
-				req := httptest.NewRequest(tc.method, u.String(), b)
-				if tc.headers != nil {
-					req.Header = tc.headers
-				}
-				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-				r.ServeHTTP(w, req)
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithRequestTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-				resp := w.Result()
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					t.Fatalf("unexpected error: %v", err)
-				}
-				defer resp.Body.Close()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=fast", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
 
-				if resp.StatusCode != tc.expCode {
-					t.Logf("expected status code %d, got %d", tc.expCode, resp.StatusCode)
-					t.Logf("%s", string(body))
-					t.FailNow()
-				}
-				if resp.StatusCode != http.StatusOK {
-					return
-				}
-				if string(body) != string(tc.expResponse) {
-					t.Fatalf("expected response body %q, got %q", string(tc.expResponse), string(body))
-				}
-			})
-		}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusGatewayTimeout, w.Code, w.Body.String())
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upstream request to be cancelled")
 	}
 }
 
-func TestBypassQueries(t *testing.T) {
-	// Test bypass functionality by creating a full routes setup
-	mockHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("query")
-		t.Logf("Mock handler called with query: %s", query)
+func TestWithH2C(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Write(okResponse)
+	}), &http2.Server{}))
+	defer srv.Close()
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(query)) // Return the query so we can check it
-	})
+	u, _ := url.Parse(srv.URL)
+	for _, tc := range []struct {
+		name string
+		opts []Option
 
-	// Create a mock upstream
-	m := newMockUpstream(mockHandler)
-	defer m.Close()
+		expCode int
+	}{
+		{
+			name:    "HTTP/1.1",
+			expCode: http.StatusHTTPVersionNotSupported,
+		},
+		{
+			name:    "h2c",
+			opts:    []Option{WithH2C()},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "h2c with custom transport",
+			opts:    []Option{WithUpstreamTransport(http.DefaultTransport.(*http.Transport).Clone()), WithH2C()},
+			expCode: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 
-	enforcer := HTTPFormEnforcer{ParameterName: "tenant"}
-	bypassQueries := []string{"1+1", "up"}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1", nil))
 
-	t.Logf("Creating routes with bypass queries: %v", bypassQueries)
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
 
-	// Create routes with bypass queries
-	routes, err := NewRoutes(m.url, "namespace", enforcer, WithBypassQueries(bypassQueries))
+	u, _ = url.Parse("https://prometheus.example.com")
+	if _, err := NewRoutes(u, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithH2C()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegisteredPaths(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	r, err := NewRoutes(u, proxyLabel, StaticLabelEnforcer{"default"},
+		WithEnabledLabelsAPI(),
+		WithEnabledAdminAPI(),
+		WithPassthroughPaths([]string{"/api/v1/status/config"}),
+	)
 	if err != nil {
-		t.Fatalf("Failed to create routes: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	endpoints := []string{"/api/v1/query", "/api/v1/query_range"}
+	paths := r.RegisteredPaths()
+	if !sort.StringsAreSorted(paths) {
+		t.Fatalf("expected sorted paths, got %v", paths)
+	}
 
-	for _, endpoint := range endpoints {
-		t.Run(endpoint, func(t *testing.T) {
-			// Test bypass queries - should NOT have label injection
-			for _, bypassQuery := range bypassQueries {
-				t.Logf("Testing bypass query: %s", bypassQuery)
-				req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=%s&tenant=%s", endpoint, url.QueryEscape(bypassQuery), enforcer.ParameterName), nil)
-				w := httptest.NewRecorder()
-				routes.ServeHTTP(w, req)
+	for _, p := range []string{
+		"/api/v1/admin/tsdb/delete_series",
+		"/api/v1/label",
+		"/api/v1/labels",
+		"/api/v1/query",
+		"/api/v1/query_range",
+		"/api/v1/status/config",
+		"/api/v2/silences",
+		"/federate",
+		"/healthz",
+	} {
+		if !slices.Contains(paths, p) {
+			t.Errorf("expected path %q to be registered, got %v", p, paths)
+		}
+	}
 
-				t.Logf("Response status: %d, body: %s", w.Code, w.Body.String())
-				if w.Code != http.StatusOK {
-					t.Errorf("Expected status OK, got %d", w.Code)
-				}
-				body := w.Body.String()
-				if body != bypassQuery {
-					t.Errorf("Expected '%s' (bypassed query), got '%s'", bypassQuery, body)
-				}
+	// The returned slice is a copy.
+	paths[0] = "/modified"
+	if r.RegisteredPaths()[0] == "/modified" {
+		t.Fatal("expected RegisteredPaths() to return a copy")
+	}
+}
+
+func TestFirstMatchEnforcer(t *testing.T) {
+	u, _ := url.Parse("http://prometheus.example.com")
+	for _, el := range []FirstMatchEnforcer{
+		{},
+		{HTTPHeaderEnforcer{Name: "X-Tenant"}, nil},
+		{HTTPHeaderEnforcer{Name: "X-Tenant"}, StaticLabelEnforcer{""}},
+	} {
+		if _, err := NewRoutes(u, proxyLabel, el); err == nil {
+			t.Fatalf("expected error for %v", el)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		el      FirstMatchEnforcer
+		headers http.Header
+		labelv  []string
+
+		expCode      int
+		expPromQuery string
+	}{
+		{
+			name:         "header",
+			el:           FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"}, StaticLabelEnforcer{"default"}},
+			headers:      http.Header{"X-Tenant": {"team-a"}},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="team-a"}`,
+		},
+		{
+			name:         "fallback to the static value",
+			el:           FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"}, StaticLabelEnforcer{"default"}},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="default"}`,
+		},
+		{
+			name:         "fallback to the parameter",
+			el:           FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"}, HTTPFormEnforcer{ParameterName: proxyLabel}, StaticLabelEnforcer{"default"}},
+			labelv:       []string{"team-b"},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="team-b"}`,
+		},
+		{
+			name:    "no match",
+			el:      FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"}, HTTPFormEnforcer{ParameterName: proxyLabel}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid header isn't skipped",
+			el:      FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant", ParseListSyntax: true}, StaticLabelEnforcer{"default"}},
+			headers: http.Header{"X-Tenant": {`"team-a`}},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:         "nested enforcers",
+			el:           FirstMatchEnforcer{FirstMatchEnforcer{HTTPHeaderEnforcer{Name: "X-Tenant"}, HTTPFormEnforcer{ParameterName: proxyLabel}}, StaticLabelEnforcer{"default"}},
+			labelv:       []string{"team-b"},
+			expCode:      http.StatusOK,
+			expPromQuery: `up{namespace="team-b"}`,
+		},
+		{
+			name:    "errors other than 400 aren't skipped",
+			el:      FirstMatchEnforcer{ClientCertEnforcer{Field: ClientCertCommonName}, StaticLabelEnforcer{"default"}},
+			expCode: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", queryParam, tc.expPromQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.el)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{queryParam: {"up"}, proxyLabel: tc.labelv}
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?"+q.Encode(), nil)
+			for k, v := range tc.headers {
+				req.Header[k] = v
 			}
 
-			// Test non-bypass query - should have label injection
-			t.Logf("Testing non-bypass query: rate(http_requests_total[5m])")
-			req := httptest.NewRequest("GET", fmt.Sprintf("%s?query=rate(http_requests_total[5m])&tenant=test", endpoint), nil)
 			w := httptest.NewRecorder()
-			routes.ServeHTTP(w, req)
+			r.ServeHTTP(w, req)
 
-			t.Logf("Response status: %d, body: %s", w.Code, w.Body.String())
-			if w.Code != http.StatusOK {
-				t.Errorf("Expected status OK, got %d", w.Code)
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
 			}
-
-			body := w.Body.String()
-			if !strings.Contains(body, `namespace="test"`) {
-				t.Errorf("Expected query with label injection containing 'namespace=\"test\"', got '%s'", body)
+			if resp.StatusCode == http.StatusOK && string(body) != string(okResponse) {
+				t.Fatalf("expected body %q, got %q", string(okResponse), string(body))
 			}
 		})
 	}
@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
 )
 
 type apiResponse struct {
@@ -172,9 +174,10 @@ type alert struct {
 var errModifyResponseFailed = errors.New("failed to process the API response")
 
 // modifyAPIResponse unwraps the Prometheus API response, passes the enforced
-// label value and the response to the given function and finally replaces the
-// result in the response.
-func modifyAPIResponse(f func([]string, *http.Request, *apiResponse) (interface{}, error)) func(*http.Response) error {
+// label matchers and the response to the given function and finally replaces
+// the result in the response. The trailers of the upstream response (if any)
+// are discarded.
+func (r *routes) modifyAPIResponse(f func([]*labels.Matcher, *http.Request, *apiResponse) (interface{}, error)) func(*http.Response) error {
 	return func(resp *http.Response) error {
 		if resp.StatusCode != http.StatusOK {
 			// Pass non-200 responses as-is.
@@ -186,7 +189,12 @@ func modifyAPIResponse(f func([]string, *http.Request, *apiResponse) (interface{
 			return fmt.Errorf("can't decode the response: %w", err)
 		}
 
-		v, err := f(MustLabelValues(resp.Request.Context()), resp.Request, apir)
+		ms, err := r.newLabelMatchers(resp.Request.Context())
+		if err != nil {
+			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
+		}
+
+		v, err := f(ms, resp.Request, apir)
 		if err != nil {
 			return fmt.Errorf("%w: %w", errModifyResponseFailed, err)
 		}
@@ -204,99 +212,240 @@ func modifyAPIResponse(f func([]string, *http.Request, *apiResponse) (interface{
 		}
 		resp.Body = io.NopCloser(&buf)
 		resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+		// The modified response has a fixed length which can't carry
+		// trailers.
+		resp.Trailer = nil
 
 		return nil
 	}
 }
 
-func (r *routes) filterRules(lvalues []string, req *http.Request, resp *apiResponse) (interface{}, error) {
+// matchLabels returns true if all the given matchers match the label values
+// returned by get. Missing labels only match the positive matchers which
+// explicitly accept the empty value (see WithOrAbsent()).
+func matchLabels(ms []*labels.Matcher, get func(string) string) bool {
+	for _, m := range ms {
+		if lval := get(m.Name); (lval == "" && !isNegativeMatchType(m.Type) && !m.Matches("")) || !m.Matches(lval) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterRules drops the rules which don't match the enforced label(s). The
+// upstream filter parameters (type, rule_name[], rule_group[] and file[]) are
+// forwarded untouched: the filtering applies to whatever the upstream returns
+// so these parameters can't be used to discover other tenants' rules.
+func (r *routes) filterRules(ms []*labels.Matcher, req *http.Request, resp *apiResponse) (interface{}, error) {
+	if r.modifierConcurrency > 1 {
+		return r.filterRulesConcurrently(ms, resp)
+	}
+
 	var rgs rulesData
 	if err := json.Unmarshal(resp.Data, &rgs); err != nil {
 		return nil, fmt.Errorf("can't decode rules data: %w", err)
 	}
 
-	m, err := r.newLabelMatcher(lvalues...)
-	if err != nil {
-		return nil, err
+	filtered := []*ruleGroup{}
+	for _, rg := range rgs.RuleGroups {
+		if rg = r.filterRuleGroup(ms, rg); rg != nil {
+			filtered = append(filtered, rg)
+		}
 	}
 
+	return &rulesData{RuleGroups: filtered}, nil
+}
+
+// filterRulesConcurrently is like filterRules but the rule groups are decoded
+// and filtered by a pool of goroutines. The rule groups being independent from
+// each other, the results are stored by index to preserve the order.
+func (r *routes) filterRulesConcurrently(ms []*labels.Matcher, resp *apiResponse) (interface{}, error) {
+	var data struct {
+		RuleGroups []json.RawMessage `json:"groups"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode rules data: %w", err)
+	}
+
+	var (
+		results = make([]*ruleGroup, len(data.RuleGroups))
+		errs    = make([]error, len(data.RuleGroups))
+	)
+	runConcurrently(r.modifierConcurrency, len(data.RuleGroups), func(i int) {
+		var rg ruleGroup
+		if err := json.Unmarshal(data.RuleGroups[i], &rg); err != nil {
+			errs[i] = err
+			return
+		}
+		results[i] = r.filterRuleGroup(ms, &rg)
+	})
+
 	filtered := []*ruleGroup{}
-	for _, rg := range rgs.RuleGroups {
-		var rules []rule
-		for _, rgr := range rg.Rules {
-			if lval := rgr.Labels().Get(r.label); lval != "" && m.Matches(lval) {
-				rules = append(rules, rgr)
-				continue
+	for i, rg := range results {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("can't decode rules data: %w", errs[i])
+		}
+		if rg != nil {
+			filtered = append(filtered, rg)
+		}
+	}
+
+	return &rulesData{RuleGroups: filtered}, nil
+}
+
+// runConcurrently calls f for each index in [0, n) from a pool of the given
+// number of goroutines and returns once all the calls have completed.
+func runConcurrently(workers, n int, f func(int)) {
+	var (
+		idx = make(chan int)
+		wg  sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range idx {
+				f(j)
 			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+}
 
-			if !r.rulesWithActiveAlerts || rgr.alertingRule == nil {
+// filterRuleGroup returns the rule group with only the rules matching the
+// enforced label(s) or nil if no rule matches: the groups without rules are
+// dropped since their names may reveal the other tenants.
+func (r *routes) filterRuleGroup(ms []*labels.Matcher, rg *ruleGroup) *ruleGroup {
+	var rules []rule
+	for _, rgr := range rg.Rules {
+		if matchLabels(ms, rgr.Labels().Get) {
+			rules = append(rules, rgr)
+			continue
+		}
+
+		if !r.rulesWithActiveAlerts || rgr.alertingRule == nil {
+			continue
+		}
+
+		var ar *alertingRule
+		for i := range rgr.Alerts {
+			if !matchLabels(ms, rgr.Alerts[i].Labels.Get) {
 				continue
 			}
 
-			var ar *alertingRule
-			for i := range rgr.Alerts {
-				if lval := rgr.Alerts[i].Labels.Get(r.label); lval == "" || !m.Matches(lval) {
-					continue
-				}
-
-				if ar == nil {
-					ar = &alertingRule{
-						Name:           rgr.alertingRule.Name,
-						Query:          rgr.alertingRule.Query,
-						Duration:       rgr.Duration,
-						KeepFiringFor:  rgr.KeepFiringFor,
-						Labels:         rgr.alertingRule.Labels.Copy(),
-						Annotations:    rgr.Annotations.Copy(),
-						Health:         rgr.alertingRule.Health,
-						LastError:      rgr.alertingRule.LastError,
-						EvaluationTime: rgr.alertingRule.EvaluationTime,
-						LastEvaluation: rgr.alertingRule.LastEvaluation,
-						Type:           rgr.alertingRule.Type,
-					}
+			if ar == nil {
+				ar = &alertingRule{
+					Name:           rgr.alertingRule.Name,
+					Query:          rgr.alertingRule.Query,
+					Duration:       rgr.Duration,
+					KeepFiringFor:  rgr.KeepFiringFor,
+					Labels:         rgr.alertingRule.Labels.Copy(),
+					Annotations:    rgr.Annotations.Copy(),
+					Health:         rgr.alertingRule.Health,
+					LastError:      rgr.alertingRule.LastError,
+					EvaluationTime: rgr.alertingRule.EvaluationTime,
+					LastEvaluation: rgr.alertingRule.LastEvaluation,
+					Type:           rgr.alertingRule.Type,
 				}
+			}
 
-				ar.Alerts = append(ar.Alerts, rgr.Alerts[i])
-				switch ar.State {
-				case "pending":
-					if rgr.alertingRule.Alerts[i].State == "firing" {
-						ar.State = rgr.alertingRule.Alerts[i].State
-					}
-				case "":
+			ar.Alerts = append(ar.Alerts, rgr.Alerts[i])
+			switch ar.State {
+			case "pending":
+				if rgr.alertingRule.Alerts[i].State == "firing" {
 					ar.State = rgr.alertingRule.Alerts[i].State
 				}
-			}
-
-			if ar != nil {
-				rules = append(rules, rule{alertingRule: ar})
+			case "":
+				ar.State = rgr.alertingRule.Alerts[i].State
 			}
 		}
 
-		if len(rules) > 0 {
-			rg.Rules = rules
-			filtered = append(filtered, rg)
+		if ar != nil {
+			rules = append(rules, rule{alertingRule: ar})
 		}
 	}
 
-	return &rulesData{RuleGroups: filtered}, nil
+	if len(rules) == 0 {
+		return nil
+	}
+
+	rg.Rules = rules
+	if r.redactRuleFiles {
+		rg.File = ""
+	}
+	return rg
 }
 
-func (r *routes) filterAlerts(lvalues []string, _ *http.Request, resp *apiResponse) (interface{}, error) {
+func (r *routes) filterAlerts(ms []*labels.Matcher, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	if r.modifierConcurrency > 1 {
+		return r.filterAlertsConcurrently(ms, resp)
+	}
+
 	var data alertsData
 	if err := json.Unmarshal(resp.Data, &data); err != nil {
 		return nil, fmt.Errorf("can't decode alerts data: %w", err)
 	}
 
-	m, err := r.newLabelMatcher(lvalues...)
-	if err != nil {
-		return nil, err
-	}
-
 	filtered := []*alert{}
 	for _, alert := range data.Alerts {
-		if lval := alert.Labels.Get(r.label); lval != "" && m.Matches(lval) {
+		if r.keepAlert(ms, alert) {
 			filtered = append(filtered, alert)
 		}
 	}
 
 	return &alertsData{Alerts: filtered}, nil
 }
+
+// filterAlertsConcurrently is like filterAlerts but the alerts are decoded
+// and filtered by a pool of goroutines. The results are stored by index to
+// preserve the order.
+func (r *routes) filterAlertsConcurrently(ms []*labels.Matcher, resp *apiResponse) (interface{}, error) {
+	var data struct {
+		Alerts []json.RawMessage `json:"alerts"`
+	}
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		return nil, fmt.Errorf("can't decode alerts data: %w", err)
+	}
+
+	var (
+		results = make([]*alert, len(data.Alerts))
+		errs    = make([]error, len(data.Alerts))
+	)
+	runConcurrently(r.modifierConcurrency, len(data.Alerts), func(i int) {
+		var a *alert
+		if err := json.Unmarshal(data.Alerts[i], &a); err != nil {
+			errs[i] = err
+			return
+		}
+		if r.keepAlert(ms, a) {
+			results[i] = a
+		}
+	})
+
+	filtered := []*alert{}
+	for i, a := range results {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("can't decode alerts data: %w", errs[i])
+		}
+		if a != nil {
+			filtered = append(filtered, a)
+		}
+	}
+
+	return &alertsData{Alerts: filtered}, nil
+}
+
+// keepAlert returns true if the alert matches the enforced label(s) and the
+// configured alert states.
+func (r *routes) keepAlert(ms []*labels.Matcher, a *alert) bool {
+	if a == nil || !matchLabels(ms, a.Labels.Get) {
+		return false
+	}
+
+	return len(r.alertStates) == 0 || slices.Contains(r.alertStates, a.State)
+}
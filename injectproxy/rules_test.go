@@ -14,6 +14,7 @@
 package injectproxy
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
@@ -21,8 +22,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
 	"gotest.tools/v3/golden"
 )
 
@@ -554,6 +558,22 @@ func TestRules(t *testing.T) {
 			upstream: validRules(),
 			opts:     []Option{WithActiveAlerts()},
 
+			expCode: http.StatusOK,
+			golden:  "rules_with_active_alerts.golden",
+		},
+		{
+			labelv:   []string{"ns1", "ns2"},
+			upstream: validRules(),
+			opts:     []Option{WithModifierConcurrency(4)},
+
+			expCode: http.StatusOK,
+			golden:  "rules_match_namespaces_ns1_and_ns2.golden",
+		},
+		{
+			labelv:   []string{"ns3"},
+			upstream: validRules(),
+			opts:     []Option{WithActiveAlerts(), WithModifierConcurrency(4)},
+
 			expCode: http.StatusOK,
 			golden:  "rules_with_active_alerts.golden",
 		},
@@ -696,6 +716,32 @@ func TestAlerts(t *testing.T) {
 			expCode: http.StatusOK,
 			golden:  "alerts_match_namespaces_ns1_and_ns2.golden",
 		},
+		{
+			labelv:   []string{"ns1", "ns2"},
+			upstream: validAlerts(),
+			opts:     []Option{WithModifierConcurrency(4)},
+
+			expCode: http.StatusOK,
+			golden:  "alerts_match_namespaces_ns1_and_ns2.golden",
+		},
+		{
+			labelv:   []string{"not_present"},
+			upstream: validAlerts(),
+			opts:     []Option{WithModifierConcurrency(4)},
+
+			expCode: http.StatusOK,
+			golden:  "alerts_no_match.golden",
+		},
+		{
+			labelv: []string{"invalid_data_from_upstream"},
+			upstream: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"status":"success","data":{"alerts":[{"labels":{"namespace":"ns1"}},0]}}`))
+			}),
+			opts: []Option{WithModifierConcurrency(4)},
+
+			expCode: http.StatusBadRequest,
+			golden:  "alerts_invalid_upstream_response.golden",
+		},
 		{
 			labelv:   []string{"ns1", "ns2"},
 			upstream: validAlerts(),
@@ -754,6 +800,78 @@ func TestAlerts(t *testing.T) {
 	}
 }
 
+func TestAlertsWithStates(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"alerts":[
+  {"labels":{"alertname":"Alert1","namespace":"ns1"},"annotations":{},"state":"firing","value":"1e+00"},
+  {"labels":{"alertname":"Alert2","namespace":"ns1"},"annotations":{},"state":"pending","value":"1e+00"},
+  {"labels":{"alertname":"Alert3","namespace":"ns2"},"annotations":{},"state":"firing","value":"1e+00"}
+]}}`))
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expAlerts []string
+	}{
+		{
+			name:      "all states",
+			expAlerts: []string{"Alert1", "Alert2"},
+		},
+		{
+			name:      "firing",
+			opts:      []Option{WithAlertStates([]string{"firing"})},
+			expAlerts: []string{"Alert1"},
+		},
+		{
+			name:      "pending and firing",
+			opts:      []Option{WithAlertStates([]string{"pending", "firing"})},
+			expAlerts: []string{"Alert1", "Alert2"},
+		},
+		{
+			name: "inactive",
+			opts: []Option{WithAlertStates([]string{"inactive"})},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/alerts?namespace=ns1", nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var data alertsData
+			if err := json.Unmarshal(apir.Data, &data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, a := range data.Alerts {
+				got = append(got, a.Labels.Get("alertname"))
+			}
+
+			if !slices.Equal(got, tc.expAlerts) {
+				t.Fatalf("expected alerts %v, got %v", tc.expAlerts, got)
+			}
+		})
+	}
+}
+
 func normalizeAPIResponse(t *testing.T, b []byte) string {
 	t.Helper()
 	var apir apiResponse
@@ -767,3 +885,342 @@ func normalizeAPIResponse(t *testing.T, b []byte) string {
 
 	return string(out)
 }
+
+func TestRulesWithCustomPaths(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		upstream http.Handler
+		opts     []Option
+
+		golden string
+	}{
+		{
+			path:     "/prometheus/api/v1/rules",
+			upstream: validRules(),
+			opts:     []Option{WithRulesPath("/prometheus/api/v1/rules")},
+			golden:   "rules_match_namespace_ns1.golden",
+		},
+		{
+			path:     "/prometheus/api/v1/alerts",
+			upstream: validAlerts(),
+			opts:     []Option{WithAlertsPath("/prometheus/api/v1/alerts")},
+			golden:   "alerts_match_namespace_ns1.golden",
+		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			m := newMockUpstream(tc.upstream)
+			defer m.Close()
+			r, err := NewRoutes(
+				m.url,
+				proxyLabel,
+				HTTPFormEnforcer{ParameterName: proxyLabel},
+				tc.opts...,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "http://prometheus.example.com"+tc.path+"?namespace=ns1", nil)
+			r.ServeHTTP(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+
+			got := normalizeAPIResponse(t, body)
+			golden.Assert(t, got, tc.golden)
+		})
+	}
+}
+
+// filteringRules simulates the filter parameters of the Prometheus rules API
+// on top of validRules().
+func filteringRules(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Has(proxyLabel) {
+			t.Errorf("unexpected %q parameter forwarded to the upstream", proxyLabel)
+		}
+
+		rec := httptest.NewRecorder()
+		validRules().ServeHTTP(rec, req)
+
+		var apir apiResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &apir); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var rgs rulesData
+		if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		q := req.URL.Query()
+		filtered := []*ruleGroup{}
+		for _, rg := range rgs.RuleGroups {
+			if len(q["rule_group[]"]) > 0 && !slices.Contains(q["rule_group[]"], rg.Name) {
+				continue
+			}
+
+			var rules []rule
+			for _, rr := range rg.Rules {
+				if q.Get("type") == "alert" && rr.alertingRule == nil {
+					continue
+				}
+				if q.Get("type") == "record" && rr.recordingRule == nil {
+					continue
+				}
+
+				name := ""
+				if rr.alertingRule != nil {
+					name = rr.alertingRule.Name
+				} else {
+					name = rr.recordingRule.Name
+				}
+				if len(q["rule_name[]"]) > 0 && !slices.Contains(q["rule_name[]"], name) {
+					continue
+				}
+
+				rules = append(rules, rr)
+			}
+
+			if len(rules) > 0 {
+				rg.Rules = rules
+				filtered = append(filtered, rg)
+			}
+		}
+
+		b, err := json.Marshal(&rulesData{RuleGroups: filtered})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		apir.Data = b
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&apir)
+	})
+}
+
+func TestRulesWithFilterParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    url.Values
+		expRules []string
+	}{
+		{
+			name:     "type=alert",
+			query:    url.Values{"type": {"alert"}},
+			expRules: []string{"group1/Alert1", "group1/Alert2"},
+		},
+		{
+			name:     "type=record",
+			query:    url.Values{"type": {"record"}},
+			expRules: []string{"group1/metric1", "group1/metric2", "group1/metric2", "group1/metric2"},
+		},
+		{
+			name:     "type=alert and rule_name[] matching the tenant",
+			query:    url.Values{"type": {"alert"}, "rule_name[]": {"Alert2"}},
+			expRules: []string{"group1/Alert2"},
+		},
+		{
+			name:  "rule_name[] probing another tenant's rule",
+			query: url.Values{"rule_name[]": {"metric3", "Alert3"}},
+		},
+		{
+			name:  "rule_group[] probing another tenant's group",
+			query: url.Values{"rule_group[]": {"group2"}},
+		},
+		{
+			name:  "type=alert and rule_group[] probing another tenant's group",
+			query: url.Values{"type": {"alert"}, "rule_group[]": {"group2"}, "file[]": {"testdata/rules2.yml"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(filteringRules(t))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			q := url.Values{}
+			for k, v := range tc.query {
+				q[k] = v
+			}
+			q.Set(proxyLabel, "ns1")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?"+q.Encode(), nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			var apir apiResponse
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var rgs rulesData
+			if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, rg := range rgs.RuleGroups {
+				for _, rr := range rg.Rules {
+					if lval := rr.Labels().Get(proxyLabel); lval != "ns1" {
+						t.Fatalf("unexpected rule with %s=%q", proxyLabel, lval)
+					}
+
+					name := ""
+					if rr.alertingRule != nil {
+						name = rr.alertingRule.Name
+					} else {
+						name = rr.recordingRule.Name
+					}
+					got = append(got, rg.Name+"/"+name)
+				}
+			}
+
+			if !slices.Equal(got, tc.expRules) {
+				t.Fatalf("expected rules %v, got %v", tc.expRules, got)
+			}
+		})
+	}
+}
+
+func TestRulesGroupsOfOtherTenants(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"groups":[
+  {"name":"acme-corp-billing","file":"/etc/prometheus/rules/acme-corp/billing.yml","interval":30,"rules":[
+    {"name":"billing:requests:rate5m","query":"sum(rate(requests_total[5m]))","labels":{"namespace":"acme"},"health":"ok","type":"recording"}
+  ]},
+  {"name":"shared","file":"/etc/prometheus/rules/shared.yml","interval":30,"rules":[
+    {"name":"up:sum","query":"sum(up)","labels":{"namespace":"ns1"},"health":"ok","type":"recording"},
+    {"name":"up:count","query":"count(up)","labels":{"namespace":"acme"},"health":"ok","type":"recording"}
+  ]},
+  {"name":"ns1-alerts","file":"/etc/prometheus/rules/ns1.yml","interval":30,"rules":[
+    {"state":"inactive","name":"Down","query":"up == 0","duration":0,"labels":{"namespace":"ns1"},"annotations":{},"alerts":[],"health":"ok","type":"alerting"}
+  ]}
+]}}`))
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+
+		expGroups []string
+		expFiles  []string
+	}{
+		{
+			name:      "default",
+			expGroups: []string{"shared", "ns1-alerts"},
+			expFiles:  []string{"/etc/prometheus/rules/shared.yml", "/etc/prometheus/rules/ns1.yml"},
+		},
+		{
+			name:      "redacted rule files",
+			opts:      []Option{WithRedactedRuleFiles()},
+			expGroups: []string{"shared", "ns1-alerts"},
+			expFiles:  []string{"", ""},
+		},
+		{
+			name:      "concurrent filtering",
+			opts:      []Option{WithRedactedRuleFiles(), WithModifierConcurrency(2)},
+			expGroups: []string{"shared", "ns1-alerts"},
+			expFiles:  []string{"", ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "http://prometheus.example.com/api/v1/rules?namespace=ns1", nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, string(body))
+			}
+
+			if strings.Contains(string(body), "acme") {
+				t.Fatalf("expected no reference to the other tenant, got %s", string(body))
+			}
+
+			var apir apiResponse
+			if err := json.Unmarshal(body, &apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var rgs rulesData
+			if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var groups, files []string
+			for _, rg := range rgs.RuleGroups {
+				groups = append(groups, rg.Name)
+				files = append(files, rg.File)
+			}
+
+			if !slices.Equal(groups, tc.expGroups) {
+				t.Fatalf("expected groups %v, got %v", tc.expGroups, groups)
+			}
+			if !slices.Equal(files, tc.expFiles) {
+				t.Fatalf("expected files %v, got %v", tc.expFiles, files)
+			}
+		})
+	}
+}
+
+func BenchmarkFilterRules(b *testing.B) {
+	var (
+		buf bytes.Buffer
+		rgs = make([]string, 0, 10000)
+	)
+	for i := 0; i < cap(rgs); i++ {
+		buf.Reset()
+		fmt.Fprintf(&buf, `{"name":"group%d","file":"rules.yml","interval":30,"rules":[`, i)
+		for j := 0; j < 10; j++ {
+			if j > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, `{"name":"metric%d","query":"sum(up)","labels":{"namespace":"ns%d"},"health":"ok","type":"recording"}`, j, i%10)
+		}
+		buf.WriteString("]}")
+		rgs = append(rgs, buf.String())
+	}
+	data := json.RawMessage(`{"groups":[` + strings.Join(rgs, ",") + `]}`)
+
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, proxyLabel, "ns1")}
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", n), func(b *testing.B) {
+			r := &routes{labelNames: []string{proxyLabel}, modifierConcurrency: n}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.filterRules(ms, nil, &apiResponse{Data: data}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"sync"
+)
+
+// drainer tracks the in-flight requests. Once closed, no new request is
+// accepted.
+type drainer struct {
+	mtx    sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// start registers a new in-flight request. It returns false if the drainer
+// is closed.
+func (d *drainer) start() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.closed {
+		return false
+	}
+
+	d.wg.Add(1)
+	return true
+}
+
+// done unregisters an in-flight request.
+func (d *drainer) done() {
+	d.wg.Done()
+}
+
+// close stops accepting new requests and returns a channel closed once all
+// the in-flight requests have completed.
+func (d *drainer) close() <-chan struct{} {
+	d.mtx.Lock()
+	d.closed = true
+	d.mtx.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(drained)
+	}()
+
+	return drained
+}
+
+// Shutdown stops accepting new requests (they are rejected with "503 Service
+// Unavailable") and waits for the in-flight requests to complete. If the
+// context expires first, Shutdown returns the context's error. The proxy
+// can't be restarted once Shutdown has been called.
+func (r *routes) Shutdown(ctx context.Context) error {
+	select {
+	case <-r.drain.close():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
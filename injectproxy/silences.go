@@ -21,7 +21,6 @@ import (
 	"io"
 	"net/http"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
 
@@ -31,6 +30,8 @@ import (
 	"github.com/prometheus/alertmanager/api/v2/client/silence"
 	"github.com/prometheus/alertmanager/api/v2/models"
 	"github.com/prometheus/alertmanager/pkg/labels"
+	promlabels "github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
 )
 
 // silences proxies HTTP requests to the Alertmanager /api/v2/silences endpoint.
@@ -46,13 +47,16 @@ func (r *routes) silences(w http.ResponseWriter, req *http.Request) {
 }
 
 // assertSingleLabelValue verifies that the proxy is configured to match only
-// one label value. If not, it will reply with "422 Unprocessable Content".
+// one value for each enforced label. If not, it will reply with "422
+// Unprocessable Content".
 func assertSingleLabelValue(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		labelValues := MustLabelValues(req.Context())
-		if len(labelValues) > 1 {
-			http.Error(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
-			return
+		named, _ := req.Context().Value(keyNamedLabels).(map[string][]string)
+		for _, labelValues := range named {
+			if len(labelValues) > 1 {
+				http.Error(w, "Multiple label matchers not supported", http.StatusUnprocessableEntity)
+				return
+			}
 		}
 
 		next(w, req)
@@ -63,39 +67,39 @@ func assertSingleLabelValue(next http.HandlerFunc) http.HandlerFunc {
 // Alertmanager API's query.
 func (r *routes) enforceFilterParameter(w http.ResponseWriter, req *http.Request) {
 	var (
-		q               = req.URL.Query()
-		proxyLabelMatch labels.Matcher
+		q                  = req.URL.Query()
+		proxyLabelMatchers = map[string]*labels.Matcher{}
+		modified           []string
 	)
 
-	if len(MustLabelValues(req.Context())) > 1 {
-		proxyLabelMatch = labels.Matcher{
-			Type:  labels.MatchRegexp,
-			Name:  r.label,
-			Value: labelValuesToRegexpString(MustLabelValues(req.Context())),
+	for _, name := range r.labelNames {
+		// The matcher is built like the PromQL one so that the regexp checks
+		// (e.g. anchoring) apply to the Alertmanager filters too.
+		m, err := r.newPositiveLabelMatcher(name, MustLabelValuesFor(req.Context(), name)...)
+		if err != nil {
+			r.countLabelMatchersRejection(req, err)
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	} else {
-		matcherType := labels.MatchEqual
-		matcherValue := MustLabelValue(req.Context())
-		if r.regexMatch {
-			compiledRegex, err := regexp.Compile(matcherValue)
-			if err != nil {
-				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if compiledRegex.MatchString("") {
-				prometheusAPIError(w, "Regex should not match empty string", http.StatusBadRequest)
-				return
-			}
-			matcherType = labels.MatchRegexp
+
+		proxyLabelMatch := &labels.Matcher{Type: labels.MatchEqual, Name: m.Name, Value: m.Value}
+		if m.Type == promlabels.MatchRegexp {
+			proxyLabelMatch.Type = labels.MatchRegexp
 		}
-		proxyLabelMatch = labels.Matcher{
-			Type:  matcherType,
-			Name:  r.label,
-			Value: matcherValue,
+
+		if isNegativeMatchType(r.matchType) {
+			switch proxyLabelMatch.Type {
+			case labels.MatchEqual:
+				proxyLabelMatch.Type = labels.MatchNotEqual
+			case labels.MatchRegexp:
+				proxyLabelMatch.Type = labels.MatchNotRegexp
+			}
 		}
+
+		proxyLabelMatchers[name] = proxyLabelMatch
+		modified = append(modified, proxyLabelMatch.String())
 	}
 
-	modified := []string{proxyLabelMatch.String()}
 	for _, filter := range q["filter"] {
 		m, err := labels.ParseMatcher(filter)
 		if err != nil {
@@ -103,9 +107,9 @@ func (r *routes) enforceFilterParameter(w http.ResponseWriter, req *http.Request
 			return
 		}
 
-		// Keep the original matcher in case of multi label values because
-		// the user might want to filter on a specific value.
-		if m.Name == r.label && proxyLabelMatch.Type != labels.MatchRegexp {
+		// Keep the original matcher in case of multi label values or negative
+		// matching because the user might want to filter on a specific value.
+		if proxyLabelMatch, ok := proxyLabelMatchers[m.Name]; ok && proxyLabelMatch.Type == labels.MatchEqual {
 			continue
 		}
 
@@ -113,17 +117,16 @@ func (r *routes) enforceFilterParameter(w http.ResponseWriter, req *http.Request
 	}
 
 	q["filter"] = modified
-	q.Del(r.label)
+	for _, name := range r.labelNames {
+		q.Del(name)
+	}
 	req.URL.RawQuery = q.Encode()
 
 	r.handler.ServeHTTP(w, req)
 }
 
 func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
-	var (
-		sil    models.PostableSilence
-		lvalue = MustLabelValue(req.Context())
-	)
+	var sil models.PostableSilence
 
 	if err := json.NewDecoder(req.Body).Decode(&sil); err != nil {
 		prometheusAPIError(w, fmt.Sprintf("bad request: can't decode: %v", err), http.StatusBadRequest)
@@ -138,25 +141,40 @@ func (r *routes) postSilence(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if !hasMatcherForLabel(existing.Matchers, r.label, lvalue) {
+		if !r.hasMatchersForLabels(req.Context(), existing.Matchers) {
 			prometheusAPIError(w, "forbidden", http.StatusForbidden)
 			return
 		}
 	}
 
-	var falsy bool
-	modified := models.Matchers{
-		&models.Matcher{Name: &(r.label), Value: &lvalue, IsRegex: &falsy},
+	var modified models.Matchers
+	for _, name := range r.labelNames {
+		var (
+			falsy  bool
+			lname  = name
+			lvalue = MustLabelValuesFor(req.Context(), name)[0]
+		)
+		modified = append(modified, &models.Matcher{Name: &lname, Value: &lvalue, IsRegex: &falsy})
 	}
-	for _, m := range sil.Matchers {
-		if m.Name != nil && *m.Name == r.label {
+	for i, m := range sil.Matchers {
+		if m.Name != nil && slices.Contains(r.labelNames, *m.Name) {
+			// Matchers on an enforced label are only accepted if they are
+			// equal to the injected matcher. Otherwise a negative matcher
+			// (e.g. namespace!="mine") could silence the alerts of other
+			// tenants.
+			lvalue := MustLabelValuesFor(req.Context(), *m.Name)[0]
+			if !isEqualityMatcherFor(m, *m.Name, lvalue) {
+				r.countRejection(req, rejectionIllegalMatcher)
+				prometheusAPIError(w, fmt.Sprintf("%v: matcher %d on label %s conflicts with injected value %q", ErrIllegalLabelMatcher, i, *m.Name, lvalue), http.StatusBadRequest)
+				return
+			}
 			continue
 		}
 		modified = append(modified, m)
 	}
-	// At least one matcher in addition to the enforced label is required,
+	// At least one matcher in addition to the enforced labels is required,
 	// otherwise all alerts would be silenced
-	if len(modified) < 2 {
+	if len(modified) <= len(r.labelNames) {
 		prometheusAPIError(w, "need at least one matcher, got none", http.StatusBadRequest)
 		return
 	}
@@ -192,7 +210,7 @@ func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !hasMatcherForLabel(sil.Matchers, r.label, MustLabelValue(req.Context())) {
+	if !r.hasMatchersForLabels(req.Context(), sil.Matchers) {
 		prometheusAPIError(w, "forbidden", http.StatusForbidden)
 		return
 	}
@@ -202,10 +220,10 @@ func (r *routes) deleteSilence(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.GettableSilence, error) {
-	amc := client.New(
-		runtimeclient.New(r.upstream.Host, path.Join(r.upstream.Path, "/api/v2"), []string{r.upstream.Scheme}),
-		strfmt.Default,
-	)
+	upstream := r.upstreamURL(ctx)
+	rt := runtimeclient.New(upstream.Host, path.Join(upstream.Path, "/api/v2"), []string{upstream.Scheme})
+	rt.Transport = r.upstreamTransport
+	amc := client.New(rt, strfmt.Default)
 	params := silence.NewGetSilenceParams().WithContext(ctx)
 	params.SetSilenceID(strfmt.UUID(id))
 	sil, err := amc.Silence.GetSilence(params)
@@ -215,11 +233,38 @@ func (r *routes) getSilenceByID(ctx context.Context, id string) (*models.Gettabl
 	return sil.Payload, nil
 }
 
+// hasMatchersForLabels returns true if the matchers include an equality
+// matcher for each enforced label and its value.
+func (r *routes) hasMatchersForLabels(ctx context.Context, matchers models.Matchers) bool {
+	for _, name := range r.labelNames {
+		if !hasMatcherForLabel(matchers, name, MustLabelValuesFor(ctx, name)[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func hasMatcherForLabel(matchers models.Matchers, name, value string) bool {
 	for _, m := range matchers {
-		if *m.Name == name && !*m.IsRegex && *m.Value == value {
+		if isEqualityMatcherFor(m, name, value) {
 			return true
 		}
 	}
 	return false
 }
+
+// isEqualityMatcherFor returns true if the matcher is an equality matcher for
+// the given label and value (e.g. namespace="default").
+func isEqualityMatcherFor(m *models.Matcher, name, value string) bool {
+	if m.Name == nil || m.Value == nil || m.IsRegex == nil {
+		return false
+	}
+
+	// The matcher is an equality matcher if isEqual is omitted.
+	if m.IsEqual != nil && !*m.IsEqual {
+		return false
+	}
+
+	return *m.Name == name && !*m.IsRegex && *m.Value == value
+}
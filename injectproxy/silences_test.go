@@ -411,14 +411,14 @@ func TestUpdateSilence(t *testing.T) {
 			expBody: okResponse,
 		},
 		{
-			// Creation of a silence with an existing namespace label is ok.
+			// Creation of a silence with the same namespace label is ok.
 			data: `{
     "comment":"foo",
     "createdBy":"bar",
     "endsAt":"2020-02-13T13:00:02.084Z",
     "matchers": [
         {"isRegex":false,"Name":"foo","Value":"bar"},
-		{"isRegex":false,"Name":"namespace","Value":"not default"}
+        {"isRegex":false,"Name":"namespace","Value":"default"}
     ],
     "startsAt":"2020-02-13T12:02:01Z"
 }`,
@@ -428,6 +428,70 @@ func TestUpdateSilence(t *testing.T) {
 			expCode: http.StatusOK,
 			expBody: okResponse,
 		},
+		{
+			// Creation of a silence with a conflicting namespace label returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":false,"Name":"namespace","Value":"not default"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: []string{"default"},
+
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Creation of a silence with a negative namespace matcher returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":false,"isEqual":false,"Name":"namespace","Value":"default"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: []string{"default"},
+
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Creation of a silence with a negative regexp namespace matcher returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":true,"isEqual":false,"Name":"namespace","Value":"mine"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: []string{"default"},
+
+			expCode: http.StatusBadRequest,
+		},
+		{
+			// Creation of a silence with a regexp namespace matcher returns an error.
+			data: `{
+    "comment":"foo",
+    "createdBy":"bar",
+    "endsAt":"2020-02-13T13:00:02.084Z",
+    "matchers": [
+        {"isRegex":false,"Name":"foo","Value":"bar"},
+        {"isRegex":true,"Name":"namespace","Value":"default|other"}
+    ],
+    "startsAt":"2020-02-13T12:02:01Z"
+}`,
+			labelv: []string{"default"},
+
+			expCode: http.StatusBadRequest,
+		},
 		{
 			// Creation of a silence without matcher returns an error.
 			data: `{
@@ -617,7 +681,18 @@ func TestGetAlertGroups(t *testing.T) {
 		},
 	} {
 		t.Run(strings.Join(tc.filters, "&"), func(t *testing.T) {
-			m := newMockUpstream(checkQueryHandler("", tc.queryParam, tc.expQueryValues...))
+			h := checkQueryHandler("", tc.queryParam, tc.expQueryValues...)
+			m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				// The response of the upstream must be a valid list of alert groups.
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					w.WriteHeader(rec.Code)
+					w.Write(rec.Body.Bytes())
+					return
+				}
+				w.Write([]byte(`[]`))
+			}))
 			defer m.Close()
 			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel})
 			if err != nil {
@@ -0,0 +1,233 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// SPIFFEValueSegment is the segment of SPIFFEEnforcer.PathTemplate
+	// holding the label value.
+	SPIFFEValueSegment = "{value}"
+	// SPIFFEAnySegment is a segment of SPIFFEEnforcer.PathTemplate
+	// matching any single segment.
+	SPIFFEAnySegment = "*"
+	// SPIFFERemainingSegments is the last segment of
+	// SPIFFEEnforcer.PathTemplate matching any number of remaining
+	// segments.
+	SPIFFERemainingSegments = "**"
+)
+
+// errMalformedSPIFFEID is returned when the URI SAN of the client certificate
+// isn't a valid SPIFFE ID.
+var errMalformedSPIFFEID = errors.New("malformed SPIFFE ID")
+
+// SPIFFEEnforcer enforces a label value extracted from the SPIFFE ID of the
+// X.509-SVID presented by the client (the URI subject alternative name of
+// the client certificate).
+//
+// Requests without a SVID or whose SPIFFE ID doesn't match the trust domain
+// and path template are rejected with "401 Unauthorized". Malformed SPIFFE
+// IDs are rejected with "400 Bad Request".
+// The proxy doesn't verify the certificate: the TLS server must be configured
+// to require and verify client certificates (tls.RequireAndVerifyClientCert).
+type SPIFFEEnforcer struct {
+	// TrustDomain is the trust domain of the accepted SPIFFE IDs (e.g.
+	// "example.org"). All trust domains are accepted if empty.
+	TrustDomain string
+
+	// PathTemplate is matched segment by segment against the path of the
+	// SPIFFE ID. It must contain exactly one SPIFFEValueSegment segment and
+	// can contain SPIFFEAnySegment segments as well as a final
+	// SPIFFERemainingSegments segment (e.g. "/tenant/{value}/**").
+	PathTemplate string
+}
+
+// Validate verifies that the trust domain and the path template are valid.
+func (se SPIFFEEnforcer) Validate() error {
+	if se.TrustDomain != "" && !isValidSPIFFETrustDomain(se.TrustDomain) {
+		return fmt.Errorf("invalid trust domain %q", se.TrustDomain)
+	}
+
+	if !strings.HasPrefix(se.PathTemplate, "/") {
+		return fmt.Errorf("invalid path template %q: must start with '/'", se.PathTemplate)
+	}
+
+	segments := strings.Split(se.PathTemplate[1:], "/")
+	var found bool
+	for i, s := range segments {
+		switch s {
+		case SPIFFEValueSegment:
+			if found {
+				return fmt.Errorf("invalid path template %q: more than one %s segment", se.PathTemplate, SPIFFEValueSegment)
+			}
+			found = true
+		case SPIFFEAnySegment:
+		case SPIFFERemainingSegments:
+			if i != len(segments)-1 {
+				return fmt.Errorf("invalid path template %q: %s must be the last segment", se.PathTemplate, SPIFFERemainingSegments)
+			}
+		default:
+			if !isValidSPIFFEPathSegment(s) {
+				return fmt.Errorf("invalid path template %q: invalid segment %q", se.PathTemplate, s)
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("invalid path template %q: missing %s segment", se.PathTemplate, SPIFFEValueSegment)
+	}
+
+	return nil
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (se SPIFFEEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			prometheusAPIError(w, "missing client certificate", http.StatusUnauthorized)
+			return
+		}
+
+		var ids []*url.URL
+		for _, u := range r.TLS.PeerCertificates[0].URIs {
+			if strings.EqualFold(u.Scheme, "spiffe") {
+				ids = append(ids, u)
+			}
+		}
+
+		switch len(ids) {
+		case 0:
+			prometheusAPIError(w, "missing SPIFFE ID in the client certificate", http.StatusUnauthorized)
+			return
+		case 1:
+		default:
+			// An X.509-SVID must contain exactly one URI SAN.
+			prometheusAPIError(w, fmt.Sprintf("%v: more than one SPIFFE ID in the client certificate", errMalformedSPIFFEID), http.StatusBadRequest)
+			return
+		}
+
+		labelValue, err := se.getLabelValue(ids[0])
+		if err != nil {
+			code := http.StatusUnauthorized
+			if errors.Is(err, errMalformedSPIFFEID) {
+				code = http.StatusBadRequest
+			}
+			prometheusAPIError(w, humanFriendlyErrorMessage(err), code)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithLabelValues(r.Context(), []string{labelValue})))
+	})
+}
+
+func (se SPIFFEEnforcer) getLabelValue(id *url.URL) (string, error) {
+	trustDomain, segments, err := parseSPIFFEID(id)
+	if err != nil {
+		return "", err
+	}
+
+	if se.TrustDomain != "" && trustDomain != se.TrustDomain {
+		return "", fmt.Errorf("SPIFFE ID %q doesn't belong to the trust domain %q", id, se.TrustDomain)
+	}
+
+	var labelValue string
+	template := strings.Split(se.PathTemplate[1:], "/")
+	for i, s := range template {
+		if s == SPIFFERemainingSegments {
+			return labelValue, nil
+		}
+
+		if i >= len(segments) {
+			break
+		}
+
+		switch s {
+		case SPIFFEValueSegment:
+			labelValue = segments[i]
+		case SPIFFEAnySegment:
+		default:
+			if segments[i] != s {
+				return "", fmt.Errorf("SPIFFE ID %q doesn't match %q", id, se.PathTemplate)
+			}
+		}
+	}
+
+	if len(segments) != len(template) {
+		return "", fmt.Errorf("SPIFFE ID %q doesn't match %q", id, se.PathTemplate)
+	}
+
+	return labelValue, nil
+}
+
+// parseSPIFFEID validates the SPIFFE ID according to the SPIFFE-ID
+// specification and returns its trust domain and path segments.
+func parseSPIFFEID(id *url.URL) (string, []string, error) {
+	switch {
+	case id.Scheme != "spiffe":
+		return "", nil, fmt.Errorf("%w %q: the scheme must be lowercase", errMalformedSPIFFEID, id)
+	case id.Opaque != "" || id.Host == "":
+		return "", nil, fmt.Errorf("%w %q: missing trust domain", errMalformedSPIFFEID, id)
+	case id.User != nil, id.Port() != "":
+		return "", nil, fmt.Errorf("%w %q: user info and port aren't allowed", errMalformedSPIFFEID, id)
+	case id.RawQuery != "" || id.ForceQuery || id.Fragment != "":
+		return "", nil, fmt.Errorf("%w %q: query and fragment aren't allowed", errMalformedSPIFFEID, id)
+	case !isValidSPIFFETrustDomain(id.Host):
+		return "", nil, fmt.Errorf("%w %q: invalid trust domain", errMalformedSPIFFEID, id)
+	case !strings.HasPrefix(id.Path, "/"):
+		return "", nil, fmt.Errorf("%w %q: missing path", errMalformedSPIFFEID, id)
+	}
+
+	segments := strings.Split(id.EscapedPath()[1:], "/")
+	for _, s := range segments {
+		if !isValidSPIFFEPathSegment(s) {
+			return "", nil, fmt.Errorf("%w %q: invalid path segment %q", errMalformedSPIFFEID, id, s)
+		}
+	}
+
+	return id.Host, segments, nil
+}
+
+func isValidSPIFFETrustDomain(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isValidSPIFFEPathSegment(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '.' && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSPIFFEEnforcer(t *testing.T) {
+	svid := func(ids ...string) *tls.ConnectionState {
+		cert := &x509.Certificate{}
+		for _, id := range ids {
+			u, err := url.Parse(id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cert.URIs = append(cert.URIs, u)
+		}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+
+	el := SPIFFEEnforcer{TrustDomain: "example.org", PathTemplate: "/tenant/{value}/**"}
+	for _, tc := range []struct {
+		name  string
+		el    SPIFFEEnforcer
+		state *tls.ConnectionState
+
+		expCode  int
+		expQuery string
+	}{
+		{
+			name:    "no TLS",
+			el:      el,
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "no client certificate",
+			el:      el,
+			state:   &tls.ConnectionState{},
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "no SPIFFE ID",
+			el:      el,
+			state:   svid("https://example.org/tenant/team-a"),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "tenant segment",
+			el:       el,
+			state:    svid("spiffe://example.org/tenant/team-a/ns/default/sa/scraper"),
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-a"}`,
+		},
+		{
+			name:     "no remaining segment",
+			el:       el,
+			state:    svid("spiffe://example.org/tenant/team-a"),
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-a"}`,
+		},
+		{
+			name:     "any segment",
+			el:       SPIFFEEnforcer{PathTemplate: "/*/{value}"},
+			state:    svid("spiffe://other.org/tenant/team-b"),
+			expCode:  http.StatusOK,
+			expQuery: `up{namespace="team-b"}`,
+		},
+		{
+			name:    "extra segments",
+			el:      SPIFFEEnforcer{PathTemplate: "/tenant/{value}"},
+			state:   svid("spiffe://example.org/tenant/team-a/sa/scraper"),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "missing segments",
+			el:      SPIFFEEnforcer{PathTemplate: "/tenant/{value}/sa/*"},
+			state:   svid("spiffe://example.org/tenant/team-a"),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "other trust domain",
+			el:      el,
+			state:   svid("spiffe://other.org/tenant/team-a"),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "path not matching",
+			el:      el,
+			state:   svid("spiffe://example.org/workload/team-a"),
+			expCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "multiple SPIFFE IDs",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant/team-a", "spiffe://example.org/tenant/team-b"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "uppercase trust domain",
+			el:      el,
+			state:   svid("spiffe://Example.org/tenant/team-a"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "port",
+			el:      el,
+			state:   svid("spiffe://example.org:8443/tenant/team-a"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "query",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant/team-a?x=y"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "empty segment",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant//team-a"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "dot segment",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant/../team-a"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "percent-encoded segment",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant/team%2Fa"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "trailing slash",
+			el:      el,
+			state:   svid("spiffe://example.org/tenant/team-a/"),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "no path",
+			el:      el,
+			state:   svid("spiffe://example.org"),
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(checkQueryHandler("", "query", tc.expQuery))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, tc.el)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://prometheus.example.com/api/v1/query?query=up", nil)
+			req.TLS = tc.state
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestSPIFFEEnforcerValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		el   SPIFFEEnforcer
+
+		expErr bool
+	}{
+		{
+			name: "valid",
+			el:   SPIFFEEnforcer{TrustDomain: "example.org", PathTemplate: "/tenant/{value}/*/**"},
+		},
+		{
+			name:   "invalid trust domain",
+			el:     SPIFFEEnforcer{TrustDomain: "Example.org", PathTemplate: "/{value}"},
+			expErr: true,
+		},
+		{
+			name:   "relative path template",
+			el:     SPIFFEEnforcer{PathTemplate: "tenant/{value}"},
+			expErr: true,
+		},
+		{
+			name:   "missing value segment",
+			el:     SPIFFEEnforcer{PathTemplate: "/tenant/*"},
+			expErr: true,
+		},
+		{
+			name:   "duplicated value segment",
+			el:     SPIFFEEnforcer{PathTemplate: "/{value}/{value}"},
+			expErr: true,
+		},
+		{
+			name:   "remaining segments not last",
+			el:     SPIFFEEnforcer{PathTemplate: "/**/{value}"},
+			expErr: true,
+		},
+		{
+			name:   "invalid segment",
+			el:     SPIFFEEnforcer{PathTemplate: "/tenant//{value}"},
+			expErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.el.Validate()
+			if tc.expErr && err == nil {
+				t.Fatal("expected error")
+			}
+			if !tc.expErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// topologyNotImplemented rejects the requests to the targets and stores APIs
+// because they would reveal the infrastructure of all the tenants.
+func topologyNotImplemented(w http.ResponseWriter, req *http.Request) {
+	prometheusAPIError(w, fmt.Sprintf("the %s API isn't supported", req.URL.Path), http.StatusNotImplemented)
+}
+
+// targetsData is the subset of the response of the /api/v1/targets endpoint
+// returned to the client.
+type targetsData struct {
+	ActiveTargets  []json.RawMessage `json:"activeTargets"`
+	DroppedTargets []json.RawMessage `json:"droppedTargets"`
+}
+
+// filterTargets drops the active targets whose labels don't match the
+// enforced label(s). The dropped targets (and their counts) are always
+// removed since they only have the labels discovered before relabeling.
+func (r *routes) filterTargets(ms []*labels.Matcher, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var td targetsData
+	if err := json.Unmarshal(resp.Data, &td); err != nil {
+		return nil, fmt.Errorf("can't decode targets data: %w", err)
+	}
+
+	filtered := &targetsData{
+		ActiveTargets:  []json.RawMessage{},
+		DroppedTargets: []json.RawMessage{},
+	}
+	for i, raw := range td.ActiveTargets {
+		var t struct {
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("can't decode target %d: %w", i, err)
+		}
+
+		if matchLabels(ms, func(name string) string { return t.Labels[name] }) {
+			filtered.ActiveTargets = append(filtered.ActiveTargets, raw)
+		}
+	}
+
+	return filtered, nil
+}
+
+// filterStores drops the Thanos stores which have no label set matching the
+// enforced label(s). The response of the /api/v1/stores endpoint maps the
+// store types (e.g. "sidecar", "store") to the lists of stores.
+func (r *routes) filterStores(ms []*labels.Matcher, _ *http.Request, resp *apiResponse) (interface{}, error) {
+	var stores map[string][]json.RawMessage
+	if err := json.Unmarshal(resp.Data, &stores); err != nil {
+		return nil, fmt.Errorf("can't decode stores data: %w", err)
+	}
+
+	filtered := make(map[string][]json.RawMessage, len(stores))
+	for typ, list := range stores {
+		for i, raw := range list {
+			var s struct {
+				LabelSets []map[string]string `json:"labelSets"`
+			}
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, fmt.Errorf("can't decode %s store %d: %w", typ, i, err)
+			}
+
+			for _, ls := range s.LabelSets {
+				if matchLabels(ms, func(name string) string { return ls[name] }) {
+					filtered[typ] = append(filtered[typ], raw)
+					break
+				}
+			}
+		}
+	}
+
+	return filtered, nil
+}
+
+// matchTargetParam is the parameter of the /api/v1/targets/metadata endpoint
+// selecting the targets by their labels.
+const matchTargetParam = "match_target"
+
+// targetsMetadata enforces the label in the target selector of the
+// /api/v1/targets/metadata endpoint so that only the metadata of the tenant's
+// targets is returned. If the selector is missing, it is set to the enforced
+// matchers.
+func (r *routes) targetsMetadata(w http.ResponseWriter, req *http.Request) {
+	matchers, err := r.newLabelMatchers(req.Context())
+	if err != nil {
+		if !r.rejectMatcherRoundTripError(w, err) {
+			r.countLabelMatchersRejection(req, err)
+			prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	r.setInjectedLabelHeader(w, matchers)
+
+	q := req.URL.Query()
+	selectors := q[matchTargetParam]
+	if len(selectors) == 0 {
+		selectors = []string{matchersToString(matchers...)}
+	} else {
+		for i, s := range selectors {
+			ms, err := r.promQLParser.ParseMetricSelector(s)
+			if err != nil {
+				r.countRejection(req, rejectionQueryParse)
+				prometheusAPIError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			selectors[i] = matchersToString(append(ms, matchers...)...)
+		}
+	}
+	q[matchTargetParam] = selectors
+
+	req.URL.RawQuery = q.Encode()
+	r.handler.ServeHTTP(w, req)
+}
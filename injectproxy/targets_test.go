@@ -0,0 +1,255 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTargetsAndStores(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch req.URL.Path {
+		case "/api/v1/targets":
+			_, _ = w.Write([]byte(`{"status":"success","data":{
+"activeTargets":[
+  {"discoveredLabels":{"__address__":"a:9090"},"labels":{"instance":"a:9090","job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"},
+  {"discoveredLabels":{"__address__":"b:9090"},"labels":{"instance":"b:9090","job":"b","namespace":"ns2"},"scrapePool":"b","health":"up"},
+  {"discoveredLabels":{"__address__":"c:9090"},"labels":{"instance":"c:9090","job":"c"},"scrapePool":"c","health":"down"}
+],
+"droppedTargets":[{"discoveredLabels":{"__address__":"d:9090","namespace":"ns1"}}],
+"droppedTargetCounts":{"a":1}
+}}`))
+		case "/api/v1/stores":
+			_, _ = w.Write([]byte(`{"status":"success","data":{
+"sidecar":[
+  {"name":"sidecar-1:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[{"namespace":"ns1","replica":"0"}],"minTime":1,"maxTime":2},
+  {"name":"sidecar-2:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[{"namespace":"ns2","replica":"0"}],"minTime":1,"maxTime":2}
+],
+"store":[
+  {"name":"store-1:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[{"namespace":"ns2"},{"namespace":"ns1"}],"minTime":1,"maxTime":2},
+  {"name":"store-2:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[],"minTime":1,"maxTime":2}
+]
+}}`))
+		default:
+			t.Errorf("unexpected request path: %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		opts []Option
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "targets not implemented by default",
+			url:     "http://prometheus.example.com/api/v1/targets?namespace=ns1",
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "stores not implemented by default",
+			url:     "http://prometheus.example.com/api/v1/stores?namespace=ns1",
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "targets as passthrough path",
+			url:     "http://prometheus.example.com/api/v1/targets",
+			opts:    []Option{WithPassthroughPaths([]string{"/api/v1/targets"})},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "targets",
+			url:     "http://prometheus.example.com/api/v1/targets?namespace=ns1",
+			opts:    []Option{WithTargetsAndStoresFiltering()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"activeTargets":[{"discoveredLabels":{"__address__":"a:9090"},"labels":{"instance":"a:9090","job":"a","namespace":"ns1"},"scrapePool":"a","health":"up"}],"droppedTargets":[]}}`,
+		},
+		{
+			name:    "targets without match",
+			url:     "http://prometheus.example.com/api/v1/targets?namespace=ns3",
+			opts:    []Option{WithTargetsAndStoresFiltering()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"activeTargets":[],"droppedTargets":[]}}`,
+		},
+		{
+			name:    "stores",
+			url:     "http://prometheus.example.com/api/v1/stores?namespace=ns1",
+			opts:    []Option{WithTargetsAndStoresFiltering()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{"sidecar":[{"name":"sidecar-1:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[{"namespace":"ns1","replica":"0"}],"minTime":1,"maxTime":2}],"store":[{"name":"store-1:10901","lastCheck":"2024-01-01T00:00:00Z","lastError":null,"labelSets":[{"namespace":"ns2"},{"namespace":"ns1"}],"minTime":1,"maxTime":2}]}}`,
+		},
+		{
+			name:    "stores without match",
+			url:     "http://prometheus.example.com/api/v1/stores?namespace=ns3",
+			opts:    []Option{WithTargetsAndStoresFiltering()},
+			expCode: http.StatusOK,
+			expBody: `{"status":"success","data":{}}`,
+		},
+		{
+			name:    "missing label",
+			url:     "http://prometheus.example.com/api/v1/targets",
+			opts:    []Option{WithTargetsAndStoresFiltering()},
+			expCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+
+			if tc.expBody == "" {
+				return
+			}
+
+			if got := strings.TrimSpace(string(body)); got != tc.expBody {
+				t.Fatalf("expected body:\n%s\ngot:\n%s", tc.expBody, got)
+			}
+		})
+	}
+}
+
+func TestTargetsMetadata(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/targets/metadata" {
+			t.Errorf("unexpected request path: %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(req.URL.RawQuery))
+	}))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		method string
+		opts   []Option
+
+		expCode  int
+		expQuery url.Values
+	}{
+		{
+			name:     "without target selector",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1&metric=up&limit=10",
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{namespace="ns1"}`}, "metric": {"up"}, "limit": {"10"}},
+		},
+		{
+			name:     "with target selector",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1&match_target=" + url.QueryEscape(`{job="a"}`),
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{job="a",namespace="ns1"}`}},
+		},
+		{
+			name:     "multiple label values",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1&namespace=ns2&match_target=" + url.QueryEscape(`{job="a"}`),
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{job="a",namespace=~"ns1|ns2"}`}},
+		},
+		{
+			name:     "targets as passthrough path",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1",
+			opts:     []Option{WithPassthroughPaths([]string{"/api/v1/targets"})},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{namespace="ns1"}`}},
+		},
+		{
+			name:     "metadata as passthrough path",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1&match_target=" + url.QueryEscape(`{job="a"}`),
+			opts:     []Option{WithPassthroughPaths([]string{"/api/v1/targets/metadata"})},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{job="a"}`}, "namespace": {"ns1"}},
+		},
+		{
+			name:     "metadata as method-scoped passthrough path",
+			url:      "http://prometheus.example.com/api/v1/targets/metadata?match_target=" + url.QueryEscape(`{job="a"}`),
+			opts:     []Option{WithPassthroughPathsMethods(map[string][]string{"/api/v1/targets/metadata": {"GET"}})},
+			expCode:  http.StatusOK,
+			expQuery: url.Values{"match_target": {`{job="a"}`}},
+		},
+		{
+			name:    "invalid target selector",
+			url:     "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1&match_target=" + url.QueryEscape(`{job=`),
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "missing label",
+			url:     "http://prometheus.example.com/api/v1/targets/metadata",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "unsupported method",
+			url:     "http://prometheus.example.com/api/v1/targets/metadata?namespace=ns1",
+			method:  http.MethodPost,
+			expCode: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(method, tc.url, nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+
+			if tc.expQuery == nil {
+				return
+			}
+
+			q, err := url.ParseQuery(string(body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(q, tc.expQuery) {
+				t.Fatalf("expected query %v, got %v", tc.expQuery, q)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const serverTimingHeader = "Server-Timing"
+
+// serverTiming records when the request went through each phase of the
+// proxy.
+type serverTiming struct {
+	start           time.Time
+	extracted       time.Time
+	upstreamStarted time.Time
+}
+
+// withServerTiming records the timing of the request's phases which are
+// reported in the Server-Timing header of the upstream response.
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		st := &serverTiming{start: time.Now()}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), keyServerTiming, st)))
+	})
+}
+
+// markLabelExtracted records the end of the label extraction phase.
+func markLabelExtracted(ctx context.Context) {
+	if st, ok := ctx.Value(keyServerTiming).(*serverTiming); ok {
+		st.extracted = time.Now()
+	}
+}
+
+// markUpstreamStarted records the end of the enforcement phase.
+func markUpstreamStarted(ctx context.Context) {
+	if st, ok := ctx.Value(keyServerTiming).(*serverTiming); ok {
+		st.upstreamStarted = time.Now()
+	}
+}
+
+// setServerTimingHeader adds the Server-Timing header to the upstream
+// response. Phases which didn't happen (e.g. for passthrough requests) are
+// omitted.
+// See https://www.w3.org/TR/server-timing/
+func setServerTimingHeader(resp *http.Response) {
+	st, ok := resp.Request.Context().Value(keyServerTiming).(*serverTiming)
+	if !ok {
+		return
+	}
+
+	var (
+		now     = time.Now()
+		metrics []string
+	)
+	addMetric := func(name string, d time.Duration) {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond)))
+	}
+
+	if !st.extracted.IsZero() {
+		addMetric("extraction", st.extracted.Sub(st.start))
+		if !st.upstreamStarted.IsZero() {
+			addMetric("enforcement", st.upstreamStarted.Sub(st.extracted))
+		}
+	}
+	if !st.upstreamStarted.IsZero() {
+		addMetric("upstream", now.Sub(st.upstreamStarted))
+	}
+
+	if len(metrics) > 0 {
+		resp.Header.Set(serverTimingHeader, strings.Join(metrics, ", "))
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestServerTimingHeader(t *testing.T) {
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.Write(okResponse) }))
+	defer m.Close()
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		opts []Option
+
+		expHeader *regexp.Regexp
+	}{
+		{
+			name:      "query",
+			url:       "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+			opts:      []Option{WithServerTimingHeader()},
+			expHeader: regexp.MustCompile(`^extraction;dur=\d+\.\d{3}, enforcement;dur=\d+\.\d{3}, upstream;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:      "series",
+			url:       "http://prometheus.example.com/api/v1/series?match[]=up&namespace=ns1",
+			opts:      []Option{WithServerTimingHeader()},
+			expHeader: regexp.MustCompile(`^extraction;dur=\d+\.\d{3}, enforcement;dur=\d+\.\d{3}, upstream;dur=\d+\.\d{3}$`),
+		},
+		{
+			name:      "passthrough",
+			url:       "http://prometheus.example.com/api/v1/status/config",
+			opts:      []Option{WithServerTimingHeader(), WithPassthroughPaths([]string{"/api/v1/status/config"})},
+			expHeader: regexp.MustCompile(`^upstream;dur=\d+\.\d{3}$`),
+		},
+		{
+			name: "without the option",
+			url:  "http://prometheus.example.com/api/v1/query?query=up&namespace=ns1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+
+			got := resp.Header.Get("Server-Timing")
+			if tc.expHeader == nil {
+				if got != "" {
+					t.Fatalf("expected no Server-Timing header, got %q", got)
+				}
+				return
+			}
+
+			if !tc.expHeader.MatchString(got) {
+				t.Fatalf("expected Server-Timing header to match %q, got %q", tc.expHeader, got)
+			}
+		})
+	}
+}
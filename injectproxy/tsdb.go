@@ -0,0 +1,204 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// defaultTSDBStatsLimit is the number of items returned per list by the TSDB
+// stats API when the "limit" parameter isn't set.
+const defaultTSDBStatsLimit = 10
+
+// defaultTSDBStatsMaxSeries is the default maximum number of series of a
+// tenant from which the TSDB stats are computed.
+const defaultTSDBStatsMaxSeries = 100000
+
+// tsdbStatsCacheTTL is how long the series statistics of a tenant are cached.
+const tsdbStatsCacheTTL = 15 * time.Second
+
+// errTSDBStatsTooManySeries is returned when the tenant has more series than
+// the TSDB stats can be computed from.
+var errTSDBStatsTooManySeries = errors.New("too many series to compute the TSDB stats")
+
+// tsdbSeriesStats holds the statistics computed from the series of a tenant,
+// before the requested limit is applied.
+type tsdbSeriesStats struct {
+	numSeries             int
+	seriesByMetricName    map[string]uint64
+	seriesByLabelPair     map[string]uint64
+	valueCountByLabelName map[string]uint64
+	memoryByLabelName     map[string]uint64
+}
+
+// tsdbStatsNotImplemented rejects the requests to the TSDB stats API because
+// the global cardinality statistics would leak information across tenants.
+func tsdbStatsNotImplemented(w http.ResponseWriter, _ *http.Request) {
+	prometheusAPIError(w, "the TSDB stats API isn't supported", http.StatusNotImplemented)
+}
+
+// scopeTSDBStats recomputes the TSDB head statistics from the series matching
+// the enforced label(s). The series are retrieved from the upstream series
+// API for the time range covered by the head block.
+// The number of chunks can't be computed from the series hence it is always
+// reported as zero.
+func (r *routes) scopeTSDBStats(ms []*labels.Matcher, req *http.Request, resp *apiResponse) (interface{}, error) {
+	var stats promv1.TSDBResult
+	if err := json.Unmarshal(resp.Data, &stats); err != nil {
+		return nil, fmt.Errorf("can't decode TSDB stats: %w", err)
+	}
+
+	limit := defaultTSDBStatsLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if l, err := strconv.Atoi(s); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	scoped := promv1.TSDBResult{
+		HeadStats: promv1.TSDBHeadStats{
+			MinTime: stats.HeadStats.MinTime,
+			MaxTime: stats.HeadStats.MaxTime,
+		},
+		SeriesCountByMetricName:     []promv1.Stat{},
+		LabelValueCountByLabelName:  []promv1.Stat{},
+		MemoryInBytesByLabelName:    []promv1.Stat{},
+		SeriesCountByLabelValuePair: []promv1.Stat{},
+	}
+	if stats.HeadStats.MaxTime < stats.HeadStats.MinTime {
+		// The head block is empty.
+		return scoped, nil
+	}
+
+	st, err := r.tsdbSeriesStats(req.Context(), ms, stats.HeadStats)
+	if err != nil {
+		return nil, err
+	}
+
+	scoped.HeadStats.NumSeries = st.numSeries
+	scoped.HeadStats.NumLabelPairs = len(st.seriesByLabelPair)
+	scoped.SeriesCountByMetricName = topStats(st.seriesByMetricName, limit)
+	scoped.LabelValueCountByLabelName = topStats(st.valueCountByLabelName, limit)
+	scoped.MemoryInBytesByLabelName = topStats(st.memoryByLabelName, limit)
+	scoped.SeriesCountByLabelValuePair = topStats(st.seriesByLabelPair, limit)
+
+	return scoped, nil
+}
+
+// tsdbSeriesStats returns the statistics of the series which match the given
+// matchers in the head block. The result is cached per tenant key and
+// selector.
+func (r *routes) tsdbSeriesStats(ctx context.Context, ms []*labels.Matcher, head promv1.TSDBHeadStats) (*tsdbSeriesStats, error) {
+	selector := matchersToString(ms...)
+	key := tenantKey(ctx) + "\xff" + selector
+	if st, ok := r.tsdbStatsCache.get(key); ok {
+		return st, nil
+	}
+
+	client, err := r.upstreamAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []promv1.Option
+	if r.tsdbStatsMaxSeries > 0 {
+		// Request one more series to detect that the maximum is exceeded.
+		opts = append(opts, promv1.WithLimit(uint64(r.tsdbStatsMaxSeries)+1))
+	}
+
+	series, _, err := client.Series(
+		ctx,
+		[]string{selector},
+		time.UnixMilli(int64(head.MinTime)),
+		time.UnixMilli(int64(head.MaxTime)),
+		opts...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can't get the series: %w", err)
+	}
+
+	if r.tsdbStatsMaxSeries > 0 && len(series) > r.tsdbStatsMaxSeries {
+		return nil, fmt.Errorf("%w: more than %d series", errTSDBStatsTooManySeries, r.tsdbStatsMaxSeries)
+	}
+
+	var (
+		seriesByMetricName = map[string]uint64{}
+		seriesByLabelPair  = map[string]uint64{}
+		valuesByLabelName  = map[string]map[string]struct{}{}
+	)
+	for _, lset := range series {
+		if name, ok := lset[model.MetricNameLabel]; ok {
+			seriesByMetricName[string(name)]++
+		}
+
+		for n, v := range lset {
+			seriesByLabelPair[string(n)+"="+string(v)]++
+
+			if _, ok := valuesByLabelName[string(n)]; !ok {
+				valuesByLabelName[string(n)] = map[string]struct{}{}
+			}
+			valuesByLabelName[string(n)][string(v)] = struct{}{}
+		}
+	}
+
+	st := &tsdbSeriesStats{
+		numSeries:             len(series),
+		seriesByMetricName:    seriesByMetricName,
+		seriesByLabelPair:     seriesByLabelPair,
+		valueCountByLabelName: make(map[string]uint64, len(valuesByLabelName)),
+		memoryByLabelName:     make(map[string]uint64, len(valuesByLabelName)),
+	}
+	for n, values := range valuesByLabelName {
+		st.valueCountByLabelName[n] = uint64(len(values))
+		for v := range values {
+			st.memoryByLabelName[n] += uint64(len(v))
+		}
+	}
+	r.tsdbStatsCache.set(key, st)
+
+	return st, nil
+}
+
+// topStats returns the limit items with the highest values sorted by
+// decreasing value (and by name for equal values).
+func topStats(m map[string]uint64, limit int) []promv1.Stat {
+	stats := make([]promv1.Stat, 0, len(m))
+	for name, v := range m {
+		stats = append(stats, promv1.Stat{Name: name, Value: v})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return stats[i].Name < stats[j].Name
+	})
+
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+
+	return stats
+}
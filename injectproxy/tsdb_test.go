@@ -0,0 +1,267 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// tsdbUpstream serves global TSDB stats and the series matching the
+// requested selector.
+func tsdbUpstream(t *testing.T) http.Handler {
+	series := []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a", "namespace", "ns1"),
+		labels.FromStrings("__name__", "up", "job", "b", "namespace", "ns1"),
+		labels.FromStrings("__name__", "http_requests_total", "job", "a", "namespace", "ns1"),
+		labels.FromStrings("__name__", "up", "job", "a", "namespace", "ns2"),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch req.URL.Path {
+		case "/api/v1/status/tsdb":
+			_, _ = w.Write([]byte(`{"status":"success","data":{
+"headStats":{"numSeries":4,"numLabelPairs":7,"chunkCount":12,"minTime":1000,"maxTime":5000},
+"seriesCountByMetricName":[{"name":"up","value":3},{"name":"http_requests_total","value":1}],
+"labelValueCountByLabelName":[{"name":"__name__","value":2},{"name":"job","value":2},{"name":"namespace","value":2}],
+"memoryInBytesByLabelName":[{"name":"__name__","value":21},{"name":"namespace","value":6},{"name":"job","value":2}],
+"seriesCountByLabelValuePair":[{"name":"__name__=up","value":3},{"name":"job=a","value":3}]
+}}`))
+
+		case "/api/v1/series":
+			if err := req.ParseForm(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if start, end := req.Form.Get("start"), req.Form.Get("end"); start != "1" || end != "5" {
+				t.Errorf("expected time range [1, 5], got [%s, %s]", start, end)
+			}
+
+			data := []map[string]string{}
+			for _, match := range req.Form["match[]"] {
+				ms, err := parser.ParseMetricSelector(match)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					continue
+				}
+
+				for _, lset := range series {
+					if matchLabels(ms, lset.Get) {
+						data = append(data, lset.Map())
+					}
+				}
+			}
+
+			if s := req.Form.Get("limit"); s != "" {
+				limit, err := strconv.Atoi(s)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if len(data) > limit {
+					data = data[:limit]
+				}
+			}
+
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+
+		default:
+			t.Errorf("unexpected request path: %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestTSDBStats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		url  string
+		opts []Option
+
+		expCode  int
+		expStats promv1.TSDBResult
+	}{
+		{
+			name:    "not implemented by default",
+			url:     "/api/v1/status/tsdb?namespace=ns1",
+			expCode: http.StatusNotImplemented,
+		},
+		{
+			name:    "missing label value",
+			url:     "/api/v1/status/tsdb",
+			opts:    []Option{WithTSDBStatsScoping()},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "ns1",
+			url:     "/api/v1/status/tsdb?namespace=ns1",
+			opts:    []Option{WithTSDBStatsScoping()},
+			expCode: http.StatusOK,
+			expStats: promv1.TSDBResult{
+				HeadStats: promv1.TSDBHeadStats{NumSeries: 3, NumLabelPairs: 5, MinTime: 1000, MaxTime: 5000},
+				SeriesCountByMetricName: []promv1.Stat{
+					{Name: "up", Value: 2},
+					{Name: "http_requests_total", Value: 1},
+				},
+				LabelValueCountByLabelName: []promv1.Stat{
+					{Name: "__name__", Value: 2},
+					{Name: "job", Value: 2},
+					{Name: "namespace", Value: 1},
+				},
+				MemoryInBytesByLabelName: []promv1.Stat{
+					{Name: "__name__", Value: 21},
+					{Name: "namespace", Value: 3},
+					{Name: "job", Value: 2},
+				},
+				SeriesCountByLabelValuePair: []promv1.Stat{
+					{Name: "namespace=ns1", Value: 3},
+					{Name: "__name__=up", Value: 2},
+					{Name: "job=a", Value: 2},
+					{Name: "__name__=http_requests_total", Value: 1},
+					{Name: "job=b", Value: 1},
+				},
+			},
+		},
+		{
+			name:    "ns2 with limit",
+			url:     "/api/v1/status/tsdb?namespace=ns2&limit=1",
+			opts:    []Option{WithTSDBStatsScoping()},
+			expCode: http.StatusOK,
+			expStats: promv1.TSDBResult{
+				HeadStats:                   promv1.TSDBHeadStats{NumSeries: 1, NumLabelPairs: 3, MinTime: 1000, MaxTime: 5000},
+				SeriesCountByMetricName:     []promv1.Stat{{Name: "up", Value: 1}},
+				LabelValueCountByLabelName:  []promv1.Stat{{Name: "__name__", Value: 1}},
+				MemoryInBytesByLabelName:    []promv1.Stat{{Name: "namespace", Value: 3}},
+				SeriesCountByLabelValuePair: []promv1.Stat{{Name: "__name__=up", Value: 1}},
+			},
+		},
+		{
+			name:    "ns1 over the series limit",
+			url:     "/api/v1/status/tsdb?namespace=ns1",
+			opts:    []Option{WithTSDBStatsScoping(), WithTSDBStatsMaxSeries(2)},
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "ns2 within the series limit",
+			url:     "/api/v1/status/tsdb?namespace=ns2&limit=1",
+			opts:    []Option{WithTSDBStatsScoping(), WithTSDBStatsMaxSeries(1)},
+			expCode: http.StatusOK,
+			expStats: promv1.TSDBResult{
+				HeadStats:                   promv1.TSDBHeadStats{NumSeries: 1, NumLabelPairs: 3, MinTime: 1000, MaxTime: 5000},
+				SeriesCountByMetricName:     []promv1.Stat{{Name: "up", Value: 1}},
+				LabelValueCountByLabelName:  []promv1.Stat{{Name: "__name__", Value: 1}},
+				MemoryInBytesByLabelName:    []promv1.Stat{{Name: "namespace", Value: 3}},
+				SeriesCountByLabelValuePair: []promv1.Stat{{Name: "__name__=up", Value: 1}},
+			},
+		},
+		{
+			name:    "unknown tenant",
+			url:     "/api/v1/status/tsdb?namespace=ns3",
+			opts:    []Option{WithTSDBStatsScoping()},
+			expCode: http.StatusOK,
+			expStats: promv1.TSDBResult{
+				HeadStats:                   promv1.TSDBHeadStats{MinTime: 1000, MaxTime: 5000},
+				SeriesCountByMetricName:     []promv1.Stat{},
+				LabelValueCountByLabelName:  []promv1.Stat{},
+				MemoryInBytesByLabelName:    []promv1.Stat{},
+				SeriesCountByLabelValuePair: []promv1.Stat{},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMockUpstream(tsdbUpstream(t))
+			defer m.Close()
+
+			r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, tc.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+
+			resp := w.Result()
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, w.Body.String())
+			}
+
+			if tc.expCode != http.StatusOK {
+				return
+			}
+
+			var apir struct {
+				Status string            `json:"status"`
+				Data   promv1.TSDBResult `json:"data"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&apir); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(apir.Data, tc.expStats) {
+				t.Fatalf("expected stats %+v, got %+v", tc.expStats, apir.Data)
+			}
+		})
+	}
+}
+
+func TestTSDBStatsCache(t *testing.T) {
+	var (
+		upstream = tsdbUpstream(t)
+		series   atomic.Int32
+	)
+	m := newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/series" {
+			series.Add(1)
+
+			_ = req.ParseForm()
+			if limit := req.Form.Get("limit"); limit != strconv.Itoa(defaultTSDBStatsMaxSeries+1) {
+				t.Errorf("expected limit %d, got %q", defaultTSDBStatsMaxSeries+1, limit)
+			}
+		}
+		upstream.ServeHTTP(w, req)
+	}))
+	defer m.Close()
+
+	r, err := NewRoutes(m.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel}, WithTSDBStatsScoping())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, u := range []string{
+		"/api/v1/status/tsdb?namespace=ns1",
+		"/api/v1/status/tsdb?namespace=ns1&limit=1",
+		"/api/v1/status/tsdb?namespace=ns2",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+u, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d: %s", u, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	// The series of each tenant should be requested once.
+	if n := series.Load(); n != 2 {
+		t.Fatalf("expected 2 requests for the series, got %d", n)
+	}
+}
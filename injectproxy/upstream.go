@@ -0,0 +1,81 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// upstreamResolvingExtractor selects the upstream of the request from the
+// label values once they have been extracted. All the label values must be
+// served by the same upstream.
+type upstreamResolvingExtractor struct {
+	ExtractLabeler
+	f func(string) (*url.URL, error)
+}
+
+// ExtractLabel implements the ExtractLabeler interface.
+func (ure upstreamResolvingExtractor) ExtractLabel(next http.HandlerFunc) http.Handler {
+	return ure.ExtractLabeler.ExtractLabel(func(w http.ResponseWriter, req *http.Request) {
+		var upstream *url.URL
+		for _, v := range MustLabelValues(req.Context()) {
+			u, err := ure.f(v)
+			if err != nil {
+				prometheusAPIError(w, fmt.Sprintf("can't resolve the upstream of label value %q: %v", v, err), http.StatusBadGateway)
+				return
+			}
+
+			if u == nil {
+				prometheusAPIError(w, fmt.Sprintf("no upstream for label value %q", v), http.StatusBadGateway)
+				return
+			}
+
+			if upstream != nil && upstream.String() != u.String() {
+				prometheusAPIError(w, "the label values are served by different upstreams", http.StatusUnprocessableEntity)
+				return
+			}
+			upstream = u
+		}
+
+		next(w, req.WithContext(context.WithValue(req.Context(), keyUpstream, upstream)))
+	})
+}
+
+// upstreamURL returns the upstream selected for the request or the default
+// upstream.
+func (r *routes) upstreamURL(ctx context.Context) *url.URL {
+	if u, ok := ctx.Value(keyUpstream).(*url.URL); ok {
+		return u
+	}
+
+	return r.upstream
+}
+
+// withResolvedUpstream wraps the director of the reverse proxy to forward the
+// requests to the upstream selected for the tenant (if any).
+func withResolvedUpstream(director func(*http.Request)) func(*http.Request) {
+	return func(req *http.Request) {
+		u, ok := req.Context().Value(keyUpstream).(*url.URL)
+		if !ok {
+			director(req)
+			return
+		}
+
+		httputil.NewSingleHostReverseProxy(u).Director(req)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWithUpstreamResolver(t *testing.T) {
+	shard := func(name string) *mockUpstream {
+		return newMockUpstream(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name + " " + req.URL.Path))
+		}))
+	}
+	shard1, shard2, fallback := shard("shard1"), shard("shard2"), shard("default")
+	defer shard1.Close()
+	defer shard2.Close()
+	defer fallback.Close()
+
+	shard2URL := *shard2.url
+	shard2URL.Path = "/prometheus"
+	resolver := func(v string) (*url.URL, error) {
+		switch v {
+		case "ns1", "ns2":
+			return shard1.url, nil
+		case "ns3":
+			return &shard2URL, nil
+		}
+		return nil, errors.New("unknown tenant")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		labels []EnforcedLabel
+		opts   []Option
+	}{
+		{
+			name: "multiple enforced labels",
+			labels: []EnforcedLabel{
+				{Name: "namespace", ExtractLabeler: HTTPFormEnforcer{ParameterName: "namespace"}},
+				{Name: "cluster", ExtractLabeler: HTTPFormEnforcer{ParameterName: "cluster"}},
+			},
+		},
+		{
+			name:   "regex match",
+			labels: []EnforcedLabel{{Name: proxyLabel, ExtractLabeler: HTTPFormEnforcer{ParameterName: proxyLabel}}},
+			opts:   []Option{WithRegexMatch()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewMultiLabelRoutes(fallback.url, tc.labels, append(tc.opts, WithUpstreamResolver(resolver))...); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	r, err := NewRoutes(fallback.url, proxyLabel, HTTPFormEnforcer{ParameterName: proxyLabel},
+		WithUpstreamResolver(resolver),
+		WithPassthroughPaths([]string{"/api/v1/status/config"}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		url  string
+
+		expCode int
+		expBody string
+	}{
+		{
+			name:    "first shard",
+			url:     "/api/v1/query?query=up&namespace=ns1",
+			expCode: http.StatusOK,
+			expBody: "shard1 /api/v1/query",
+		},
+		{
+			name:    "second shard with path prefix",
+			url:     "/api/v1/query?query=up&namespace=ns3",
+			expCode: http.StatusOK,
+			expBody: "shard2 /prometheus/api/v1/query",
+		},
+		{
+			name:    "multiple values of the same shard",
+			url:     "/api/v1/query?query=up&namespace=ns1&namespace=ns2",
+			expCode: http.StatusOK,
+			expBody: "shard1 /api/v1/query",
+		},
+		{
+			name:    "multiple values of different shards",
+			url:     "/api/v1/query?query=up&namespace=ns1&namespace=ns3",
+			expCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:    "resolver error",
+			url:     "/api/v1/query?query=up&namespace=ns4",
+			expCode: http.StatusBadGateway,
+		},
+		{
+			name:    "passthrough path",
+			url:     "/api/v1/status/config",
+			expCode: http.StatusOK,
+			expBody: "default /api/v1/status/config",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://prometheus.example.com"+tc.url, nil))
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tc.expCode {
+				t.Fatalf("expected status code %d, got %d: %s", tc.expCode, resp.StatusCode, string(body))
+			}
+
+			if tc.expBody != "" && string(body) != tc.expBody {
+				t.Fatalf("expected body %q, got %q", tc.expBody, string(body))
+			}
+		})
+	}
+}
@@ -14,19 +14,150 @@
 package injectproxy
 
 import (
+	"context"
 	"encoding/json"
+	"html/template"
 	"log"
 	"net/http"
+
+	"github.com/munnerz/goautoneg"
 )
 
 func prometheusAPIError(w http.ResponseWriter, errorMessage string, code int) {
+	if rl := requestLogFor(w); rl != nil {
+		rl.log(context.Background(), "request rejected", code, errorMessage)
+	}
+
+	if prefersHTMLErrors(w) {
+		htmlError(w, errorMessage, code)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(code)
 
-	res := map[string]string{"status": "error", "errorType": "prom-label-proxy", "error": errorMessage}
+	res := map[string]any{"status": "error", "errorType": "prom-label-proxy", "error": errorMessage}
+	if d := errorDecoratorFor(w); d != nil {
+		d.f(d.req, code, res)
+	}
 
 	if err := json.NewEncoder(w).Encode(res); err != nil {
 		log.Printf("error: Failed to encode json: %v", err)
 	}
 }
+
+var htmlErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{ .Code }} {{ .Status }}</title></head>
+<body>
+<h1>{{ .Code }} {{ .Status }}</h1>
+<p>{{ .Message }}</p>
+<hr><p>prom-label-proxy</p>
+</body>
+</html>
+`))
+
+func htmlError(w http.ResponseWriter, errorMessage string, code int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	err := htmlErrorTemplate.Execute(w, struct {
+		Code    int
+		Status  string
+		Message string
+	}{
+		Code:    code,
+		Status:  http.StatusText(code),
+		Message: errorMessage,
+	})
+	if err != nil {
+		log.Printf("error: Failed to render html: %v", err)
+	}
+}
+
+// htmlErrorResponseWriter marks the responses for which prometheusAPIError
+// should render an HTML page instead of a JSON document.
+type htmlErrorResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap returns the original http.ResponseWriter (used by http.ResponseController).
+func (w *htmlErrorResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements the http.Flusher interface.
+func (w *htmlErrorResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// prefersHTMLErrors returns true if the response writer (or one of the
+// writers it wraps) is an htmlErrorResponseWriter.
+func prefersHTMLErrors(w http.ResponseWriter) bool {
+	for {
+		switch rw := w.(type) {
+		case *htmlErrorResponseWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// errorDecoratingResponseWriter holds the function decorating the JSON error
+// documents returned by prometheusAPIError.
+type errorDecoratingResponseWriter struct {
+	http.ResponseWriter
+	req *http.Request
+	f   func(*http.Request, int, map[string]any)
+}
+
+// Unwrap returns the original http.ResponseWriter (used by http.ResponseController).
+func (w *errorDecoratingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements the http.Flusher interface.
+func (w *errorDecoratingResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// errorDecoratorFor returns the errorDecoratingResponseWriter if the response
+// writer (or one of the writers it wraps) is one.
+func errorDecoratorFor(w http.ResponseWriter) *errorDecoratingResponseWriter {
+	for {
+		switch rw := w.(type) {
+		case *errorDecoratingResponseWriter:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// withErrorResponseDecorator lets f decorate the JSON error documents of the
+// requests.
+func withErrorResponseDecorator(f func(*http.Request, int, map[string]any), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&errorDecoratingResponseWriter{ResponseWriter: w, req: req, f: f}, req)
+	})
+}
+
+// withHTMLErrorPages renders errors as HTML pages for the requests which
+// prefer HTML over JSON (e.g. web browsers).
+func withHTMLErrorPages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		accept := req.Header.Get("Accept")
+		if accept != "" && goautoneg.Negotiate(accept, []string{"application/json", "text/html"}) == "text/html" {
+			w = &htmlErrorResponseWriter{ResponseWriter: w}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
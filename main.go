@@ -19,13 +19,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/metalmatze/signal/internalserver"
 	"github.com/oklog/run"
@@ -59,22 +62,84 @@ func main() {
 		internalListenAddress  string
 		upstream               string
 		queryParam             string
+		queryParamAliases      arrayFlags
 		headerName             string
 		label                  string
 		labelValues            arrayFlags
 		enableLabelAPIs        bool
+		enableAdminAPI         bool
 		unsafePassthroughPaths string // Comma-delimited string.
+		exactPassthroughPaths  bool
+		passthroughPathMethods arrayFlags
+		streamingPaths         string // Comma-delimited string.
 		errorOnReplace         bool
 		regexMatch             bool
+		regexAnchoring         bool
+		allowEmptyRegex        bool
 		headerUsesListSyntax   bool
+		headerListDelimiter    string
 		rulesWithActiveAlerts  bool
+		redactRuleFiles        bool
+		alertStates            string // Comma-delimited string.
 		bypassQueries          arrayFlags
+		promQLParamAliases     arrayFlags
+		bypassMatchers         arrayFlags
+		strictContentLength    bool
+		enableRemoteWrite      bool
+		enableOTLP             bool
+		serverTimingHeader     bool
+		queryRewriteHeader     bool
+		upstreamDurationTenant bool
+		forwardOrgIDHeader     string
+		maxQueryRange          time.Duration
+		minQueryStep           time.Duration
+		batchQueryField        string
+		preserveParamOrder     bool
+		metadataPassthrough    bool
+		metadataFiltering      bool
+		alertmanagerStatus     bool
+		receiversSeparator     string
+		tsdbStatsScoping       bool
+		tsdbStatsMaxSeries     int
+		topologyFiltering      bool
+		behaviorVersion        int
+		replaceRejectionStatus int
+		upstreamHealthCheck    string
+		defaultLabelValue      string
+		allowedLabelValues     arrayFlags
+		deniedLabelValues      arrayFlags
+		maxLabelValues         int
+		singleValueOnly        bool
+		deniedMetricNames      arrayFlags
+		matcherRoundTrip       bool
+		maintenanceMode        bool
+		maintenanceTokenFile   string
+		maintenanceMessage     string
+		maintenanceRetryAfter  time.Duration
+		upstreamDialTimeout    time.Duration
+		upstreamHeaderTimeout  time.Duration
+		upstreamRequestTimeout time.Duration
+		breakerThreshold       int
+		breakerCooldown        time.Duration
+		shutdownTimeout        time.Duration
+		upstreamMaxIdleConns   int
+		upstreamH2C            bool
+		stripAbsentLabels      bool
+		lenientMatchSelectors  bool
+		orAbsent               bool
+		rateLimit              float64
+		rateLimitBurst         int
+		queryCoalescing        bool
+		logFormat              string
+		dryRun                 bool
+		maxBodyBytes           int64
 	)
 
 	flagset := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flagset.StringVar(&insecureListenAddress, "insecure-listen-address", "", "The address the prom-label-proxy HTTP server should listen on.")
 	flagset.StringVar(&internalListenAddress, "internal-listen-address", "", "The address the internal prom-label-proxy HTTP server should listen on to expose metrics about itself.")
 	flagset.StringVar(&queryParam, "query-param", "", "Name of the HTTP parameter that contains the tenant value.At most one of -query-param, -header-name and -label-value should be given. If the flag isn't defined and neither -header-name nor -label-value is set, it will default to the value of the -label flag.")
+	flagset.Var(&queryParamAliases, "query-param-alias", "Additional name of the HTTP parameter that contains the tenant value. It can be repeated and requires -query-param to be set (explicitly or by default).")
 	flagset.StringVar(&headerName, "header-name", "", "Name of the HTTP header name that contains the tenant value. At most one of -query-param, -header-name and -label-value should be given.")
 	flagset.StringVar(&upstream, "upstream", "", "The upstream URL to proxy to.")
 	flagset.StringVar(&label, "label", "", "The label name to enforce in all proxied PromQL queries.")
@@ -82,14 +147,83 @@ func main() {
 	flagset.BoolVar(&enableLabelAPIs, "enable-label-apis", false, "When specified proxy allows to inject label to label APIs like /api/v1/labels and /api/v1/label/<name>/values. "+
 		"NOTE: Enable with care because filtering by matcher is not implemented in older versions of Prometheus (>= v2.24.0 required) and Thanos (>= v0.18.0 required, >= v0.23.0 recommended). If enabled and "+
 		"any labels endpoint does not support selectors, the injected matcher will have no effect.")
+	flagset.BoolVar(&enableAdminAPI, "enable-admin-api", false, "When specified proxy allows to delete series with the TSDB admin API (/api/v1/admin/tsdb/delete_series). The label is injected into all the series selectors so that a tenant can only delete its own series.")
 	flagset.StringVar(&unsafePassthroughPaths, "unsafe-passthrough-paths", "", "Comma delimited allow list of exact HTTP path segments that should be allowed to hit upstream URL without any enforcement. "+
 		"This option is checked after Prometheus APIs, you cannot override enforced API endpoints to be not enforced with this option. Use carefully as it can easily cause a data leak if the provided path is an important "+
 		"API (like /api/v1/configuration) which isn't enforced by prom-label-proxy. NOTE: \"all\" matching paths like \"/\" or \"\" and regex are not allowed.")
+	flagset.BoolVar(&exactPassthroughPaths, "exact-passthrough-paths", false, "When specified, the passthrough paths (including the method-scoped and streaming ones) only match the exact paths. By default, their sub-paths (e.g. '/federate/foo' for '/federate') are also forwarded without enforcement.")
+	flagset.Var(&passthroughPathMethods, "unsafe-passthrough-path-methods", "Exact HTTP path that should be allowed to hit upstream URL without any enforcement for the given HTTP methods only (e.g. '/api/v1/targets=GET,HEAD'). "+
+		"It can be repeated. The same restrictions as -unsafe-passthrough-paths apply.")
+	flagset.StringVar(&streamingPaths, "unsafe-streaming-passthrough-paths", "", "Comma delimited allow list of exact HTTP path segments that should be allowed to hit upstream URL without any enforcement and whose responses are streamed to the client (e.g. Server-Sent Events or WebSocket endpoints). "+
+		"The same restrictions as -unsafe-passthrough-paths apply.")
 	flagset.BoolVar(&errorOnReplace, "error-on-replace", false, "When specified, the proxy will return HTTP status code 400 if the query already contains a label matcher that differs from the one the proxy would inject.")
+	flagset.Int64Var(&maxBodyBytes, "max-body-bytes", 10<<20, "The maximum size in bytes of the request bodies accepted by the query, matcher, remote write and OTLP endpoints (before and after decompression for remote write). Larger bodies are rejected with HTTP status code 413. A negative value disables the limit.")
+	flagset.IntVar(&replaceRejectionStatus, "replace-rejection-status", http.StatusBadRequest, "The HTTP status code returned when a request is rejected because of -error-on-replace (e.g. 403).")
 	flagset.BoolVar(&regexMatch, "regex-match", false, "When specified, the tenant name is treated as a regular expression. In this case, only one tenant name should be provided.")
+	flagset.BoolVar(&allowEmptyRegex, "unsafe-allow-empty-matching-regex", false, "When specified with -regex-match, the tenant regular expressions matching the empty string (e.g. 'team-a|') aren't rejected. Use with care: such regular expressions also match the series without the tenant label.")
+	flagset.BoolVar(&regexAnchoring, "regex-anchoring", false, "When specified with -regex-match, the tenant name is explicitly anchored and regular expressions for which an alternative doesn't start with a literal prefix (e.g. '.*foo') are rejected.")
 	flagset.BoolVar(&headerUsesListSyntax, "header-uses-list-syntax", false, "When specified, the header line value will be parsed as a comma-separated list. This allows a single tenant header line to specify multiple tenant names.")
+	flagset.StringVar(&headerListDelimiter, "header-list-delimiter", ",", "The delimiter of the header values when -header-uses-list-syntax is specified. The values containing the delimiter can be enclosed in double quotes (e.g. '\"team,a\",team-b').")
+	flagset.StringVar(&alertStates, "alert-states", "", "Comma delimited list of the alert states (e.g. 'pending,firing') returned by the alerts endpoint. By default, the alerts are returned whatever their state.")
+	flagset.BoolVar(&redactRuleFiles, "redact-rule-files", false, "When true, the proxy removes the paths of the rule files from the responses of the rules endpoint.")
 	flagset.BoolVar(&rulesWithActiveAlerts, "rules-with-active-alerts", false, "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels.")
+	flagset.Var(&promQLParamAliases, "promql-param-alias", "Additional name of the HTTP parameter holding the PromQL query of the query endpoints (e.g. 'g0.expr' as sent by Grafana Explore). The label is enforced in this parameter in addition to 'query'. It can be repeated.")
 	flagset.Var(&bypassQueries, "bypass-query", "A query to bypass the proxy. This can be a PromQL query or a label selector. It can be repeated in which case the proxy will bypass all matching queries.")
+	flagset.Var(&bypassMatchers, "bypass-matcher", "A metric selector (e.g. 'up{job=\"prometheus\"}') to bypass the proxy. Queries for which all the selectors include the matchers of a bypass selector aren't enforced. It can be repeated.")
+
+	flagset.BoolVar(&strictContentLength, "strict-content-length", false, "When specified, the proxy will return HTTP status code 400 if the size of the request body doesn't match the Content-Length header.")
+	flagset.BoolVar(&enableRemoteWrite, "enable-remote-write", false, "When specified, the proxy allows to inject the label into the series pushed to the remote write API (/api/v1/write). Only one label value is supported.")
+	flagset.BoolVar(&enableOTLP, "enable-otlp", false, "When specified, the proxy allows to inject the label as an attribute of the data points and resources of the metrics pushed to the OTLP metrics receiver (/api/v1/otlp/v1/metrics). Only one label value is supported.")
+	flagset.BoolVar(&metadataPassthrough, "enable-metadata-passthrough", false, "When specified, the proxy forwards the requests to the metric metadata API (/api/v1/metadata) without enforcement. "+
+		"NOTE: the metadata can't be filtered by label so all the tenants can see the metadata of all the metrics.")
+	flagset.BoolVar(&metadataFiltering, "enable-metadata-filtering", false, "When specified, the proxy returns only the metadata of the metrics having series matching the label from the metric metadata API (/api/v1/metadata). "+
+		"The metric names are retrieved from the upstream label values API (/api/v1/label/__name__/values) which needs to support selectors.")
+	flagset.BoolVar(&alertmanagerStatus, "enable-alertmanager-status-passthrough", false, "When specified, the proxy forwards the requests to the Alertmanager status and receivers APIs (/api/v2/status and /api/v2/receivers) without enforcement. "+
+		"NOTE: these APIs aren't scoped to a tenant so all the tenants can see the cluster status, the configuration and the names of all the receivers.")
+	flagset.StringVar(&receiversSeparator, "receivers-filtering-separator", "", "When specified, the proxy returns only the receivers named after the label value from the Alertmanager receivers API (/api/v2/receivers), either exactly or followed by this separator and a suffix (e.g. 'team-a/pager' with '/').")
+	flagset.StringVar(&defaultLabelValue, "default-label-value", "", "When specified, the proxy enforces this label value if the request doesn't provide one via -query-param or -header-name instead of returning HTTP status code 400. "+
+		"NOTE: all the requests without tenant information get access to the data of the default tenant.")
+	flagset.Var(&allowedLabelValues, "allowed-label-value", "When specified, the proxy rejects the requests whose label value isn't in the list with HTTP status code 403. It can be repeated. Ignored when -regex-match is specified.")
+	flagset.Var(&deniedLabelValues, "denied-label-value", "A label value for which the requests are rejected with HTTP status code 403. It can be repeated.")
+	flagset.IntVar(&maxLabelValues, "max-label-values", 0, "The maximum number of values of the label per request. The requests exceeding it are rejected with HTTP status code 400. Disabled if 0.")
+	flagset.BoolVar(&singleValueOnly, "single-label-value-only", false, "When specified, the requests with more than one value for the label are rejected with HTTP status code 400 instead of being enforced with a regexp matcher. It takes precedence over -max-label-values.")
+	flagset.Var(&deniedMetricNames, "denied-metric-name", "A regular expression of the metric names which can't be queried (e.g. 'apiserver_.*'). The queries and match[] selectors selecting a matching metric name or no literal metric name are rejected with HTTP status code 403. It can be repeated.")
+	flagset.BoolVar(&tsdbStatsScoping, "enable-tsdb-stats-scoping", false, "When specified, the proxy returns the TSDB head statistics (/api/v1/status/tsdb) computed from the series matching the label. "+
+		"The series are retrieved from the upstream series API (/api/v1/series) and cached per tenant for 15s. Otherwise the endpoint returns HTTP status code 501.")
+	flagset.IntVar(&tsdbStatsMaxSeries, "tsdb-stats-max-series", 100000, "The maximum number of series from which the TSDB head statistics of a tenant are computed when -enable-tsdb-stats-scoping is specified. The requests for tenants with more series are rejected with HTTP status code 422. A negative value disables the limit.")
+	flagset.BoolVar(&topologyFiltering, "enable-targets-and-stores-filtering", false, "When specified, the proxy returns the active targets (/api/v1/targets) and the Thanos stores (/api/v1/stores) whose labels match the label. "+
+		"Otherwise the endpoints return HTTP status code 501.")
+	flagset.BoolVar(&matcherRoundTrip, "matcher-round-trip-validation", false, "When specified, the proxy verifies that the injected label matchers parse back into the same matchers and returns HTTP status code 500 otherwise.")
+	flagset.BoolVar(&maintenanceMode, "enable-maintenance-mode", false, "When specified, the maintenance mode can be toggled by sending the SIGUSR1 signal to the process. In maintenance mode, the proxy returns HTTP status code 503 for all requests except the health endpoints.")
+	flagset.StringVar(&maintenanceTokenFile, "maintenance-token-file", "", "Path to a file containing the bearer token required to report (GET), enable (POST) and disable (DELETE) the maintenance mode via the /-/maintenance endpoint. It implies -enable-maintenance-mode.")
+	flagset.StringVar(&maintenanceMessage, "maintenance-message", "", "The error message returned in maintenance mode.")
+	flagset.DurationVar(&maintenanceRetryAfter, "maintenance-retry-after", time.Minute, "The value of the Retry-After header returned in maintenance mode. 0 disables the header.")
+	flagset.IntVar(&behaviorVersion, "behavior-version", injectproxy.LatestBehaviorVersion, "The version of the enforcement behavior. Pin it to avoid changes in the accepted and rejected requests when upgrading the proxy.")
+	flagset.DurationVar(&upstreamDialTimeout, "upstream-dial-timeout", 30*time.Second, "The maximum amount of time to wait for a connection to the upstream.")
+	flagset.DurationVar(&upstreamHeaderTimeout, "upstream-response-header-timeout", 5*time.Minute, "The maximum amount of time to wait for the response headers of the upstream. 0 means no timeout.")
+	flagset.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "The maximum amount of time to wait for the in-flight requests to complete on shutdown. The new requests are rejected with HTTP status code 503 in the meantime. 0 means that the server stops immediately.")
+	flagset.DurationVar(&upstreamRequestTimeout, "upstream-request-timeout", 0, "The maximum duration of the upstream requests including the transfer of the response body. The requests exceeding it are cancelled and HTTP status code 504 is returned. 0 means no timeout.")
+	flagset.IntVar(&breakerThreshold, "upstream-circuit-breaker-threshold", 0, "The number of consecutive upstream failures (5xx responses except the JSON-encoded 503 query errors, connection errors and upstream timeouts) after which the requests are rejected with HTTP status code 503 during -upstream-circuit-breaker-cooldown. Disabled if 0.")
+	flagset.DurationVar(&breakerCooldown, "upstream-circuit-breaker-cooldown", 30*time.Second, "The duration during which the requests are rejected once the circuit breaker is open.")
+	flagset.IntVar(&upstreamMaxIdleConns, "upstream-max-idle-conns", 100, "The maximum number of idle (keep-alive) connections to the upstream.")
+	flagset.BoolVar(&upstreamH2C, "upstream-h2c", false, "When specified, the proxy uses HTTP/2 over cleartext connections (h2c) to the upstream. The upstream URL must use the http scheme and the -upstream-response-header-timeout and -upstream-max-idle-conns flags have no effect.")
+	flagset.Float64Var(&rateLimit, "rate-limit", 0, "The maximum number of requests per second per tenant. Requests exceeding the limit are rejected with HTTP status code 429. Disabled if 0.")
+	flagset.IntVar(&rateLimitBurst, "rate-limit-burst", 10, "The maximum burst of requests per tenant when -rate-limit is set.")
+	flagset.BoolVar(&orAbsent, "or-absent", false, "When specified, the injected label matchers also match the series without the enforced label (e.g. namespace=~\"default|\") so that global series are visible to all tenants.")
+	flagset.BoolVar(&lenientMatchSelectors, "lenient-match-selectors", false, "When specified, the match[] parameters which aren't bare series selectors (e.g. 'rate(up[5m])') are accepted and the label is enforced in all the selectors of the expression instead of returning HTTP status code 400.")
+	flagset.BoolVar(&stripAbsentLabels, "strip-absent-labels", false, "When specified, the enforced labels are removed from the results of the absent() and absent_over_time() functions.")
+	flagset.BoolVar(&queryCoalescing, "enable-query-coalescing", false, "When specified, concurrent identical queries from the same tenant are sent only once to the upstream and the response is shared.")
+	flagset.StringVar(&logFormat, "log-format", "", "The format of the logs. Can be empty (unstructured logs) or 'json'. With 'json', the rejected requests are logged with the request's method, path and enforced label values.")
+	flagset.BoolVar(&dryRun, "dry-run", false, "When specified, the proxy logs the requests which it would enforce (or reject) but forwards the original requests unmodified. It should only be used to validate the configuration because it provides no isolation between tenants.")
+	flagset.StringVar(&upstreamHealthCheck, "upstream-health-check-path", "", "When specified, the /healthz and /readyz endpoints return HTTP status code 503 if the request to this upstream path (e.g. /-/ready) fails. The /livez endpoint never checks the upstream.")
+	flagset.DurationVar(&maxQueryRange, "max-query-range", 0, "The maximum range (end - start) of the range queries. Requests exceeding it are rejected with HTTP status code 400. 0 means no limit.")
+	flagset.DurationVar(&minQueryStep, "min-query-step", 0, "The minimum step of the range queries. Requests with a lower step are rejected with HTTP status code 400. 0 means no limit.")
+	flagset.BoolVar(&preserveParamOrder, "preserve-parameter-order", false, "When specified, the query endpoints keep the order of the request parameters and only re-encode the enforced values (e.g. for upstreams verifying signed requests).")
+	flagset.StringVar(&batchQueryField, "batch-query-field", "", "When specified, the query endpoints accept JSON-encoded POST bodies made of an array of objects in which this field holds the query (e.g. 'expr'). The label is enforced in all the queries of the array.")
+	flagset.StringVar(&forwardOrgIDHeader, "forward-org-id-header", "", "When specified, the proxy sets the enforced label value in this header of the upstream requests (e.g. X-Scope-OrgID for Cortex and Mimir). Requests with multiple label values are rejected.")
+	flagset.BoolVar(&queryRewriteHeader, "query-rewrite-header", false, "When specified, the proxy will report the original and enforced queries in the X-Original-Query and X-Enforced-Query response headers. The values are escaped and truncated to 1024 bytes.")
+	flagset.BoolVar(&serverTimingHeader, "server-timing-header", false, "When specified, the proxy will report the time spent in label extraction, enforcement and upstream round-trip in the Server-Timing response header.")
+	flagset.BoolVar(&upstreamDurationTenant, "upstream-duration-tenant-label", false, "When specified, the proxy_upstream_duration_seconds histogram is also labeled by tenant. It should only be used when the number of tenants is bounded.")
 
 	//nolint: errcheck // Parse() will exit on error.
 	flagset.Parse(os.Args[1:])
@@ -109,6 +243,10 @@ func main() {
 		log.Fatalf("at most one of -query-param, -header-name and -label-value must be set")
 	}
 
+	if len(queryParamAliases) > 0 && queryParam == "" {
+		log.Fatalf("-query-param-alias requires -query-param")
+	}
+
 	upstreamURL, err := url.Parse(upstream)
 	if err != nil {
 		log.Fatalf("Failed to build parse upstream URL: %v", err)
@@ -124,15 +262,58 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
-	opts := []injectproxy.Option{injectproxy.WithPrometheusRegistry(reg)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = upstreamHeaderTimeout
+	transport.MaxIdleConns = upstreamMaxIdleConns
+	transport.MaxIdleConnsPerHost = upstreamMaxIdleConns
+
+	opts := []injectproxy.Option{
+		injectproxy.WithPrometheusRegistry(reg),
+		injectproxy.WithUpstreamTransport(transport),
+	}
+	if upstreamH2C {
+		opts = append(opts, injectproxy.WithH2C())
+	}
+	if upstreamRequestTimeout > 0 {
+		opts = append(opts, injectproxy.WithRequestTimeout(upstreamRequestTimeout))
+	}
+
+	if breakerThreshold > 0 {
+		opts = append(opts, injectproxy.WithCircuitBreaker(breakerThreshold, breakerCooldown))
+	}
 	if enableLabelAPIs {
 		opts = append(opts, injectproxy.WithEnabledLabelsAPI())
 	}
 
+	if enableAdminAPI {
+		opts = append(opts, injectproxy.WithEnabledAdminAPI())
+	}
+
 	if len(unsafePassthroughPaths) > 0 {
 		opts = append(opts, injectproxy.WithPassthroughPaths(strings.Split(unsafePassthroughPaths, ",")))
 	}
 
+	if len(passthroughPathMethods) > 0 {
+		pathsMethods := make(map[string][]string, len(passthroughPathMethods))
+		for _, v := range passthroughPathMethods {
+			path, methods, found := strings.Cut(v, "=")
+			if !found || methods == "" {
+				log.Fatalf("Invalid value %q for -unsafe-passthrough-path-methods, expected <path>=<method>[,<method>...]", v)
+			}
+			pathsMethods[path] = append(pathsMethods[path], strings.Split(methods, ",")...)
+		}
+		opts = append(opts, injectproxy.WithPassthroughPathsMethods(pathsMethods))
+	}
+
+	if len(streamingPaths) > 0 {
+		opts = append(opts, injectproxy.WithStreamingPassthroughPaths(strings.Split(streamingPaths, ",")))
+	}
+
+	if exactPassthroughPaths {
+		opts = append(opts, injectproxy.WithExactPassthroughPaths())
+	}
+
 	if errorOnReplace {
 		opts = append(opts, injectproxy.WithErrorOnReplace())
 	}
@@ -141,6 +322,14 @@ func main() {
 		opts = append(opts, injectproxy.WithActiveAlerts())
 	}
 
+	if redactRuleFiles {
+		opts = append(opts, injectproxy.WithRedactedRuleFiles())
+	}
+
+	if alertStates != "" {
+		opts = append(opts, injectproxy.WithAlertStates(strings.Split(alertStates, ",")))
+	}
+
 	if regexMatch {
 		if len(labelValues) > 0 {
 			if len(labelValues) > 1 {
@@ -153,27 +342,196 @@ func main() {
 				return
 			}
 
-			if compiledRegex.MatchString("") {
+			if !allowEmptyRegex && compiledRegex.MatchString("") {
 				log.Fatalf("Regex should not match empty string")
 				return
 			}
 		}
 
 		opts = append(opts, injectproxy.WithRegexMatch())
+
+		if regexAnchoring {
+			opts = append(opts, injectproxy.WithRegexAnchoring())
+		}
+
+		if allowEmptyRegex {
+			opts = append(opts, injectproxy.WithAllowEmptyMatchingRegex())
+		}
+	} else if regexAnchoring {
+		log.Fatalf("-regex-anchoring requires -regex-match")
+	} else if allowEmptyRegex {
+		log.Fatalf("-unsafe-allow-empty-matching-regex requires -regex-match")
 	}
 
 	if len(bypassQueries) > 0 {
 		opts = append(opts, injectproxy.WithBypassQueries(bypassQueries))
 	}
 
+	if len(promQLParamAliases) > 0 {
+		opts = append(opts, injectproxy.WithQueryParamAliases(promQLParamAliases))
+	}
+
+	if len(bypassMatchers) > 0 {
+		opts = append(opts, injectproxy.WithBypassMatchers(bypassMatchers))
+	}
+
+	if strictContentLength {
+		opts = append(opts, injectproxy.WithStrictContentLength())
+	}
+
+	if enableRemoteWrite {
+		opts = append(opts, injectproxy.WithEnabledRemoteWrite())
+	}
+
+	if enableOTLP {
+		opts = append(opts, injectproxy.WithEnabledOTLP())
+	}
+
+	if metadataPassthrough {
+		opts = append(opts, injectproxy.WithMetadataPassthrough())
+	}
+
+	if metadataFiltering {
+		opts = append(opts, injectproxy.WithEmulatedMetadataFiltering())
+	}
+
+	if alertmanagerStatus {
+		opts = append(opts, injectproxy.WithAlertmanagerStatusPassthrough())
+	}
+
+	if receiversSeparator != "" {
+		opts = append(opts, injectproxy.WithReceiversFiltering(receiversSeparator))
+	}
+
+	if tsdbStatsScoping {
+		opts = append(opts, injectproxy.WithTSDBStatsScoping(), injectproxy.WithTSDBStatsMaxSeries(tsdbStatsMaxSeries))
+	}
+
+	if topologyFiltering {
+		opts = append(opts, injectproxy.WithTargetsAndStoresFiltering())
+	}
+
+	opts = append(opts, injectproxy.WithBehaviorVersion(behaviorVersion))
+	opts = append(opts, injectproxy.WithReplaceRejectionStatus(replaceRejectionStatus))
+	opts = append(opts, injectproxy.WithMaxBodyBytes(maxBodyBytes))
+
+	if upstreamHealthCheck != "" {
+		opts = append(opts, injectproxy.WithUpstreamHealthCheck(upstreamHealthCheck))
+	}
+
+	if matcherRoundTrip {
+		opts = append(opts, injectproxy.WithMatcherRoundTripValidation())
+	}
+
+	if rateLimit > 0 {
+		opts = append(opts, injectproxy.WithRateLimit(rateLimit, rateLimitBurst))
+	}
+
+	if orAbsent {
+		opts = append(opts, injectproxy.WithOrAbsent())
+	}
+
+	if stripAbsentLabels {
+		opts = append(opts, injectproxy.WithAbsentLabelsStripping())
+	}
+
+	if lenientMatchSelectors {
+		opts = append(opts, injectproxy.WithLenientMatchSelectors())
+	}
+
+	if queryCoalescing {
+		opts = append(opts, injectproxy.WithQueryCoalescing())
+	}
+
+	if dryRun {
+		opts = append(opts, injectproxy.WithDryRun())
+	}
+
+	switch logFormat {
+	case "":
+	case "json":
+		opts = append(opts, injectproxy.WithLogger(slog.New(slog.NewJSONHandler(os.Stderr, nil))))
+	default:
+		log.Fatalf("invalid -log-format %q: must be empty or 'json'", logFormat)
+	}
+
+	if maintenanceMode || maintenanceTokenFile != "" {
+		var token string
+		if maintenanceTokenFile != "" {
+			b, err := os.ReadFile(maintenanceTokenFile)
+			if err != nil {
+				log.Fatalf("Failed to read the maintenance token file: %v", err)
+			}
+
+			token = strings.TrimSpace(string(b))
+			if token == "" {
+				log.Fatalf("The maintenance token file %q is empty", maintenanceTokenFile)
+			}
+		}
+
+		opts = append(opts, injectproxy.WithMaintenanceMode(token, maintenanceMessage, maintenanceRetryAfter))
+	}
+
+	if defaultLabelValue != "" {
+		opts = append(opts, injectproxy.WithDefaultLabelValue(defaultLabelValue))
+	}
+
+	if len(allowedLabelValues) > 0 {
+		opts = append(opts, injectproxy.WithAllowedLabelValues(allowedLabelValues))
+	}
+
+	if len(deniedLabelValues) > 0 {
+		opts = append(opts, injectproxy.WithDeniedLabelValues(deniedLabelValues))
+	}
+
+	if maxLabelValues > 0 {
+		opts = append(opts, injectproxy.WithMaxLabelValues(maxLabelValues))
+	}
+
+	if singleValueOnly {
+		opts = append(opts, injectproxy.WithSingleValueOnly())
+	}
+
+	if len(deniedMetricNames) > 0 {
+		opts = append(opts, injectproxy.WithMetricNameDenylist(deniedMetricNames))
+	}
+
+	if serverTimingHeader {
+		opts = append(opts, injectproxy.WithServerTimingHeader())
+	}
+
+	if queryRewriteHeader {
+		opts = append(opts, injectproxy.WithQueryRewriteHeader())
+	}
+
+	if upstreamDurationTenant {
+		opts = append(opts, injectproxy.WithUpstreamDurationTenantLabel())
+	}
+
+	if maxQueryRange > 0 || minQueryStep > 0 {
+		opts = append(opts, injectproxy.WithRangeLimits(maxQueryRange, minQueryStep))
+	}
+
+	if preserveParamOrder {
+		opts = append(opts, injectproxy.WithPreserveParameterOrder())
+	}
+
+	if batchQueryField != "" {
+		opts = append(opts, injectproxy.WithBatchQueryField(batchQueryField))
+	}
+
+	if forwardOrgIDHeader != "" {
+		opts = append(opts, injectproxy.WithForwardOrgIDHeader(forwardOrgIDHeader))
+	}
+
 	var extractLabeler injectproxy.ExtractLabeler
 	switch {
 	case len(labelValues) > 0:
 		extractLabeler = injectproxy.StaticLabelEnforcer(labelValues)
 	case queryParam != "":
-		extractLabeler = injectproxy.HTTPFormEnforcer{ParameterName: queryParam}
+		extractLabeler = injectproxy.HTTPFormEnforcer{ParameterName: queryParam, Aliases: queryParamAliases}
 	case headerName != "":
-		extractLabeler = injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(headerName), ParseListSyntax: headerUsesListSyntax}
+		extractLabeler = injectproxy.HTTPHeaderEnforcer{Name: http.CanonicalHeaderKey(headerName), ParseListSyntax: headerUsesListSyntax, ListDelimiter: headerListDelimiter}
 	}
 
 	var g run.Group
@@ -188,6 +546,29 @@ func main() {
 		mux := http.NewServeMux()
 		mux.Handle("/", routes)
 
+		if maintenanceMode || maintenanceTokenFile != "" {
+			// Toggle the maintenance mode on SIGUSR1.
+			ctx, cancel := context.WithCancel(context.Background())
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGUSR1)
+
+			g.Add(func() error {
+				for {
+					select {
+					case <-sig:
+						enabled := !routes.MaintenanceMode()
+						routes.SetMaintenanceMode(enabled)
+						log.Printf("Maintenance mode enabled: %v", enabled)
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			}, func(error) {
+				signal.Stop(sig)
+				cancel()
+			})
+		}
+
 		l, err := net.Listen("tcp", insecureListenAddress)
 		if err != nil {
 			log.Fatalf("Failed to listen on insecure address: %v", err)
@@ -203,6 +584,13 @@ func main() {
 			}
 			return nil
 		}, func(error) {
+			if shutdownTimeout > 0 {
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				if err := routes.Shutdown(ctx); err != nil {
+					log.Printf("Failed to drain the in-flight requests: %v", err)
+				}
+				cancel()
+			}
 			srv.Close()
 		})
 	}